@@ -2,58 +2,447 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"macsmol.pl/logpack/pack"
 )
 
 const (
-	MAX_DISK_READ_BYTES = 5 * 1000 * 1000
+	// default of --buffer-size
+	MAX_DISK_READ_BYTES  = 5 * 1000 * 1000
+	MAX_DISK_WRITE_BYTES = 1000 * 1000
+
+	// exit code when some archive was damaged and only partially unpacked with --salvage
+	EXIT_CODE_SALVAGED = 2
+	// exit code when some file was not packed because it did not compress to --min-ratio
+	EXIT_CODE_POOR_RATIO = 3
+	// exit code when user declined to overwrite some existing file
+	EXIT_CODE_NOT_OVERWRITTEN = 4
+	// exit code when some file was not written because it existed (--no-prompt without -f)
+	EXIT_CODE_FILE_EXISTS = 5
+
+	// written into the directory unpacked with -d -r
+	MANIFEST_FILE_NAME = "logpack-manifest.csv"
+)
+
+var (
+	errCorruptArchive = errors.New("Input file is corrupted or is not a Logpack archive")
+	errNoDigest       = errors.New("Archive does not contain a digest")
+	errDigestMismatch = errors.New("Unpacked content does not match the stored digest")
+	errBundleInTree   = errors.New("Archive holds several files (packed with --concat); unpack it with -d alone")
+	// output could not be written, eg. the disk is full; wraps the error of writing too
+	errWritingOutput = errors.New("Cannot write output")
+	errDictRequired  = errors.New("Archive was packed with a dictionary; give the same one with --dict")
+	errDictMismatch  = errors.New("Given dictionary is not the one the archive was packed with")
 )
 
+// Set when an output file was not written because it existed - user declined to overwrite it or --no-prompt
+// was given. Reported with the exit code.
+var notOverwritten, existingSkipped bool
+
+// Input file every archive written into --outdir was packed from, so that files of the same name (eg. flattened
+// from different directories of a tree) don't overwrite each other's archive. Set when one was not packed for that.
+var packedInto = map[string]string{}
+var nameCollided bool
+
+type cliOptions struct {
+	unpack           bool
+	inspect          bool
+	printSize        bool
+	compare          bool
+	verify           bool
+	salvage          bool
+	recursive        bool
+	quiet            bool
+	verbose          bool
+	force            bool
+	// don't ask whether to overwrite existing files; skip them
+	noPrompt         bool
+	compressionLevel int
+	// overrides the one of compressionLevel (see pack.Options.GoodEnoughPercent); 0 to keep it
+	goodEnoughPercent int
+	digest           byte
+	// only files with this extension are packed in recursive mode; all files if empty
+	extension  string
+	// pattern of timestamps to delta-encode (see pack.TimestampCodec); disabled if empty
+	timestampPattern string
+	// archives bigger than this fraction of the original are not kept; disabled if 0
+	minRatio   float64
+	// stored in the archive header
+	comment    string
+	// byte lines end with instead of '\n' (see pack.Options.RecordSeparator); 0 for '\n'
+	recordSeparator byte
+	// see pack.Options.SortLines
+	sortLines bool
+	// file of lines the compressor is primed with (see pack.Compressor.Prime()); disabled if empty
+	dictPath string
+	// content of dictPath
+	dict []byte
+	// how much of the input file is read at once
+	readBufferSize int
+	// expected size of input files whose size is unknown (eg. pipes) to report progress against; 0 if not given
+	sizeHint int64
+	// CSV file a row of stats is appended to for every packed file; disabled if empty
+	statsCsvPath string
+	// all input files are packed into this one archive (see pack.PackBundle()); disabled if empty
+	concatPath string
+	// archives are written into this directory instead of next to the input files; disabled if empty
+	outDir string
+	// with outDir in recursive mode, archives keep the path relative to the packed directory instead of being
+	// flattened into outDir
+	mirror bool
+	// CPU profile of the run is written there (see runtime/pprof); disabled if empty
+	cpuProfilePath string
+	// heap profile at the end of the run is written there; disabled if empty
+	memProfilePath string
+	inputPaths []string
+}
+
 func main() {
-	if len(os.Args) == 2 {
-		tryDoPack(os.Args[1], pack.COMPRESSION_LEVEL_DEFAULT)
-	} else if len(os.Args) == 3 {
-		if os.Args[1] == "-d" {
-			flp := openFileForReadingOrDie(os.Args[2])
-			defer flp.Close()
-
-			outputFileName := deriveOutputFileNameOrDie(os.Args[2])
-			
-			unpackedFile := createFileForWritingOrDie(outputFileName, "Cannot unpack %v")
-			defer unpackedFile.Close()
-
-			start := time.Now()
-			totalBytesRead, totalBytesWritten := unpackFile(flp, unpackedFile)
-
-			{
-				elapsed := time.Since(start)
-
-				var megabytesRead  float32   = float32(totalBytesRead)    / 1000_000.0
-				var megabytesWritten float32 = float32(totalBytesWritten) / 1000_000.0
-				var speed_MBps float32 = float32(totalBytesRead) / float32(elapsed.Microseconds())
-
-				fmt.Printf("%.2f MB unpacked to %.2f MB in %.2fs (%5.2f MB/s)\n", 
-				           megabytesRead, megabytesWritten, elapsed.Seconds(), speed_MBps)
-			}
+	opts := parseArgsOrDie(os.Args[1:])
+	stopProfiling := startProfilingOrDie(opts)
+	salvaged, poorRatio, invalid, failed := false, false, false, false
 
-		} else if compressionLevel, err := tryToParseCompressionLevel(os.Args[1]); err == nil {
-			tryDoPack(os.Args[2], compressionLevel)
+	if opts.concatPath != "" {
+		packConcatenated(opts)
+		stopProfiling()
+		exitIfNotOverwritten()
+		return
+	}
+	for _, inputPath := range opts.inputPaths {
+		if opts.inspect {
+			invalid = !inspectArchive(inputPath) || invalid
+		} else if opts.printSize {
+			invalid = !printUnpackedSize(inputPath, opts) || invalid
+		} else if opts.compare {
+			compareWithGzip(inputPath, opts)
+		} else if opts.unpack && opts.recursive {
+			treeSalvaged, treeFailed := unpackTree(inputPath, opts)
+			salvaged = treeSalvaged || salvaged
+			failed = treeFailed || failed
+		} else if opts.unpack {
+			salvaged = !tryDoUnpack(inputPath, opts) || salvaged
+		} else if opts.recursive {
+			poorRatio = packTree(inputPath, opts) || poorRatio
 		} else {
-			printUsageAndExit()
+			if fi, err := os.Stat(inputPath); err == nil && fi.IsDir() {
+				log.Fatalf("Cannot pack %s. It is a directory (use -r to pack files in it)\n", inputPath)
+			}
+			_, _, refused := tryDoPack(inputPath, archivePath(inputPath, "", opts), opts)
+			poorRatio = refused || poorRatio
 		}
-	} else {
+	}
+	stopProfiling()
+	if invalid || failed || nameCollided {
+		os.Exit(1)
+	}
+	if salvaged {
+		os.Exit(EXIT_CODE_SALVAGED)
+	}
+	if poorRatio {
+		os.Exit(EXIT_CODE_POOR_RATIO)
+	}
+	exitIfNotOverwritten()
+}
+
+// Starts writing CPU profile into opts.cpuProfilePath if set. Returned func stops it and writes heap profile into
+// opts.memProfilePath if set; it must be called before exiting. Runs that end with log.Fatal() leave no profiles.
+func startProfilingOrDie(opts cliOptions) (stop func()) {
+	var cpuProfile *os.File
+	if opts.cpuProfilePath != "" {
+		var err error
+		if cpuProfile, err = os.Create(opts.cpuProfilePath); err != nil {
+			log.Fatalf("Cannot write CPU profile: %v\n", err)
+		}
+		if err := pprof.StartCPUProfile(cpuProfile); err != nil {
+			log.Fatalf("Cannot start CPU profile: %v\n", err)
+		}
+	}
+	return func() {
+		if cpuProfile != nil {
+			pprof.StopCPUProfile()
+			if err := cpuProfile.Close(); err != nil {
+				log.Fatalf("Cannot write CPU profile: %v\n", err)
+			}
+		}
+		if opts.memProfilePath != "" {
+			memProfile, err := os.Create(opts.memProfilePath)
+			if err != nil {
+				log.Fatalf("Cannot write heap profile: %v\n", err)
+			}
+			// heap profile shows the state as of the last GC
+			runtime.GC()
+			err = pprof.WriteHeapProfile(memProfile)
+			if closeErr := memProfile.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				log.Fatalf("Cannot write heap profile: %v\n", err)
+			}
+		}
+	}
+}
+
+func exitIfNotOverwritten() {
+	if notOverwritten {
+		os.Exit(EXIT_CODE_NOT_OVERWRITTEN)
+	}
+	if existingSkipped {
+		os.Exit(EXIT_CODE_FILE_EXISTS)
+	}
+}
+
+func parseArgsOrDie(args []string) (opts cliOptions) {
+	opts.compressionLevel = pack.COMPRESSION_LEVEL_DEFAULT
+	opts.readBufferSize = MAX_DISK_READ_BYTES
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "--version":
+			printVersionAndExit()
+		case "-d":
+			opts.unpack = true
+		case "--inspect":
+			opts.inspect = true
+		case "--print-size":
+			opts.printSize = true
+		case "--compare":
+			opts.compare = true
+		case "-r":
+			opts.recursive = true
+		case "-q":
+			opts.quiet = true
+		case "-v":
+			opts.verbose = true
+		case "-f":
+			opts.force = true
+		case "--no-prompt":
+			opts.noPrompt = true
+		case "--verify":
+			opts.verify = true
+		case "--salvage":
+			opts.salvage = true
+		case "--hash":
+			opts.digest = parseDigestNameOrDie(nextArgOrDie(args, &i))
+		case "--timestamps":
+			opts.timestampPattern = nextArgOrDie(args, &i)
+			if err := pack.ValidateTimestampPattern(opts.timestampPattern); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		case "--min-ratio":
+			minRatio, err := strconv.ParseFloat(nextArgOrDie(args, &i), 64)
+			if err != nil || !(minRatio > 0) {
+				fmt.Printf("Invalid --min-ratio %s. Use a positive number, eg. 0.9\n", args[i])
+				os.Exit(1)
+			}
+			opts.minRatio = minRatio
+		case "--good-enough":
+			factor, err := strconv.ParseFloat(nextArgOrDie(args, &i), 64)
+			// factors that round to 0 percent would mean the default of the level
+			if err != nil || !(factor > 0 && factor <= 1) || math.Round(factor*100) == 0 {
+				fmt.Printf("Invalid --good-enough %s. Use a number greater than 0 and at most 1, eg. 0.85\n", args[i])
+				os.Exit(1)
+			}
+			opts.goodEnoughPercent = int(math.Round(factor * 100))
+		case "--comment":
+			opts.comment = nextArgOrDie(args, &i)
+			if len(opts.comment) > pack.MAX_COMMENT_SIZE {
+				fmt.Printf("Comment is too long (%d bytes). At most %d bytes allowed\n", len(opts.comment), pack.MAX_COMMENT_SIZE)
+				os.Exit(1)
+			}
+		case "--buffer-size":
+			size, err := parseSize(nextArgOrDie(args, &i))
+			if err != nil || size < int64(pack.DecompressBound()) || size > math.MaxInt32 {
+				fmt.Printf("Invalid --buffer-size %s. Use a size between %d bytes and 2GB, eg. 16MB\n",
+					args[i], pack.DecompressBound())
+				os.Exit(1)
+			}
+			opts.readBufferSize = int(size)
+		case "--size":
+			size, err := parseSize(nextArgOrDie(args, &i))
+			if err != nil || size <= 0 {
+				fmt.Printf("Invalid --size %s. Use a positive size, eg. 1GB\n", args[i])
+				os.Exit(1)
+			}
+			opts.sizeHint = size
+		case "--record-sep":
+			opts.recordSeparator = parseRecordSeparatorOrDie(nextArgOrDie(args, &i))
+		case "--sort-lines":
+			opts.sortLines = true
+		case "--concat":
+			opts.concatPath = nextArgOrDie(args, &i)
+		case "--dict", "--dictionary-file":
+			opts.dictPath = nextArgOrDie(args, &i)
+		case "--outdir":
+			opts.outDir = nextArgOrDie(args, &i)
+		case "--mirror":
+			opts.mirror = true
+		case "--profile":
+			opts.cpuProfilePath = nextArgOrDie(args, &i)
+		case "--memprofile":
+			opts.memProfilePath = nextArgOrDie(args, &i)
+		case "--stats-csv":
+			opts.statsCsvPath = nextArgOrDie(args, &i)
+		case "--ext":
+			opts.extension = nextArgOrDie(args, &i)
+			if !strings.HasPrefix(opts.extension, ".") {
+				opts.extension = "." + opts.extension
+			}
+		default:
+			if compressionLevel, err := tryToParseCompressionLevel(arg); err == nil {
+				if err := (pack.Options{CompressionLevel: compressionLevel}).Validate(); err != nil {
+					fmt.Printf("Invalid compression level -%d. Use a number between %d and %d\n",
+						compressionLevel, pack.COMPRESSION_LEVEL_WORST, pack.COMPRESSION_LEVEL_BEST)
+					os.Exit(1)
+				}
+				opts.compressionLevel = compressionLevel
+			} else if strings.HasPrefix(arg, "-") {
+				printUsageAndExit()
+			} else {
+				opts.inputPaths = append(opts.inputPaths, arg)
+			}
+		}
+	}
+
+	if len(opts.inputPaths) == 0 {
+		printUsageAndExit()
+	}
+	// options that make sense only in one of the modes
+	if opts.unpack && (opts.digest != pack.DIGEST_NONE || opts.extension != "" || opts.timestampPattern != "" ||
+		opts.minRatio != 0 || opts.comment != "" || opts.statsCsvPath != "" || opts.recordSeparator != 0 ||
+		opts.sortLines || opts.goodEnoughPercent != 0) ||
+		opts.timestampPattern != "" && opts.recordSeparator != 0 ||
+		!opts.unpack && (opts.verify || opts.salvage) ||
+		!opts.recursive && opts.extension != "" ||
+		opts.inspect && (opts.unpack || opts.recursive || opts.statsCsvPath != "") ||
+		opts.compare && (opts.unpack || opts.inspect || opts.recursive || opts.statsCsvPath != "") ||
+		opts.printSize && (opts.unpack || opts.inspect || opts.compare || opts.recursive || opts.statsCsvPath != "") ||
+		opts.concatPath != "" && (opts.unpack || opts.inspect || opts.compare || opts.printSize || opts.recursive ||
+			opts.digest != pack.DIGEST_NONE || opts.timestampPattern != "" || opts.recordSeparator != 0 ||
+			opts.minRatio != 0 || opts.statsCsvPath != "") ||
+		opts.outDir != "" && (opts.unpack || opts.inspect || opts.compare || opts.printSize || opts.concatPath != "") ||
+		opts.mirror && (opts.outDir == "" || !opts.recursive) ||
+		opts.dictPath != "" && (opts.inspect || opts.compare || opts.printSize || opts.concatPath != "") ||
+		opts.goodEnoughPercent != 0 && (opts.inspect || opts.printSize) ||
+		(opts.cpuProfilePath != "" || opts.memProfilePath != "") && (opts.unpack || opts.inspect || opts.printSize) ||
+		opts.sizeHint != 0 && (opts.unpack || opts.inspect || opts.printSize || opts.compare || opts.recursive ||
+			opts.concatPath != "") {
+		printUsageAndExit()
+	}
+	if opts.dictPath != "" {
+		opts.dict = readDictionaryOrDie(opts.dictPath)
+	}
+	return opts
+}
+
+func readDictionaryOrDie(path string) []byte {
+	dict, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Cannot read dictionary: %v\n", err)
+	}
+	if len(dict) == 0 {
+		log.Fatalf("Dictionary %s is empty\n", path)
+	}
+	return dict
+}
+
+// Lines of the dictionary, each with its separator ('\n' if 0) as the compressor sees lines; the last one may
+// have none. Nil if there's no dictionary.
+func dictionaryLines(dict []byte, separator byte) [][]byte {
+	if dict == nil {
+		return nil
+	}
+	if separator == 0 {
+		separator = '\n'
+	}
+	lines := bytes.SplitAfter(dict, []byte{separator})
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Returns errDictRequired or errDictMismatch unless dictLines are the lines header says the archive was primed
+// with. Archives that were not primed need no dictionary; a given one is ignored.
+func checkDictionary(header pack.ArchiveHeader, dictLines [][]byte) error {
+	if !header.Primed {
+		return nil
+	}
+	if dictLines == nil {
+		return errDictRequired
+	}
+	if pack.PrimingHash(dictLines) != header.PrimingHash {
+		return errDictMismatch
+	}
+	return nil
+}
+
+// Returns value of the option at args[*i] and advances *i past it
+func nextArgOrDie(args []string, i *int) string {
+	*i++
+	if *i >= len(args) {
 		printUsageAndExit()
 	}
+	return args[*i]
+}
+
+// Separator is given as a number (eg. 0x1e or 30) or as a single char (eg. ';').
+func parseRecordSeparatorOrDie(arg string) byte {
+	separator, err := strconv.ParseUint(arg, 0, 8)
+	if err != nil && len(arg) == 1 {
+		separator, err = uint64(arg[0]), nil
+	}
+	if err == nil {
+		err = (pack.Options{RecordSeparator: byte(separator)}).Validate()
+	}
+	if err != nil || separator == 0 {
+		fmt.Printf("Invalid --record-sep %s. Use an ASCII char or its code, eg. 0x1e\n", arg)
+		os.Exit(1)
+	}
+	return byte(separator)
+}
+
+func parseDigestNameOrDie(name string) byte {
+	switch name {
+	case "md5":
+		return pack.DIGEST_MD5
+	case "sha256":
+		return pack.DIGEST_SHA256
+	}
+	fmt.Printf("Unknown hash \"%s\" (md5 or sha256 expected)\n", name)
+	os.Exit(1)
+	return pack.DIGEST_NONE
+}
+
+// Name of the digest as given to --hash.
+func digestName(kind byte) string {
+	switch kind {
+	case pack.DIGEST_MD5:
+		return "md5"
+	case pack.DIGEST_SHA256:
+		return "sha256"
+	}
+	return "none"
 }
 
 func deriveOutputFileNameOrDie(inputFilename string) string {
@@ -76,112 +465,913 @@ func openFileForReadingOrDie(filePath string) *os.File {
 	return flp
 }
 
-func createFileForWritingOrDie(outputFileName, fmtString string) *os.File {
-	var file *os.File
-	var err error
-	file, err = os.OpenFile(outputFileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+// Returns nil if the file exists and was not overwritten (see createFileForWriting()).
+func createFileForWritingOrDie(outputFileName, fmtString string, opts cliOptions) *os.File {
+	file, err := createFileForWriting(outputFileName, opts)
 	if err != nil {
-		if errors.Is(err, fs.ErrExist) {
-			fmt.Printf("File %s already exists. Overwrite (y/n) ? ", outputFileName)
-
-			scanner := bufio.NewScanner(os.Stdin)
-			scanner.Scan()
-			text := scanner.Text()
+		log.Default().Fatalf(fmtString, err)
+	}
+	return file
+}
 
-			if text == "y" {
-				file, err = os.Create(outputFileName)
-				if err != nil {
-					log.Default().Fatalf(fmtString, err)
-				}
-			} else {
-				fmt.Printf("Not overwritten\n")
-				os.Exit(0)
-			}
-		} else {
-			log.Default().Fatalf(fmtString, err)
+// Returns nil file (and no error) if the file exists and user decided not to overwrite it or, with opts.noPrompt,
+// was not asked.
+func createFileForWriting(outputFileName string, opts cliOptions) (*os.File, error) {
+	if opts.force {
+		return os.Create(outputFileName)
+	}
+	file, err := os.OpenFile(outputFileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if errors.Is(err, fs.ErrExist) {
+		if !mayOverwrite(outputFileName, opts) {
+			return nil, nil
 		}
+		return os.Create(outputFileName)
+	}
+	return file, err
+}
+
+// Like createFileForWritingOrDie() but the file is created aside, in the directory of outputFileName, so that
+// a file it is to replace stays intact until replaceWithTempFileOrDie().
+func createTempFileForWritingOrDie(outputFileName, fmtString string, opts cliOptions) *os.File {
+	if _, err := os.Lstat(outputFileName); err == nil && !opts.force && !mayOverwrite(outputFileName, opts) {
+		return nil
+	}
+	file, err := os.CreateTemp(filepath.Dir(outputFileName), "."+filepath.Base(outputFileName)+".*.tmp")
+	if err != nil {
+		log.Default().Fatalf(fmtString, err)
 	}
 	return file
 }
 
-func tryDoPack(inputFilePath string, compressionLevel int) {
+// Renames closed temporary file of createTempFileForWritingOrDie() over outputFileName. The file gets permissions
+// of the file it replaces, if any.
+func replaceWithTempFileOrDie(tempFileName, outputFileName string) {
+	perm := fs.FileMode(0644)
+	if fi, err := os.Stat(outputFileName); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	err := os.Chmod(tempFileName, perm)
+	if err == nil {
+		err = os.Rename(tempFileName, outputFileName)
+	}
+	if err != nil {
+		os.Remove(tempFileName)
+		log.Fatalf("Error: Cannot write %s. %v\n", outputFileName, err)
+	}
+}
+
+// Asks whether to overwrite existing file, unless opts.noPrompt says to skip it.
+func mayOverwrite(outputFileName string, opts cliOptions) bool {
+	if opts.noPrompt {
+		fmt.Printf("File %s already exists. Skipped\n", outputFileName)
+		existingSkipped = true
+		return false
+	}
+	fmt.Printf("File %s already exists. Overwrite (y/n) ? ", outputFileName)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Scan()
+	text := scanner.Text()
+
+	if text == "y" {
+		return true
+	}
+	fmt.Printf("Not overwritten\n")
+	notOverwritten = true
+	return false
+}
+
+// Returns false if the archive was damaged and only part of it was salvaged.
+func tryDoUnpack(inputFilePath string, opts cliOptions) (complete bool) {
+	flp := openFileForReadingOrDie(inputFilePath)
+	defer flp.Close()
+
+	if isBundle(flp) {
+		unpackConcatenated(flp, opts)
+		return true
+	}
+
+	outputFileName := deriveOutputFileNameOrDie(inputFilePath)
+
+	outputFile := createFileForWritingOrDie(outputFileName, "Cannot unpack %v", opts)
+	if outputFile == nil {
+		return true
+	}
+	unpackedFile := newBufferedFileWriter(outputFile)
+
+	start := time.Now()
+	totalBytesRead, totalBytesWritten, _, unpackErr := unpackFile(flp, unpackedFile, opts)
+	if err := unpackedFile.Close(); unpackErr == nil && err != nil {
+		unpackErr = writingOutputError(err)
+	}
+	// output that was not written completely is not salvaged
+	if errors.Is(unpackErr, errWritingOutput) {
+		failWritingOutput(outputFileName, unpackErr)
+	}
+	if errors.Is(unpackErr, errDigestMismatch) {
+		log.Fatalf("Error: Verification of \"%s\" failed. %v\n", inputFilePath, unpackErr)
+	}
+	if errors.Is(unpackErr, errNoDigest) {
+		os.Remove(outputFileName)
+		log.Fatalf("Error: Cannot verify \"%s\". %v\n", inputFilePath, unpackErr)
+	}
+	if unpackErr != nil && (!opts.salvage || !errors.Is(unpackErr, errCorruptArchive)) {
+		// don't leave incomplete output behind
+		os.Remove(outputFileName)
+		log.Fatalf("Error: Cannot unpack \"%s\". %v\n", inputFilePath, unpackErr)
+	}
+	if unpackErr != nil {
+		fmt.Printf("Warning: \"%s\" is damaged (%v). Salvaged %d bytes decoded before the damage into %s\n",
+			inputFilePath, unpackErr, totalBytesWritten, outputFileName)
+		return false
+	}
+
+	if !opts.quiet {
+		elapsed := time.Since(start)
+
+		fmt.Println(unpackSummary(totalBytesRead, totalBytesWritten, elapsed))
+	}
+	return true
+}
+
+// Path the archive of inputFilePath is written to: next to it or, with opts.outDir, into that directory. In recursive
+// mode (rootDir is the packed directory then; "" otherwise) with opts.mirror it keeps its path relative to rootDir.
+func archivePath(inputFilePath, rootDir string, opts cliOptions) string {
+	if opts.outDir == "" {
+		return inputFilePath + ".lp"
+	}
+	name := filepath.Base(inputFilePath)
+	if opts.mirror && rootDir != "" {
+		if relativePath, err := filepath.Rel(rootDir, inputFilePath); err == nil {
+			name = relativePath
+		}
+	}
+	return filepath.Join(opts.outDir, name+".lp")
+}
+
+// Returns refused == true if the archive was not kept because it did not compress to opts.minRatio.
+func tryDoPack(inputFilePath, outputFileName string, opts cliOptions) (totalBytesRead, totalBytesWritten int64, refused bool) {
+	if opts.outDir != "" {
+		if source, found := packedInto[outputFileName]; found {
+			fmt.Printf("Not packed \"%s\": %s was already packed into %s (use --mirror to keep directories)\n",
+				inputFilePath, source, outputFileName)
+			nameCollided = true
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(outputFileName), 0777); err != nil {
+			log.Fatalf("Cannot create output directory: %v\n", err)
+		}
+	}
+
 	//------------------ OPEN raw log file
 	f := openFileForReadingOrDie(inputFilePath)
 	defer f.Close()
 
 	//------------------  CREATE packed log file
-	outputFileName := inputFilePath + ".lp"
-	flp := createFileForWritingOrDie(outputFileName, "Cannot unpack %v")
-	defer flp.Close()
+	// ratio is known only once the whole file is packed; with --min-ratio the archive is packed aside, so that
+	// a poorly packed one does not replace the file that is there already
+	var outputFile *os.File
+	if opts.minRatio > 0 {
+		outputFile = createTempFileForWritingOrDie(outputFileName, "Cannot pack %v", opts)
+	} else {
+		outputFile = createFileForWritingOrDie(outputFileName, "Cannot pack %v", opts)
+	}
+	if outputFile == nil {
+		return
+	}
+	writtenFileName := outputFile.Name()
+	if opts.outDir != "" {
+		packedInto[outputFileName] = inputFilePath
+	}
+	flp := newBufferedFileWriter(outputFile)
 
 	start := time.Now()
-	totalBytesRead, totalBytesWritten := packFile(f, flp, compressionLevel)
+	totalBytesRead, totalBytesWritten, stats, err := packFile(f, flp, opts)
+	if closeErr := flp.Close(); err == nil && closeErr != nil {
+		err = writingOutputError(closeErr)
+	}
+	if err != nil {
+		failWritingOutput(writtenFileName, err)
+	}
+	elapsed := time.Since(start)
+
+	ratio := float64(totalBytesWritten) / float64(totalBytesRead)
+	if opts.minRatio > 0 && totalBytesRead > 0 && ratio > opts.minRatio {
+		os.Remove(writtenFileName)
+		fmt.Printf("Not packed \"%s\": it compresses to %.1f%% of its size (--min-ratio allows %.1f%%)\n",
+			inputFilePath, 100*ratio, 100*opts.minRatio)
+		return totalBytesRead, 0, true
+	}
+	if writtenFileName != outputFileName {
+		replaceWithTempFileOrDie(writtenFileName, outputFileName)
+	}
 
-	{
+	if opts.statsCsvPath != "" {
+		appendStatsCsvRowOrDie(opts.statsCsvPath, inputFilePath, totalBytesRead, totalBytesWritten, opts.compressionLevel, elapsed)
+	}
+	if !opts.quiet {
+		fmt.Println(packSummary(inputFilePath, outputFileName, totalBytesRead, totalBytesWritten, elapsed))
+	}
+	if opts.verbose {
+		printLineEndings(inputFilePath, stats.lineEndings)
+		printEscapes(inputFilePath, stats.escapedBytes, totalBytesRead)
+	}
+	return
+}
+
+// header of --stats-csv file, written when the file is created
+var statsCsvHeader = []string{"timestamp", "filename", "rawBytes", "packedBytes", "ratio", "level", "elapsedMs", "mbps"}
+
+// Appends a row of stats of packing inputFilePath to the CSV file at csvPath; file that does not exist yet (or is
+// empty) gets the header first. The file is opened for every row, so rows of consecutive runs end up in one file.
+// Ratio is packed size as a fraction of raw size (as in --min-ratio); MB are 10^6 bytes.
+func appendStatsCsvRowOrDie(csvPath, inputFilePath string, rawBytes, packedBytes int64, level int, elapsed time.Duration) {
+	csvFile, err := os.OpenFile(csvPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Fatalf("Cannot write stats to %s: %v\n", csvPath, err)
+	}
+	defer csvFile.Close()
+	fi, err := csvFile.Stat()
+	if err != nil {
+		log.Fatalf("Cannot write stats to %s: %v\n", csvPath, err)
+	}
+
+	var ratio, megabytesPerSecond float64
+	if rawBytes > 0 {
+		ratio = float64(packedBytes) / float64(rawBytes)
+	}
+	megabytesPerSecond = speedMBps(rawBytes, elapsed)
+	w := csv.NewWriter(csvFile)
+	if fi.Size() == 0 {
+		w.Write(statsCsvHeader)
+	}
+	w.Write([]string{
+		time.Now().Format(time.RFC3339), inputFilePath,
+		strconv.FormatInt(rawBytes, 10), strconv.FormatInt(packedBytes, 10), strconv.FormatFloat(ratio, 'f', 4, 64),
+		strconv.Itoa(level), strconv.FormatInt(elapsed.Milliseconds(), 10), strconv.FormatFloat(megabytesPerSecond, 'f', 2, 64),
+	})
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Fatalf("Cannot write stats to %s: %v\n", csvPath, err)
+	}
+}
+
+// Input of packFile() analyzed in verbose mode
+type inputStats struct {
+	lineEndings pack.LineEndingStats
+	// see pack.EscapeStats()
+	escapedBytes int64
+}
+
+func printEscapes(inputFilePath string, escapedBytes, totalBytes int64) {
+	if escapedBytes == 0 {
+		return
+	}
+	fmt.Printf("%s: %d bytes (%.1f%%) are not ASCII; each takes 2 bytes packed unless matched in an earlier line\n",
+		inputFilePath, escapedBytes, 100*float64(escapedBytes)/float64(totalBytes))
+}
+
+func printLineEndings(inputFilePath string, stats pack.LineEndingStats) {
+	fmt.Printf("%s: %d lines, %.1f%% end with CRLF", inputFilePath, stats.Lines(), 100*stats.CRLFFraction())
+	if !stats.Consistent() {
+		fmt.Printf(" - mixed line endings (lines ending differently match worse)")
+	}
+	fmt.Printf("\n")
+}
+
+// Packs every regular file under rootDir (optionally just the ones with opts.extension) next to the original or into
+// opts.outDir (see archivePath()).
+// Returns true if some file was not packed because it did not compress to opts.minRatio.
+func packTree(rootDir string, opts cliOptions) (poorRatio bool) {
+	start := time.Now()
+	var filesPacked int
+	var totalBytesRead, totalBytesWritten int64
+
+	err := filepath.WalkDir(rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// don't pack archives again
+		if !d.Type().IsRegular() || strings.HasSuffix(path, ".lp") {
+			return nil
+		}
+		if opts.extension != "" && filepath.Ext(path) != opts.extension {
+			return nil
+		}
+		bytesRead, bytesWritten, refused := tryDoPack(path, archivePath(path, rootDir, opts), opts)
+		poorRatio = refused || poorRatio
+		// nothing written if user refused to overwrite existing archive
+		if bytesWritten > 0 {
+			totalBytesRead += bytesRead
+			totalBytesWritten += bytesWritten
+			filesPacked++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !opts.quiet && filesPacked == 0 {
+		fmt.Printf("%s: no files packed\n", rootDir)
+	} else if !opts.quiet {
+		elapsed := time.Since(start)
+		fmt.Printf("%s: %d files, %.2f MB packed to %.2f MB (%.1f%%) in %.2fs\n",
+		           rootDir, filesPacked, megabytes(totalBytesRead), megabytes(totalBytesWritten),
+		           percentOf(totalBytesWritten, totalBytesRead), elapsed.Seconds())
+	}
+	return poorRatio
+}
+
+// Unpacks every *.lp archive under rootDir next to it and writes a manifest of restored files (path relative to
+// rootDir, unpacked size and digest verified against the one stored in the archive) into rootDir.
+// Archives that cannot be unpacked don't stop the others; they are reported at the end. Returns salvaged == true
+// if some archive was only partially unpacked with --salvage and failed == true if some was not unpacked at all.
+func unpackTree(rootDir string, opts cliOptions) (salvaged, failed bool) {
+	start := time.Now()
+	manifest := [][]string{{"file", "rawBytes", "digest"}}
+	var failures []string
+	var totalBytesRead, totalBytesWritten int64
+
+	err := filepath.WalkDir(rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !strings.HasSuffix(path, ".lp") {
+			return nil
+		}
+		outputPath := strings.TrimSuffix(path, ".lp")
+		bytesRead, bytesWritten, verifiedDigest, err := unpackTreeArchive(path, outputPath, opts)
+		if errors.Is(err, errCorruptArchive) && opts.salvage {
+			salvaged = true
+			failures = append(failures, fmt.Sprintf("%s: %v (salvaged %d bytes)", path, err, bytesWritten))
+			return nil
+		} else if err != nil {
+			failed = true
+			failures = append(failures, fmt.Sprintf("%s: %v", path, err))
+			return nil
+		}
+		// nothing read if user refused to overwrite existing file
+		if bytesRead == 0 {
+			return nil
+		}
+		totalBytesRead += bytesRead
+		totalBytesWritten += bytesWritten
+		if !opts.quiet {
+			fmt.Printf("%s: %.2f MB unpacked to %.2f MB\n", path, megabytes(bytesRead), megabytes(bytesWritten))
+		}
+
+		relativePath, err := filepath.Rel(rootDir, outputPath)
+		if err != nil {
+			return err
+		}
+		manifest = append(manifest, []string{relativePath, strconv.FormatInt(bytesWritten, 10), verifiedDigest})
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	writeManifestOrDie(filepath.Join(rootDir, MANIFEST_FILE_NAME), manifest, opts)
+
+	if !opts.quiet {
 		elapsed := time.Since(start)
-		var megabytesRead float32 = float32(totalBytesRead) / 1000_000.0
-		var megabytesWritten float32 = float32(totalBytesWritten) / 1000_000.0
-		var compRatioPercent float32 = float32(100*totalBytesWritten) / float32(totalBytesRead)
-		
-		var speed_MBps float32 = float32(totalBytesRead) / float32(elapsed.Microseconds())
-		fmt.Printf("(%s => %s) %.2f MB packed to %.2f MB (%.1f%%) in %.2fs; average speed: %.1f MB/s\n",
-		           inputFilePath, outputFileName, 
-				   megabytesRead, megabytesWritten, compRatioPercent, 
-				   elapsed.Seconds(), speed_MBps)
+		fmt.Printf("%s: %d files, %.2f MB unpacked to %.2f MB in %.2fs\n",
+		           rootDir, len(manifest)-1, megabytes(totalBytesRead), megabytes(totalBytesWritten), elapsed.Seconds())
+	}
+	if len(failures) > 0 {
+		fmt.Printf("%s: %d archives not unpacked:\n", rootDir, len(failures))
+		for _, failure := range failures {
+			fmt.Printf("   %s\n", failure)
+		}
+	}
+	return salvaged, failed
+}
+
+// Unpacks archive at path into outputPath like tryDoUnpack() does, but returns errors instead of exiting.
+// Output is removed unless it was salvaged. Returns 0 bytesRead if user refused to overwrite existing outputPath.
+func unpackTreeArchive(path, outputPath string, opts cliOptions) (bytesRead, bytesWritten int64, verifiedDigest string, err error) {
+	archive, err := os.Open(path)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer archive.Close()
+	if isBundle(archive) {
+		return 0, 0, "", errBundleInTree
+	}
+
+	outputFile, err := createFileForWriting(outputPath, opts)
+	if outputFile == nil {
+		return 0, 0, "", err
+	}
+	unpackedFile := newBufferedFileWriter(outputFile)
+
+	bytesRead, bytesWritten, verifiedDigest, err = unpackFile(archive, unpackedFile, opts)
+	if closeErr := unpackedFile.Close(); err == nil && closeErr != nil {
+		err = writingOutputError(closeErr)
+	}
+	if err != nil && (!opts.salvage || !errors.Is(err, errCorruptArchive)) {
+		os.Remove(outputPath)
+	}
+	return bytesRead, bytesWritten, verifiedDigest, err
+}
+
+// Packs all opts.inputPaths into one archive at opts.concatPath. Files are stored by their base names, so -d
+// writes them next to the archive. Files are streamed one after another; see pack.BundleWriter for memory needed.
+func packConcatenated(opts cliOptions) {
+	names := make(map[string]bool)
+	for _, inputPath := range opts.inputPaths {
+		name := filepath.Base(inputPath)
+		if names[name] {
+			log.Fatalf("Cannot pack %s. Another file named %s is packed already\n", inputPath, name)
+		}
+		names[name] = true
+	}
+
+	outputFile := createFileForWritingOrDie(opts.concatPath, "Cannot pack %v", opts)
+	if outputFile == nil {
+		return
+	}
+	start := time.Now()
+	packedFile := newBufferedFileWriter(outputFile)
+	counter := &countingWriter{w: packedFile}
+	bundle, err := pack.NewBundleWriter(counter, pack.WriterOptions{Options: pack.Options{
+		CompressionLevel: opts.compressionLevel, GoodEnoughPercent: opts.goodEnoughPercent, SortLines: opts.sortLines},
+		Comment: []byte(opts.comment)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	var totalBytesRead int64
+	for _, inputPath := range opts.inputPaths {
+		size, err := addToBundle(bundle, inputPath)
+		// failure to write the archive is reported below
+		if err != nil && counter.err == nil {
+			packedFile.Close()
+			os.Remove(opts.concatPath)
+			log.Fatalf("Cannot pack %s. %v\n", inputPath, err)
+		}
+		totalBytesRead += size
+	}
+	err = bundle.Close()
+	if closeErr := packedFile.Close(); err == nil && closeErr != nil {
+		err = writingOutputError(closeErr)
+	} else if counter.err != nil {
+		err = writingOutputError(counter.err)
+	}
+	if errors.Is(err, errWritingOutput) {
+		failWritingOutput(opts.concatPath, err)
+	} else if err != nil {
+		os.Remove(opts.concatPath)
+		log.Fatalf("Cannot pack %s. %v\n", opts.concatPath, err)
+	}
+	if !opts.quiet {
+		fmt.Println(packSummary(fmt.Sprintf("%d files", len(opts.inputPaths)), opts.concatPath, totalBytesRead,
+			counter.n, time.Since(start)))
+	}
+}
+
+// Streams file at inputPath into bundle under its base name. Returns its size.
+func addToBundle(bundle *pack.BundleWriter, inputPath string) (size int64, err error) {
+	file, err := os.Open(inputPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), bundle.AddFile(filepath.Base(inputPath), fi.Size(), file)
+}
+
+// Tells whether packed is an archive of several files written by packConcatenated(). Only the header is read;
+// archives with invalid one are not bundles (unpacking them reports why).
+func isBundle(packed *os.File) bool {
+	header, _, err := readArchiveHeader(packed)
+	return err == nil && header.Bundle
+}
+
+// Unpacks files of an archive written by packConcatenated() next to it. Damaged archives are not salvaged:
+// nothing is written then.
+func unpackConcatenated(packed *os.File, opts cliOptions) {
+	if opts.verify {
+		log.Fatalf("Error: Cannot verify \"%s\". %v\n", packed.Name(), errNoDigest)
+	}
+	fi, err := packed.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	start := time.Now()
+	files, err := pack.UnpackBundle(io.NewSectionReader(packed, 0, fi.Size()))
+	if err != nil {
+		log.Fatalf("Error: Cannot unpack \"%s\". %v\n", packed.Name(), err)
+	}
+
+	var totalBytesWritten int64
+	for _, file := range files {
+		// names come from the archive; don't let them point out of its directory
+		if !filepath.IsLocal(file.Name) || filepath.Base(file.Name) != file.Name {
+			log.Fatalf("Error: Cannot unpack \"%s\". Invalid file name %q\n", packed.Name(), file.Name)
+		}
+		outputPath := filepath.Join(filepath.Dir(packed.Name()), file.Name)
+		outputFile := createFileForWritingOrDie(outputPath, "Cannot unpack %v", opts)
+		if outputFile == nil {
+			continue
+		}
+		_, err := outputFile.Write(file.Content)
+		if closeErr := outputFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			failWritingOutput(outputPath, writingOutputError(err))
+		}
+		totalBytesWritten += int64(len(file.Content))
+		if opts.verbose {
+			fmt.Printf("%s: %d bytes\n", outputPath, len(file.Content))
+		}
+	}
+	if !opts.quiet {
+		fmt.Printf("%s: %d files; %s\n", packed.Name(), len(files), unpackSummary(fi.Size(), totalBytesWritten,
+			time.Since(start)))
+	}
+}
+
+func writingOutputError(err error) error {
+	return fmt.Errorf("%w: %w", errWritingOutput, err)
+}
+
+// Removes output that was not written completely, so that no truncated file is left to pass for a complete one,
+// and exits. Full disk is reported as such.
+func failWritingOutput(outputPath string, err error) {
+	os.Remove(outputPath)
+	if errors.Is(err, syscall.ENOSPC) {
+		log.Fatalf("Error: Cannot write %s. No space left on the disk; incomplete file removed\n", outputPath)
+	}
+	log.Fatalf("Error: Cannot write %s. %v; incomplete file removed\n", outputPath, err)
+}
+
+// Writes manifest rows as CSV. Nothing is written if the file exists and user decided not to overwrite it.
+func writeManifestOrDie(manifestPath string, manifest [][]string, opts cliOptions) {
+	file := createFileForWritingOrDie(manifestPath, "Cannot write manifest: %v", opts)
+	if file == nil {
+		return
+	}
+	w := csv.NewWriter(file)
+	w.WriteAll(manifest)
+	if err := w.Error(); err != nil {
+		log.Fatalf("Cannot write manifest: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		log.Fatalf("Cannot write manifest: %v", err)
+	}
+}
+
+// Gathers small writes (eg. of compressed chunks) into bigger ones to save on syscalls.
+type bufferedFileWriter struct {
+	*bufio.Writer
+	file *os.File
+}
+
+func newBufferedFileWriter(file *os.File) *bufferedFileWriter {
+	return &bufferedFileWriter{bufio.NewWriterSize(file, MAX_DISK_WRITE_BYTES), file}
+}
+
+// Flushes buffered data and closes the file. Errors of both are reported - unflushed data means output is incomplete.
+func (w *bufferedFileWriter) Close() error {
+	flushErr := w.Flush()
+	closeErr := w.file.Close()
+	if flushErr != nil {
+		return flushErr
+	}
+	return closeErr
+}
+
+// Counts bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+	// first error of w
+	err error
+}
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = w.w.Write(p)
+	w.n += int64(n)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// Line reported after packing a file.
+func packSummary(inputPath, outputPath string, bytesRead, bytesWritten int64, elapsed time.Duration) string {
+	return fmt.Sprintf("(%s => %s) %.2f MB packed to %.2f MB (%.1f%%) in %.2fs; average speed: %.1f MB/s",
+		inputPath, outputPath, megabytes(bytesRead), megabytes(bytesWritten), percentOf(bytesWritten, bytesRead),
+		elapsed.Seconds(), speedMBps(bytesRead, elapsed))
+}
+
+// Line reported after unpacking a file.
+func unpackSummary(bytesRead, bytesWritten int64, elapsed time.Duration) string {
+	return fmt.Sprintf("%.2f MB unpacked to %.2f MB in %.2fs (%5.2f MB/s)",
+		megabytes(bytesRead), megabytes(bytesWritten), elapsed.Seconds(), speedMBps(bytesRead, elapsed))
+}
+
+// MB are 10^6 bytes. float64 holds byte counts exactly far beyond any file size (float32 is off by hundreds of bytes
+// above 2 GB).
+func megabytes(bytes int64) float64 {
+	return float64(bytes) / 1000_000.0
+}
+
+// Part as percent of whole; 0 for empty whole.
+func percentOf(part, whole int64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(whole)
+}
+
+// Average speed in MB/s; 0 if elapsed is not positive (eg. clock too coarse for a tiny file).
+func speedMBps(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return megabytes(bytes) / elapsed.Seconds()
+}
+
+// Parses size given in bytes, optionally with K, M or G suffix (powers of 1000, "B" may follow; case-insensitive).
+func parseSize(arg string) (int64, error) {
+	number := strings.TrimSuffix(strings.ToUpper(arg), "B")
+	multiplier := int64(1)
+	for suffix, value := range map[string]int64{"K": 1000, "M": 1000 * 1000, "G": 1000 * 1000 * 1000} {
+		if trimmed, found := strings.CutSuffix(number, suffix); found {
+			number, multiplier = trimmed, value
+			break
+		}
 	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 || size > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %s", arg)
+	}
+	return size * multiplier, nil
 }
 
+// Parses "-#" argument. Numbers out of the valid range are parsed too so that they can be reported.
 func tryToParseCompressionLevel(arg string) (int, error) {
 
-	if len(arg) != 2 || arg[0] != '-' {
+	if len(arg) < 2 || arg[0] != '-' || arg[1] < '0' || arg[1] > '9' {
 		return -1, errors.New("cannot parse compression level")
 	}
 	return strconv.Atoi(arg[1:])
 }
 
+// Version of the tool comes from the build (module version when installed with "go install", VCS revision
+// when built from a checkout).
+func printVersionAndExit() {
+	version, revision := "unknown", ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+		settings := make(map[string]string)
+		for _, setting := range info.Settings {
+			settings[setting.Key] = setting.Value
+		}
+		if rev := settings["vcs.revision"]; rev != "" {
+			revision = fmt.Sprintf(", revision %s (%s)", rev, settings["vcs.time"])
+			if settings["vcs.modified"] == "true" {
+				revision += " with local changes"
+			}
+		}
+	}
+	fmt.Printf("logpack %s%s\n", version, revision)
+	fmt.Printf("archive format version %d (reads versions 0-%d and later ones that need no bigger window than %d)\n",
+		pack.FORMAT_VERSION, pack.FORMAT_VERSION, pack.MAX_BACKREFERENCE_CAPACITY)
+	os.Exit(0)
+}
+
 func printUsageAndExit() {
 	fmt.Printf(`Usage is:
 
 	Packing:
-logpack [Options.. ] file.log
+logpack [Options.. ] file.log [file2.log ..]
+logpack -r [Options.. ] directory
+logpack --concat all.lp [Options.. ] file.log [file2.log ..]
 
 	Unpacking:
-logpack -d file.lp
+logpack -d [Options.. ] file.lp [file2.lp ..]
+logpack -d -r [Options.. ] directory
+
+	Listing chunks of archives (without unpacking):
+logpack --inspect file.lp [file2.lp ..]
+
+	Printing unpacked size of archives (a number of bytes per line):
+logpack --print-size file.lp [file2.lp ..]
+
+	Comparing ratio and speed with gzip (no archives are written):
+logpack --compare [-#] [--good-enough 0.85] file.log [file2.log ..]
+
+	Printing version of the tool and of the archive format:
+logpack --version
 
 Options:
    -#       Desired compression level, where '#' is a number between 1 and 9;
             lower numbers provide faster compression, higher numbers yield
             better compression ratios. [Default: 4]
-`)
+   --good-enough 0.85
+            Stop searching for the line to encode a line against at the first
+            one this similar to it, overriding the factor of the compression
+            level (0.8 for levels 1-6, then 0.9, 0.95 and 1). Lower values pack
+            faster, higher ones smaller (packing only).
+   --hash md5|sha256
+            Store a digest of the original file in the archive.
+   --verify Check the unpacked file against the digest stored in the archive
+            (unpacking only).
+   --salvage
+            Unpack as much of a damaged (eg. truncated) archive as possible
+            instead of failing; exit code is %d then (unpacking only).
+   --timestamps "####-##-## ##:##:##"
+            Delta-encode timestamps at the beginning of lines. '#' in the
+            pattern stands for a digit; other chars must match literally.
+            May improve compression of logs with regularly spaced entries.
+   --record-sep 0x1e
+            Split input into records at this byte instead of at '\n', eg.
+            for records that contain newlines. An ASCII char or its code;
+            stored in the archive. Cannot be used with --timestamps.
+   --sort-lines
+            Sort lines of every chunk so that similar messages are packed
+            next to each other; their order is restored when unpacking.
+            Better ratio for logs interleaving many kinds of messages, but
+            about twice as slow. Older versions of logpack refuse such
+            archives.
+   --comment "host=web01"
+            Store a comment (at most %d bytes) in the archive. It is shown
+            when unpacking with -v.
+   --min-ratio 0.9
+            Don't keep archives bigger than this fraction of the original
+            file; exit code is %d if some file was not packed.
+   -r       Pack every file in the directory tree (except *.lp archives).
+            Archives are written next to the originals (or into --outdir).
+            With -d unpack every *.lp archive in the tree, verifying stored
+            digests, and write %s listing unpacked files into
+            the directory. Archives that fail are listed at the end; exit
+            code is 1 then.
+   --concat all.lp
+            Pack all files into one archive; lines repeated across the files
+            are packed just once (up to 64 MB of distinct lines are
+            remembered). -d writes the files (by their base names)
+            next to the archive. Cannot be used with --hash, --timestamps,
+            --record-sep and --min-ratio.
+   --outdir /archive
+            Write archives into the directory (created if needed) instead of
+            next to the originals. With -r all archives go straight into it;
+            a file whose name was already packed there is not packed and exit
+            code is 1.
+   --mirror With --outdir and -r keep the directory tree of the packed files
+            under the output directory.
+   --dict common.txt
+            Prime the compressor with lines of the file, eg. lines common to
+            many small similar logs; their archives get smaller. Unpacking
+            (-d) needs the same file; another one is refused.
+   --ext .log
+            Pack only files with given extension (with -r only).
+   --stats-csv stats.csv
+            Append a row of stats (timestamp, filename, raw and packed
+            bytes, ratio, level, elapsed ms and MB/s) to the CSV file for
+            every packed file. Header is written when the file is created.
+   --buffer-size 16MB
+            How much of the input is read from disk at once; K, M and G
+            suffixes are powers of 1000. At least %d bytes. [Default: 5MB]
+   --size 1GB
+            Expected size of input that is not a regular file (eg. a pipe
+            like /dev/stdin, packed with --outdir), to report progress
+            against; without it only bytes packed so far are reported.
+   --profile cpu.prof
+            Write CPU profile of packing to the file, to be viewed with
+            'go tool pprof' (packing only).
+   --memprofile mem.prof
+            Write heap profile at the end of packing to the file (packing
+            only).
+   -f       Overwrite existing files without asking.
+   --no-prompt
+            Don't ask whether to overwrite existing files; skip them and
+            exit with code %d. Declining to overwrite when asked gives
+            exit code %d.
+   -q       Quiet; don't report progress and results.
+   --inspect
+            List chunks of archives (offset, compressed and raw size) read
+            from their headers, without unpacking. Exit code is 1 if some
+            archive is not valid.
+   --print-size
+            Print just the unpacked size of archives in bytes, one per line,
+            summed from chunk headers. Errors go to stderr; exit code is 1
+            if some archive is not valid.
+   -v       Verbose; report line endings and non-ASCII bytes (2 bytes
+            each packed unless matched) of packed files and format
+            version, compression level and comment of unpacked archives.
+`, EXIT_CODE_SALVAGED, pack.MAX_COMMENT_SIZE, EXIT_CODE_POOR_RATIO, MANIFEST_FILE_NAME, pack.DecompressBound(),
+		EXIT_CODE_FILE_EXISTS, EXIT_CODE_NOT_OVERWRITTEN)
 	os.Exit(0)
 }
 
-func packFile(inFile, outFile *os.File, compressionLevel int) (totalBytesRead, totalBytesWritten int64) {
+// Size of fi to report progress of packing against: its own if it's a regular file, opts.sizeHint otherwise (0 if
+// unknown).
+func expectedInputSize(fi os.FileInfo, opts cliOptions) int64 {
+	if fi.Mode().IsRegular() {
+		return fi.Size()
+	}
+	return opts.sizeHint
+}
+
+// Input is analyzed only in verbose mode. Returns an error wrapping errWritingOutput if outFile fails.
+// Regular files are packed from their beginning whatever was read of them before; other ones (eg. pipes) from where
+// they are.
+func packFile(inFile *os.File, outFile io.Writer, opts cliOptions) (totalBytesRead, totalBytesWritten int64, stats inputStats, err error) {
 	fi, err := inFile.Stat()
 	if err != nil {
 		log.Fatal(err)
 	}
-	inputFileSizeBytes := fi.Size()
+	inputFileSizeBytes := expectedInputSize(fi, opts)
+	var input io.Reader = inFile
+	if fi.Mode().IsRegular() {
+		input = io.NewSectionReader(inFile, 0, math.MaxInt64)
+	}
 
 	chunkSize := pack.DecompressBound()
-	inBuff := make([]byte, MAX_DISK_READ_BYTES)
+	inBuff := make([]byte, opts.readBufferSize)
 	outBuff := make([]byte, chunkSize)
 
-	for {
-		n, err := inFile.ReadAt(inBuff, totalBytesRead)
+	header := pack.ArchiveHeader{CompressionLevel: opts.compressionLevel, Digest: opts.digest,
+		TimestampPattern: opts.timestampPattern, Comment: []byte(opts.comment), RecordSeparator: opts.recordSeparator,
+		SortedLines: opts.sortLines}
+	dictLines := dictionaryLines(opts.dict, opts.recordSeparator)
+	if dictLines != nil {
+		header.Primed, header.PrimingHash = true, pack.PrimingHash(dictLines)
+	}
+	headerSize := pack.StoreArchiveHeader(outBuff, header)
+	if _, err := outFile.Write(outBuff[:headerSize]); err != nil {
+		return totalBytesRead, totalBytesWritten, stats, writingOutputError(err)
+	}
+	totalBytesWritten += int64(headerSize)
+
+	compressor, err := pack.NewCompressor(pack.Options{CompressionLevel: opts.compressionLevel,
+		GoodEnoughPercent: opts.goodEnoughPercent, RecordSeparator: opts.recordSeparator, SortLines: opts.sortLines})
+	if err != nil {
+		log.Fatal(err)
+	}
+	compressor.Prime(dictLines)
 
+	// digest is computed as the input is read so no second pass over the input is needed
+	digest := pack.NewDigest(opts.digest)
+	var lastByteRead byte
+
+	// input passes through timestamp encoder into encodedBuff before being packed
+	var encodedBuff bytes.Buffer
+	var timestamps *pack.TimestampCodec
+	if opts.timestampPattern != "" {
+		timestamps, err = pack.NewTimestampEncoder(&encodedBuff, opts.timestampPattern)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for {
+		// pipes return what they have at hand; the buffer is filled to pack the same chunks as of a regular file
+		n, err := io.ReadFull(input, inBuff)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
 		if err != nil && err != io.EOF {
 			log.Fatal(err)
 		}
+		if digest != nil {
+			digest.Write(inBuff[:n])
+		}
+		if opts.verbose && n > 0 {
+			// "\r\n" split between reads was counted as "\n"
+			if totalBytesRead > 0 && inBuff[0] == '\n' && lastByteRead == '\r' {
+				stats.lineEndings.LF--
+				stats.lineEndings.CRLF++
+			}
+			stats.lineEndings = stats.lineEndings.Add(pack.AnalyzeLineEndings(inBuff[:n]))
+			escapedBytes, _ := pack.EscapeStats(inBuff[:n])
+			stats.escapedBytes += int64(escapedBytes)
+			lastByteRead = inBuff[n-1]
+		}
 
 		inRemainder := inBuff[:n]
+		if timestamps != nil {
+			encodedBuff.Reset()
+			timestamps.Write(inRemainder)
+			if err == io.EOF {
+				timestamps.Close()
+			}
+			inRemainder = encodedBuff.Bytes()
+		}
 		// write compressed until input buffer is read completely.
 		for len(inRemainder) > 0 {
-			read, written := pack.Compress(outBuff, inRemainder, compressionLevel)
+			read, written := compressor.Compress(outBuff, inRemainder)
 
 			_, err2 := outFile.Write(outBuff[:written])
 			if err2 != nil {
-				log.Fatal(err2)
+				return totalBytesRead, totalBytesWritten, stats, writingOutputError(err2)
 			}
 
 			inRemainder = inRemainder[read:]
@@ -190,75 +1380,379 @@ func packFile(inFile, outFile *os.File, compressionLevel int) (totalBytesRead, t
 		}
 		totalBytesRead += int64(n)
 
-		{
-			var megabytesRead float32 = float32(totalBytesRead) / 1000_000.0
-			var inputMegabytes float32 = float32(inputFileSizeBytes) / 1000_000.0
-			var compRatioPercent float32 = float32(100*totalBytesWritten) / float32(totalBytesRead)
-
-			fmt.Printf("%7.2f MB / %.2f MB packed (%.1f%%)\r", 
-			           megabytesRead, inputMegabytes, compRatioPercent)
+		if !opts.quiet && inputFileSizeBytes > 0 {
+			fmt.Printf("%7.2f MB / %.2f MB packed (%.1f%%)\r",
+			           megabytes(totalBytesRead), megabytes(inputFileSizeBytes), percentOf(totalBytesWritten, totalBytesRead))
+		} else if !opts.quiet {
+			fmt.Printf("%7.2f MB packed (%.1f%%)\r", megabytes(totalBytesRead), percentOf(totalBytesWritten, totalBytesRead))
 		}
 
 		if err == io.EOF {
 			break
 		}
 	}
+
+	if digest != nil {
+		written, err := outFile.Write(digest.Sum(nil))
+		if err != nil {
+			return totalBytesRead, totalBytesWritten, stats, writingOutputError(err)
+		}
+		totalBytesWritten += int64(written)
+	}
 	return
 }
 
-func unpackFile(packed, dstFile *os.File) (totalBytesRead, totalBytesWritten int64) {
+// Unpacks packed into dstFile. Returns errCorruptArchive (or other error of decoding) if packed cannot be unpacked
+// completely; everything that was decoded before the damaged spot is written to dstFile then.
+// Digest stored in the archive is checked with opts.verify and in recursive mode; verifiedDigest is the one that
+// matched, as "sha256:<hex>" (empty if not checked).
+func unpackFile(packed *os.File, dstFile io.Writer, opts cliOptions) (totalBytesRead, totalBytesWritten int64, verifiedDigest string, err error) {
 	fi, err := packed.Stat()
 	if err != nil {
 		log.Fatal(err)
 	}
 	inputFileSizeBytes := fi.Size()
 
-	inBuff := make([]byte, MAX_DISK_READ_BYTES)
+	inBuff := make([]byte, opts.readBufferSize)
 	unpackedBuff := make([]byte, pack.DecompressBound())
 
+	header, headerSize, err := readArchiveHeader(packed)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	totalBytesRead = int64(headerSize)
+	if opts.verbose {
+		printArchiveHeader(packed.Name(), header)
+	}
+	dictLines := dictionaryLines(opts.dict, header.RecordSeparator)
+	if err := checkDictionary(header, dictLines); err != nil {
+		return totalBytesRead, 0, "", err
+	}
+
+	// chunks take everything between the header and the footer or trailer
+	chunksEnd := inputFileSizeBytes - int64(header.TrailerSize())
+	if header.Footer {
+		if _, chunksEnd, err = pack.ReadFooter(packed, inputFileSizeBytes); err != nil {
+			return totalBytesRead, 0, "", errCorruptArchive
+		}
+	}
+	if chunksEnd < totalBytesRead {
+		return totalBytesRead, 0, "", errCorruptArchive
+	}
+
+	if opts.verify && header.Digest == pack.DIGEST_NONE {
+		return totalBytesRead, 0, "", errNoDigest
+	}
+	var digest hash.Hash
+	if header.Digest != pack.DIGEST_NONE && (opts.verify || opts.recursive) {
+		digest = pack.NewDigest(header.Digest)
+		dstFile = io.MultiWriter(dstFile, digest)
+	}
+	counter := &countingWriter{w: dstFile}
+	dst := io.Writer(counter)
+
+	// chunks are wrapped in frames of the second stage; Reader unwraps them
+	if header.SecondStage != "" {
+		if err := unpackSecondStage(counter, packed, inputFileSizeBytes, dictLines); err != nil {
+			return totalBytesRead, counter.n, "", err
+		}
+		verifiedDigest, err = checkTrailerDigest(packed, inputFileSizeBytes, header, digest)
+		return inputFileSizeBytes, counter.n, verifiedDigest, err
+	}
+
+	var scratch pack.Scratch
+	scratch.SetRecordSeparator(header.RecordSeparator)
+	if header.Primed {
+		scratch.Prime(dictLines)
+	}
+
+	var timestamps *pack.TimestampCodec
+	if header.TimestampPattern != "" {
+		timestamps, err = pack.NewTimestampDecoder(dst, header.TimestampPattern)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dst = timestamps
+	}
+
 	for {
-		n, err := packed.ReadAt(inBuff, totalBytesRead)
+		readLimit := int64(len(inBuff))
+		if chunksEnd-totalBytesRead < readLimit {
+			readLimit = chunksEnd - totalBytesRead
+		}
+		n, err := packed.ReadAt(inBuff[:readLimit], totalBytesRead)
 		if err != nil && err != io.EOF {
 			log.Fatal(err)
 		}
+		// do not read the trailer as if it were chunks
+		if totalBytesRead+int64(n) == chunksEnd {
+			err = io.EOF
+		}
 
 		inRemainder := inBuff[:n]
 		// write decompressed until input buffer is read completely
 		for len(inRemainder) > 0 {
-			compressedBytesRead, uncompressedBytesWritten := pack.Decompress(unpackedBuff, inRemainder)
+			compressedBytesRead, uncompressedBytesWritten := pack.DecompressWith(unpackedBuff, inRemainder, &scratch)
 
 			if compressedBytesRead == pack.CORRUPT_INPUT {
-				log.Fatalf("Error: Cannot unpack \"%s\". Input file is corrupted or is not a Logpack archive\n", packed.Name())
+				return totalBytesRead, counter.n, "", errCorruptArchive
 			}
 
 			// inRemainder did not contain full chunk; break to read more from disk on fresh buffer
 			if compressedBytesRead == pack.NOT_ENOUGH_INPUT {
 				// header declares that there is more input but we're at the end
 				if err == io.EOF {
-					log.Fatalf("Error: Cannot unpack \"%s\". Input file is corrupted or is not a Logpack archive\n", packed.Name())
+					return totalBytesRead, counter.n, "", errCorruptArchive
 				}
 				break
 			}
 			inRemainder = inRemainder[compressedBytesRead:]
 
 			totalBytesRead    += int64(compressedBytesRead)
-			totalBytesWritten += int64(uncompressedBytesWritten)
 
-			_, err2 := dstFile.Write(unpackedBuff[:uncompressedBytesWritten])
-			if err2 != nil {
+			_, err2 := dst.Write(unpackedBuff[:uncompressedBytesWritten])
+			if counter.err != nil {
+				return totalBytesRead, counter.n, "", writingOutputError(counter.err)
+			} else if errors.Is(err2, pack.ErrCorruptInput) {
+				return totalBytesRead, counter.n, "", errCorruptArchive
+			} else if err2 != nil {
 				log.Fatal(err2)
 			}
 		}
 
-		{
-			var megabytesRead  float32 = float32(totalBytesRead)     / 1000_000.0
-			var inputMegabytes float32 = float32(inputFileSizeBytes) / 1000_000.0
-			fmt.Printf("%.2f MB / %.2f MB unpacked\r", megabytesRead, inputMegabytes)
+		if !opts.quiet {
+			fmt.Printf("%.2f MB / %.2f MB unpacked\r", megabytes(totalBytesRead), megabytes(inputFileSizeBytes))
 		}
 
 		if err == io.EOF {
 			break
 		}
 	}
-	return 
+
+	if timestamps != nil {
+		if err := timestamps.Close(); counter.err != nil {
+			return totalBytesRead, counter.n, "", writingOutputError(counter.err)
+		} else if err != nil {
+			return totalBytesRead, counter.n, "", errCorruptArchive
+		}
+	}
+	totalBytesWritten = counter.n
+
+	verifiedDigest, err = checkTrailerDigest(packed, inputFileSizeBytes, header, digest)
+	return inputFileSizeBytes, totalBytesWritten, verifiedDigest, err
+}
+
+// Unpacks archive of a second stage (the whole packed file) into dst with pack.Reader. Returns errCorruptArchive
+// if it cannot be unpacked completely, or error of pack.NewReader() if the second stage is not known.
+func unpackSecondStage(dst *countingWriter, packed *os.File, inputFileSizeBytes int64, dictLines [][]byte) error {
+	reader, err := pack.NewReader(io.NewSectionReader(packed, 0, inputFileSizeBytes))
+	if err != nil {
+		return err
+	}
+	// dictionary has been checked against the header
+	if reader.Header().Primed {
+		reader.Prime(dictLines)
+	}
+	if _, err := io.Copy(dst, reader); dst.err != nil {
+		return writingOutputError(dst.err)
+	} else if errors.Is(err, pack.ErrCorruptInput) || err == io.ErrUnexpectedEOF {
+		return errCorruptArchive
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	return nil
+}
+
+// Compares digest (if not nil) of what was unpacked with the one stored at the end of the trailer.
+// Returns the matching digest as "sha256:<hex>" or errDigestMismatch.
+func checkTrailerDigest(packed *os.File, inputFileSizeBytes int64, header pack.ArchiveHeader, digest hash.Hash) (verifiedDigest string, err error) {
+	// digest is the last field of the trailer
+	trailer := make([]byte, pack.DigestSize(header.Digest))
+	if _, err := packed.ReadAt(trailer, inputFileSizeBytes-int64(len(trailer))); err != nil {
+		log.Fatal(err)
+	}
+	if digest == nil {
+		return "", nil
+	}
+	if !bytes.Equal(digest.Sum(nil), trailer) {
+		return "", errDigestMismatch
+	}
+	return fmt.Sprintf("%s:%x", digestName(header.Digest), trailer), nil
+}
+
+// Packs file at inputPath with logpack (at opts.compressionLevel) and with gzip (at its default level) without
+// writing any archive and prints sizes and speeds of both.
+func compareWithGzip(inputPath string, opts cliOptions) {
+	content, err := os.ReadFile(inputPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	start := time.Now()
+	result, err := pack.PackStream(io.Discard, bytes.NewReader(content),
+		pack.WriterOptions{Options: pack.Options{CompressionLevel: opts.compressionLevel,
+			GoodEnoughPercent: opts.goodEnoughPercent, RecordSeparator: opts.recordSeparator}})
+	if err != nil {
+		log.Fatal(err)
+	}
+	logpackElapsed := time.Since(start)
+
+	start = time.Now()
+	gzipped := &countingWriter{w: io.Discard}
+	gz := gzip.NewWriter(gzipped)
+	if _, err := gz.Write(content); err != nil {
+		log.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		log.Fatal(err)
+	}
+	gzipElapsed := time.Since(start)
+
+	fmt.Printf("%s: %.2f MB\n", inputPath, megabytes(int64(len(content))))
+	printComparisonRow(fmt.Sprintf("logpack -%d", opts.compressionLevel), int64(len(content)), result.BytesWritten, logpackElapsed)
+	printComparisonRow("gzip -6", int64(len(content)), gzipped.n, gzipElapsed)
+}
+
+func printComparisonRow(method string, rawBytes, packedBytes int64, elapsed time.Duration) {
+	fmt.Printf("  %-10s %8.2f MB (%5.1f%%) in %.2fs; %7.1f MB/s\n",
+		method, megabytes(packedBytes), percentOf(packedBytes, rawBytes), elapsed.Seconds(), speedMBps(rawBytes, elapsed))
+}
+
+// Prints header and a table of chunks of the archive read from their headers only. Returns false if the archive
+// is not valid - chunks do not add up to the file.
+func inspectArchive(archivePath string) (valid bool) {
+	archive, err := os.ReadFile(archivePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	header, headerSize, err := pack.ReadArchiveHeader(archive)
+	if err != nil {
+		fmt.Printf("%s: not a valid archive: %v\n", archivePath, err)
+		return false
+	}
+	printArchiveHeader(archivePath, header)
+
+	chunksEnd := len(archive) - header.TrailerSize()
+	if header.Footer {
+		_, footerOffset, err := pack.ReadFooter(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			fmt.Printf("%s: not a valid archive: %v\n", archivePath, err)
+			return false
+		}
+		chunksEnd = int(footerOffset)
+	}
+	if chunksEnd < headerSize {
+		fmt.Printf("%s: not a valid archive: too short to hold its header and trailer\n", archivePath)
+		return false
+	}
+	if header.SecondStage != "" {
+		fmt.Printf("%s: chunks are wrapped in frames of second stage %q; not listed\n", archivePath, header.SecondStage)
+		return true
+	}
+	chunks, remainder := pack.ScanChunks(archive[headerSize:chunksEnd])
+
+	fmt.Printf("%8s %12s %12s %12s %8s\n", "chunk", "offset", "compressed", "raw", "ratio")
+	var totalRaw int64
+	for i, chunk := range chunks {
+		fmt.Printf("%8d %12d %12d %12d %8.2f\n", i, headerSize+chunk.Offset, chunk.CompressedSize, chunk.RawSize,
+			float64(chunk.RawSize)/float64(chunk.CompressedSize))
+		totalRaw += int64(chunk.RawSize)
+	}
+	trailerLabel := "trailer"
+	if header.Footer {
+		trailerLabel = "footer and trailer"
+	}
+	fmt.Printf("%d chunks; %d bytes unpack to %d; header %d bytes, %s %d bytes\n",
+		len(chunks), chunksEnd-headerSize-remainder, totalRaw, headerSize, trailerLabel, len(archive)-chunksEnd)
+
+	if remainder >= pack.HEADER_SIZE {
+		fmt.Printf("%s: not a valid archive: last %d bytes of chunks are an incomplete chunk (truncated?)\n",
+			archivePath, remainder)
+		return false
+	} else if remainder > 0 {
+		fmt.Printf("%s: not a valid archive: %d trailing bytes after the last chunk\n", archivePath, remainder)
+		return false
+	}
+	return true
+}
+
+// Prints the number of bytes archive at archivePath unpacks to and nothing else, for scripts. Errors are printed
+// to stderr.
+func printUnpackedSize(archivePath string, opts cliOptions) (valid bool) {
+	size, err := unpackedSize(archivePath, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: not a valid archive: %v\n", archivePath, err)
+		return false
+	}
+	fmt.Println(size)
+	return true
+}
+
+// The size is summed from chunk headers. Archives whose chunks don't unpack to the original bytes (timestamps
+// delta-encoded, chunks wrapped by a second stage) are unpacked to count them, without writing anything.
+func unpackedSize(archivePath string, opts cliOptions) (int64, error) {
+	archive, err := os.ReadFile(archivePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	header, headerSize, err := pack.ReadArchiveHeader(archive)
+	if err != nil {
+		return 0, err
+	}
+	if header.TimestampPattern != "" || header.SecondStage != "" {
+		packed := openFileForReadingOrDie(archivePath)
+		defer packed.Close()
+		opts.quiet, opts.verbose = true, false
+		_, size, _, err := unpackFile(packed, io.Discard, opts)
+		return size, err
+	}
+
+	chunksEnd := len(archive) - header.TrailerSize()
+	if header.Footer {
+		_, footerOffset, err := pack.ReadFooter(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return 0, err
+		}
+		chunksEnd = int(footerOffset)
+	}
+	if chunksEnd < headerSize {
+		return 0, errCorruptArchive
+	}
+	return pack.DecompressedSize(archive[headerSize:chunksEnd])
+}
+
+func printArchiveHeader(archiveName string, header pack.ArchiveHeader) {
+	level := "unknown"
+	if header.CompressionLevel != 0 {
+		level = strconv.Itoa(header.CompressionLevel)
+	}
+	fmt.Printf("%s: format version %d, compression level %s\n", archiveName, header.Version, level)
+	if len(header.Comment) > 0 {
+		fmt.Printf("%s: comment: %s\n", archiveName, header.Comment)
+	}
+	if header.RecordSeparator != 0 {
+		fmt.Printf("%s: record separator: 0x%02x\n", archiveName, header.RecordSeparator)
+	}
+	if header.SecondStage != "" {
+		fmt.Printf("%s: second stage: %s\n", archiveName, header.SecondStage)
+	}
+	if header.Primed {
+		fmt.Printf("%s: packed with a dictionary\n", archiveName)
+	}
+	if header.Bundle {
+		fmt.Printf("%s: bundle of files (packed with --concat)\n", archiveName)
+	}
+	if header.SortedLines {
+		fmt.Printf("%s: lines sorted within chunks\n", archiveName)
+	}
+}
+
+// Returns error of pack.ReadArchiveHeader() if packed does not start with a valid archive header.
+func readArchiveHeader(packed *os.File) (header pack.ArchiveHeader, headerSize int, err error) {
+	buff := make([]byte, pack.MAX_ARCHIVE_HEADER_SIZE)
+	n, err := packed.ReadAt(buff, 0)
+	if err != nil && err != io.EOF {
+		log.Fatal(err)
+	}
+	return pack.ReadArchiveHeader(buff[:n])
 }
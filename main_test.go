@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"macsmol.pl/logpack/pack"
+)
+
+func TestSummariesOfMultiGigabyteFiles(t *testing.T) {
+	// 5 GB (plus a few bytes, lost in float32) packed to 1 GB in 20 seconds
+	const raw, packed = int64(5_000_000_123), int64(1_000_000_000)
+	elapsed := 20 * time.Second
+
+	expected := "(big.log => big.log.lp) 5000.00 MB packed to 1000.00 MB (20.0%) in 20.00s; average speed: 250.0 MB/s"
+	if summary := packSummary("big.log", "big.log.lp", raw, packed, elapsed); summary != expected {
+		t.Errorf("Expected %q; got %q", expected, summary)
+	}
+	expected = "1000.00 MB unpacked to 5000.00 MB in 20.00s (50.00 MB/s)"
+	if summary := unpackSummary(packed, raw, elapsed); summary != expected {
+		t.Errorf("Expected %q; got %q", expected, summary)
+	}
+	if mb := megabytes(raw); mb != 5000.000123 {
+		t.Errorf("Expected 5000.000123 MB; got %v", mb)
+	}
+}
+
+func TestSummariesOfInstantOrEmptyRuns(t *testing.T) {
+	for _, elapsed := range []time.Duration{0, time.Nanosecond, -time.Second} {
+		for _, raw := range []int64{0, 10, 10_000_000_000} {
+			speed, percent := speedMBps(raw, elapsed), percentOf(raw/2, raw)
+			if math.IsInf(speed, 0) || math.IsNaN(speed) || speed < 0 || math.IsNaN(percent) {
+				t.Errorf("%d bytes in %v: speed %v MB/s, %v%%", raw, elapsed, speed, percent)
+			}
+			for _, summary := range []string{packSummary("a", "b", raw, raw/2, elapsed), unpackSummary(raw/2, raw, elapsed)} {
+				if strings.Contains(summary, "Inf") || strings.Contains(summary, "NaN") {
+					t.Errorf("Summary of %d bytes in %v: %s", raw, elapsed, summary)
+				}
+			}
+		}
+	}
+}
+
+func TestUnpackFileOfSecondStageArchive(t *testing.T) {
+	input := []byte(strings.Repeat("2024-05-17 12:00:00 INFO request served in 12 ms\n", 5000))
+	var packed bytes.Buffer
+	w, err := pack.NewWriterOpts(&packed, pack.WriterOptions{Options: pack.Options{SecondStage: pack.GzipSecondStage{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(input)
+	w.Close()
+	// Writer stores no digest; add one as the CLI does
+	header, headerSize, _ := pack.ReadArchiveHeader(packed.Bytes())
+	header.Digest = pack.DIGEST_SHA256
+	archiveBytes := make([]byte, pack.MAX_ARCHIVE_HEADER_SIZE)
+	archiveBytes = append(archiveBytes[:pack.StoreArchiveHeader(archiveBytes, header)], packed.Bytes()[headerSize:]...)
+	digest := pack.NewDigest(pack.DIGEST_SHA256)
+	digest.Write(input)
+	archiveBytes = digest.Sum(archiveBytes)
+	archivePath := filepath.Join(t.TempDir(), "served.log.lp")
+	os.WriteFile(archivePath, archiveBytes, 0644)
+
+	archive, _ := os.Open(archivePath)
+	defer archive.Close()
+	var unpacked bytes.Buffer
+	opts := cliOptions{readBufferSize: MAX_DISK_READ_BYTES, quiet: true, verify: true}
+	bytesRead, bytesWritten, verifiedDigest, err := unpackFile(archive, &unpacked, opts)
+	if err != nil || !bytes.Equal(unpacked.Bytes(), input) || bytesRead != int64(len(archiveBytes)) ||
+		bytesWritten != int64(len(input)) || !strings.HasPrefix(verifiedDigest, "sha256:") {
+		t.Errorf("Unpacked %d of %d bytes (read %d), digest %q, err: %v", bytesWritten, len(input), bytesRead,
+			verifiedDigest, err)
+	}
+}
+
+func TestConcatenatedFilesUnpackSeparately(t *testing.T) {
+	dir := t.TempDir()
+	contents := map[string]string{
+		"app.log":     strings.Repeat("2024-05-17 12:00:00 INFO request served in 12 ms\n", 3000),
+		"no-eol.log":  "first line\nlast line without newline",
+		"empty.log":   "",
+		"markers.log": "\x1d\"app.log\" 10\n\x1e0 2\n\x1fescaped\n",
+	}
+	opts := cliOptions{compressionLevel: pack.COMPRESSION_LEVEL_DEFAULT, quiet: true, force: true,
+		concatPath: filepath.Join(dir, "all.lp")}
+	for name, content := range contents {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0644)
+		opts.inputPaths = append(opts.inputPaths, path)
+	}
+	packConcatenated(opts)
+
+	outDir := filepath.Join(dir, "out")
+	os.Mkdir(outDir, 0755)
+	os.Rename(opts.concatPath, filepath.Join(outDir, "all.lp"))
+	archive, _ := os.Open(filepath.Join(outDir, "all.lp"))
+	defer archive.Close()
+	if !isBundle(archive) {
+		t.Fatal("Archive of concatenated files not recognized")
+	}
+	unpackConcatenated(archive, opts)
+
+	for name, content := range contents {
+		if unpacked, err := os.ReadFile(filepath.Join(outDir, name)); err != nil || string(unpacked) != content {
+			t.Errorf("%s: unpacked %d bytes instead of %d; err: %v", name, len(unpacked), len(content), err)
+		}
+	}
+	if entries, _ := os.ReadDir(outDir); len(entries) != len(contents)+1 {
+		t.Errorf("Expected %d files next to the archive; got %d", len(contents), len(entries)-1)
+	}
+}
+
+// A file of its own that starts like a bundle is unpacked as it is, not as files of a bundle.
+func TestFileStartingWithBundleMagicUnpacksAsItIs(t *testing.T) {
+	dir := t.TempDir()
+	content := pack.BUNDLE_MAGIC + "\x1d\"other.log\" 6\nfirst line\n"
+	logPath := filepath.Join(dir, "looks-like-bundle.log")
+	os.WriteFile(logPath, []byte(content), 0644)
+	opts := cliOptions{compressionLevel: pack.COMPRESSION_LEVEL_DEFAULT, readBufferSize: MAX_DISK_READ_BYTES,
+		quiet: true, force: true}
+	tryDoPack(logPath, logPath+".lp", opts)
+	os.Remove(logPath)
+
+	archive, _ := os.Open(logPath + ".lp")
+	defer archive.Close()
+	if isBundle(archive) {
+		t.Error("Archive of a single file taken for a bundle")
+	}
+	if complete := tryDoUnpack(logPath+".lp", opts); !complete {
+		t.Error("Archive not unpacked completely")
+	}
+	if unpacked, err := os.ReadFile(logPath); err != nil || string(unpacked) != content {
+		t.Errorf("Unpacked %q; err: %v", unpacked, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other.log")); err == nil {
+		t.Error("File of the fake bundle unpacked")
+	}
+}
+
+// Fails with ENOSPC once limit bytes are written, like a disk filling up.
+type fullDiskWriter struct {
+	limit int
+}
+
+func (w *fullDiskWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, syscall.ENOSPC
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestFullDiskFailsPackAndUnpack(t *testing.T) {
+	input := []byte(strings.Repeat("2024-05-17 12:00:00 INFO request served in 12 ms\n", 50000))
+	inputPath := filepath.Join(t.TempDir(), "served.log")
+	os.WriteFile(inputPath, input, 0644)
+	opts := cliOptions{compressionLevel: pack.COMPRESSION_LEVEL_DEFAULT, readBufferSize: MAX_DISK_READ_BYTES, quiet: true}
+
+	inFile, _ := os.Open(inputPath)
+	defer inFile.Close()
+	for _, limit := range []int{0, 1000} {
+		if _, _, _, err := packFile(inFile, &fullDiskWriter{limit: limit}, opts); !errors.Is(err, errWritingOutput) || !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("Packing to disk full after %d bytes: expected errWritingOutput and ENOSPC; got %v", limit, err)
+		}
+	}
+
+	var packed bytes.Buffer
+	if _, _, _, err := packFile(inFile, &packed, opts); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := inputPath + ".lp"
+	os.WriteFile(archivePath, packed.Bytes(), 0644)
+	archive, _ := os.Open(archivePath)
+	defer archive.Close()
+	if _, _, _, err := unpackFile(archive, &fullDiskWriter{limit: len(input) / 2}, opts); !errors.Is(err, errWritingOutput) || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Unpacking to full disk: expected errWritingOutput and ENOSPC; got %v", err)
+	}
+}
+
+func TestOutdirFlattensOrMirrorsTree(t *testing.T) {
+	dir := t.TempDir()
+	logs := filepath.Join(dir, "logs")
+	for _, path := range []string{"app.log", "a/app.log", "b/web.log"} {
+		os.MkdirAll(filepath.Join(logs, filepath.Dir(path)), 0755)
+		os.WriteFile(filepath.Join(logs, path), []byte(strings.Repeat(path+" line\n", 100)), 0644)
+	}
+	defer func() { packedInto, nameCollided = map[string]string{}, false }()
+
+	flat := cliOptions{compressionLevel: pack.COMPRESSION_LEVEL_DEFAULT, readBufferSize: MAX_DISK_READ_BYTES,
+		quiet: true, recursive: true, outDir: filepath.Join(dir, "flat")}
+	packTree(logs, flat)
+	if !nameCollided {
+		t.Error("Second app.log flattened into the same archive name was not reported")
+	}
+	for _, name := range []string{"app.log.lp", "web.log.lp"} {
+		if _, err := os.Stat(filepath.Join(flat.outDir, name)); err != nil {
+			t.Errorf("%s not packed into outdir: %v", name, err)
+		}
+	}
+
+	packedInto, nameCollided = map[string]string{}, false
+	mirrored := flat
+	mirrored.outDir, mirrored.mirror = filepath.Join(dir, "mirrored", "new"), true
+	packTree(logs, mirrored)
+	if nameCollided {
+		t.Error("Mirrored tree reported a name collision")
+	}
+	for _, path := range []string{"app.log", "a/app.log", "b/web.log"} {
+		if _, err := os.Stat(filepath.Join(mirrored.outDir, path+".lp")); err != nil {
+			t.Errorf("%s not mirrored into outdir: %v", path, err)
+		}
+		if _, err := os.Stat(filepath.Join(logs, path+".lp")); err == nil {
+			t.Errorf("%s packed next to the original", path)
+		}
+	}
+}
+
+func TestDictionaryPrimesPackingAndIsRequiredToUnpack(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0644)
+		return path
+	}
+	dict := []byte("[notice] jk2_init() Found child in scoreboard slot\n[error] mod_jk child workerEnv in error state\n")
+	logPath := write("small.log", "[notice] jk2_init() Found child 6725 in scoreboard slot 10\n"+
+		"[error] mod_jk child workerEnv in error state 6\n")
+	otherDict := write("other.txt", "something else\n")
+
+	packLog := func(opts cliOptions) string {
+		opts.compressionLevel, opts.readBufferSize = pack.COMPRESSION_LEVEL_DEFAULT, MAX_DISK_READ_BYTES
+		in, _ := os.Open(logPath)
+		defer in.Close()
+		var packed bytes.Buffer
+		if _, _, _, err := packFile(in, &packed, opts); err != nil {
+			t.Fatal(err)
+		}
+		return write("small.log.lp", packed.String())
+	}
+	unpackArchive := func(archivePath string, dict []byte) (string, error) {
+		archive, _ := os.Open(archivePath)
+		defer archive.Close()
+		var unpacked bytes.Buffer
+		_, _, _, err := unpackFile(archive, &unpacked, cliOptions{readBufferSize: MAX_DISK_READ_BYTES, dict: dict})
+		return unpacked.String(), err
+	}
+
+	plainSize := len(mustRead(t, packLog(cliOptions{})))
+	archivePath := packLog(cliOptions{dict: dict})
+	if primedSize := len(mustRead(t, archivePath)); primedSize >= plainSize {
+		t.Errorf("Packed with dictionary to %d bytes; %d without", primedSize, plainSize)
+	}
+	if unpacked, err := unpackArchive(archivePath, dict); err != nil || unpacked != string(mustRead(t, logPath)) {
+		t.Errorf("Unpacked %q with the dictionary; err: %v", unpacked, err)
+	}
+	if _, err := unpackArchive(archivePath, nil); !errors.Is(err, errDictRequired) {
+		t.Errorf("Unpacking without dictionary: %v; expected %v", err, errDictRequired)
+	}
+	if _, err := unpackArchive(archivePath, mustRead(t, otherDict)); !errors.Is(err, errDictMismatch) {
+		t.Errorf("Unpacking with other dictionary: %v; expected %v", err, errDictMismatch)
+	}
+}
+
+func mustRead(t *testing.T, path string) []byte {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestProfilesOfPackingAreWritten(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "some.log")
+	os.WriteFile(logPath, bytes.Repeat([]byte("GET /index.html 200 served in 12 ms\n"), 10000), 0644)
+	opts := cliOptions{compressionLevel: pack.COMPRESSION_LEVEL_DEFAULT, readBufferSize: MAX_DISK_READ_BYTES,
+		cpuProfilePath: filepath.Join(dir, "cpu.prof"), memProfilePath: filepath.Join(dir, "mem.prof")}
+
+	stopProfiling := startProfilingOrDie(opts)
+	in, _ := os.Open(logPath)
+	_, _, _, err := packFile(in, io.Discard, opts)
+	in.Close()
+	stopProfiling()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{opts.cpuProfilePath, opts.memProfilePath} {
+		if profile := mustRead(t, path); len(profile) == 0 {
+			t.Errorf("%s is empty", path)
+		}
+	}
+}
+
+func TestVerbosePackingCountsEscapedBytes(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "utf8.log")
+	os.WriteFile(logPath, []byte(strings.Repeat("zażółć gęślą jaźń\n", 100)), 0644)
+	opts := cliOptions{compressionLevel: pack.COMPRESSION_LEVEL_DEFAULT, readBufferSize: MAX_DISK_READ_BYTES,
+		verbose: true}
+
+	in, _ := os.Open(logPath)
+	defer in.Close()
+	_, _, stats, err := packFile(in, io.Discard, opts)
+	if err != nil || stats.escapedBytes != 18*100 || stats.lineEndings.LF != 100 {
+		t.Errorf("Counted %+v; expected 1800 escaped bytes of 100 lines, err: %v", stats, err)
+	}
+}
+
+func TestPackFileOfPipeWithSizeHint(t *testing.T) {
+	input := []byte(strings.Repeat("2024-05-17 12:00:00 INFO request served in 12 ms\n", 50000))
+	dir := t.TempDir()
+	opts := cliOptions{compressionLevel: pack.COMPRESSION_LEVEL_DEFAULT, readBufferSize: pack.DecompressBound(),
+		quiet: true, sizeHint: int64(len(input))}
+
+	pipeOut, pipeIn, _ := os.Pipe()
+	defer pipeOut.Close()
+	go func() {
+		// pieces smaller than the read buffer
+		for rest := input; len(rest) > 0; rest = rest[min(1000, len(rest)):] {
+			pipeIn.Write(rest[:min(1000, len(rest))])
+		}
+		pipeIn.Close()
+	}()
+	if fi, _ := pipeOut.Stat(); expectedInputSize(fi, opts) != int64(len(input)) {
+		t.Errorf("Pipe: expected size of the hint %d; got %d", len(input), expectedInputSize(fi, opts))
+	}
+	var packed bytes.Buffer
+	if _, _, _, err := packFile(pipeOut, &packed, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same archive as of a regular file, whose own size overrides the hint
+	inputPath := filepath.Join(dir, "served.log")
+	os.WriteFile(inputPath, input, 0644)
+	inFile, _ := os.Open(inputPath)
+	defer inFile.Close()
+	opts.sizeHint = 1
+	if fi, _ := inFile.Stat(); expectedInputSize(fi, opts) != int64(len(input)) {
+		t.Errorf("Regular file: expected its size %d; got %d", len(input), expectedInputSize(fi, opts))
+	}
+	var packedFile bytes.Buffer
+	if _, _, _, err := packFile(inFile, &packedFile, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packed.Bytes(), packedFile.Bytes()) {
+		t.Errorf("Pipe packed to %d bytes, regular file to %d", packed.Len(), packedFile.Len())
+	}
+}
+
+func TestRefusedRepackKeepsExistingArchive(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	os.WriteFile(logPath, []byte(strings.Repeat("2024-05-17 12:00:00 INFO request served\n", 1000)), 0644)
+	archivePath := logPath + ".lp"
+	opts := cliOptions{compressionLevel: pack.COMPRESSION_LEVEL_DEFAULT, readBufferSize: MAX_DISK_READ_BYTES,
+		quiet: true, force: true}
+	tryDoPack(logPath, archivePath, opts)
+	archive := mustRead(t, archivePath)
+
+	// random bytes do not compress to 10%
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	os.WriteFile(logPath, random, 0644)
+	opts.minRatio = 0.1
+	if _, _, refused := tryDoPack(logPath, archivePath, opts); !refused {
+		t.Fatal("Repack of incompressible file was not refused")
+	}
+	if !bytes.Equal(mustRead(t, archivePath), archive) {
+		t.Error("Refused repack changed the existing archive")
+	}
+
+	opts.minRatio = 2
+	if _, _, refused := tryDoPack(logPath, archivePath, opts); refused {
+		t.Fatal("Repack within --min-ratio was refused")
+	}
+	if bytes.Equal(mustRead(t, archivePath), archive) {
+		t.Error("Repack within --min-ratio did not replace the archive")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("Expected only the log and its archive in the directory; got %d entries", len(entries))
+	}
+}
+
+func TestUnpackReportsDigestMismatch(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	input := []byte(strings.Repeat("2024-05-17 12:00:00 INFO request served in 12 ms\n", 1000))
+	os.WriteFile(logPath, input, 0644)
+	opts := cliOptions{compressionLevel: pack.COMPRESSION_LEVEL_DEFAULT, readBufferSize: MAX_DISK_READ_BYTES,
+		quiet: true, digest: pack.DIGEST_SHA256}
+
+	in, _ := os.Open(logPath)
+	defer in.Close()
+	var packed bytes.Buffer
+	if _, _, _, err := packFile(in, &packed, opts); err != nil {
+		t.Fatal(err)
+	}
+	unpack := func(archiveBytes []byte) (unpacked []byte, err error) {
+		archivePath := filepath.Join(dir, "app.log.lp")
+		os.WriteFile(archivePath, archiveBytes, 0644)
+		archive, _ := os.Open(archivePath)
+		defer archive.Close()
+		var out bytes.Buffer
+		_, _, _, err = unpackFile(archive, &out, cliOptions{readBufferSize: MAX_DISK_READ_BYTES, quiet: true, verify: true})
+		return out.Bytes(), err
+	}
+	if unpacked, err := unpack(packed.Bytes()); err != nil || !bytes.Equal(unpacked, input) {
+		t.Fatalf("Unpacked %d of %d bytes, err: %v", len(unpacked), len(input), err)
+	}
+
+	// digest is the last field of the trailer
+	damaged := bytes.Clone(packed.Bytes())
+	damaged[len(damaged)-1] ^= 0x01
+	if _, err := unpack(damaged); !errors.Is(err, errDigestMismatch) {
+		t.Errorf("Expected errDigestMismatch; got %v", err)
+	}
+}
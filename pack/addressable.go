@@ -0,0 +1,229 @@
+package pack
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+var (
+	ErrLineChecksumMismatch = errors.New("logpack: line does not match its checksum")
+	ErrLineOutOfRange       = errors.New("logpack: line number out of range of the index")
+)
+
+const (
+	// Every ADDRESSABLE_ANCHOR_INTERVAL-th line of a line-addressable archive (0, 16, 32...) is an anchor: it is
+	// packed referring no other line.
+	ADDRESSABLE_ANCHOR_INTERVAL = 16
+	// Other lines refer up to this many anchors before them - the rolling window they are primed with (see
+	// Compressor.Prime()). So GetLine() unpacks at most this many lines besides the one asked for.
+	ADDRESSABLE_WINDOW_ANCHORS = 16
+)
+
+// Offsets of lines in an archive written by CompressLineAddressable(). Line n (counting from 0) is stored
+// in packed[index[n]:index[n+1]], so the index holds one offset more than there are lines.
+type LineIndex []int
+
+// Number of lines in the index.
+func (index LineIndex) Lines() int {
+	return len(index) - 1
+}
+
+/*
+Packs every line of src into its own chunk (or several chunks if the line is longer than MAX_CHUNK_SIZE), so that
+any line can be unpacked with GetLine() without unpacking all the lines before it. Returns number of bytes consumed
+from src, number of bytes written to dst and index of the packed lines.
+
+Lines refer a rolling window of anchors (see ADDRESSABLE_ANCHOR_INTERVAL): the last ADDRESSABLE_WINDOW_ANCHORS
+anchors up to the line. Anchors themselves are packed alone, so a line needs just them unpacked first, however
+far it is in the archive. Chunks of lines other than anchors are primed: unpack them with GetLine() or, all of them
+at once, with UnpackLineAddressable() - not with Decompress().
+
+Line-addressable archive is still bigger than a regular one: a line refers only every 16th line before it, and
+every line takes a chunk header. On the loghub corpus it takes 0.41x input size instead of 0.27x of a regular
+archive of the default level (apache: 0.27x instead of 0.11x); lines packed alone, referring no window, would take
+about 1.04x. Use it only if random access to single lines is worth more than the ratio.
+
+Only whole lines are consumed. If dst fills up, caller should pass src[bytesRead:] and a fresh dst to the next call;
+it makes an archive of its own, with its own index.
+*/
+func CompressLineAddressable(dst, src []byte) (bytesRead, bytesWritten int, index LineIndex) {
+	index = LineIndex{0}
+	compressor := newCompressor(Options{})
+	var anchors [][]byte
+	for n := 0; bytesRead < len(src); n++ {
+		line, _ := nextLine(src[bytesRead:])
+		compressor.opts.primingLines = addressableWindow(anchors, n)
+		lineWritten := compressWholeLine(dst[bytesWritten:], line, compressor)
+		if lineWritten == 0 {
+			break
+		}
+		if n%ADDRESSABLE_ANCHOR_INTERVAL == 0 {
+			anchors = append(anchors, line)
+		}
+		bytesRead += len(line)
+		bytesWritten += lineWritten
+		index = append(index, bytesWritten)
+	}
+	return bytesRead, bytesWritten, index
+}
+
+// Anchors line n refers, the most recent last; anchors holds all of them up to the line. Anchors refer none.
+func addressableWindow(anchors [][]byte, n int) [][]byte {
+	if n%ADDRESSABLE_ANCHOR_INTERVAL == 0 {
+		return nil
+	}
+	return anchors[max(0, len(anchors)-ADDRESSABLE_WINDOW_ANCHORS):]
+}
+
+// Packs line into as many chunks as it takes. Returns 0 if the whole line does not fit in dst.
+func compressWholeLine(dst, line []byte, compressor *Compressor) (bytesWritten int) {
+	for bytesRead := 0; bytesRead < len(line); {
+		if len(dst)-bytesWritten < HEADER_SIZE+2 {
+			return 0
+		}
+		read, written := compressor.Compress(dst[bytesWritten:], line[bytesRead:])
+		if read == 0 {
+			return 0
+		}
+		bytesRead += read
+		bytesWritten += written
+	}
+	return bytesWritten
+}
+
+/*
+Unpacks line number n (counting from 0) of archive written by CompressLineAddressable() into dst. Only the chunks
+of that line and of the anchors it refers are read. Returns number of bytes written to dst or one of errors returned
+by Decompress(); CORRUPT_INPUT also if n is not in 0..index.Lines()-1 (GetLineChecked() tells it apart).
+*/
+func GetLine(dst, packed []byte, index LineIndex, n int) (bytesWritten int) {
+	if n < 0 || n >= index.Lines() {
+		return CORRUPT_INPUT
+	}
+	var scratch Scratch
+	if n%ADDRESSABLE_ANCHOR_INTERVAL != 0 {
+		lastAnchor := n - n%ADDRESSABLE_ANCHOR_INTERVAL
+		firstAnchor := max(0, lastAnchor-(ADDRESSABLE_WINDOW_ANCHORS-1)*ADDRESSABLE_ANCHOR_INTERVAL)
+		var window [][]byte
+		for anchor := firstAnchor; anchor <= lastAnchor; anchor += ADDRESSABLE_ANCHOR_INTERVAL {
+			line, result := unpackAnchor(packed, index, anchor)
+			if result < 0 {
+				return result
+			}
+			window = append(window, line)
+		}
+		scratch.Prime(window)
+	}
+	return unpackIndexedLine(dst, packed, index, n, &scratch)
+}
+
+// Unpacks all lines of archive written by CompressLineAddressable() into dst, each anchor just once. Returns number
+// of bytes written to dst or one of errors returned by Decompress().
+func UnpackLineAddressable(dst, packed []byte, index LineIndex) (bytesWritten int) {
+	var scratch Scratch
+	var anchors [][]byte
+	for n := 0; n < index.Lines(); n++ {
+		scratch.Prime(addressableWindow(anchors, n))
+		written := unpackIndexedLine(dst[bytesWritten:], packed, index, n, &scratch)
+		if written < 0 {
+			return written
+		}
+		if n%ADDRESSABLE_ANCHOR_INTERVAL == 0 {
+			anchors = append(anchors, dst[bytesWritten:bytesWritten+written])
+		}
+		bytesWritten += written
+	}
+	return bytesWritten
+}
+
+// Unpacks anchor line n into a buffer of its size. Returns the line or one of errors returned by Decompress().
+func unpackAnchor(packed []byte, index LineIndex, n int) (line []byte, result int) {
+	begin, end := index[n], index[n+1]
+	if begin < 0 || end > len(packed) || begin > end {
+		return nil, CORRUPT_INPUT
+	}
+	size, err := DecompressedSize(packed[begin:end])
+	if err != nil {
+		return nil, CORRUPT_INPUT
+	}
+	line = make([]byte, size)
+	var scratch Scratch
+	if result = unpackIndexedLine(line, packed, index, n, &scratch); result < 0 {
+		return nil, result
+	}
+	return line, result
+}
+
+// Unpacks chunks of line n into dst with scratch. Returns number of bytes written or one of errors returned
+// by Decompress().
+func unpackIndexedLine(dst, packed []byte, index LineIndex, n int, scratch *Scratch) (bytesWritten int) {
+	begin, end := index[n], index[n+1]
+	if begin < 0 || end > len(packed) || begin > end {
+		return CORRUPT_INPUT
+	}
+	lineChunks := packed[begin:end]
+	for len(lineChunks) > 0 {
+		read, written := DecompressWith(dst[bytesWritten:], lineChunks, scratch)
+		if read < 0 {
+			if read == NOT_ENOUGH_INPUT {
+				// index does not match the archive
+				return CORRUPT_INPUT
+			}
+			return read
+		}
+		lineChunks = lineChunks[read:]
+		bytesWritten += written
+	}
+	return bytesWritten
+}
+
+// Checksums of lines of an archive written by CompressLineAddressableWithChecksums(), one per line: checksums[n] is
+// the checksum of unpacked line n. Like LineIndex it is kept next to the archive rather than in it.
+type LineChecksums []uint16
+
+// Lower 16 bits of CRC-32 (IEEE) of line.
+func lineChecksum(line []byte) uint16 {
+	return uint16(crc32.ChecksumIEEE(line))
+}
+
+/*
+Same as CompressLineAddressable() but also returns a 2-byte checksum of every line, so that GetLineChecked() can tell
+a line damaged in the archive (or in the index) from a good one. Plain GetLine() may return wrong bytes then -
+a damaged literal still decodes fine.
+
+Packed bytes are the same as without checksums. Checksums cost 2 bytes per line on top of the line-addressable archive:
+on the loghub corpus that is 3.9% more (from 1.8% for open_stack to 8.8% for hpc; apache: 0.273x -> 0.295x input
+size). That is half of what chunk headers of the lines take already.
+*/
+func CompressLineAddressableWithChecksums(dst, src []byte) (bytesRead, bytesWritten int, index LineIndex,
+	checksums LineChecksums) {
+	bytesRead, bytesWritten, index = CompressLineAddressable(dst, src)
+	checksums = make(LineChecksums, 0, index.Lines())
+	for rest := src[:bytesRead]; len(rest) > 0; {
+		var line []byte
+		line, rest = nextLine(rest)
+		checksums = append(checksums, lineChecksum(line))
+	}
+	return bytesRead, bytesWritten, index, checksums
+}
+
+// Same as GetLine() but verifies the unpacked line against checksums[n]. Returns an error wrapping
+// ErrLineChecksumMismatch or ErrCorruptInput (that one if the chunks of the line do not unpack at all); error
+// message holds the line number. io.ErrShortBuffer is returned if the line does not fit in dst.
+func GetLineChecked(dst, packed []byte, index LineIndex, checksums LineChecksums, n int) (bytesWritten int, err error) {
+	if n < 0 || n >= index.Lines() || n >= len(checksums) {
+		return 0, fmt.Errorf("%w: line %d of %d", ErrLineOutOfRange, n, min(index.Lines(), len(checksums)))
+	}
+	bytesWritten = GetLine(dst, packed, index, n)
+	if bytesWritten == NOT_ENOUGH_OUTPUT_SPACE {
+		return 0, io.ErrShortBuffer
+	} else if bytesWritten < 0 {
+		return 0, fmt.Errorf("%w: line %d", ErrCorruptInput, n)
+	}
+	if lineChecksum(dst[:bytesWritten]) != checksums[n] {
+		return 0, fmt.Errorf("%w: line %d", ErrLineChecksumMismatch, n)
+	}
+	return bytesWritten, nil
+}
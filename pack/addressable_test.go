@@ -0,0 +1,143 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestGetLineUnpacksEveryLineOnCorpus(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	packedBuff := make([]byte, test_compression_bound_bytes)
+	lineBuff := make([]byte, test_max_input_size_bytes)
+
+	dir := path_defaultLoghubCorpus + "apache/"
+	inputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+	input := inputBuff[:inputSize]
+
+	bytesRead, bytesWritten, index := CompressLineAddressable(packedBuff, input)
+	if bytesRead != inputSize {
+		t.Fatalf("Consumed %d bytes of %d", bytesRead, inputSize)
+	}
+	t.Logf("line-addressable size: %.3f of input", float64(bytesWritten)/float64(inputSize))
+	// lines refer the window of anchors
+	if bytesWritten > inputSize/2 {
+		t.Errorf("Expected less than half of %d input bytes; got %d", inputSize, bytesWritten)
+	}
+
+	unpackedSize := UnpackLineAddressable(lineBuff, packedBuff[:bytesWritten], index)
+	assertInversibility(t, "apache", inputBuff, lineBuff, inputSize, unpackedSize)
+
+	for n, rest := 0, input; len(rest) > 0; n++ {
+		var line []byte
+		line, rest = nextLine(rest)
+		lineSize := GetLine(lineBuff, packedBuff[:bytesWritten], index, n)
+		if !bytes.Equal(lineBuff[:max(lineSize, 0)], line) {
+			t.Fatalf("Line %d: expected %q; got %q (%d)", n, line, lineBuff[:max(lineSize, 0)], lineSize)
+		}
+	}
+}
+
+func TestGetLineSpanningSeveralChunks(t *testing.T) {
+	long := strings.Repeat("x", 3*MAX_CHUNK_SIZE) + "\n"
+	// long lines among anchors too
+	input := []byte(long + "short\n" + long + strings.Repeat("line between anchors\n", ADDRESSABLE_ANCHOR_INTERVAL-3) +
+		long + "short\n" + long + "last")
+	packed := make([]byte, 2*len(input)+100)
+	unpacked := make([]byte, len(input))
+
+	bytesRead, bytesWritten, index := CompressLineAddressable(packed, input)
+	if bytesRead != len(input) || index.Lines() != ADDRESSABLE_ANCHOR_INTERVAL+4 {
+		t.Fatalf("Consumed %d bytes of %d into %d lines", bytesRead, len(input), index.Lines())
+	}
+	for n, line := range bytes.SplitAfter(input, []byte("\n")) {
+		lineSize := GetLine(unpacked, packed[:bytesWritten], index, n)
+		if !bytes.Equal(unpacked[:max(lineSize, 0)], line) {
+			t.Errorf("Line %d of size %d unpacked wrong (%d)", n, len(line), lineSize)
+		}
+	}
+	if unpackedSize := UnpackLineAddressable(unpacked, packed[:bytesWritten], index); unpackedSize != len(input) ||
+		!bytes.Equal(unpacked, input) {
+		t.Errorf("Unpacked %d bytes of %d", unpackedSize, len(input))
+	}
+}
+
+func TestGetLineOutOfRangeFails(t *testing.T) {
+	input := []byte("first line\nsecond line\n")
+	packed := make([]byte, 2*len(input)+100)
+	unpacked := make([]byte, len(input))
+
+	_, bytesWritten, index, checksums := CompressLineAddressableWithChecksums(packed, input)
+	for _, n := range []int{-1, 2, 100} {
+		if lineSize := GetLine(unpacked, packed[:bytesWritten], index, n); lineSize != CORRUPT_INPUT {
+			t.Errorf("Line %d: expected CORRUPT_INPUT; got %d", n, lineSize)
+		}
+		if _, err := GetLineChecked(unpacked, packed[:bytesWritten], index, checksums, n); !errors.Is(err, ErrLineOutOfRange) {
+			t.Errorf("Line %d: expected ErrLineOutOfRange; got %v", n, err)
+		}
+	}
+}
+
+func TestCompressLineAddressableConsumesWholeLinesWhenDstFills(t *testing.T) {
+	input := []byte("first line\nsecond line\nthird line\n")
+	// fits exactly two line chunks
+	packed := make([]byte, 2*HEADER_SIZE+len("first line\nsecond line\n"))
+
+	bytesRead, _, index := CompressLineAddressable(packed, input)
+	if bytesRead != len("first line\nsecond line\n") || index.Lines() != 2 {
+		t.Errorf("Expected 2 whole lines consumed; got %d bytes, %d lines", bytesRead, index.Lines())
+	}
+}
+
+func TestGetLineCheckedDetectsDamagedLine(t *testing.T) {
+	input := []byte("first line\nsecond line\nthird line\n")
+	packed := make([]byte, 2*len(input)+100)
+	unpacked := make([]byte, len(input))
+
+	_, bytesWritten, index, checksums := CompressLineAddressableWithChecksums(packed, input)
+	packed = packed[:bytesWritten]
+	for n, line := range []string{"first line\n", "second line\n", "third line\n"} {
+		if lineSize, err := GetLineChecked(unpacked, packed, index, checksums, n); err != nil || string(unpacked[:lineSize]) != line {
+			t.Errorf("Line %d: expected %q; got %q, err: %v", n, line, unpacked[:lineSize], err)
+		}
+	}
+
+	// literal of the second line; it still unpacks, just to wrong bytes
+	packed[index[1]+HEADER_SIZE+1] ^= 0x01
+	if lineSize := GetLine(unpacked, packed, index, 1); lineSize != len("second line\n") {
+		t.Fatalf("Damaged line is expected to unpack; got %d", lineSize)
+	}
+	if _, err := GetLineChecked(unpacked, packed, index, checksums, 1); !errors.Is(err, ErrLineChecksumMismatch) ||
+		!strings.Contains(err.Error(), "line 1") {
+		t.Errorf("Expected checksum mismatch of line 1; got %v", err)
+	}
+	// other lines are fine
+	if _, err := GetLineChecked(unpacked, packed, index, checksums, 2); err != nil {
+		t.Errorf("Line 2: %v", err)
+	}
+	// chunk header of the third line declares more than there is
+	packed[index[2]] = 0xff
+	if _, err := GetLineChecked(unpacked, packed, index, checksums, 2); !errors.Is(err, ErrCorruptInput) {
+		t.Errorf("Expected corrupt line 2; got %v", err)
+	}
+}
+
+func TestGetLineOfCorruptIndexFails(t *testing.T) {
+	input := []byte("first line\nsecond line\nthird line\n")
+	packed := make([]byte, 2*len(input)+100)
+	unpacked := make([]byte, len(input))
+
+	_, bytesWritten, index, checksums := CompressLineAddressableWithChecksums(packed, input)
+	packed = packed[:bytesWritten]
+	// every corrupt index damages line 1
+	for _, corrupt := range []LineIndex{{index[0], -3, index[2], index[3]}, {-3, index[1], index[2], index[3]},
+		{index[0], index[2], index[1], index[3]}, {index[0], index[1], len(packed) + 1, index[3]}} {
+		if lineSize := GetLine(unpacked, packed, corrupt, 1); lineSize != CORRUPT_INPUT {
+			t.Errorf("Index %v: expected CORRUPT_INPUT; got %d", corrupt, lineSize)
+		}
+		if _, err := GetLineChecked(unpacked, packed, corrupt, checksums, 1); !errors.Is(err, ErrCorruptInput) {
+			t.Errorf("Index %v: expected ErrCorruptInput; got %v", corrupt, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package pack
+
+import (
+	"testing"
+)
+
+// Measures how much smaller lines would get if the format let the first matched block of a line start at any word
+// of both the line and its key line (explicit keyLine offset plus length of the literal head) instead of just
+// the keyLine offset of NO_SHARED_PREFIX_FLAG encoding. For every line the best of all such alignments is taken,
+// so it is an upper bound of the gain. Reported as percent of the archive size saved.
+//
+// Level 4, 1 MB of every corpus file: 0.02% saved if only lines with no shared prefix are realigned
+// (hadoop 0.17% at most), 0.38% if every line is (android_v2 1.38% at most). Not worth a format change.
+func BenchmarkRealignedFirstBlock(b *testing.B) {
+	fileBuff := make([]byte, test_max_input_size_bytes)
+	dst := make([]byte, DecompressBound())
+
+	for _, allLines := range []bool{false, true} {
+		name := "noPrefixLines_"
+		if allLines {
+			name = "allLines_"
+		}
+		for _, file := range corpusFiles(path_loghubCorpus) {
+			fileSize := readFileToBuffer(fileBuff, file.path)
+			src := fileBuff[:min2(fileSize, test_level_sample_size_bytes)]
+
+			b.Run(name+file.name, func(b *testing.B) {
+				var packedSize, savedSize int
+				for i := 0; i < b.N; i++ {
+					packedSize, savedSize = realignmentGain(src, dst, allLines)
+				}
+				b.ReportMetric(100*float64(savedSize)/float64(packedSize), "saved%")
+			})
+		}
+	}
+}
+
+// Packs src at default level and sums up how much smaller lines would get if optimally realigned.
+func realignmentGain(src, dst []byte, allLines bool) (packedSize, savedSize int) {
+	compressionParams := getCompressionParameters(COMPRESSION_LEVEL_DEFAULT)
+	lineScratch := make([]byte, 2*MAX_CHUNK_SIZE+2)
+
+	for len(src) > 0 {
+		read, written := compress(dst, src, compressionParams, MAX_SIMILARITY)
+		packedSize += written
+		chunk := src[:read]
+		src = src[read:]
+
+		backref := backrefBuffer{capacity: int(compressionParams.backreferenceCapacity)}
+		firstLine, chunk := nextLine(chunk)
+		backref.add(firstLine)
+		for currLine, chunk := nextLine(chunk); len(currLine) > 0; currLine, chunk = nextLine(chunk) {
+			lineRef := backref.chooseReferenceLine(currLine, compressionParams.goodEnoughPercent, MAX_SIMILARITY)
+			if lineRef.prefixLength <= 0 || allLines {
+				currentSize := compressLine(lineRef, currLine, lineScratch, false)
+				bestSize := currentSize
+				keyLine := backref.getLineAt(int(lineRef.linesBefore))
+
+				for _, idxCurrLine := range wordBoundaries(currLine) {
+					for _, idxKeyLine := range wordBoundaries(keyLine) {
+						// line reference, two lengths, literal head and the rest compared the usual way
+						size := 1 + encodedLengthSize(idxKeyLine) + encodedLengthSize(idxCurrLine) +
+							quote(lineScratch, currLine[:idxCurrLine]) +
+							compressLineFrom(keyLine, currLine, idxKeyLine, idxCurrLine, lineScratch)
+						bestSize = min2(bestSize, size)
+					}
+				}
+				savedSize += currentSize - bestSize
+			}
+			backref.add(currLine)
+		}
+	}
+	return packedSize, savedSize
+}
+
+// Positions compressLine() may align lines at: beginning and spaces within first MAX_SIMILARITY chars.
+func wordBoundaries(line []byte) []int {
+	boundaries := []int{0}
+	for i := indexOfFirstSpace(0, line); i < min2(len(line), MAX_SIMILARITY); i = indexOfFirstSpace(i+1, line) {
+		boundaries = append(boundaries, i)
+	}
+	return boundaries
+}
+
+// Size of encodeLength() output; 0 takes a byte too as it would have to be stored explicitly.
+func encodedLengthSize(length int) int {
+	return length/int(LENGTH_BASE) + 1
+}
+
+// Loop of compressLine() starting at given cursors.
+func compressLineFrom(keyLine, currLine []byte, idxKeyLine, idxCurrLine int, dst []byte) (bytesWritten int) {
+	sameStringLength := 0
+	for idxKeyLine < len(keyLine) && idxCurrLine < len(currLine) {
+		if currLine[idxCurrLine] == keyLine[idxKeyLine] {
+			sameStringLength++
+			idxCurrLine++
+			idxKeyLine++
+		} else {
+			bytesWritten += encodeLength(sameStringLength, dst, bytesWritten)
+			sameStringLength = 0
+			idxKeyLine = indexOfFirstSpace(idxKeyLine, keyLine)
+			idxNextSpaceCurrLine := indexOfFirstSpace(idxCurrLine, currLine)
+			bytesWritten += quote(dst[bytesWritten:], currLine[idxCurrLine:idxNextSpaceCurrLine])
+			idxCurrLine = idxNextSpaceCurrLine
+		}
+	}
+	bytesWritten += encodeLength(sameStringLength, dst, bytesWritten)
+	bytesWritten += quote(dst[bytesWritten:], currLine[idxCurrLine:])
+	return bytesWritten
+}
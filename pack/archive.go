@@ -0,0 +1,449 @@
+package pack
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+)
+
+// Layout of a Logpack archive (as written by the logpack executable):
+//
+//	header:  ARCHIVE_MAGIC | version | flags | compression level | optional fields (presence depends on flags)
+//	chunks:  sequence of chunks as produced by Compress(), or frames of a second stage wrapping them (see SecondStage)
+//	footer:  index of chunks (optional, see WriterOptions.Footer)
+//	trailer: optional fields (presence depends on flags)
+//
+// Archives written before the header was introduced are plain sequences of chunks. They are still readable
+// and are reported as version 0. Version 1 header has no compression level.
+//
+// From WINDOW_FORMAT_VERSION on the compression level is followed by:
+//
+//	backreference capacity | required features | extension size | extension
+//
+// and the layout stays the same in later versions: what they add either goes to the extension, which older
+// versions of the package skip, or sets a bit of required features, which makes them refuse the archive. So an
+// archive of a later version is read as long as its chunks need no bigger window than MAX_BACKREFERENCE_CAPACITY
+// and no feature unknown to this version of the package.
+const (
+	// Fifth byte of the magic is > ESCAPE_BYTE. Valid headerless archive can never start with it because
+	// the first byte of every chunk (which follows 4-byte chunk header) is <= ESCAPE_BYTE or STORED_CHUNK_MARKER.
+	ARCHIVE_MAGIC = "LPAK\xff"
+	// version of the archive layout written by StoreArchiveHeader()
+	FORMAT_VERSION byte = 2
+	// first version storing backreference capacity, required features and extension; written by
+	// StoreArchiveHeader() only for headers with BackreferenceCapacity set
+	WINDOW_FORMAT_VERSION byte = 3
+
+	// Archive flags
+	// Trailer contains digest of the original (uncompressed) content. Header stores the digest kind.
+	FLAG_DIGEST byte = 0x01
+	// Content was transformed by TimestampCodec before packing. Header stores the timestamp pattern.
+	FLAG_TIMESTAMP_DELTA byte = 0x02
+	// Chunks were compressed by a primed Compressor. Header stores PrimingHash() of the priming lines.
+	FLAG_PRIMED byte = 0x04
+	// Header stores a freeform comment (see ArchiveHeader.Comment).
+	FLAG_COMMENT byte = 0x08
+	// Chunks are followed by a footer. Header stores offset of the footer; if it's 0 trailer does.
+	FLAG_FOOTER byte = 0x10
+	// Chunks may contain numeric delta tokens (see Options.NumericDelta). No field in the header; the flag just
+	// makes older versions refuse the archive rather than unpack the tokens as literals.
+	FLAG_NUMERIC_DELTA byte = 0x20
+	// Lines end with other byte than '\n' (see Options.RecordSeparator). Header stores the byte.
+	FLAG_RECORD_SEPARATOR byte = 0x40
+	// Chunks are wrapped in frames of a second stage compressor (see Options.SecondStage). Header stores its name.
+	FLAG_SECOND_STAGE byte = 0x80
+	// flags known to this version of the package. Archive with any other flag set cannot be read correctly
+	knownFlags = FLAG_DIGEST | FLAG_TIMESTAMP_DELTA | FLAG_PRIMED | FLAG_COMMENT | FLAG_FOOTER | FLAG_NUMERIC_DELTA |
+		FLAG_RECORD_SEPARATOR | FLAG_SECOND_STAGE
+
+	// Required features (see WINDOW_FORMAT_VERSION)
+	// Chunks may be sorted (see Options.SortLines). No field in the header.
+	FEATURE_SORTED_LINES byte = 0x01
+	// Chunks may be marked as ASCII (see Options.MarkAsciiChunks). No field in the header; without the feature
+	// older versions would take the marker for a numeric delta token.
+	FEATURE_ASCII_CHUNKS byte = 0x02
+	// Content is a bundle of files (see PackBundle()), not a file of its own. No field in the header.
+	FEATURE_BUNDLE byte = 0x04
+	// required features known to this version of the package. Archive with any other one set cannot be read correctly
+	knownFeatures = FEATURE_SORTED_LINES | FEATURE_ASCII_CHUNKS | FEATURE_BUNDLE
+
+	// comment length is stored in one byte
+	MAX_COMMENT_SIZE = 255
+	// extension size is stored in one byte
+	MAX_EXTENSION_SIZE = 255
+	// big enough to fit any header accepted by ReadArchiveHeader()
+	MAX_ARCHIVE_HEADER_SIZE = 64 + 1 + MAX_COMMENT_SIZE + 1 + 1 + MAX_SECOND_STAGE_NAME_SIZE + SIZEOF_INT64 +
+		3 + MAX_EXTENSION_SIZE
+)
+
+// Kinds of digest of the original content that can be stored in the archive trailer
+const (
+	DIGEST_NONE byte = iota
+	DIGEST_MD5
+	DIGEST_SHA256
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("logpack: unsupported archive version")
+	ErrTruncatedHeader    = errors.New("logpack: truncated archive header")
+	ErrUnknownDigest      = errors.New("logpack: unknown digest kind")
+	ErrCorruptInput       = errors.New("logpack: input is corrupted or is not a Logpack archive")
+	ErrCommentTooLong     = errors.New("logpack: archive comment too long")
+	ErrUnsupportedWindow  = errors.New("logpack: archive window bigger than supported")
+)
+
+type ArchiveHeader struct {
+	// 0 for headerless archives
+	Version byte
+	// Level the archive was packed at. Informational only - it is not needed for unpacking.
+	// 0 if unknown (archives older than version 2)
+	CompressionLevel int
+	// one of DIGEST_* constants
+	Digest byte
+	// Pattern given to NewTimestampEncoder() or empty if timestamps were not encoded
+	TimestampPattern string
+	// Set if chunks were compressed by a primed Compressor; PrimingHash identifies the priming lines then
+	Primed      bool
+	PrimingHash uint32
+	// Freeform annotation (eg. "host=web01 app=shop") of at most MAX_COMMENT_SIZE bytes; nil if there's none.
+	// Not interpreted by the package in any way.
+	Comment []byte
+	// Set if chunks are followed by a footer (see ReadFooter()). FooterOffset is where it starts in the archive;
+	// 0 if the archive was written to a non-seekable sink - the offset is in the trailer then.
+	Footer       bool
+	FooterOffset int64
+	// Set if chunks were compressed with Options.NumericDelta
+	NumericDelta bool
+	// Options.RecordSeparator chunks were compressed with; 0 for '\n'
+	RecordSeparator byte
+	// Name of the second stage chunks are wrapped with (see Options.SecondStage); empty if none
+	SecondStage string
+	// Backreference capacity (see compressionLevelPresets) chunks were compressed with; 0 if not stored, which
+	// means at most MAX_BACKREFERENCE_CAPACITY. Only archives of WINDOW_FORMAT_VERSION or later store it; they are
+	// refused with ErrUnsupportedWindow if it exceeds MAX_BACKREFERENCE_CAPACITY.
+	BackreferenceCapacity int
+	// Fields of a later version unknown to this version of the package, kept as they are; nil if there are none.
+	// Stored (at most MAX_EXTENSION_SIZE bytes) only along with BackreferenceCapacity.
+	Extension []byte
+	// Set if chunks were compressed with Options.SortLines. Stored as a required feature, so versions of the package
+	// that can't unpack sorted chunks refuse the archive.
+	SortedLines bool
+	// Set if chunks were compressed with Options.MarkAsciiChunks. Stored as a required feature like SortedLines.
+	AsciiChunks bool
+	// Set if content is a bundle of files written by PackBundle(); unpack it with UnpackBundle().
+	// Stored as a required feature: content of any file may look like a bundle, only the header tells.
+	Bundle bool
+}
+
+func (header ArchiveHeader) flags() (flags byte) {
+	if header.Digest != DIGEST_NONE {
+		flags |= FLAG_DIGEST
+	}
+	if header.TimestampPattern != "" {
+		flags |= FLAG_TIMESTAMP_DELTA
+	}
+	if header.Primed {
+		flags |= FLAG_PRIMED
+	}
+	if len(header.Comment) > 0 {
+		flags |= FLAG_COMMENT
+	}
+	if header.Footer {
+		flags |= FLAG_FOOTER
+	}
+	if header.NumericDelta {
+		flags |= FLAG_NUMERIC_DELTA
+	}
+	if header.RecordSeparator != 0 {
+		flags |= FLAG_RECORD_SEPARATOR
+	}
+	if header.SecondStage != "" {
+		flags |= FLAG_SECOND_STAGE
+	}
+	return flags
+}
+
+func (header ArchiveHeader) features() (features byte) {
+	if header.SortedLines {
+		features |= FEATURE_SORTED_LINES
+	}
+	if header.AsciiChunks {
+		features |= FEATURE_ASCII_CHUNKS
+	}
+	if header.Bundle {
+		features |= FEATURE_BUNDLE
+	}
+	return features
+}
+
+// Whether the header has the fields of WINDOW_FORMAT_VERSION: backreference capacity, required features and extension.
+func (header ArchiveHeader) hasWindowFields() bool {
+	return header.BackreferenceCapacity != 0 || header.features() != 0
+}
+
+// Number of bytes the header takes at the beginning of the archive.
+func (header ArchiveHeader) Size() int {
+	if header.Version == 0 {
+		return 0
+	}
+	size := len(ARCHIVE_MAGIC) + 2
+	if header.Version >= 2 {
+		size++
+	}
+	if header.hasWindowFields() {
+		size += 3 + len(header.Extension)
+	}
+	if header.Digest != DIGEST_NONE {
+		size++
+	}
+	if header.TimestampPattern != "" {
+		size += 1 + len(header.TimestampPattern)
+	}
+	if header.Primed {
+		size += 4
+	}
+	if len(header.Comment) > 0 {
+		size += 1 + len(header.Comment)
+	}
+	if header.RecordSeparator != 0 {
+		size++
+	}
+	if header.SecondStage != "" {
+		size += 1 + len(header.SecondStage)
+	}
+	if header.Footer {
+		size += SIZEOF_INT64
+	}
+	return size
+}
+
+// Number of bytes the trailer takes at the end of the archive. Footer is not part of the trailer.
+func (header ArchiveHeader) TrailerSize() int {
+	size := DigestSize(header.Digest)
+	if header.Footer && header.FooterOffset == 0 {
+		size += SIZEOF_INT64
+	}
+	return size
+}
+
+// Writes header at the beginning of dst. Dst should have at least MAX_ARCHIVE_HEADER_SIZE bytes.
+// Version field of the header is ignored; FORMAT_VERSION is written, or WINDOW_FORMAT_VERSION if
+// BackreferenceCapacity or a required feature (SortedLines, AsciiChunks, Bundle) is set. The package itself never sets
+// BackreferenceCapacity, so archives stay readable by its older versions unless they need such a feature; capacity
+// is stored as MAX_BACKREFERENCE_CAPACITY then. Extension longer than MAX_EXTENSION_SIZE is cut to that size.
+// Compression level is stored the way Compress() interprets it (eg. 0 as COMPRESSION_LEVEL_DEFAULT).
+// Comment longer than MAX_COMMENT_SIZE is cut to that size (WriterOptions.Validate() reports such comments), so is
+// second stage name longer than MAX_SECOND_STAGE_NAME_SIZE.
+func StoreArchiveHeader(dst []byte, header ArchiveHeader) (bytesWritten int) {
+	header.Comment = limitSlice(header.Comment, MAX_COMMENT_SIZE)
+	header.SecondStage = header.SecondStage[:min(len(header.SecondStage), MAX_SECOND_STAGE_NAME_SIZE)]
+	bytesWritten = copy(dst, ARCHIVE_MAGIC)
+	dst[bytesWritten] = FORMAT_VERSION
+	dst[bytesWritten+1] = header.flags()
+	dst[bytesWritten+2] = byte(normalizeCompressionLevel(header.CompressionLevel))
+	bytesWritten += 3
+
+	if header.hasWindowFields() {
+		if header.BackreferenceCapacity == 0 {
+			header.BackreferenceCapacity = MAX_BACKREFERENCE_CAPACITY
+		}
+		extension := limitSlice(header.Extension, MAX_EXTENSION_SIZE)
+		dst[len(ARCHIVE_MAGIC)] = WINDOW_FORMAT_VERSION
+		dst[bytesWritten] = byte(header.BackreferenceCapacity)
+		dst[bytesWritten+1] = header.features()
+		dst[bytesWritten+2] = byte(len(extension))
+		bytesWritten += 3
+		bytesWritten += copy(dst[bytesWritten:], extension)
+	}
+
+	if header.Digest != DIGEST_NONE {
+		dst[bytesWritten] = header.Digest
+		bytesWritten++
+	}
+	if header.TimestampPattern != "" {
+		dst[bytesWritten] = byte(len(header.TimestampPattern))
+		bytesWritten++
+		bytesWritten += copy(dst[bytesWritten:], header.TimestampPattern)
+	}
+	if header.Primed {
+		binary.LittleEndian.PutUint32(dst[bytesWritten:], header.PrimingHash)
+		bytesWritten += 4
+	}
+	if len(header.Comment) > 0 {
+		dst[bytesWritten] = byte(len(header.Comment))
+		bytesWritten++
+		bytesWritten += copy(dst[bytesWritten:], header.Comment)
+	}
+	if header.RecordSeparator != 0 {
+		dst[bytesWritten] = header.RecordSeparator
+		bytesWritten++
+	}
+	if header.SecondStage != "" {
+		dst[bytesWritten] = byte(len(header.SecondStage))
+		bytesWritten++
+		bytesWritten += copy(dst[bytesWritten:], header.SecondStage)
+	}
+	if header.Footer {
+		binary.LittleEndian.PutUint64(dst[bytesWritten:], uint64(header.FooterOffset))
+		bytesWritten += SIZEOF_INT64
+	}
+	return bytesWritten
+}
+
+// Parses archive header at the beginning of src. If src does not start with ARCHIVE_MAGIC it is assumed to be
+// a headerless archive - version 0 header of size 0 is returned.
+func ReadArchiveHeader(src []byte) (header ArchiveHeader, headerSize int, err error) {
+	if !bytes.HasPrefix(src, []byte(ARCHIVE_MAGIC)) {
+		return header, 0, nil
+	}
+	src = src[len(ARCHIVE_MAGIC):]
+	if len(src) < 2 {
+		return header, 0, ErrTruncatedHeader
+	}
+	header.Version = src[0]
+	if header.Version == 0 {
+		return header, 0, ErrUnsupportedVersion
+	}
+	flags := src[1]
+	src = src[2:]
+	if flags&^knownFlags != 0 {
+		return header, 0, ErrUnsupportedVersion
+	}
+
+	if header.Version >= 2 {
+		if len(src) < 1 {
+			return header, 0, ErrTruncatedHeader
+		}
+		header.CompressionLevel = int(src[0])
+		src = src[1:]
+	}
+	if header.Version >= WINDOW_FORMAT_VERSION {
+		if len(src) < 3 || len(src)-3 < int(src[2]) {
+			return header, 0, ErrTruncatedHeader
+		}
+		header.BackreferenceCapacity = int(src[0])
+		if header.BackreferenceCapacity == 0 {
+			return header, 0, ErrCorruptInput
+		}
+		if header.BackreferenceCapacity > MAX_BACKREFERENCE_CAPACITY {
+			return header, 0, ErrUnsupportedWindow
+		}
+		if src[1]&^knownFeatures != 0 {
+			return header, 0, ErrUnsupportedVersion
+		}
+		header.SortedLines = src[1]&FEATURE_SORTED_LINES != 0
+		header.AsciiChunks = src[1]&FEATURE_ASCII_CHUNKS != 0
+		header.Bundle = src[1]&FEATURE_BUNDLE != 0
+		if src[2] > 0 {
+			header.Extension = append([]byte(nil), src[3:3+int(src[2])]...)
+		}
+		src = src[3+int(src[2]):]
+	}
+
+	if flags&FLAG_DIGEST != 0 {
+		if len(src) < 1 {
+			return header, 0, ErrTruncatedHeader
+		}
+		header.Digest = src[0]
+		if DigestSize(header.Digest) == 0 {
+			return header, 0, ErrUnknownDigest
+		}
+		src = src[1:]
+	}
+	if flags&FLAG_TIMESTAMP_DELTA != 0 {
+		if len(src) < 1 || len(src)-1 < int(src[0]) {
+			return header, 0, ErrTruncatedHeader
+		}
+		header.TimestampPattern = string(src[1 : 1+src[0]])
+		if err := ValidateTimestampPattern(header.TimestampPattern); err != nil {
+			return header, 0, err
+		}
+		src = src[1+src[0]:]
+	}
+	if flags&FLAG_PRIMED != 0 {
+		if len(src) < 4 {
+			return header, 0, ErrTruncatedHeader
+		}
+		header.Primed = true
+		header.PrimingHash = binary.LittleEndian.Uint32(src)
+		src = src[4:]
+	}
+	if flags&FLAG_COMMENT != 0 {
+		if len(src) < 1 || len(src)-1 < int(src[0]) {
+			return header, 0, ErrTruncatedHeader
+		}
+		header.Comment = append([]byte(nil), src[1:1+int(src[0])]...)
+		src = src[1+int(src[0]):]
+	}
+	header.NumericDelta = flags&FLAG_NUMERIC_DELTA != 0
+	if flags&FLAG_RECORD_SEPARATOR != 0 {
+		if len(src) < 1 {
+			return header, 0, ErrTruncatedHeader
+		}
+		header.RecordSeparator = src[0]
+		// Options.Validate() refuses digits along with numeric delta
+		if header.RecordSeparator == 0 || header.RecordSeparator >= ESCAPE_BYTE ||
+			header.NumericDelta && isDigit(header.RecordSeparator) {
+			return header, 0, ErrCorruptInput
+		}
+		src = src[1:]
+	}
+	if flags&FLAG_SECOND_STAGE != 0 {
+		if len(src) < 1 || len(src)-1 < int(src[0]) {
+			return header, 0, ErrTruncatedHeader
+		}
+		header.SecondStage = string(src[1 : 1+src[0]])
+		if err := validateSecondStageName(header.SecondStage); err != nil {
+			return header, 0, ErrCorruptInput
+		}
+		src = src[1+src[0]:]
+	}
+	if flags&FLAG_FOOTER != 0 {
+		if len(src) < SIZEOF_INT64 {
+			return header, 0, ErrTruncatedHeader
+		}
+		header.Footer = true
+		header.FooterOffset = int64(binary.LittleEndian.Uint64(src))
+		if header.FooterOffset < 0 {
+			return header, 0, ErrCorruptInput
+		}
+	}
+	return header, header.Size(), nil
+}
+
+// Returns comment stored in the header of archive r (nil if there's none) without unpacking anything.
+func ReadComment(r io.ReaderAt) ([]byte, error) {
+	buff := make([]byte, MAX_ARCHIVE_HEADER_SIZE)
+	n, err := r.ReadAt(buff, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	header, _, err := ReadArchiveHeader(buff[:n])
+	return header.Comment, err
+}
+
+// Returns a new hash computing digest of given kind or nil for DIGEST_NONE.
+func NewDigest(kind byte) hash.Hash {
+	switch kind {
+	case DIGEST_MD5:
+		return md5.New()
+	case DIGEST_SHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+// Size in bytes of a digest of given kind.
+func DigestSize(kind byte) int {
+	switch kind {
+	case DIGEST_MD5:
+		return md5.Size
+	case DIGEST_SHA256:
+		return sha256.Size
+	}
+	return 0
+}
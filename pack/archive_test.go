@@ -0,0 +1,74 @@
+package pack
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestArchiveHeaderRoundTripsWithEveryField(t *testing.T) {
+	for _, header := range []ArchiveHeader{
+		{CompressionLevel: 3},
+		{Digest: DIGEST_MD5},
+		{Digest: DIGEST_SHA256},
+		{TimestampPattern: test_timestamp_pattern},
+		{Primed: true, PrimingHash: 0xdeadbeef},
+		{Comment: []byte("host=web01 app=shop")},
+		{NumericDelta: true},
+		{RecordSeparator: 0x1e},
+		{SecondStage: "gzip"},
+		{Footer: true, FooterOffset: 1 << 40},
+		{Footer: true},
+		{BackreferenceCapacity: MAX_BACKREFERENCE_CAPACITY - 1},
+		{SortedLines: true, AsciiChunks: true, Bundle: true, Extension: []byte{1, 2, 3}},
+	} {
+		buff := make([]byte, MAX_ARCHIVE_HEADER_SIZE)
+		headerSize := StoreArchiveHeader(buff, header)
+
+		expected := header
+		expected.CompressionLevel = normalizeCompressionLevel(header.CompressionLevel)
+		expected.Version = FORMAT_VERSION
+		if header.hasWindowFields() {
+			expected.Version = WINDOW_FORMAT_VERSION
+			if header.BackreferenceCapacity == 0 {
+				expected.BackreferenceCapacity = MAX_BACKREFERENCE_CAPACITY
+			}
+		}
+		stored, storedSize, err := ReadArchiveHeader(buff[:headerSize])
+		if err != nil || storedSize != headerSize || fmt.Sprint(stored) != fmt.Sprint(expected) {
+			t.Errorf("Expected %v; got %v of size %d, err: %v", expected, stored, storedSize, err)
+		}
+		// chunks that follow the header are not read
+		if _, storedSize, err := ReadArchiveHeader(append(buff[:headerSize], 0, 0, 0, 0)); err != nil ||
+			storedSize != headerSize {
+			t.Errorf("%v followed by a chunk: got size %d, err: %v", header, storedSize, err)
+		}
+		for truncatedSize := len(ARCHIVE_MAGIC); truncatedSize < headerSize; truncatedSize++ {
+			if _, _, err := ReadArchiveHeader(buff[:truncatedSize]); err != ErrTruncatedHeader {
+				t.Errorf("%v truncated to %d bytes: expected ErrTruncatedHeader; got %v", header, truncatedSize, err)
+			}
+		}
+	}
+}
+
+func TestArchiveHeaderOfUnknownVersionIsRejected(t *testing.T) {
+	buff := make([]byte, MAX_ARCHIVE_HEADER_SIZE)
+	headerSize := StoreArchiveHeader(buff, ArchiveHeader{SortedLines: true})
+	features := bytes.Clone(buff[:headerSize])
+	// every flag bit is taken; later versions mark what older ones can't read as required features
+	features[len(ARCHIVE_MAGIC)+4] |= 0x80
+	if _, _, err := ReadArchiveHeader(features); err != ErrUnsupportedVersion {
+		t.Errorf("Unknown required feature: expected ErrUnsupportedVersion; got %v", err)
+	}
+	version := bytes.Clone(buff[:headerSize])
+	version[len(ARCHIVE_MAGIC)] = 0
+	if _, _, err := ReadArchiveHeader(version); err != ErrUnsupportedVersion {
+		t.Errorf("Version 0: expected ErrUnsupportedVersion; got %v", err)
+	}
+
+	headerSize = StoreArchiveHeader(buff, ArchiveHeader{Digest: DIGEST_SHA256})
+	buff[headerSize-1] = DIGEST_SHA256 + 1
+	if _, _, err := ReadArchiveHeader(buff[:headerSize]); err != ErrUnknownDigest {
+		t.Errorf("Expected ErrUnknownDigest; got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package pack
+
+import "encoding/binary"
+
+/*
+Second byte of an ASCII chunk (see Options.MarkAsciiChunks), following ESCAPE_BYTE: the chunk is packed from bytes
+that are all ASCII, so no literal in it is escaped. Like SORTED_CHUNK_MARKER it never starts a regular chunk.
+
+ASCII chunk: ESCAPE_BYTE | ASCII_CHUNK_MARKER | body
+Body is a regular chunk (without header); it is never a sorted or stored one.
+*/
+const ASCII_CHUNK_MARKER byte = 'A'
+
+// Whether src has no byte with the high bit set. Checks 8 bytes at once.
+func isAscii(src []byte) bool {
+	for len(src) >= SIZEOF_INT64 {
+		if binary.LittleEndian.Uint64(src)&HIGH_BITS_MASK != 0 {
+			return false
+		}
+		src = src[SIZEOF_INT64:]
+	}
+	for _, b := range src {
+		if b >= ESCAPE_BYTE {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Puts ESCAPE_BYTE and ASCII_CHUNK_MARKER before the body of the chunk of chunkSize bytes (header included) at the
+beginning of dst, packed from src, if src is all ASCII. Stored and sorted chunks are left as they are, and so is
+the chunk if the marker does not fit in dst or in the chunk size. Returns size of the chunk that is in dst then.
+*/
+func markAsciiChunk(dst []byte, chunkSize int, src []byte) int {
+	body := dst[HEADER_SIZE:chunkSize]
+	if body[0] == STORED_CHUNK_MARKER || len(body) > 1 && body[0] == ESCAPE_BYTE && body[1] == SORTED_CHUNK_MARKER {
+		return chunkSize
+	}
+	if chunkSize+2 > len(dst) || len(body)+2 > MAX_CHUNK_SIZE || !isAscii(src) {
+		return chunkSize
+	}
+	copy(dst[HEADER_SIZE+2:], body)
+	dst[HEADER_SIZE], dst[HEADER_SIZE+1] = ESCAPE_BYTE, ASCII_CHUNK_MARKER
+	storeHeader(dst, len(body)+2, len(src))
+	return chunkSize + 2
+}
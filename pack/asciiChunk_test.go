@@ -0,0 +1,85 @@
+package pack
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAsciiChunksRoundTrip(t *testing.T) {
+	ascii := []byte(strings.Repeat("GET /index.html 200 served in 12 ms\n", 2000))
+	utf8 := []byte(strings.Repeat("GET /zażółć.html 200 served in 12 ms\n", 2000))
+	input := append(append(append([]byte{}, ascii...), utf8...), ascii...)
+
+	for _, opts := range []Options{{MarkAsciiChunks: true}, {MarkAsciiChunks: true, NumericDelta: true},
+		{MarkAsciiChunks: true, SortLines: true}} {
+		packed := make([]byte, 2*len(input)+DecompressBound())
+		packed = packed[:packBufferWithOptions(input, packed, opts)]
+		if unpacked := unpackAll(t, packed); !bytes.Equal(unpacked, input) {
+			t.Fatalf("%+v: unpacked %d bytes differ from %d packed", opts, len(unpacked), len(input))
+		}
+		metadata, err := ChunkMetadata(packed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := 0
+		for i, meta := range metadata {
+			if isAscii(input[offset:offset+meta.RawSize]) != meta.Ascii {
+				t.Errorf("%+v: chunk %d marked ASCII: %v", opts, i, meta.Ascii)
+			}
+			offset += meta.RawSize
+		}
+		plain := make([]byte, 2*len(input)+DecompressBound())
+		plain = plain[:packBufferWithOptions(input, plain, Options{NumericDelta: opts.NumericDelta, SortLines: opts.SortLines})]
+		if len(packed) > len(plain)+2*len(metadata) {
+			t.Errorf("%+v: marked chunks take %d bytes; expected at most 2 per chunk more than %d", opts, len(packed), len(plain))
+		}
+	}
+
+	writerOpts := WriterOptions{Options: Options{MarkAsciiChunks: true}}
+	archive := packWithOpts(t, input, writerOpts)
+	if unpacked := unpackAll(t, archive); !bytes.Equal(unpacked, input) {
+		t.Errorf("Writer: unpacked %d bytes differ from %d packed", len(unpacked), len(input))
+	}
+	// versions not knowing the marker would take it for a numeric delta token; the required feature makes them refuse
+	if header, _, err := ReadArchiveHeader(archive); err != nil || !header.AsciiChunks || header.SortedLines {
+		t.Errorf("Writer: expected ASCII chunks as the only required feature; got %+v, err: %v", header, err)
+	}
+}
+
+func TestIsAscii(t *testing.T) {
+	for _, input := range []string{"", "a", "GET /index.html 200\n", strings.Repeat("x", 17)} {
+		if !isAscii([]byte(input)) {
+			t.Errorf("%q not recognized as ASCII", input)
+		}
+	}
+	for _, input := range []string{"\x80", "żółw", strings.Repeat("x", 16) + "é", "1234567\xff89"} {
+		if isAscii([]byte(input)) {
+			t.Errorf("%q recognized as ASCII", input)
+		}
+	}
+}
+
+// Decoding speed of the corpus sample packed with and without Options.MarkAsciiChunks.
+func BenchmarkUnpackAsciiChunks(b *testing.B) {
+	input := readCorpusSample(test_level_sample_size_bytes)
+	for _, markAscii := range []bool{false, true} {
+		packedBuff := make([]byte, 2*len(input)+DecompressBound())
+		unpackedBuff := make([]byte, len(input))
+		packedSize := packBufferWithOptions(input, packedBuff, Options{MarkAsciiChunks: markAscii})
+		var scratch Scratch
+
+		name := "plain"
+		if markAscii {
+			name = "ascii_marked"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				if _, written := DecompressWith(unpackedBuff, packedBuff[:packedSize], &scratch); written != len(input) {
+					b.Fatalf("Unpacked %d bytes; expected %d", written, len(input))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package pack
+
+import (
+	"fmt"
+	"testing"
+)
+
+// never good enough to stop the scan early
+const scan_all_lines_percent = 200
+
+func numberedLine(n int) []byte {
+	return []byte(fmt.Sprintf("line number %03d with some common words\n", n))
+}
+
+// Lines chooseReferenceLine() can return: every line in the buffer, found at linesBefore it was added.
+func scannedLines(backref *backrefBuffer, lines int) map[string]int {
+	found := make(map[string]int)
+	for n := 0; n < lines; n++ {
+		line := numberedLine(n)
+		if lineRef := backref.chooseReferenceLine(line, scan_all_lines_percent, MAX_SIMILARITY); string(lineRef.line) == string(line) {
+			found[string(line)] = int(lineRef.linesBefore)
+		}
+	}
+	return found
+}
+
+func TestBackrefBufferAroundCapacity(t *testing.T) {
+	for _, capacity := range []int{2, 8, MAX_BACKREFERENCE_CAPACITY} {
+		for _, added := range []int{1, capacity - 2, capacity - 1, capacity, capacity + 1, 2 * capacity, 2*capacity + 1} {
+			if added < 1 {
+				continue
+			}
+			t.Run(fmt.Sprintf("capacity %d, %d lines", capacity, added), func(t *testing.T) {
+				var backref backrefBuffer
+				// lines of a previous use stay in slots after reset
+				backref.reset(capacity)
+				for n := 0; n < capacity; n++ {
+					backref.add(numberedLine(1000 + n))
+				}
+				backref.reset(capacity)
+				for n := 0; n < added; n++ {
+					backref.add(numberedLine(n))
+				}
+
+				// at most capacity-1 most recent lines are kept
+				expectedSize := min(added, capacity-1)
+				if backref.size() != expectedSize {
+					t.Errorf("Expected size %d; got %d", expectedSize, backref.size())
+				}
+				found := scannedLines(&backref, added)
+				if len(found) != expectedSize {
+					t.Errorf("Expected %d lines to be scanned; found %d: %v", expectedSize, len(found), found)
+				}
+				for linesBefore := 1; linesBefore <= expectedSize; linesBefore++ {
+					line := numberedLine(added - linesBefore)
+					if found[string(line)] != linesBefore {
+						t.Errorf("Line %q: expected at %d lines before; found at %d", line, linesBefore, found[string(line)])
+					}
+					if string(backref.getLineAt(linesBefore)) != string(line) {
+						t.Errorf("getLineAt(%d) = %q; expected %q", linesBefore, backref.getLineAt(linesBefore), line)
+					}
+				}
+				if backref.getLineAt(expectedSize+1) != nil {
+					t.Errorf("getLineAt(%d) beyond size returned %q", expectedSize+1, backref.getLineAt(expectedSize+1))
+				}
+				// stale lines of the previous use are never scanned
+				for n := 0; n < capacity; n++ {
+					if lineRef := backref.chooseReferenceLine(numberedLine(1000+n), scan_all_lines_percent, MAX_SIMILARITY); string(lineRef.line) == string(numberedLine(1000+n)) {
+						t.Errorf("Stale line %q found at %d lines before", lineRef.line, lineRef.linesBefore)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestChooseReferenceLineInEmptyBackrefBuffer(t *testing.T) {
+	var backref backrefBuffer
+	backref.reset(8)
+	backref.add(numberedLine(1))
+	backref.reset(8)
+	if lineRef := backref.chooseReferenceLine(numberedLine(1), scan_all_lines_percent, MAX_SIMILARITY); lineRef.line != nil {
+		t.Errorf("Empty buffer returned line %q", lineRef.line)
+	}
+}
@@ -0,0 +1,69 @@
+package pack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrInvalidBlockSize = errors.New("logpack: invalid block size")
+
+/*
+Unpacks src (sequence of chunks, as Decompress() takes) and passes what it unpacks to to fn in blocks of exactly
+blockSize bytes, whatever sizes the chunks have; only the last block may be shorter. Chunks are unpacked one at a time,
+so memory taken is about blockSize plus the biggest chunk however big the archive is. Block is valid until fn returns
+only - its memory is reused.
+
+Returns ErrInvalidBlockSize if blockSize < 1, the first error fn returns (which stops unpacking) or an error of
+unpacking as in DecompressOpts(): ErrCorruptInput, io.ErrUnexpectedEOF for an incomplete last chunk or
+ErrTrailingBytes. fn gets every complete block unpacked before the error, but not the short one at the end.
+*/
+func DecompressBlocks(src []byte, blockSize int, fn func(block []byte) error) error {
+	if blockSize < 1 {
+		return fmt.Errorf("%w: %d", ErrInvalidBlockSize, blockSize)
+	}
+	var scratch Scratch
+	unpacked := make([]byte, DecompressBound())
+	// unpacked bytes that don't make a whole block yet
+	var block []byte
+
+	for len(src) >= HEADER_SIZE {
+		// one chunk at a time, so that blocks of valid chunks come before an error
+		chunkSize, _ := readHeader(src)
+		read, written := DecompressWith(unpacked, src[:min(len(src), HEADER_SIZE+chunkSize)], &scratch)
+		switch read {
+		case CORRUPT_INPUT:
+			return ErrCorruptInput
+		case NOT_ENOUGH_INPUT:
+			return io.ErrUnexpectedEOF
+		}
+		src = src[read:]
+
+		chunk := unpacked[:written]
+		if len(block) > 0 {
+			n := min(blockSize-len(block), len(chunk))
+			block, chunk = append(block, chunk[:n]...), chunk[n:]
+			if len(block) < blockSize {
+				continue
+			}
+			if err := fn(block); err != nil {
+				return err
+			}
+			block = block[:0]
+		}
+		// whole blocks straight from the chunk
+		for ; len(chunk) >= blockSize; chunk = chunk[blockSize:] {
+			if err := fn(chunk[:blockSize]); err != nil {
+				return err
+			}
+		}
+		block = append(block, chunk...)
+	}
+	if len(src) > 0 {
+		return fmt.Errorf("%w: %d bytes", ErrTrailingBytes, len(src))
+	}
+	if len(block) > 0 {
+		return fn(block)
+	}
+	return nil
+}
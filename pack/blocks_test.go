@@ -0,0 +1,78 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func collectBlocks(src []byte, blockSize int) (blocks [][]byte, err error) {
+	err = DecompressBlocks(src, blockSize, func(block []byte) error {
+		blocks = append(blocks, bytes.Clone(block))
+		return nil
+	})
+	return blocks, err
+}
+
+func TestDecompressBlocksCutsExactBlocks(t *testing.T) {
+	input := randomTextWithLongLines(3)
+	packed := make([]byte, 2*len(input)+DecompressBound())
+	packed = packed[:PackBuffer(input, packed, COMPRESSION_LEVEL_DEFAULT)]
+
+	for _, blockSize := range []int{1, 4096, 4097, MAX_CHUNK_SIZE, 3 * MAX_CHUNK_SIZE, len(input), len(input) + 1} {
+		t.Run(fmt.Sprint(blockSize), func(t *testing.T) {
+			blocks, err := collectBlocks(packed, blockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, block := range blocks[:len(blocks)-1] {
+				if len(block) != blockSize {
+					t.Fatalf("Block %d of %d: %d bytes", i, len(blocks), len(block))
+				}
+			}
+			if last := blocks[len(blocks)-1]; len(last) == 0 || len(last) > blockSize {
+				t.Errorf("Last block: %d bytes", len(last))
+			}
+			if unpacked := bytes.Join(blocks, nil); !bytes.Equal(unpacked, input) {
+				t.Errorf("Blocks make %d bytes; expected %d", len(unpacked), len(input))
+			}
+		})
+	}
+	if blocks, err := collectBlocks(nil, 4096); err != nil || len(blocks) != 0 {
+		t.Errorf("Empty src: %d blocks, err: %v", len(blocks), err)
+	}
+}
+
+func TestDecompressBlocksStopsOnError(t *testing.T) {
+	input := incrementingIdsLog(10000)
+	packed := make([]byte, 2*len(input)+DecompressBound())
+	packed = packed[:PackBuffer(input, packed, COMPRESSION_LEVEL_DEFAULT)]
+	chunks, _ := ScanChunks(packed)
+	firstChunkSize := chunks[0].RawSize
+
+	// blocks of the complete chunks come before the error; the short one does not
+	blocks, err := collectBlocks(packed[:chunks[1].Offset+HEADER_SIZE+1], 1000)
+	if err != io.ErrUnexpectedEOF || len(blocks) != firstChunkSize/1000 {
+		t.Errorf("Expected %d blocks and io.ErrUnexpectedEOF; got %d blocks, err: %v", firstChunkSize/1000, len(blocks), err)
+	}
+	if _, err := collectBlocks(append(bytes.Clone(packed), 0), 1000); !errors.Is(err, ErrTrailingBytes) {
+		t.Errorf("Expected ErrTrailingBytes; got %v", err)
+	}
+
+	stop := errors.New("enough")
+	calls := 0
+	err = DecompressBlocks(packed, 1000, func([]byte) error {
+		if calls++; calls == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || calls != 3 {
+		t.Errorf("Expected to stop after 3 blocks with fn error; got %d calls, err: %v", calls, err)
+	}
+	if err := DecompressBlocks(packed, 0, nil); !errors.Is(err, ErrInvalidBlockSize) {
+		t.Errorf("Expected ErrInvalidBlockSize; got %v", err)
+	}
+}
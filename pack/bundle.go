@@ -0,0 +1,329 @@
+package pack
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+/*
+Bundle packs several files into one Logpack archive whose content is a tape of lines:
+
+	BUNDLE_MAGIC
+	BUNDLE_FILE_MARKER "quoted name" size  - before lines of every file
+	line                                    - line of the file as it is
+	BUNDLE_REF_MARKER id [count]            - count (1 if omitted) lines of the file repeated from the tape
+	BUNDLE_ESCAPE_MARKER line               - line of the file starting with one of the markers
+
+Every literal line of BUNDLE_MIN_DEDUP_LINE..BUNDLE_MAX_DEDUP_LINE bytes gets the next id (0, 1, ...) until they
+take BUNDLE_MAX_DICTIONARY_SIZE bytes in total. A line seen before is
+replaced by a reference to its id unless it was written within the last MAX_BACKREFERENCE_CAPACITY lines -
+chunks refer those more cheaply anyway. Consecutive ids make one reference. So lines repeated anywhere across
+the files cost just a few bytes, not only within the backreference window of their chunk.
+Last line of a file without '\n' gets one on the tape; size of the file tells to drop it.
+The archive header marks bundles (see ArchiveHeader.Bundle): a file of its own may well start with BUNDLE_MAGIC.
+*/
+const (
+	BUNDLE_MAGIC          = "LPBUNDLE 1\n"
+	BUNDLE_FILE_MARKER    = 0x1D
+	BUNDLE_REF_MARKER     = 0x1E
+	BUNDLE_ESCAPE_MARKER  = 0x1F
+	BUNDLE_MIN_DEDUP_LINE = 16
+	// longer lines are hardly ever repeated; packing holds a line of at most this size
+	BUNDLE_MAX_DEDUP_LINE = MAX_CHUNK_SIZE
+	// Bounds memory packing and unpacking need for the lines that got ids: those lines take at most this much
+	// (plus a few dozen bytes of bookkeeping per line). Lines after that are not deduplicated.
+	BUNDLE_MAX_DICTIONARY_SIZE = 64 << 20
+)
+
+// A file of a bundle: name is stored as it is and is not interpreted in any way.
+type BundleFile struct {
+	Name    string
+	Content []byte
+}
+
+var ErrBundleFileSize = errors.New("logpack: bundle file size differs from the declared one")
+
+// BundleWriter packs files given one by one into a bundle archive (see BUNDLE_MAGIC), deduplicating lines across all
+// of them. Files are streamed: it holds the dictionary of lines (see BUNDLE_MAX_DICTIONARY_SIZE) and a line at most.
+type BundleWriter struct {
+	w    *Writer
+	tape *bufio.Writer
+	// reads lines of the file being added
+	lines *bufio.Reader
+	// id of every line in the dictionary and the line of input it was last written literally at
+	occurrences map[string]bundleOccurrence
+	dictionary  bundleDictionary
+	inputLine   int
+	// references to consecutive ids are written as one
+	run bundleRun
+	err error
+}
+
+type bundleOccurrence struct{ id, literalLine int }
+
+// Returns a BundleWriter packing into dst with opts (see NewWriterOpts()). It is the caller's responsibility to
+// call Close() when done.
+func NewBundleWriter(dst io.Writer, opts WriterOptions) (*BundleWriter, error) {
+	w, err := NewWriterOpts(dst, opts)
+	if err != nil {
+		return nil, err
+	}
+	w.header.Bundle = true
+	b := &BundleWriter{
+		w:           w,
+		tape:        bufio.NewWriterSize(w, MAX_CHUNK_SIZE),
+		lines:       bufio.NewReaderSize(nil, BUNDLE_MAX_DEDUP_LINE),
+		occurrences: make(map[string]bundleOccurrence),
+		dictionary:  bundleDictionary{limit: BUNDLE_MAX_DICTIONARY_SIZE},
+	}
+	b.tape.WriteString(BUNDLE_MAGIC)
+	return b, nil
+}
+
+// Packs content of a file of given name and size. Returns an error wrapping ErrBundleFileSize if content has
+// other size (eg. the file grew since its size was taken); the bundle can't be completed then.
+func (b *BundleWriter) AddFile(name string, size int64, content io.Reader) error {
+	if b.err != nil {
+		return b.err
+	}
+	b.run.flush(b.tape)
+	fmt.Fprintf(b.tape, "%c%s %d\n", BUNDLE_FILE_MARKER, strconv.Quote(name), size)
+	// a byte more than size tells that content is bigger
+	counter := &countingReader{r: io.LimitReader(content, size+1)}
+	b.lines.Reset(counter)
+	for {
+		line, err := b.lines.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// too long to get an id anyway; the rest of it comes with the next slice
+			b.run.flush(b.tape)
+			writeBundleLine(b.tape, line)
+			for err == bufio.ErrBufferFull {
+				line, err = b.lines.ReadSlice('\n')
+				b.tape.Write(line)
+			}
+			if len(line) == 0 || line[len(line)-1] != '\n' {
+				b.tape.WriteByte('\n')
+			}
+			b.inputLine++
+		} else if len(line) > 0 {
+			b.addLine(line)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			b.err = err
+			return err
+		}
+	}
+	if counter.n != size {
+		b.err = fmt.Errorf("%w: %q has %d bytes instead of %d", ErrBundleFileSize, name, counter.n, size)
+	} else if b.w.err != nil {
+		// failed writing chunks packed so far
+		b.err = b.w.err
+	}
+	return b.err
+}
+
+// Adds a line of at most BUNDLE_MAX_DEDUP_LINE bytes; the last one of a file may have no '\n'.
+func (b *BundleWriter) addLine(line []byte) {
+	b.inputLine++
+	if line[len(line)-1] != '\n' {
+		line = append(line[:len(line):len(line)], '\n')
+	}
+	seen, ok := b.occurrences[string(line)]
+	if ok && b.inputLine-seen.literalLine > MAX_BACKREFERENCE_CAPACITY {
+		b.run.add(b.tape, seen.id)
+		return
+	}
+	b.run.flush(b.tape)
+	writeBundleLine(b.tape, line)
+	if id, ok := b.dictionary.add(line); ok {
+		b.occurrences[string(line)] = bundleOccurrence{id, b.inputLine}
+	}
+}
+
+// Packs what is pending and finishes the archive. It does not close the underlying io.Writer.
+func (b *BundleWriter) Close() error {
+	if b.err != nil {
+		return b.err
+	}
+	b.run.flush(b.tape)
+	if err := b.tape.Flush(); err != nil {
+		return err
+	}
+	return b.w.Close()
+}
+
+// Packs files into a bundle archive written to dst, deduplicating lines across all of them (see BundleWriter).
+func PackBundle(dst io.Writer, files []BundleFile, opts WriterOptions) error {
+	b, err := NewBundleWriter(dst, opts)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := b.AddFile(file.Name, int64(len(file.Content)), bytes.NewReader(file.Content)); err != nil {
+			return err
+		}
+	}
+	return b.Close()
+}
+
+// Gives ids to literal lines of a bundle the same way for BundleWriter and UnpackBundle(): in order, to lines of
+// BUNDLE_MIN_DEDUP_LINE..BUNDLE_MAX_DEDUP_LINE bytes, until they take limit bytes in total.
+type bundleDictionary struct {
+	limit, size, count int
+}
+
+// Returns id of line if it gets one.
+func (dictionary *bundleDictionary) add(line []byte) (id int, ok bool) {
+	if len(line) < BUNDLE_MIN_DEDUP_LINE || len(line) > BUNDLE_MAX_DEDUP_LINE || dictionary.size >= dictionary.limit {
+		return 0, false
+	}
+	dictionary.size += len(line)
+	dictionary.count++
+	return dictionary.count - 1, true
+}
+
+// References to count consecutive ids starting at start, not written yet.
+type bundleRun struct {
+	start, count int
+}
+
+func (run *bundleRun) add(tape *bufio.Writer, id int) {
+	if run.count > 0 && id == run.start+run.count {
+		run.count++
+		return
+	}
+	run.flush(tape)
+	run.start, run.count = id, 1
+}
+
+func (run *bundleRun) flush(tape *bufio.Writer) {
+	if run.count == 1 {
+		fmt.Fprintf(tape, "%c%d\n", BUNDLE_REF_MARKER, run.start)
+	} else if run.count > 1 {
+		fmt.Fprintf(tape, "%c%d %d\n", BUNDLE_REF_MARKER, run.start, run.count)
+	}
+	run.count = 0
+}
+
+func writeBundleLine(tape *bufio.Writer, line []byte) {
+	if line[0] == BUNDLE_FILE_MARKER || line[0] == BUNDLE_REF_MARKER || line[0] == BUNDLE_ESCAPE_MARKER {
+		tape.WriteByte(BUNDLE_ESCAPE_MARKER)
+	}
+	tape.Write(line)
+}
+
+// Unpacks files of a bundle archive written by PackBundle(). Returns an error wrapping ErrCorruptInput if src is
+// not a bundle or its lines do not add up.
+func UnpackBundle(src io.Reader) ([]BundleFile, error) {
+	r, err := NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+	if !r.Header().Bundle {
+		return nil, bundleError(nil, "not a bundle")
+	}
+	tape := bufio.NewReaderSize(r, MAX_CHUNK_SIZE)
+	if magic, err := tape.ReadString('\n'); magic != BUNDLE_MAGIC {
+		return nil, bundleError(err, "not a bundle")
+	}
+
+	var files []BundleFile
+	var sizes []int
+	// literal lines that got ids, in order
+	var lines [][]byte
+	dictionary := bundleDictionary{limit: BUNDLE_MAX_DICTIONARY_SIZE}
+	for {
+		line, err := tape.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		} else if err != nil {
+			return nil, bundleError(err, "ends within a line")
+		}
+
+		switch line[0] {
+		case BUNDLE_FILE_MARKER:
+			name, size, err := parseBundleFileLine(line[1 : len(line)-1])
+			if err != nil {
+				return nil, bundleError(nil, fmt.Sprintf("invalid file line %q", line))
+			}
+			files = append(files, BundleFile{Name: name})
+			sizes = append(sizes, size)
+			continue
+		case BUNDLE_REF_MARKER:
+			start, count, err := parseBundleReference(line[1 : len(line)-1])
+			if err != nil || start+count > len(lines) || len(files) == 0 {
+				return nil, bundleError(nil, fmt.Sprintf("invalid reference %q", line))
+			}
+			file := &files[len(files)-1]
+			for _, line := range lines[start : start+count] {
+				file.Content = append(file.Content, line...)
+			}
+			continue
+		case BUNDLE_ESCAPE_MARKER:
+			line = line[1:]
+		}
+		if len(files) == 0 || len(line) == 0 {
+			return nil, bundleError(nil, "line outside of a file")
+		}
+		if _, ok := dictionary.add(line); ok {
+			lines = append(lines, line)
+		}
+		file := &files[len(files)-1]
+		file.Content = append(file.Content, line...)
+	}
+
+	for i := range files {
+		content := files[i].Content
+		// '\n' added to the last line
+		if len(content) == sizes[i]+1 && content[sizes[i]] == '\n' {
+			files[i].Content = content[:sizes[i]]
+		} else if len(content) != sizes[i] {
+			return nil, bundleError(nil, fmt.Sprintf("file %q has %d bytes instead of %d", files[i].Name, len(content), sizes[i]))
+		}
+	}
+	return files, nil
+}
+
+// Parses "quoted name" size (BUNDLE_FILE_MARKER and '\n' cut off)
+func parseBundleFileLine(fileLine []byte) (name string, size int, err error) {
+	sizeStart := bytes.LastIndexByte(fileLine, ' ')
+	if sizeStart < 0 {
+		return "", 0, strconv.ErrSyntax
+	}
+	if name, err = strconv.Unquote(string(fileLine[:sizeStart])); err != nil {
+		return "", 0, err
+	}
+	if size, err = strconv.Atoi(string(fileLine[sizeStart+1:])); err != nil || size < 0 {
+		return "", 0, strconv.ErrSyntax
+	}
+	return name, size, nil
+}
+
+// Parses "id" or "id count" (BUNDLE_REF_MARKER and '\n' cut off)
+func parseBundleReference(reference []byte) (start, count int, err error) {
+	startText, countText, isRun := bytes.Cut(reference, []byte{' '})
+	count = 1
+	if start, err = strconv.Atoi(string(startText)); err != nil || start < 0 {
+		return 0, 0, strconv.ErrSyntax
+	}
+	if isRun {
+		if count, err = strconv.Atoi(string(countText)); err != nil || count < 2 {
+			return 0, 0, strconv.ErrSyntax
+		}
+	}
+	return start, count, nil
+}
+
+// Error of reading the tape if there was one, ErrCorruptInput for given reason otherwise.
+func bundleError(err error, reason string) error {
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return fmt.Errorf("%w: bundle %s", ErrCorruptInput, reason)
+}
@@ -0,0 +1,159 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Splits content into n files of (about) the same number of whole lines.
+func splitIntoFiles(content []byte, n int) (files []BundleFile) {
+	lines := bytes.SplitAfter(content, []byte{'\n'})
+	for i := 0; i < n; i++ {
+		part := bytes.Join(lines[i*len(lines)/n:(i+1)*len(lines)/n], nil)
+		files = append(files, BundleFile{Name: fmt.Sprintf("part%d.log", i), Content: part})
+	}
+	return files
+}
+
+func assertBundleRoundTrips(t *testing.T, files []BundleFile, opts WriterOptions) (packedSize int) {
+	var packed bytes.Buffer
+	if err := PackBundle(&packed, files, opts); err != nil {
+		t.Fatal(err)
+	}
+	packedSize = packed.Len()
+	unpacked, err := UnpackBundle(&packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unpacked) != len(files) {
+		t.Fatalf("Expected %d files; got %d", len(files), len(unpacked))
+	}
+	for i := range files {
+		if unpacked[i].Name != files[i].Name || !bytes.Equal(unpacked[i].Content, files[i].Content) {
+			t.Errorf("File %d (%q, %d bytes) unpacked as %q, %d bytes", i, files[i].Name, len(files[i].Content),
+				unpacked[i].Name, len(unpacked[i].Content))
+		}
+	}
+	return packedSize
+}
+
+func TestBundleRoundTripsEdgeCases(t *testing.T) {
+	files := []BundleFile{
+		{Name: "empty", Content: nil},
+		{Name: "no newline at the end", Content: []byte("first line of the file\nlast line without newline")},
+		{Name: "dir/with space\n and newline.log", Content: []byte("\n\n\nshort\n")},
+		{Name: "markers", Content: []byte("\x1d\"fake\" 3\n\x1e0\n\x1f\x1f\n\x1dlong line starting with a marker\n")},
+		{Name: "żółw", Content: []byte("first line of the file\nlast line without newline\n\x1dlong line starting with a marker\n")},
+		{Name: "", Content: []byte("\n")},
+	}
+	assertBundleRoundTrips(t, files, WriterOptions{})
+	assertBundleRoundTrips(t, nil, WriterOptions{})
+}
+
+// Lines too long to get an id are packed in pieces, however they end.
+func TestBundleRoundTripsLongLines(t *testing.T) {
+	long := strings.Repeat("0123456789abcdef", BUNDLE_MAX_DEDUP_LINE/16)
+	files := []BundleFile{
+		{Name: "max", Content: []byte(long[1:] + "\n" + long[1:] + "\n" + long[1:])},
+		{Name: "longer", Content: []byte("\x1d" + long + "\n" + long + "\nshort line\n" + long)},
+		{Name: "longer without newline", Content: []byte(long + long)},
+	}
+	assertBundleRoundTrips(t, files, WriterOptions{})
+}
+
+func TestBundleWriterRejectsFileOfOtherSize(t *testing.T) {
+	for _, size := range []int64{9, 11} {
+		b, _ := NewBundleWriter(io.Discard, WriterOptions{})
+		if err := b.AddFile("a", size, strings.NewReader("0123456789")); !errors.Is(err, ErrBundleFileSize) {
+			t.Errorf("Size %d of 10 bytes: expected ErrBundleFileSize; got %v", size, err)
+		}
+		if err := b.Close(); !errors.Is(err, ErrBundleFileSize) {
+			t.Errorf("Size %d of 10 bytes: expected ErrBundleFileSize on Close(); got %v", size, err)
+		}
+	}
+}
+
+func TestBundleDictionaryStopsAtLimit(t *testing.T) {
+	dictionary := bundleDictionary{limit: 40}
+	for i, tc := range []struct {
+		line string
+		id   int
+		ok   bool
+	}{
+		{"short\n", 0, false},
+		{"line long enough to get id\n", 0, true},
+		{"another line long enough\n", 1, true},
+		{"limit reached before this line\n", 0, false},
+	} {
+		if id, ok := dictionary.add([]byte(tc.line)); id != tc.id || ok != tc.ok {
+			t.Errorf("Line %d: expected id %d, %v; got %d, %v", i, tc.id, tc.ok, id, ok)
+		}
+	}
+}
+
+// Rotated logs overlap: every file repeats the tail of the previous one, which is out of reach of backreferences.
+func TestBundleDeduplicatesLinesAcrossFiles(t *testing.T) {
+	dir := path_defaultLoghubCorpus + "apache/"
+	apache, _ := os.ReadFile(dir + findFirstLogFile(dir))
+	parts := splitIntoFiles(apache, 8)
+	var files []BundleFile
+	var concatenated []byte
+	for i, part := range parts {
+		content := part.Content
+		if i > 0 {
+			previous := parts[i-1].Content
+			content = append(previous[len(previous)/2:len(previous):len(previous)], content...)
+		}
+		files = append(files, BundleFile{Name: part.Name, Content: content})
+		concatenated = append(concatenated, content...)
+	}
+
+	for _, level := range []int{COMPRESSION_LEVEL_WORST, COMPRESSION_LEVEL_BEST} {
+		opts := WriterOptions{Options: Options{CompressionLevel: level}}
+		bundleSize := assertBundleRoundTrips(t, files, opts)
+		plainSize := len(packWithOpts(t, concatenated, opts))
+		if bundleSize >= plainSize {
+			t.Errorf("Level %d: bundle of %d bytes is not smaller than %d bytes of packed concatenation",
+				level, bundleSize, plainSize)
+		}
+		t.Logf("Level %d: bundle %.2fx, concatenation %.2fx", level,
+			float64(len(concatenated))/float64(bundleSize), float64(len(concatenated))/float64(plainSize))
+	}
+}
+
+// Packs tape as the content of a bundle archive, as if PackBundle() wrote it.
+func packBundleTape(t *testing.T, tape []byte) []byte {
+	var packed bytes.Buffer
+	w, _ := NewWriterOpts(&packed, WriterOptions{})
+	w.header.Bundle = true
+	w.Write(tape)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return packed.Bytes()
+}
+
+func TestUnpackBundleRejectsOtherArchives(t *testing.T) {
+	// only the header tells bundles apart: a file of its own may start with BUNDLE_MAGIC
+	for _, content := range []string{"not a bundle\n", BUNDLE_MAGIC + "\x1d\"a\" 1\na\n"} {
+		packed := packWithOpts(t, []byte(content), WriterOptions{})
+		if _, err := UnpackBundle(bytes.NewReader(packed)); !errors.Is(err, ErrCorruptInput) {
+			t.Errorf("%q: expected ErrCorruptInput; got %v", content, err)
+		}
+	}
+	for _, content := range []string{"not a bundle\n", BUNDLE_MAGIC + "line outside of file\n",
+		BUNDLE_MAGIC + "\x1d\"a\" 1\n\x1e0\n", BUNDLE_MAGIC + "\x1d\"a\" 100\nabc\n", BUNDLE_MAGIC + "\x1d\"a\" 3\nabc",
+		// run of 1 is written without count; run reaching beyond the dictionary
+		BUNDLE_MAGIC + "\x1d\"a\" 40\nline long enough to get id\n\x1e0 1\n",
+		BUNDLE_MAGIC + "\x1d\"a\" 40\nline long enough to get id\n\x1e0 2\n"} {
+		packed := packBundleTape(t, []byte(content))
+		if _, err := UnpackBundle(bytes.NewReader(packed)); !errors.Is(err, ErrCorruptInput) {
+			t.Errorf("%q: expected ErrCorruptInput; got %v", content, err)
+		}
+	}
+}
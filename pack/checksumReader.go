@@ -0,0 +1,52 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+)
+
+var (
+	ErrNoDigest       = errors.New("logpack: archive has no digest")
+	ErrDigestMismatch = errors.New("logpack: unpacked content does not match digest of the archive")
+)
+
+/*
+ChecksumReader reads unpacked content of a Reader, computing a running digest of it, and checks it against the digest
+stored in the archive trailer (see FLAG_DIGEST) once the content is over: the last Read() returns ErrDigestMismatch
+instead of io.EOF if they differ. Meant for archives from untrusted sources, where a chunk may be altered so that it
+still unpacks.
+
+Mind that content is returned before it is verified: nothing read is trustworthy until io.EOF.
+*/
+type ChecksumReader struct {
+	r      *Reader
+	digest hash.Hash
+	err    error
+}
+
+// Returns a ChecksumReader reading from r. Returns ErrNoDigest if the archive does not store a digest.
+// Must be called before the first r.Read().
+func NewChecksumReader(r *Reader) (*ChecksumReader, error) {
+	digest := NewDigest(r.Header().Digest)
+	if digest == nil {
+		return nil, ErrNoDigest
+	}
+	return &ChecksumReader{r: r, digest: digest}, nil
+}
+
+// Reads unpacked content into p. Returns errors of Reader.Read() and, after the last byte of content,
+// io.EOF or ErrDigestMismatch.
+func (cr *ChecksumReader) Read(p []byte) (n int, err error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	n, err = cr.r.Read(p)
+	cr.digest.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(cr.digest.Sum(nil), cr.r.digest) {
+		err = ErrDigestMismatch
+	}
+	cr.err = err
+	return n, err
+}
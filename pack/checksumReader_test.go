@@ -0,0 +1,73 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// Archive of Writer with sha256 digest of input added the way the logpack tool stores it.
+func packWithDigest(t *testing.T, input []byte, opts WriterOptions) []byte {
+	packed := packWithOpts(t, input, opts)
+	header, headerSize, err := ReadArchiveHeader(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.Digest = DIGEST_SHA256
+	archive := make([]byte, MAX_ARCHIVE_HEADER_SIZE)
+	archive = append(archive[:StoreArchiveHeader(archive, header)], packed[headerSize:]...)
+	digest := NewDigest(DIGEST_SHA256)
+	digest.Write(input)
+	return digest.Sum(archive)
+}
+
+func readChecked(archive []byte) ([]byte, error) {
+	r, err := NewReader(iotest.HalfReader(bytes.NewReader(archive)))
+	if err != nil {
+		return nil, err
+	}
+	cr, err := NewChecksumReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(cr)
+}
+
+func TestChecksumReaderVerifiesDigest(t *testing.T) {
+	input := incrementingIdsLog(5000)
+	for _, footer := range []bool{false, true} {
+		archive := packWithDigest(t, input, WriterOptions{Footer: footer})
+		if unpacked, err := readChecked(archive); err != nil || !bytes.Equal(unpacked, input) {
+			t.Errorf("Footer %v: did not unpack to input; err: %v", footer, err)
+		}
+
+		altered := bytes.Clone(archive)
+		altered[len(altered)-1] ^= 1
+		if _, err := readChecked(altered); err != ErrDigestMismatch {
+			t.Errorf("Footer %v, altered digest: expected ErrDigestMismatch; got %v", footer, err)
+		}
+		if _, err := readChecked(archive[:len(archive)-1]); err == nil {
+			t.Errorf("Footer %v: truncated archive should fail", footer)
+		}
+	}
+}
+
+func TestChecksumReaderDetectsChunkThatStillUnpacks(t *testing.T) {
+	input := []byte("first line\nsecond line\n")
+	archive := packWithDigest(t, input, WriterOptions{})
+	// the first line is stored literally
+	idx := bytes.Index(archive, []byte("first"))
+	archive[idx] = 'F'
+	if _, err := readChecked(archive); err != ErrDigestMismatch {
+		t.Errorf("Expected ErrDigestMismatch; got %v", err)
+	}
+}
+
+func TestChecksumReaderRequiresDigest(t *testing.T) {
+	r, _ := NewReader(bytes.NewReader(packWithOpts(t, []byte("line\n"), WriterOptions{})))
+	if _, err := NewChecksumReader(r); !errors.Is(err, ErrNoDigest) {
+		t.Errorf("Expected ErrNoDigest; got %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package pack
+
+import "bytes"
+
+// Range of src a chunk is packed from (see ChunkPlan()).
+type ChunkSpan struct {
+	Offset int
+	Size   int
+}
+
+/*
+Returns how Compress() (called until src is consumed, with dst of at least DecompressBound() bytes, as
+CompressToBuffer() and Writer do) splits src into chunks, without compressing anything. Parallel packers may compress
+the spans independently and get the same chunks; range decoders may tell which chunk holds a given offset.
+
+A chunk takes as many whole lines as fit in MAX_CHUNK_SIZE bytes, or all that is left of src if it fits. Line longer
+than MAX_CHUNK_SIZE is cut: its first MAX_CHUNK_SIZE bytes make a chunk of their own.
+
+The plan is exact for input that compresses, at any compression level. Compress() ends a chunk earlier if it turns
+out not to compress (eg. binary data or mostly non-ASCII lines, which escaping makes bigger): such chunk is stored
+raw and takes at most MAX_CHUNK_SIZE-1 bytes.
+*/
+func ChunkPlan(src []byte) (spans []ChunkSpan) {
+	for offset := 0; offset < len(src); {
+		size := len(src) - offset
+		if size > MAX_CHUNK_SIZE {
+			size = bytes.LastIndexByte(src[offset:offset+MAX_CHUNK_SIZE], '\n') + 1
+			if size == 0 {
+				size = MAX_CHUNK_SIZE
+			}
+		}
+		spans = append(spans, ChunkSpan{Offset: offset, Size: size})
+		offset += size
+	}
+	return spans
+}
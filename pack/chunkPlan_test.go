@@ -0,0 +1,69 @@
+package pack
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Spans of chunks Compress() actually packs src into.
+func packedSpans(src []byte, compressionLevel int) (spans []ChunkSpan) {
+	var packed bytes.Buffer
+	CompressToBuffer(&packed, src, compressionLevel)
+	chunks, _ := ScanChunks(packed.Bytes())
+	offset := 0
+	for _, chunk := range chunks {
+		spans = append(spans, ChunkSpan{Offset: offset, Size: chunk.RawSize})
+		offset += chunk.RawSize
+	}
+	return spans
+}
+
+func TestChunkPlanMatchesCompressOnCorpus(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	for _, file := range corpusFiles(path_loghubCorpus) {
+		// a sample is enough: chunks are planned the same way all along
+		inputSize := min2(readFileToBuffer(inputBuff, file.path), test_level_sample_size_bytes)
+		plan := ChunkPlan(inputBuff[:inputSize])
+		for _, level := range []int{COMPRESSION_LEVEL_WORST, COMPRESSION_LEVEL_BEST} {
+			if packed := packedSpans(inputBuff[:inputSize], level); fmt.Sprint(plan) != fmt.Sprint(packed) {
+				t.Errorf("%s, level %d: planned %d chunks; packed %d", file.name, level, len(plan), len(packed))
+			}
+		}
+	}
+}
+
+func TestChunkPlanAroundMaxChunkSize(t *testing.T) {
+	line := func(size int) string {
+		return strings.Repeat("x", size-1) + "\n"
+	}
+	for _, tc := range []struct {
+		name     string
+		src      string
+		expected []int
+	}{
+		{"empty", "", nil},
+		{"no newline at the end", "a\nb", []int{3}},
+		{"exactly max chunk size", line(MAX_CHUNK_SIZE), []int{MAX_CHUNK_SIZE}},
+		{"line ends one byte after", line(MAX_CHUNK_SIZE-10) + line(11), []int{MAX_CHUNK_SIZE - 10, 11}},
+		{"long line is cut", line(MAX_CHUNK_SIZE + 100), []int{MAX_CHUNK_SIZE, 100}},
+		{"long line after short", "a\n" + line(2*MAX_CHUNK_SIZE), []int{2, MAX_CHUNK_SIZE, MAX_CHUNK_SIZE}},
+	} {
+		var sizes []int
+		offset := 0
+		for _, span := range ChunkPlan([]byte(tc.src)) {
+			if span.Offset != offset {
+				t.Errorf("%s: span %+v does not start where the previous one ends (%d)", tc.name, span, offset)
+			}
+			sizes = append(sizes, span.Size)
+			offset += span.Size
+		}
+		if fmt.Sprint(sizes) != fmt.Sprint(tc.expected) {
+			t.Errorf("%s: expected chunks of %v bytes; got %v", tc.name, tc.expected, sizes)
+		}
+		if packed := packedSpans([]byte(tc.src), COMPRESSION_LEVEL_DEFAULT); fmt.Sprint(ChunkPlan([]byte(tc.src))) != fmt.Sprint(packed) {
+			t.Errorf("%s: planned %v; packed %v", tc.name, ChunkPlan([]byte(tc.src)), packed)
+		}
+	}
+}
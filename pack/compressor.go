@@ -0,0 +1,101 @@
+package pack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+var ErrPrimingMismatch = errors.New("logpack: archive was primed with other lines")
+
+// Compressor compresses src into chunks just like CompressOpts() with the same Options. Additionally it can be
+// primed with boilerplate lines (app banner, common message templates) that are expected to repeat in the input.
+// Compressor is not safe for concurrent use: it starts the clock of Options.MaxDuration on the first Compress() call
+// and Prime() modifies its lines.
+type Compressor struct {
+	opts   chunkOptions
+	budget timeBudget
+}
+
+// Returns a Compressor using opts or an error if opts are invalid (see Options.Validate()).
+func NewCompressor(opts Options) (*Compressor, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return newCompressor(opts), nil
+}
+
+// Same as NewCompressor() but with opts taken as valid.
+func newCompressor(opts Options) *Compressor {
+	return &Compressor{opts: opts.chunkOptions(), budget: timeBudget{limit: opts.MaxDuration}}
+}
+
+/*
+Puts lines in the backreference window of every chunk before its first line without emitting them to output,
+so that even the first lines of a chunk can refer them. Lines are copied; consecutive calls add more lines.
+Only as many of the most recently added lines as the window of the compression level holds are ever referred.
+
+Chunks of a primed Compressor can be unpacked only with the same lines given to Scratch.Prime() or Reader.Prime().
+Store PrimingHash() of the lines in the archive header (ArchiveHeader.Primed) so that readers can tell.
+*/
+func (c *Compressor) Prime(lines [][]byte) {
+	for _, line := range lines {
+		c.opts.primingLines = append(c.opts.primingLines, append([]byte(nil), line...))
+	}
+}
+
+// All lines the Compressor was primed with.
+func (c *Compressor) PrimingLines() [][]byte {
+	return c.opts.primingLines
+}
+
+/*
+Snapshot of the backreference window every chunk starts with, most recent line first: the lines the first line of
+a chunk can refer. Chunks don't refer lines of each other, so these are the most recent priming lines the window
+of the compression level holds (none if not primed) - the same for every chunk. Lines are copies.
+Meant for checking what priming actually gives the compressor.
+*/
+func (c *Compressor) Window() [][]byte {
+	// the same window compressPrimed() starts a chunk with
+	backref := backrefBuffer{capacity: int(c.opts.compressionParams.backreferenceCapacity)}
+	for _, line := range c.opts.primingLines {
+		backref.add(line)
+	}
+	window := make([][]byte, 0, backref.size())
+	for linesBefore := 1; linesBefore <= backref.size(); linesBefore++ {
+		window = append(window, bytes.Clone(backref.getLineAt(linesBefore)))
+	}
+	return window
+}
+
+// Compresses beginning of src into one chunk written to dst. See doc of Compress() for meaning of arguments
+// and results. Once Options.MaxDuration is exceeded chunks are stored rather than compressed.
+func (c *Compressor) Compress(dst, src []byte) (bytesRead, bytesWritten int) {
+	if c.budget.exceeded() {
+		return storeChunk(dst, src, c.opts.separator)
+	}
+	return compressSorted(dst, src, c.opts)
+}
+
+/*
+Makes the Compressor encode every line against the line selector chooses instead of the one the linear search
+of the compression level finds (see ReferenceSelector); nil restores the search. Meant for experimenting with
+reference selection heuristics, eg. hash-based lookup of candidate lines. Chunks unpack as any others.
+*/
+func (c *Compressor) SetReferenceSelector(selector ReferenceSelector) {
+	c.opts.selector = selector
+}
+
+// Identifies priming lines in the archive header. Lines as well as their order matter.
+func PrimingHash(lines [][]byte) uint32 {
+	hash := crc32.NewIEEE()
+	var lengthBytes [4]byte
+	for _, line := range lines {
+		// length prefix tells ["ab", "c"] and ["a", "bc"] apart
+		binary.LittleEndian.PutUint32(lengthBytes[:], uint32(len(line)))
+		hash.Write(lengthBytes[:])
+		hash.Write(line)
+	}
+	return hash.Sum32()
+}
@@ -0,0 +1,160 @@
+package pack
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+var test_priming_lines = [][]byte{
+	[]byte("MyApp v1.2.3 starting on host web01\n"),
+	[]byte("INFO [main] Loaded configuration from /etc/myapp/config.yaml\n"),
+}
+
+func compressAll(c *Compressor, dst, src []byte) (totalBytesWritten int) {
+	for len(src) > 0 {
+		read, written := c.Compress(dst[totalBytesWritten:], src)
+		src = src[read:]
+		totalBytesWritten += written
+	}
+	return totalBytesWritten
+}
+
+func TestPrimedCompressorRefersPrimingLines(t *testing.T) {
+	input := []byte("MyApp v1.2.4 starting on host web02\nINFO [main] Loaded configuration from /etc/myapp/local.yaml\n")
+	packed := make([]byte, DecompressBound())
+	unpacked := make([]byte, DecompressBound())
+
+	_, unprimedSize := Compress(packed, input, COMPRESSION_LEVEL_DEFAULT)
+	c, _ := NewCompressor(Options{})
+	c.Prime(test_priming_lines)
+	read, primedSize := c.Compress(packed, input)
+	if read != len(input) || primedSize >= unprimedSize/2 {
+		t.Errorf("Primed compression consumed %d bytes of %d into %d bytes; unprimed into %d",
+			read, len(input), primedSize, unprimedSize)
+	}
+
+	if read, _ := Decompress(unpacked, packed[:primedSize]); read != CORRUPT_INPUT {
+		t.Errorf("Primed chunk unpacked without priming; read %d", read)
+	}
+	var scratch Scratch
+	scratch.Prime(test_priming_lines)
+	read, written := DecompressWith(unpacked, packed[:primedSize], &scratch)
+	if read != primedSize || !bytes.Equal(unpacked[:written], input) {
+		t.Errorf("Expected %q; got %q (read %d)", input, unpacked[:written], read)
+	}
+}
+
+func TestPrimedCompressorOnCorpus(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	packedBuff := make([]byte, test_compression_bound_bytes)
+	unpackedBuff := make([]byte, test_max_input_size_bytes)
+	dir := path_defaultLoghubCorpus + "apache/"
+	inputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+
+	for _, level := range []int{COMPRESSION_LEVEL_WORST, COMPRESSION_LEVEL_BEST} {
+		c, _ := NewCompressor(Options{CompressionLevel: level})
+		// priming set bigger than the window of the level
+		for rest, i := inputBuff[:inputSize], 0; i < 100; i++ {
+			var line []byte
+			line, rest = nextLine(rest)
+			c.Prime([][]byte{line})
+		}
+		packedSize := compressAll(c, packedBuff, inputBuff[:inputSize])
+
+		var scratch Scratch
+		scratch.Prime(c.PrimingLines())
+		_, unpackedSize, err := decompressAllWith(unpackedBuff, packedBuff[:packedSize], &scratch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertInversibility(t, "apache", inputBuff, unpackedBuff, inputSize, unpackedSize)
+	}
+}
+
+func TestPrimedCompressorPacksLineLongerThanChunk(t *testing.T) {
+	input := []byte(strings.Repeat("MyApp", MAX_CHUNK_SIZE) + "\nMyApp v1.2.3 starting on host web01\n")
+	packed := make([]byte, 2*len(input)+100)
+	unpacked := make([]byte, len(input))
+
+	c, _ := NewCompressor(Options{})
+	c.Prime(test_priming_lines)
+	packedSize := compressAll(c, packed, input)
+
+	var scratch Scratch
+	scratch.Prime(test_priming_lines)
+	_, unpackedSize, err := decompressAllWith(unpacked, packed[:packedSize], &scratch)
+	if err != nil || !bytes.Equal(unpacked[:unpackedSize], input) {
+		t.Errorf("Long line did not survive primed round trip; err: %v", err)
+	}
+}
+
+func TestReaderRequiresSamePriming(t *testing.T) {
+	input := []byte("MyApp v1.2.3 starting on host web02\n")
+	archive := make([]byte, DecompressBound()+MAX_ARCHIVE_HEADER_SIZE)
+	headerSize := StoreArchiveHeader(archive, ArchiveHeader{Primed: true, PrimingHash: PrimingHash(test_priming_lines)})
+	c, _ := NewCompressor(Options{})
+	c.Prime(test_priming_lines)
+	_, chunkSize := c.Compress(archive[headerSize:], input)
+	archive = archive[:headerSize+chunkSize]
+
+	r, err := NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 10)); err != ErrPrimingMismatch {
+		t.Errorf("Expected ErrPrimingMismatch reading unprimed; got %v", err)
+	}
+	if err := r.Prime(test_priming_lines[:1]); err != ErrPrimingMismatch {
+		t.Errorf("Expected ErrPrimingMismatch priming with other lines; got %v", err)
+	}
+	if err := r.Prime(test_priming_lines); err != nil {
+		t.Fatal(err)
+	}
+	unpacked, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(unpacked, input) {
+		t.Errorf("Expected %q; got %q, err: %v", input, unpacked, err)
+	}
+}
+
+// Unpacks all chunks of src with scratch.
+func decompressAllWith(dst, src []byte, scratch *Scratch) (bytesRead, bytesWritten int, err error) {
+	for bytesRead < len(src) {
+		read, written := DecompressWith(dst[bytesWritten:], src[bytesRead:], scratch)
+		if read < 0 {
+			return bytesRead, bytesWritten, ErrCorruptInput
+		}
+		bytesRead += read
+		bytesWritten += written
+	}
+	return bytesRead, bytesWritten, nil
+}
+
+func TestCompressorWindowHoldsMostRecentPrimingLines(t *testing.T) {
+	c, _ := NewCompressor(Options{CompressionLevel: COMPRESSION_LEVEL_DEFAULT})
+	if window := c.Window(); len(window) != 0 {
+		t.Errorf("Unprimed window holds %d lines", len(window))
+	}
+	var priming [][]byte
+	for i := 0; i < 2*MAX_BACKREFERENCE_CAPACITY; i++ {
+		priming = append(priming, numberedLine(i))
+	}
+	c.Prime(priming)
+
+	window := c.Window()
+	capacity := int(getCompressionParameters(COMPRESSION_LEVEL_DEFAULT).backreferenceCapacity)
+	if len(window) != capacity-1 {
+		t.Fatalf("Expected %d lines in the window; got %d", capacity-1, len(window))
+	}
+	for i, line := range window {
+		if expected := priming[len(priming)-1-i]; !bytes.Equal(line, expected) {
+			t.Errorf("Line %d: expected %q; got %q", i, expected, line)
+		}
+	}
+	// a snapshot: changing it does not affect the compressor
+	window[0][0] = 'X'
+	if c.Window()[0][0] == 'X' {
+		t.Errorf("Window returned lines of the compressor")
+	}
+}
@@ -0,0 +1,49 @@
+package pack
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Packs every input into own buffers at once; run with -race to have shared state reported.
+func TestConcurrentCompressRoundTrips(t *testing.T) {
+	const goroutines = 16
+	inputs := make([][]byte, goroutines)
+	for i := range inputs {
+		if i%2 == 0 {
+			inputs[i] = randomTextWithLongLines(int64(i))
+		} else {
+			inputs[i] = incrementingIdsLog(1000 + 100*i)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, goroutines)
+	for i, input := range inputs {
+		wg.Add(1)
+		go func(i int, input []byte) {
+			defer wg.Done()
+			level := COMPRESSION_LEVEL_WORST + i%(COMPRESSION_LEVEL_BEST-COMPRESSION_LEVEL_WORST+1)
+			packed := make([]byte, 2*len(input)+DecompressBound())
+			written := 0
+			for src := input; len(src) > 0; {
+				bytesRead, bytesWritten := Compress(packed[written:], src, level)
+				src, written = src[bytesRead:], written+bytesWritten
+			}
+			unpacked := make([]byte, len(input)+MAX_CHUNK_SIZE)
+			_, unpackedSize, err := DecompressOpts(unpacked, packed[:written], DecompressOptions{})
+			if err == nil && !bytes.Equal(unpacked[:unpackedSize], input) {
+				err = fmt.Errorf("unpacked %d bytes differ from input of %d", unpackedSize, len(input))
+			}
+			errs[i] = err
+		}(i, input)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Input %d: %v", i, err)
+		}
+	}
+}
@@ -1,21 +1,27 @@
 package pack
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"math/rand"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
 
 const (
-	number_of_random_cases = 50
-	dict_size              = 80
-
-	abnormal_inputs_dir                = "./../testData/abnormalCases/"
+	number_of_random_cases       = 50
+	dict_size                    = 80
+	number_of_unique_lines_cases = 5
+	unique_lines_per_case        = 20000
+	max_packed_prefix_bytes      = 12
 )
 
+var abnormal_inputs_dir = corpusDirFromEnv("LOGPACK_ABNORMAL_CORPUS", "./../testData/abnormalCases/")
+
 func TestPackAndUnpackLongLines(t *testing.T) {
 
 	packedBuff := make([]byte, test_compression_bound_bytes)
@@ -63,6 +69,41 @@ func TestPackAndUnpackNonAsciiLines(t *testing.T) {
 	}
 }
 
+// Every line is unique: only the timestamp and the prefix after it are shared, which the previous line matches best.
+func TestPackAndUnpackUniqueLinesWithCommonPrefix(t *testing.T) {
+
+	packedBuff := make([]byte, test_compression_bound_bytes)
+	unpackedBuff := make([]byte, test_max_input_size_bytes)
+
+	testSeed := time.Now().UnixMicro()
+	for i := 0; i < number_of_unique_lines_cases; i++ {
+		inputBuff, payloadSize := randomUniqueLinesWithCommonPrefix(testSeed, unique_lines_per_case)
+
+		t.Run(fmt.Sprintf("seed %d", testSeed), func(t *testing.T) {
+			// --------- packing
+			packOutputSize := PackBuffer(inputBuff, packedBuff, COMPRESSION_LEVEL_DEFAULT)
+
+			// --------- unpacking
+			unpackOutputSize := UnpackBuffer(packedBuff[:packOutputSize], unpackedBuff, t)
+
+			// --------- test assertions
+			assertInversibility(t, fmt.Sprintf("seed %d", testSeed), inputBuff, unpackedBuff, len(inputBuff), unpackOutputSize)
+
+			// the previous line has the longest common timestamp prefix but its payload has nothing to refer
+			histogram := ReferenceHistogram(inputBuff, COMPRESSION_LEVEL_DEFAULT)
+			if histogram[1] < unique_lines_per_case*9/10 {
+				t.Errorf("Only %d of %d lines refer the previous one: %v", histogram[1], unique_lines_per_case, histogram)
+			}
+			// the 65 bytes prefix of every line is referred: about 8 bytes of it are left
+			if packOutputSize > payloadSize+unique_lines_per_case*max_packed_prefix_bytes {
+				t.Errorf("Packed %d bytes (%d of payloads) to %d; expected at most %d bytes per line more than payloads",
+					len(inputBuff), payloadSize, packOutputSize, max_packed_prefix_bytes)
+			}
+		})
+		testSeed++
+	}
+}
+
 func TestCompressEmpty(t * testing.T) {
 	packedBuff := make([]byte, test_compression_bound_bytes)
 	unpackedBuff := make([]byte, test_max_input_size_bytes)
@@ -75,6 +116,9 @@ func TestCompressEmpty(t * testing.T) {
 		if read != 0 {
 			t.Errorf("Compression of empty buffer read non-zero bytes: %d", read)
 		}
+		if written != 0 {
+			t.Errorf("Compression of empty buffer wrote %d bytes: %x", written, packedBuff[:written])
+		}
 		_, writtenDec := Decompress(unpackedBuff,packedBuff[:written])
 		if writtenDec != 0 {
 			t.Errorf("Empty buffer after pack-unpack is no longer empty! and has %d bytes", writtenDec)
@@ -82,6 +126,36 @@ func TestCompressEmpty(t * testing.T) {
 	})
 }
 
+// First line is stored as it is even if it's just "\n" - it must still be referable by the lines after it.
+func TestCompressEmptyFirstLineFollowedByContent(t *testing.T) {
+	unpackedBuff := make([]byte, test_max_input_size_bytes)
+	for _, input := range []string{
+		"\n",
+		"\nfirst line with content\n",
+		"\n\n\n\nlines after empty ones\n\n",
+		" \n",
+		"\t \nsecond line\n \nfourth line\n",
+		"\r\n\r\nCRLF line\r\n",
+		"\nno newline at the end",
+		"\n" + strings.Repeat("repeated line after empty first one\n", 200),
+	} {
+		for level := COMPRESSION_LEVEL_WORST; level <= COMPRESSION_LEVEL_BEST; level++ {
+			packedBuff := make([]byte, 2*len(input)+DecompressBound())
+			packedSize := PackBuffer([]byte(input), packedBuff, level)
+			unpackedSize := UnpackBuffer(packedBuff[:packedSize], unpackedBuff, t)
+			assertInversibility(t, fmt.Sprintf("%.20q at level %d", input, level), []byte(input), unpackedBuff, len(input), unpackedSize)
+		}
+	}
+}
+
+func TestCompressIntoDstTooSmallForAnyByteWritesNothing(t *testing.T) {
+	// non-ASCII byte takes 2 bytes escaped
+	packedBuff := make([]byte, HEADER_SIZE+1)
+	if read, written := Compress(packedBuff, []byte("\xc4bc\n"), COMPRESSION_LEVEL_DEFAULT); read != 0 || written != 0 {
+		t.Errorf("Expected nothing read nor written; got %d and %d bytes: %x", read, written, packedBuff[:written])
+	}
+}
+
 func randomTextWithLongLines(seed int64) []byte {
 	r := rand.New(rand.NewSource(seed))
 
@@ -136,6 +210,28 @@ func randomNonAsciiLines(seed int64) []byte {
 	return rawBuff
 }
 
+// Lines of a structured log: rising timestamp, the same host and logger, then a payload of 40-160 random base64
+// chars. Returns them and the size of the payloads alone.
+func randomUniqueLinesWithCommonPrefix(seed int64, lines int) (rawBuff []byte, payloadSize int) {
+	r := rand.New(rand.NewSource(seed))
+	myEncoding := base64.StdEncoding.WithPadding(base64.NoPadding)
+
+	timestamp := time.Date(2024, 3, 17, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < lines; i++ {
+		timestamp = timestamp.Add(time.Duration(r.Intn(1000)) * time.Millisecond)
+		rawBuff = append(rawBuff, timestamp.Format("2006-01-02 15:04:05.000")...)
+		rawBuff = append(rawBuff, " web01 shop.checkout.PaymentService INFO "...)
+
+		someBytes := make([]byte, 30+r.Intn(90))
+		r.Read(someBytes)
+		payload := myEncoding.EncodeToString(someBytes)
+		rawBuff = append(rawBuff, payload...)
+		rawBuff = append(rawBuff, '\n')
+		payloadSize += len(payload)
+	}
+	return rawBuff, payloadSize
+}
+
 func initRandomDict(r *rand.Rand) [dict_size][]byte {
 	myEncoding := base64.StdEncoding.WithPadding(base64.NoPadding)
 	var words [dict_size][]byte
@@ -160,3 +256,464 @@ func initRandomDict(r *rand.Rand) [dict_size][]byte {
 func TestPackAndUnpackAbnormalInputs(t *testing.T) {
 	testPackAndUnpackFromDir(t, abnormal_inputs_dir)
 }
+
+// Boundary files TestPackAndUnpackAbnormalInputs must cover, with their exact content.
+func TestAbnormalInputsCoverBoundaryFiles(t *testing.T) {
+	for _, tc := range []struct {
+		path    string
+		content []byte
+		chunks  int
+	}{
+		{"empty/empty.log", nil, 0},
+		{"oneByte/oneByte.log", []byte("a"), 1},
+		{"newlineOnly/newlineOnly.log", []byte("\n"), 1},
+		// one giant line taking exactly the biggest chunk
+		{"chunkOfOneLine/chunkOfOneLine.log", bytes.Repeat([]byte("a"), MAX_CHUNK_SIZE), 1},
+	} {
+		input, err := os.ReadFile(abnormal_inputs_dir + tc.path)
+		if err != nil || !bytes.Equal(input, tc.content) {
+			t.Errorf("%s: expected %d bytes fixture; got %d bytes, err: %v", tc.path, len(tc.content), len(input), err)
+			continue
+		}
+		packed := make([]byte, len(input)+DecompressBound())
+		packed = packed[:PackBuffer(input, packed, COMPRESSION_LEVEL_DEFAULT)]
+		chunks, remainder := ScanChunks(packed)
+		if len(chunks) != tc.chunks || remainder != 0 {
+			t.Errorf("%s: expected %d chunks; got %d and %d bytes more", tc.path, tc.chunks, len(chunks), remainder)
+		}
+		unpacked := make([]byte, len(input)+1)
+		if read, written, err := DecompressOpts(unpacked, packed, DecompressOptions{}); err != nil || read != len(packed) || !bytes.Equal(unpacked[:written], input) {
+			t.Errorf("%s: read %d of %d bytes; unpacked %d bytes of %d, err: %v", tc.path, read, len(packed), written,
+				len(input), err)
+		}
+	}
+}
+
+// byte-by-byte reference of quoting
+func quoteSlowly(src []byte) []byte {
+	quoted := make([]byte, 0, 2*len(src))
+	for _, char := range src {
+		if char&ESCAPE_BYTE != 0 {
+			quoted = append(quoted, ESCAPE_BYTE)
+		}
+		quoted = append(quoted, char)
+	}
+	return quoted
+}
+
+func TestQuoteNonAsciiAtEveryOffset(t *testing.T) {
+	dst := make([]byte, 100)
+	for length := 0; length < 20; length++ {
+		for nonAsciiIdx := 0; nonAsciiIdx < length; nonAsciiIdx++ {
+			src := []byte(strings.Repeat("a", length))
+			src[nonAsciiIdx] = 0xC4
+
+			written := quote(dst, src)
+			if string(dst[:written]) != string(quoteSlowly(src)) {
+				t.Errorf("quote(%v) = %v; expected %v", src, dst[:written], quoteSlowly(src))
+			}
+		}
+	}
+}
+
+// Bytes 129-255 are line references and lengths in the compressed stream; as literals they must always be escaped.
+func TestLiteralBytesInReferenceRangeAreNotMistakenForTokens(t *testing.T) {
+	packedBuff := make([]byte, DecompressBound())
+	unpackedBuff := make([]byte, DecompressBound())
+
+	for value := 128; value < 256; value++ {
+		char := string([]byte{byte(value)})
+		// at the beginning of the chunk and of a line, in the middle of a literal word following a reference,
+		// as a whole word, before '\n' and repeated
+		input := []byte(char + "x common words here\n" +
+			char + " common words here\n" +
+			"common wo" + char + "rds here\n" +
+			"common " + char + " here\n" +
+			"common words here" + char + "\n" +
+			"common " + strings.Repeat(char, 200) + " here\n")
+
+		read, written := Compress(packedBuff, input, COMPRESSION_LEVEL_DEFAULT)
+		_, unpackedSize := Decompress(unpackedBuff, packedBuff[:written])
+		if read != len(input) || string(unpackedBuff[:max(unpackedSize, 0)]) != string(input) {
+			t.Errorf("Byte %d: expected %q; got %q", value, input, unpackedBuff[:max(unpackedSize, 0)])
+		}
+
+		lines := bytes.SplitAfter(input, []byte("\n"))
+		explanation := ExplainLine(lines[:2], lines[2], COMPRESSION_LEVEL_DEFAULT)
+		var literals []byte
+		for _, token := range explanation.Tokens {
+			if token.Kind == TOKEN_LITERAL {
+				literals = append(literals, token.Text...)
+			}
+		}
+		if !bytes.Contains(literals, []byte(char)) {
+			t.Errorf("Byte %d: not stored as a literal:\n%s", value, explanation)
+		}
+	}
+}
+
+func TestQuoteSafelyDoesNotOverrunDst(t *testing.T) {
+	src := []byte("abc\xc4\xc5defghijk\xff")
+	expected := quoteSlowly(src)
+
+	for dstSize := 0; dstSize <= len(expected); dstSize++ {
+		dst := make([]byte, dstSize)
+		read, written := quoteSafely(dst, src)
+
+		if string(dst[:written]) != string(quoteSlowly(src[:read])) {
+			t.Errorf("dst size %d: quoted %v as %v", dstSize, src[:read], dst[:written])
+		}
+		// only an escape pair that does not fit may be left unwritten
+		if written < dstSize-1 {
+			t.Errorf("dst size %d: only %d bytes written", dstSize, written)
+		}
+	}
+}
+
+func TestPackAndUnpackLongLineWithNonAsciiHead(t *testing.T) {
+	packedBuff := make([]byte, test_compression_bound_bytes)
+	unpackedBuff := make([]byte, test_max_input_size_bytes)
+
+	// escaped head makes the line overflow the chunk
+	inputBuff := []byte(strings.Repeat("\xc4", 100) + strings.Repeat("a", 2*MAX_CHUNK_SIZE) + "\n")
+
+	packOutputSize := PackBuffer(inputBuff, packedBuff, COMPRESSION_LEVEL_DEFAULT)
+	unpackOutputSize := UnpackBuffer(packedBuff[:packOutputSize], unpackedBuff, t)
+
+	assertInversibility(t, "long line with non-ascii head", inputBuff, unpackedBuff, len(inputBuff), unpackOutputSize)
+}
+
+func TestRandomBytesAreStoredNearRawSize(t *testing.T) {
+	src := make([]byte, 1000*1000)
+	rand.New(rand.NewSource(7)).Read(src)
+	// escaping alone would take about 1.5x
+	packedBuff := make([]byte, 2*len(src))
+	unpackedBuff := make([]byte, len(src))
+
+	packOutputSize := PackBuffer(src, packedBuff, COMPRESSION_LEVEL_DEFAULT)
+	chunks, _ := ScanChunks(packedBuff[:packOutputSize])
+	if packOutputSize > len(src)+len(chunks)*(HEADER_SIZE+1) || len(chunks) > len(src)/(MAX_CHUNK_SIZE/2)+1 {
+		t.Errorf("Random %d bytes packed into %d bytes in %d chunks", len(src), packOutputSize, len(chunks))
+	}
+	for _, chunk := range chunks {
+		if packedBuff[chunk.Offset+HEADER_SIZE] != STORED_CHUNK_MARKER {
+			t.Fatalf("Chunk at %d is not stored", chunk.Offset)
+		}
+	}
+
+	unpackOutputSize := UnpackBuffer(packedBuff[:packOutputSize], unpackedBuff, t)
+	assertInversibility(t, "random bytes", src, unpackedBuff, len(src), unpackOutputSize)
+}
+
+func TestCompressConsumesWholeLinesWhenDstFills(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	var src []byte
+	for i := 0; i < 100; i++ {
+		src = append(src, fmt.Sprintf("%d unique payload %x\n", i, r.Uint64())...)
+	}
+	packedBuff := make([]byte, 1000)
+	unpackedBuff := make([]byte, len(src))
+
+	read, written := Compress(packedBuff, src, COMPRESSION_LEVEL_DEFAULT)
+	if read >= len(src) {
+		t.Fatalf("Expected dst to fill up before src is consumed. Read %d of %d bytes", read, len(src))
+	}
+	if src[read-1] != '\n' {
+		t.Errorf("Compression did not stop on a line boundary. Consumed: \"%s\"", src[:read])
+	}
+	unpackOutputSize := UnpackBuffer(packedBuff[:written], unpackedBuff, t)
+	assertInversibility(t, "dst fills up", src, unpackedBuff, read, unpackOutputSize)
+}
+
+func TestCompressConsumesWholeLinesWhenSrcExceedsChunk(t *testing.T) {
+	// lines of 100 bytes; MAX_CHUNK_SIZE is not a multiple of line length
+	src := []byte(strings.Repeat(strings.Repeat("a", 99)+"\n", 1000))
+	packedBuff := make([]byte, DecompressBound())
+
+	read, _ := Compress(packedBuff, src, COMPRESSION_LEVEL_DEFAULT)
+	if read != MAX_CHUNK_SIZE/100*100 {
+		t.Errorf("Expected %d bytes (whole lines) to be consumed; got %d", MAX_CHUNK_SIZE/100*100, read)
+	}
+}
+
+func TestInputOfMaxChunkSizePlusOneSplitsIntoTwoChunks(t *testing.T) {
+	for _, lineLength := range []int{64, 100} {
+		// numbered lines of lineLength bytes cut to MAX_CHUNK_SIZE+1 bytes
+		var src []byte
+		for i := 0; len(src) <= MAX_CHUNK_SIZE; i++ {
+			line := fmt.Sprintf("line %05d ", i)
+			src = append(src, line+strings.Repeat("x", lineLength-len(line)-1)+"\n"...)
+		}
+		src = src[:MAX_CHUNK_SIZE+1]
+		// 64 divides MAX_CHUNK_SIZE so the first chunk ends exactly at the limit; 100 does not - it ends on the last whole line
+		firstChunkRawSize := MAX_CHUNK_SIZE / lineLength * lineLength
+
+		t.Run(fmt.Sprintf("line length %d", lineLength), func(t *testing.T) {
+			packedBuff := make([]byte, 2*DecompressBound())
+			unpackedBuff := make([]byte, len(src))
+
+			packedSize := PackBuffer(src, packedBuff, COMPRESSION_LEVEL_DEFAULT)
+			var rawSizes []int
+			for rest := packedBuff[:packedSize]; len(rest) > 0; {
+				chunkSize, rawSize := readHeader(rest)
+				rawSizes = append(rawSizes, rawSize)
+				rest = rest[HEADER_SIZE+chunkSize:]
+			}
+			expected := []int{firstChunkRawSize, len(src) - firstChunkRawSize}
+			if fmt.Sprint(rawSizes) != fmt.Sprint(expected) {
+				t.Errorf("Expected chunks of raw sizes %v; got %v", expected, rawSizes)
+			}
+
+			unpackOutputSize := UnpackBuffer(packedBuff[:packedSize], unpackedBuff, t)
+			assertInversibility(t, "MAX_CHUNK_SIZE+1", src, unpackedBuff, len(src), unpackOutputSize)
+		})
+	}
+}
+
+func TestCompressFillsSmallDstWithWellCompressingLines(t *testing.T) {
+	line := strings.Repeat("a", 99) + "\n"
+	src := []byte(strings.Repeat(line, 20))
+	// fits the first line plus a reference to it for every other line - but not the worst case of even one more line
+	packedBuff := make([]byte, HEADER_SIZE+len(line)+2*19)
+	unpackedBuff := make([]byte, len(src))
+
+	read, written := Compress(packedBuff, src, COMPRESSION_LEVEL_DEFAULT)
+	if read != len(src) {
+		t.Errorf("Expected all %d bytes to be packed in one chunk; packed %d", len(src), read)
+	}
+	unpackOutputSize := UnpackBuffer(packedBuff[:written], unpackedBuff, t)
+	assertInversibility(t, "repeated line", src, unpackedBuff, len(src), unpackOutputSize)
+}
+
+func TestDecompressWithReusedScratch(t *testing.T) {
+	packedBuff := make([]byte, test_compression_bound_bytes)
+	unpackedBuff := make([]byte, test_max_input_size_bytes)
+	var scratch Scratch
+
+	for _, input := range []string{
+		strings.Repeat("first archive line\n", 100),
+		"second\narchive\n",
+		strings.Repeat("third archive line number ", 10000) + "\n",
+	} {
+		packOutputSize := PackBuffer([]byte(input), packedBuff, COMPRESSION_LEVEL_DEFAULT)
+
+		read, written := DecompressWith(unpackedBuff, packedBuff[:packOutputSize], &scratch)
+		if read != packOutputSize {
+			t.Fatalf("Unpacked only %d bytes of %d buffer!", read, packOutputSize)
+		}
+		assertInversibility(t, input[:10], []byte(input), unpackedBuff, len(input), written)
+	}
+}
+
+func TestDecompressWithReusedScratchRejectsLinesOfPreviousChunk(t *testing.T) {
+	packedBuff := make([]byte, DecompressBound())
+	unpackedBuff := make([]byte, DecompressBound())
+	var scratch Scratch
+
+	// fills whole backref buffer
+	_, written := Compress(packedBuff, []byte(strings.Repeat("line\n", 2*MAX_BACKREFERENCE_CAPACITY)), COMPRESSION_LEVEL_DEFAULT)
+	if read, _ := DecompressWith(unpackedBuff, packedBuff[:written], &scratch); read != written {
+		t.Fatalf("Unpacked only %d bytes of %d buffer!", read, written)
+	}
+
+	// second line refers 2 lines before, while there's just one line in this chunk
+	body := []byte{'x', '\n', ESCAPE_BYTE + 2, ESCAPE_BYTE + 1, '\n'}
+	chunk := make([]byte, HEADER_SIZE+len(body))
+	storeHeader(chunk, len(body), 4)
+	copy(chunk[HEADER_SIZE:], body)
+
+	if read, _ := DecompressWith(unpackedBuff, chunk, &scratch); read != CORRUPT_INPUT {
+		t.Errorf("Reference to a line outside of the chunk was not detected. Result: %d", read)
+	}
+}
+
+// NUL is ASCII - it is copied literally by quote() and never mistaken for a length token or escape (both > ESCAPE_BYTE).
+// Lines end only on '\n', so NUL does not end a line in decompressChunk() either.
+func TestPackAndUnpackLinesWithNul(t *testing.T) {
+	inputs := []string{
+		"a\x00b\n",
+		"\x00leading NUL\n\x00leading NUL\n",
+		"\x00\x00\x00\n\x00\x00\x00\n\x00\n",
+		// NUL inside referenced words and right before/after the reference
+		"key=\x00val\x00 next word \x00\nkey=\x00val\x00 next word \x00\nkey=\x00vaL\x00 next word \x00\n",
+		"words with\x00 NUL \x00 and spaces\nwords with\x01 NUL \x00 and spaces\n",
+		"no newline at the end\x00",
+		"\x00",
+		"\x00\n\n\x00\x80\x00\n",
+	}
+	packedBuff := make([]byte, DecompressBound())
+	unpackedBuff := make([]byte, DecompressBound())
+
+	for i, input := range inputs {
+		for _, compressionLevel := range []int{COMPRESSION_LEVEL_WORST, COMPRESSION_LEVEL_BEST} {
+			t.Run(fmt.Sprintf("input %d level %d", i, compressionLevel), func(t *testing.T) {
+				packOutputSize := PackBuffer([]byte(input), packedBuff, compressionLevel)
+				unpackOutputSize := UnpackBuffer(packedBuff[:packOutputSize], unpackedBuff, t)
+
+				if string(unpackedBuff[:unpackOutputSize]) != input {
+					t.Errorf("Expected %q; got %q", input, unpackedBuff[:unpackOutputSize])
+				}
+			})
+		}
+	}
+}
+
+// Reference copied past the raw size declared in the header used to run off the end of dst
+// (in the '\n' check following the copy) instead of being reported as corrupt input.
+func TestDecompressRejectsReferenceLongerThanRawSize(t *testing.T) {
+	unpackedBuff := make([]byte, DecompressBound())
+
+	// "ab\n" followed by a line copying all 3 bytes of it, while header declares just 4 bytes
+	body := []byte{'a', 'b', '\n', ESCAPE_BYTE + 1, ESCAPE_BYTE + 3}
+	chunk := make([]byte, HEADER_SIZE+len(body))
+	storeHeader(chunk, len(body), 4)
+	copy(chunk[HEADER_SIZE:], body)
+
+	if read, _ := Decompress(unpackedBuff, chunk); read != CORRUPT_INPUT {
+		t.Errorf("Reference exceeding raw size was not detected. Result: %d", read)
+	}
+}
+
+func craftChunk(body []byte, rawSize int) []byte {
+	chunk := make([]byte, HEADER_SIZE+len(body))
+	storeHeader(chunk, len(body), rawSize)
+	copy(chunk[HEADER_SIZE:], body)
+	return chunk
+}
+
+// Chunk may start with ESCAPE_BYTE (escaped literal) or STORED_CHUNK_MARKER but not with anything else above
+// ESCAPE_BYTE (line reference).
+func TestChunkStartingAtEscapeByteBoundary(t *testing.T) {
+	unpackedBuff := make([]byte, DecompressBound())
+
+	valid := []struct {
+		body     []byte
+		expected string
+	}{
+		{[]byte{ESCAPE_BYTE, ESCAPE_BYTE, '\n'}, "\x80\n"},
+		{[]byte{ESCAPE_BYTE, ESCAPE_BYTE + 1, '\n'}, "\x81\n"},
+		{[]byte{ESCAPE_BYTE, 0xff}, "\xff"},
+		// second line starting with escaped literal is not a reference either
+		{[]byte{'a', '\n', ESCAPE_BYTE, ESCAPE_BYTE + 1, '\n'}, "a\n\x81\n"},
+		// stored chunk holds raw bytes - nothing is escaped or referred
+		{[]byte{STORED_CHUNK_MARKER, ESCAPE_BYTE + 1, '\n', ESCAPE_BYTE}, "\x81\n\x80"},
+	}
+	for _, tc := range valid {
+		read, written := Decompress(unpackedBuff, craftChunk(tc.body, len(tc.expected)))
+		if read != HEADER_SIZE+len(tc.body) || string(unpackedBuff[:written]) != tc.expected {
+			t.Errorf("Chunk %x: expected %q; got %q (%d)", tc.body, tc.expected, unpackedBuff[:written], read)
+		}
+	}
+
+	corrupt := [][]byte{
+		{ESCAPE_BYTE + 1, ESCAPE_BYTE + 1, '\n'},
+		{ESCAPE_BYTE | NO_SHARED_PREFIX_FLAG | 1, ESCAPE_BYTE + 1, '\n'},
+		{0xff, '\n'},
+		// unfinished escape
+		{ESCAPE_BYTE},
+		// stored chunk one byte shorter than declared raw size
+		{STORED_CHUNK_MARKER, 'a'},
+	}
+	for _, body := range corrupt {
+		if read, _ := Decompress(unpackedBuff, craftChunk(body, 2)); read != CORRUPT_INPUT {
+			t.Errorf("Chunk %x should be corrupt. Result: %d", body, read)
+		}
+	}
+
+	// packed chunks (and lines) starting with bytes around ESCAPE_BYTE
+	packedBuff := make([]byte, DecompressBound())
+	for _, first := range []byte{0x7f, ESCAPE_BYTE, ESCAPE_BYTE + 1, ESCAPE_BYTE | NO_SHARED_PREFIX_FLAG, 0xff} {
+		input := []byte{first, ' ', 'x', '\n', first, ' ', 'x', '\n', first, '\n'}
+		packOutputSize := PackBuffer(input, packedBuff, COMPRESSION_LEVEL_BEST)
+		unpackOutputSize := UnpackBuffer(packedBuff[:packOutputSize], unpackedBuff, t)
+		if string(unpackedBuff[:unpackOutputSize]) != string(input) {
+			t.Errorf("Expected %q; got %q", input, unpackedBuff[:unpackOutputSize])
+		}
+	}
+}
+
+func TestCompressToBufferKeepsWellCompressingLongLinesInChunk(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	longLine := make([]byte, 30000)
+	for i := range longLine {
+		longLine[i] = byte('a' + random.Intn(26))
+	}
+	longLine[len(longLine)-1] = '\n'
+	// after the first line there is less room in the chunk than the worst case of the second one (2*len+2)
+	src := bytes.Repeat(longLine, 2)
+
+	var buf bytes.Buffer
+	CompressToBuffer(&buf, src, COMPRESSION_LEVEL_DEFAULT)
+	chunks, remainder := ScanChunks(buf.Bytes())
+	if len(chunks) != 1 || remainder != 0 || chunks[0].RawSize != len(src) {
+		t.Errorf("Expected all %d bytes in one chunk; got %+v", len(src), chunks)
+	}
+	unpackedBuff := make([]byte, len(src))
+	unpackOutputSize := UnpackBuffer(buf.Bytes(), unpackedBuff, t)
+	assertInversibility(t, "repeated long line", src, unpackedBuff, len(src), unpackOutputSize)
+}
+
+// References that end exactly at the end of the referred line (or of its last word, with no space after it) leave
+// nothing of it to refer: compressor must store the rest of the line as literals, never as another reference.
+func TestReferenceReachingEndOfKeyLineRoundTrips(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		keyLine string
+		line    string
+	}{
+		{"last word before newline", "user alice logged in\n", "user alice logged in from 10.0.0.1\n"},
+		{"whole line", "GET /index.html 200\n", "GET /index.html 200\n"},
+		{"line without newline", "GET /index.html", "GET /index.html 200 OK\n"},
+		{"word cut by line end", "job 42 done", "job 42 doneness 7\n"},
+		{"number at the end", "seq=10000", "seq=10005 next=10006\n"},
+		{"no shared prefix", "x GET /a", "y GET /a b c\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			keyLine, line := []byte(tc.keyLine), []byte(tc.line)
+			explanation := ExplainLine([][]byte{keyLine}, line, COMPRESSION_LEVEL_BEST)
+			reachesEnd := false
+			for i, token := range explanation.Tokens {
+				end := token.KeyLineOffset + len(token.Text)
+				if token.Kind == TOKEN_REFERENCE && (end == len(keyLine) || indexOfFirstSpace(end, keyLine) == len(keyLine)) {
+					reachesEnd = true
+					if i+1 < len(explanation.Tokens) && explanation.Tokens[i+1].Kind == TOKEN_REFERENCE {
+						t.Errorf("Reference follows one that exhausted the key line: %v", explanation)
+					}
+				}
+			}
+			if !reachesEnd {
+				t.Fatalf("Expected a reference reaching the end of the key line: %v", explanation)
+			}
+
+			for level := COMPRESSION_LEVEL_WORST; level <= COMPRESSION_LEVEL_BEST; level++ {
+				for _, numericDelta := range []bool{false, true} {
+					// key line without newline can only be a priming line
+					compressor, _ := NewCompressor(Options{CompressionLevel: level, NumericDelta: numericDelta})
+					var scratch Scratch
+					input := line
+					if keyLine[len(keyLine)-1] == '\n' {
+						input = append(append([]byte{}, keyLine...), line...)
+					} else {
+						compressor.Prime([][]byte{keyLine})
+						scratch.Prime([][]byte{keyLine})
+					}
+					packed := make([]byte, DecompressBound())
+					_, written := compressor.Compress(packed, input)
+					unpacked := make([]byte, len(input))
+					if read, unpackedSize := DecompressWith(unpacked, packed[:written], &scratch); read != written ||
+						!bytes.Equal(unpacked[:unpackedSize], input) {
+						t.Errorf("Level %d, numeric delta %v: expected %q; got %q (result %d)", level, numericDelta,
+							input, unpacked[:max(unpackedSize, 0)], read)
+					}
+				}
+			}
+		})
+	}
+
+	// "a b" exhausts "a b\n": a reference after it is refused rather than read beyond the key line
+	unpackedBuff := make([]byte, DecompressBound())
+	chunk := craftChunk([]byte{'a', ' ', 'b', '\n', ESCAPE_BYTE + 1, ESCAPE_BYTE + 3, ESCAPE_BYTE + 1, '\n'}, 9)
+	if read, _ := Decompress(unpackedBuff, chunk); read != CORRUPT_INPUT {
+		t.Errorf("Reference beyond exhausted key line should be corrupt. Result: %d", read)
+	}
+}
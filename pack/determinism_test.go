@@ -0,0 +1,46 @@
+package pack
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+)
+
+// sha256 of the apache sample packed with PackBuffer() at levels 1-9. Same bytes must pack to the same output on every
+// platform and Go version; update only on a deliberate change of the format or of the algorithm.
+var apachePackedDigests = [...]string{
+	"c3dfbdc2c3a26869cf3c50aed5120f45a7adfebfd758b088cddfa1036de32b72",
+	"8b634366c67cdd26c5b52170e7f68bcf3942db7a05b233208e22d9f0cefaf833",
+	"398b1fd02a2197c2ac21e4b9b95091a27e51a2a6d344b4da882d3c5eb9e1fe1b",
+	"d129fdbca347b6204df145ac4d50a84dae7e110464678fefb9df88d39f9d6c75",
+	"fe9392fd157a448237d85571a270a42302bd23c2c478e14c9f72bcdf24014c66",
+	"3dc46d5744e9ed8ebe53c5a747daf896ff1a27d79a922e925a26a6042697ade8",
+	"e0292117615b60826647260449fce1d8db513947a585c144e8509e94c7a8d7dd",
+	"9cfd4d5fed17a6ac45d22eb30bcdd88709409abcf7330b75769a336ef21024d2",
+	"36460de9c9939b693764bf20989d32a5710d6651fb9a62a93417ff5f2aaad5e8",
+}
+
+func packApache(t *testing.T, level int) []byte {
+	dir := path_defaultLoghubCorpus + "apache/"
+	apache, err := os.ReadFile(dir + findFirstLogFile(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packed := make([]byte, len(apache)+DecompressBound())
+	return packed[:PackBuffer(apache, packed, level)]
+}
+
+func TestPackingIsReproducible(t *testing.T) {
+	for level := COMPRESSION_LEVEL_WORST; level <= COMPRESSION_LEVEL_BEST; level++ {
+		packed := packApache(t, level)
+		if again := packApache(t, level); !bytes.Equal(packed, again) {
+			t.Errorf("Level %d: packing the same input twice gave different output", level)
+		}
+		digest := sha256.Sum256(packed)
+		if hex.EncodeToString(digest[:]) != apachePackedDigests[level-1] {
+			t.Errorf("Level %d: expected digest %s; got %x", level, apachePackedDigests[level-1], digest)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package pack
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Counts bytes of src with the high bit set (eg. of UTF-8 or binary data). Packed as literals they are escaped with
+// ESCAPE_BYTE and take 2 bytes each, which explains poor ratios of such input. totalBytes is len(src).
+// It's a read-only pass for diagnostics, like AnalyzeLineEndings(): escapedBytes is the upper bound of escapes
+// written - the ones in parts of lines copied from referred lines take no space at all.
+func EscapeStats(src []byte) (escapedBytes, totalBytes int) {
+	totalBytes = len(src)
+	for ; len(src) >= SIZEOF_INT64; src = src[SIZEOF_INT64:] {
+		escapedBytes += bits.OnesCount64(binary.LittleEndian.Uint64(src) & HIGH_BITS_MASK)
+	}
+	for _, char := range src {
+		if char&ESCAPE_BYTE != 0 {
+			escapedBytes++
+		}
+	}
+	return escapedBytes, totalBytes
+}
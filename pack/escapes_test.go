@@ -0,0 +1,34 @@
+package pack
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEscapeStatsCountsHighBitBytes(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected int
+	}{
+		{"", 0},
+		{"plain ASCII line\n", 0},
+		{"zażółć gęślą jaźń\n", 18},
+		{strings.Repeat("\xff", 17), 17},
+		{"1234567\x80", 1},
+	} {
+		escaped, total := EscapeStats([]byte(tc.input))
+		if escaped != tc.expected || total != len(tc.input) {
+			t.Errorf("%q: %d of %d bytes escaped; expected %d of %d", tc.input, escaped, total, tc.expected, len(tc.input))
+		}
+	}
+}
+
+// Lines of random bytes have the high bit set in every byte but newlines.
+func TestEscapeStatsOfNonAsciiLines(t *testing.T) {
+	input := randomNonAsciiLines(1)
+	escaped, total := EscapeStats(input)
+	if newlines := bytes.Count(input, []byte{'\n'}); escaped != total-newlines {
+		t.Errorf("%d of %d bytes escaped; expected all but %d newlines", escaped, total, newlines)
+	}
+}
@@ -0,0 +1,136 @@
+package pack
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kinds of tokens a compressed line consists of
+const (
+	// sequence of chars copied from the referred line
+	TOKEN_REFERENCE = iota
+	// chars stored as they are (non-ASCII ones escaped)
+	TOKEN_LITERAL
+)
+
+// One piece of a compressed line.
+type LineToken struct {
+	Kind int
+	// chars of the line the token stands for
+	Text []byte
+	// where Text starts in the referred line; TOKEN_REFERENCE only
+	KeyLineOffset int
+	// bytes the token takes in the compressed line
+	EncodedSize int
+}
+
+// Describes how a line gets compressed. See ExplainLine().
+type LineExplanation struct {
+	// how many lines before the explained one the referred line is (1 for the previous line);
+	// 0 if there was no line to refer - the line is stored as it is, like the first line of a chunk
+	LinesBefore   int
+	ReferenceLine []byte
+	// length of the prefix shared with ReferenceLine. Negative value means there is no shared prefix; then it's
+	// the negated offset in ReferenceLine the comparison starts at
+	PrefixLength int
+	// the line as stored in a chunk
+	Encoded []byte
+	Tokens  []LineToken
+}
+
+/*
+Tells how line would be compressed after prevLines (oldest first) at given compressionLevel: which of the lines
+is referred and which parts of line are copied from it or stored literally. Only as many of the last prevLines
+as the compression level looks back at are considered - the same as in Compress() when they all fit in one chunk.
+
+Meant for finding out why some lines compress poorly. Anything after the first '\n' of line is ignored.
+*/
+func ExplainLine(prevLines [][]byte, line []byte, compressionLevel int) (explanation LineExplanation) {
+	compressionParams := getCompressionParameters(compressionLevel)
+	line, _ = nextLine(line)
+	encoded := make([]byte, 2*len(line)+2)
+
+	if len(prevLines) == 0 {
+		explanation.Encoded = encoded[:quote(encoded, line)]
+		explanation.Tokens = explainTokens(explanation.Encoded, nil, 0)
+		return explanation
+	}
+
+	backref := backrefBuffer{capacity: int(compressionParams.backreferenceCapacity)}
+	for _, prevLine := range prevLines {
+		backref.add(prevLine)
+	}
+	lineRef := backref.chooseReferenceLine(line, compressionParams.goodEnoughPercent, MAX_SIMILARITY)
+
+	explanation.LinesBefore = int(lineRef.linesBefore)
+	explanation.ReferenceLine = backref.getLineAt(explanation.LinesBefore)
+	explanation.PrefixLength = lineRef.prefixLength
+	explanation.Encoded = encoded[:compressLine(lineRef, line, encoded, false)]
+
+	// skip the line reference and initial offset the same way decompressChunk() does
+	tokens, idxKeyLine := explanation.Encoded[1:], 0
+	if explanation.Encoded[0]&NO_SHARED_PREFIX_FLAG != 0 {
+		var offsetSize int
+		idxKeyLine, offsetSize = decodeLength(tokens)
+		tokens = tokens[offsetSize:]
+	}
+	explanation.Tokens = explainTokens(tokens, explanation.ReferenceLine, idxKeyLine)
+	return explanation
+}
+
+// Splits encoded body of a line into tokens. Follows decompressChunk() but does no validation - encoded must come
+// from compressLine() or quote().
+func explainTokens(encoded, keyLine []byte, idxKeyLine int) (tokens []LineToken) {
+	for len(encoded) > 0 {
+		if encoded[0] > ESCAPE_BYTE {
+			length, lengthSize := decodeLength(encoded)
+			tokens = append(tokens, LineToken{
+				Kind:          TOKEN_REFERENCE,
+				Text:          keyLine[idxKeyLine : idxKeyLine+length],
+				KeyLineOffset: idxKeyLine,
+				EncodedSize:   lengthSize,
+			})
+			idxKeyLine = indexOfFirstSpace(idxKeyLine+length, keyLine)
+			encoded = encoded[lengthSize:]
+			continue
+		}
+
+		literal := LineToken{Kind: TOKEN_LITERAL}
+		for len(encoded) > 0 && encoded[0] <= ESCAPE_BYTE {
+			if encoded[0] == ESCAPE_BYTE {
+				encoded = encoded[1:]
+				literal.EncodedSize++
+			}
+			literal.Text = append(literal.Text, encoded[0])
+			literal.EncodedSize++
+			encoded = encoded[1:]
+		}
+		tokens = append(tokens, literal)
+	}
+	return tokens
+}
+
+// Human-readable breakdown of the explanation, one token per line.
+func (explanation LineExplanation) String() string {
+	var sb strings.Builder
+	rawSize := 0
+	for _, token := range explanation.Tokens {
+		rawSize += len(token.Text)
+	}
+	if explanation.LinesBefore == 0 {
+		fmt.Fprintf(&sb, "no reference line; %d bytes -> %d bytes\n", rawSize, len(explanation.Encoded))
+	} else {
+		fmt.Fprintf(&sb, "refers the line %d before (shared prefix: %d) %q; %d bytes -> %d bytes\n",
+			explanation.LinesBefore, max(explanation.PrefixLength, 0), explanation.ReferenceLine,
+			rawSize, len(explanation.Encoded))
+	}
+	for _, token := range explanation.Tokens {
+		if token.Kind == TOKEN_REFERENCE {
+			fmt.Fprintf(&sb, "  reference [%d:%d] %q (%d bytes)\n",
+				token.KeyLineOffset, token.KeyLineOffset+len(token.Text), token.Text, token.EncodedSize)
+		} else {
+			fmt.Fprintf(&sb, "  literal %q (%d bytes)\n", token.Text, token.EncodedSize)
+		}
+	}
+	return sb.String()
+}
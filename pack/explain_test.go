@@ -0,0 +1,49 @@
+package pack
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExplainLineMatchesCompress(t *testing.T) {
+	prevLines := [][]byte{
+		[]byte("081109 203615 148 INFO dfs.DataNode$PacketResponder: Received block blk_38865049064139660\n"),
+		[]byte("081109 203807 222 INFO dfs.DataNode$PacketResponder: PacketResponder 0 for block blk_-6952295868487656571 terminating\n"),
+	}
+	line := []byte("081109 204005 35 INFO dfs.DataNode$PacketResponder: PacketResponder 1 for block blk_8229193803249955061 terminating\n")
+
+	explanation := ExplainLine(prevLines, line, COMPRESSION_LEVEL_DEFAULT)
+	if explanation.LinesBefore != 1 || !bytes.Equal(explanation.ReferenceLine, prevLines[1]) {
+		t.Errorf("Expected the previous line to be referred; got %d lines before", explanation.LinesBefore)
+	}
+
+	// line is compressed the same as the last line of a chunk
+	chunk := make([]byte, DecompressBound())
+	_, chunkSize := Compress(chunk, bytes.Join(append(prevLines, line), nil), COMPRESSION_LEVEL_DEFAULT)
+	if !bytes.HasSuffix(chunk[:chunkSize], explanation.Encoded) {
+		t.Errorf("Encoded line %q is not the end of chunk %q", explanation.Encoded, chunk[:chunkSize])
+	}
+
+	var text []byte
+	encodedSize := 1
+	for _, token := range explanation.Tokens {
+		text = append(text, token.Text...)
+		encodedSize += token.EncodedSize
+	}
+	if !bytes.Equal(text, line) || encodedSize != len(explanation.Encoded) {
+		t.Errorf("Tokens do not add up to the line:\n%s", explanation)
+	}
+	t.Log(explanation)
+}
+
+func TestExplainLineWithoutPreviousLines(t *testing.T) {
+	line := []byte("zażółć\nignored")
+	explanation := ExplainLine(nil, line, COMPRESSION_LEVEL_BEST)
+
+	if explanation.LinesBefore != 0 || len(explanation.Tokens) != 1 || explanation.Tokens[0].Kind != TOKEN_LITERAL {
+		t.Fatalf("Expected one literal token:\n%s", explanation)
+	}
+	if token := explanation.Tokens[0]; string(token.Text) != "zażółć\n" || token.EncodedSize != len(explanation.Encoded) {
+		t.Errorf("Unexpected literal %q of %d bytes", token.Text, token.EncodedSize)
+	}
+}
@@ -0,0 +1,61 @@
+package pack
+
+import (
+	"io"
+	"os"
+)
+
+// Options of PackFile() and UnpackFile()
+type FileOptions struct {
+	// used by PackFile() only
+	WriterOptions
+	// Replace output file if it exists. Otherwise an error wrapping fs.ErrExist is returned.
+	Overwrite bool
+}
+
+// Packs file at inPath into a Logpack archive at outPath. Never interacts with the user - whether an existing
+// output file is replaced is decided by opts.Overwrite alone. Incomplete output is removed on error.
+func PackFile(inPath, outPath string, opts FileOptions) error {
+	if err := opts.WriterOptions.Validate(); err != nil {
+		return err
+	}
+	return convertFile(inPath, outPath, opts.Overwrite, func(dst io.Writer, src io.Reader) error {
+		_, err := PackStream(dst, src, opts.WriterOptions)
+		return err
+	})
+}
+
+// Unpacks Logpack archive at inPath into outPath. Never interacts with the user - whether an existing
+// output file is replaced is decided by opts.Overwrite alone. Incomplete output is removed on error.
+func UnpackFile(inPath, outPath string, opts FileOptions) error {
+	return convertFile(inPath, outPath, opts.Overwrite, func(dst io.Writer, src io.Reader) error {
+		_, err := DecompressTo(dst, src)
+		return err
+	})
+}
+
+func convertFile(inPath, outPath string, overwrite bool, convert func(dst io.Writer, src io.Reader) error) (err error) {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+	out, err := os.OpenFile(outPath, flags, 0666)
+	if err != nil {
+		return err
+	}
+
+	err = convert(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outPath)
+	}
+	return err
+}
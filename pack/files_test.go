@@ -0,0 +1,73 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackFileAndUnpackFile(t *testing.T) {
+	dir := t.TempDir()
+	corpusDir := path_defaultLoghubCorpus + "apache/"
+	inPath := corpusDir + findFirstLogFile(corpusDir)
+	packedPath := filepath.Join(dir, "apache.log.lp")
+	unpackedPath := filepath.Join(dir, "apache.log")
+
+	opts := FileOptions{WriterOptions: WriterOptions{Options: Options{CompressionLevel: COMPRESSION_LEVEL_BEST}}}
+	if err := PackFile(inPath, packedPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackFile(packedPath, unpackedPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	input, _ := os.ReadFile(inPath)
+	unpacked, _ := os.ReadFile(unpackedPath)
+	if !bytes.Equal(input, unpacked) {
+		t.Errorf("Unpacked file differs from the original")
+	}
+}
+
+func TestPackFileDoesNotOverwriteUnlessAsked(t *testing.T) {
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "a.log")
+	outPath := filepath.Join(dir, "a.log.lp")
+	os.WriteFile(inPath, []byte("some line\n"), 0666)
+	os.WriteFile(outPath, []byte("existing"), 0666)
+
+	if err := PackFile(inPath, outPath, FileOptions{}); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Expected fs.ErrExist; got %v", err)
+	}
+	if err := UnpackFile(outPath, inPath, FileOptions{}); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Expected fs.ErrExist; got %v", err)
+	}
+	if existing, _ := os.ReadFile(outPath); string(existing) != "existing" {
+		t.Errorf("Existing file was modified: %q", existing)
+	}
+
+	if err := PackFile(inPath, outPath, FileOptions{Overwrite: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackFile(outPath, inPath, FileOptions{Overwrite: true}); err != nil {
+		t.Fatal(err)
+	}
+	if unpacked, _ := os.ReadFile(inPath); string(unpacked) != "some line\n" {
+		t.Errorf("Expected %q; got %q", "some line\n", unpacked)
+	}
+}
+
+func TestUnpackFileRemovesIncompleteOutput(t *testing.T) {
+	dir := t.TempDir()
+	packedPath := filepath.Join(dir, "corrupt.lp")
+	outPath := filepath.Join(dir, "corrupt")
+	os.WriteFile(packedPath, []byte(ARCHIVE_MAGIC+"\x02\x00\x04garbage"), 0666)
+
+	if err := UnpackFile(packedPath, outPath, FileOptions{}); err == nil {
+		t.Errorf("Unpacking corrupt archive should fail")
+	}
+	if _, err := os.Stat(outPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Incomplete output was not removed: %v", err)
+	}
+}
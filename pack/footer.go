@@ -0,0 +1,96 @@
+package pack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+Footer follows the last chunk of an archive with FLAG_FOOTER:
+
+	FOOTER_MARKER | number of chunks (uint32) | header of every chunk (HEADER_SIZE bytes each)
+
+Copies of chunk headers are enough to tell where every chunk starts and how much it unpacks to, without reading
+the chunks. Offset of the footer is either patched into the archive header (seekable output) or stored in the
+trailer just after the footer (SIZEOF_INT64 bytes, before the digest if there is one).
+*/
+const (
+	// Chunk header no chunk can have: 1 byte can't unpack to MAX_CHUNK_SIZE bytes (first line is stored as it is).
+	// Tells sequential readers that chunks are over.
+	FOOTER_MARKER = "\x00\x00\xff\xff"
+)
+
+var ErrNoFooter = errors.New("logpack: archive has no footer")
+
+// Appends footer listing chunks to dst.
+func appendFooter(dst []byte, chunks []ChunkInfo) []byte {
+	dst = append(dst, FOOTER_MARKER...)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(chunks)))
+	for _, chunk := range chunks {
+		var header [HEADER_SIZE]byte
+		storeHeader(header[:], chunk.CompressedSize-HEADER_SIZE, chunk.RawSize)
+		dst = append(dst, header[:]...)
+	}
+	return dst
+}
+
+func isFooterMarker(src []byte) bool {
+	return len(src) >= len(FOOTER_MARKER) && string(src[:len(FOOTER_MARKER)]) == FOOTER_MARKER
+}
+
+/*
+Returns chunks of archive r of given size listed in its footer (see WriterOptions.Footer) and offset of the footer,
+which is where the chunks end. Offsets of chunks are relative to the beginning of the archive. Nothing but the header,
+the footer and the trailer is read.
+
+Returns ErrNoFooter if the archive has none and ErrCorruptInput if the footer does not add up.
+*/
+func ReadFooter(r io.ReaderAt, size int64) (chunks []ChunkInfo, footerOffset int64, err error) {
+	headerBuff := make([]byte, min(size, MAX_ARCHIVE_HEADER_SIZE))
+	if _, err := r.ReadAt(headerBuff, 0); err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	header, headerSize, err := ReadArchiveHeader(headerBuff)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !header.Footer {
+		return nil, 0, ErrNoFooter
+	}
+
+	footerEnd := size - int64(header.TrailerSize())
+	footerOffset = header.FooterOffset
+	if footerOffset == 0 && footerEnd >= int64(headerSize) {
+		// written to non-seekable output; offset is the first field of the trailer
+		var offsetBytes [SIZEOF_INT64]byte
+		if _, err := r.ReadAt(offsetBytes[:], footerEnd); err != nil {
+			return nil, 0, err
+		}
+		footerOffset = int64(binary.LittleEndian.Uint64(offsetBytes[:]))
+	}
+	if footerOffset < int64(headerSize) || footerEnd-footerOffset < int64(len(FOOTER_MARKER)+4) {
+		return nil, 0, fmt.Errorf("%w: footer offset %d out of range", ErrCorruptInput, footerOffset)
+	}
+
+	footer := make([]byte, footerEnd-footerOffset)
+	if _, err := r.ReadAt(footer, footerOffset); err != nil {
+		return nil, 0, err
+	}
+	count := int64(binary.LittleEndian.Uint32(footer[len(FOOTER_MARKER):]))
+	if !isFooterMarker(footer) || int64(len(footer)) != int64(len(FOOTER_MARKER)+4)+count*HEADER_SIZE {
+		return nil, 0, fmt.Errorf("%w: malformed footer", ErrCorruptInput)
+	}
+
+	offset := headerSize
+	for headers := footer[len(FOOTER_MARKER)+4:]; len(headers) > 0; headers = headers[HEADER_SIZE:] {
+		chunkSize, rawSize := readHeader(headers)
+		chunks = append(chunks, ChunkInfo{Offset: offset, CompressedSize: HEADER_SIZE + chunkSize, RawSize: rawSize})
+		offset += HEADER_SIZE + chunkSize
+	}
+	if int64(offset) != footerOffset {
+		return nil, 0, fmt.Errorf("%w: chunks listed in the footer end at %d, not at the footer", ErrCorruptInput, offset)
+	}
+	return chunks, footerOffset, nil
+}
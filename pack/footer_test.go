@@ -0,0 +1,79 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFooterListsChunksOfSeekableAndNonSeekableOutput(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	dir := path_defaultLoghubCorpus + "apache/"
+	input := inputBuff[:readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))]
+
+	var buffered bytes.Buffer
+	file, err := os.Create(filepath.Join(t.TempDir(), "apache.log.lp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	for _, out := range []io.Writer{&buffered, file} {
+		w, _ := NewWriterOpts(out, WriterOptions{Footer: true, Comment: []byte("host=web01")})
+		w.Write(input)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileContent, _ := os.ReadFile(file.Name())
+
+	for name, archive := range map[string][]byte{"non-seekable": buffered.Bytes(), "seekable": fileContent} {
+		header, headerSize, _ := ReadArchiveHeader(archive)
+		if patched := header.FooterOffset != 0; patched != (name == "seekable") {
+			t.Errorf("%s: footer offset in header: %d", name, header.FooterOffset)
+		}
+
+		chunks, footerOffset, err := ReadFooter(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		scanned, remainder := ScanChunks(archive[headerSize:footerOffset])
+		if remainder != 0 || len(chunks) != len(scanned) || len(chunks) < 2 {
+			t.Fatalf("%s: footer lists %d chunks; scanned %d", name, len(chunks), len(scanned))
+		}
+		for i := range chunks {
+			scanned[i].Offset += headerSize
+			if chunks[i] != scanned[i] {
+				t.Errorf("%s: chunk %d: expected %+v; got %+v", name, i, scanned[i], chunks[i])
+			}
+		}
+
+		// sequential reader stops at the footer
+		r, _ := NewReader(bytes.NewReader(archive))
+		unpacked, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(unpacked, input) {
+			t.Errorf("%s: archive did not unpack to the input; err: %v", name, err)
+		}
+	}
+}
+
+func TestReadFooterRejectsArchiveWithoutFooter(t *testing.T) {
+	var packed bytes.Buffer
+	PackStream(&packed, bytes.NewReader([]byte("a line\n")), WriterOptions{})
+	if _, _, err := ReadFooter(bytes.NewReader(packed.Bytes()), int64(packed.Len())); err != ErrNoFooter {
+		t.Errorf("Expected ErrNoFooter; got %v", err)
+	}
+
+	packed.Reset()
+	PackStream(&packed, bytes.NewReader([]byte("a line\n")), WriterOptions{Footer: true})
+	// chunk cut out: footer does not add up
+	archive := packed.Bytes()
+	damaged := append(append([]byte(nil), archive[:ArchiveHeader{Version: FORMAT_VERSION, Footer: true}.Size()]...),
+		archive[len(archive)-SIZEOF_INT64-len(FOOTER_MARKER)-4-HEADER_SIZE:]...)
+	if _, _, err := ReadFooter(bytes.NewReader(damaged), int64(len(damaged))); !errors.Is(err, ErrCorruptInput) {
+		t.Errorf("Expected ErrCorruptInput; got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package pack
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidFlushBytes = errors.New("logpack: invalid number of bytes to flush after")
+
+// Options of NewFrameWriter()
+type FrameOptions struct {
+	Options
+	// Pending records are packed once they take at least that many bytes (newlines included).
+	// 0 means MAX_CHUNK_SIZE: a frame is then usually a single chunk.
+	FlushBytes int
+	// If > 0 pending records are packed also once there are that many of them, however small.
+	FlushRecords int
+}
+
+/*
+FrameWriter is the record-oriented counterpart of Writer for log collectors: it takes discrete records (eg. messages
+of a gRPC stream) rather than a byte stream, and leaves shipping of packed bytes to the caller.
+
+Every record is a line: '\n' (or Options.RecordSeparator) is appended unless the record ends with it (newlines within
+a record make more lines).
+Records are packed into chunks once FrameOptions.FlushBytes or FlushRecords is reached, or on Flush(). Take packed
+chunks with TakePacked(). Chunks do not refer lines of each other, so bytes of every take unpack on their own
+(with Decompress()); concatenated they make a headerless archive (version 0) readable by Reader.
+Headerless bytes do not tell the separator though: with Options.RecordSeparator set, unpack takes with
+DecompressOpts() given the same DecompressOptions.RecordSeparator, or with Scratch.SetRecordSeparator().
+*/
+type FrameWriter struct {
+	compressor   *Compressor
+	flushBytes   int
+	flushRecords int
+	separator    byte
+	// raw records waiting to be packed
+	pending        []byte
+	pendingRecords int
+	// chunks not taken yet
+	packed []byte
+}
+
+// Returns a FrameWriter or an error if opts are invalid.
+func NewFrameWriter(opts FrameOptions) (*FrameWriter, error) {
+	if opts.FlushBytes < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidFlushBytes, opts.FlushBytes)
+	}
+	if opts.FlushRecords < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidFlushEveryLines, opts.FlushRecords)
+	}
+	compressor, err := NewCompressor(opts.Options)
+	if err != nil {
+		return nil, err
+	}
+	flushBytes := opts.FlushBytes
+	if flushBytes == 0 {
+		flushBytes = MAX_CHUNK_SIZE
+	}
+	return &FrameWriter{compressor: compressor, flushBytes: flushBytes, flushRecords: opts.FlushRecords,
+		separator: recordSeparator(opts.RecordSeparator)}, nil
+}
+
+// Adds record as a line and packs pending records if a threshold is reached.
+func (fw *FrameWriter) WriteRecord(record []byte) {
+	fw.pending = append(fw.pending, record...)
+	if len(record) == 0 || record[len(record)-1] != fw.separator {
+		fw.pending = append(fw.pending, fw.separator)
+	}
+	fw.pendingRecords++
+	if len(fw.pending) >= fw.flushBytes || fw.flushRecords > 0 && fw.pendingRecords >= fw.flushRecords {
+		fw.Flush()
+	}
+}
+
+// Packs all pending records, however few.
+func (fw *FrameWriter) Flush() {
+	for src := fw.pending; len(src) > 0; {
+		if cap(fw.packed)-len(fw.packed) < DecompressBound() {
+			fw.packed = append(make([]byte, 0, 2*cap(fw.packed)+DecompressBound()), fw.packed...)
+		}
+		read, written := fw.compressor.Compress(fw.packed[len(fw.packed):cap(fw.packed)], src)
+		fw.packed = fw.packed[:len(fw.packed)+written]
+		src = src[read:]
+	}
+	fw.pending = fw.pending[:0]
+	fw.pendingRecords = 0
+}
+
+// Number of records written but not packed yet.
+func (fw *FrameWriter) PendingRecords() int {
+	return fw.pendingRecords
+}
+
+// Returns chunks packed since the last call (nil if none) - bytes to ship. They are valid until the next call
+// of WriteRecord() or Flush().
+func (fw *FrameWriter) TakePacked() []byte {
+	if len(fw.packed) == 0 {
+		return nil
+	}
+	packed := fw.packed
+	fw.packed = fw.packed[:0]
+	return packed
+}
@@ -0,0 +1,104 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func unpackFrame(t *testing.T, frame []byte) string {
+	unpacked := make([]byte, 4*MAX_CHUNK_SIZE)
+	_, written, err := DecompressOpts(unpacked, frame, DecompressOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(unpacked[:written])
+}
+
+func TestFrameWriterFlushesEveryRecords(t *testing.T) {
+	fw, err := NewFrameWriter(FrameOptions{FlushRecords: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []string
+	for i := 0; i < 10; i++ {
+		record := fmt.Sprintf("2024-05-17 12:00:%02d INFO request %d served", i, i)
+		// records may end with a newline already
+		if i%2 == 0 {
+			record += "\n"
+		}
+		fw.WriteRecord([]byte(record))
+		if frame := fw.TakePacked(); frame != nil {
+			frames = append(frames, unpackFrame(t, frame))
+		}
+	}
+	if len(frames) != 3 || fw.PendingRecords() != 1 {
+		t.Fatalf("Expected 3 frames and 1 pending record; got %d and %d", len(frames), fw.PendingRecords())
+	}
+	fw.Flush()
+	frames = append(frames, unpackFrame(t, fw.TakePacked()))
+
+	for i, frame := range frames {
+		records := strings.SplitAfter(frame, "\n")
+		for j, record := range records[:len(records)-1] {
+			n := 3*i + j
+			if expected := fmt.Sprintf("2024-05-17 12:00:%02d INFO request %d served\n", n, n); record != expected {
+				t.Errorf("Frame %d, record %d: expected %q; got %q", i, j, expected, record)
+			}
+		}
+	}
+	if fw.TakePacked() != nil {
+		t.Errorf("Nothing should be left to take")
+	}
+}
+
+func TestFrameWriterFlushesOnSize(t *testing.T) {
+	fw, _ := NewFrameWriter(FrameOptions{FlushBytes: 1000})
+	record := []byte(strings.Repeat("x", 99))
+	var shipped bytes.Buffer
+	for i := 0; i < 25; i++ {
+		fw.WriteRecord(record)
+		if frame := fw.TakePacked(); frame != nil {
+			if i%10 != 9 {
+				t.Errorf("Frame after record %d; expected after every 1000 bytes (10 records)", i)
+			}
+			shipped.Write(frame)
+		}
+	}
+	fw.Flush()
+	shipped.Write(fw.TakePacked())
+
+	// frames concatenated make a headerless archive
+	var unpacked bytes.Buffer
+	if _, err := DecompressTo(&unpacked, &shipped); err != nil || unpacked.String() != strings.Repeat(string(record)+"\n", 25) {
+		t.Errorf("Unpacked %d bytes; err: %v", unpacked.Len(), err)
+	}
+}
+
+func TestFrameWriterPacksRecordsBiggerThanChunk(t *testing.T) {
+	fw, _ := NewFrameWriter(FrameOptions{Options: Options{CompressionLevel: COMPRESSION_LEVEL_BEST}})
+	big := []byte(strings.Repeat("big record ", MAX_CHUNK_SIZE/5))
+	fw.WriteRecord(big)
+	fw.WriteRecord(nil)
+	fw.Flush()
+	if frame := unpackFrame(t, fw.TakePacked()); frame != string(big)+"\n\n" {
+		t.Errorf("Unpacked %d bytes; expected %d", len(frame), len(big)+2)
+	}
+}
+
+func TestNewFrameWriterRejectsInvalidOptions(t *testing.T) {
+	for _, tc := range []struct {
+		opts     FrameOptions
+		expected error
+	}{
+		{FrameOptions{FlushBytes: -1}, ErrInvalidFlushBytes},
+		{FrameOptions{FlushRecords: -1}, ErrInvalidFlushEveryLines},
+		{FrameOptions{Options: Options{CompressionLevel: 10}}, ErrInvalidCompressionLevel},
+	} {
+		if _, err := NewFrameWriter(tc.opts); !errors.Is(err, tc.expected) {
+			t.Errorf("%+v: expected %v; got %v", tc.opts, tc.expected, err)
+		}
+	}
+}
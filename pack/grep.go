@@ -0,0 +1,60 @@
+package pack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+/*
+Unpacks src (sequence of chunks, as Decompress() takes) and passes lines that re matches to fn along with their
+numbers in the unpacked content, counted from 1 across chunks - the way grep -n reports them. Lines are matched
+and passed without their '\n'; a line cut between chunks is matched once whole. Line is valid until fn returns only
+- its memory is reused. Chunks are unpacked one at a time, so memory taken is about the biggest chunk plus the
+longest line.
+
+Returns the first error fn returns (which stops unpacking) or an error of unpacking as in DecompressOpts():
+ErrCorruptInput, io.ErrUnexpectedEOF for an incomplete last chunk or ErrTrailingBytes. fn gets matches of the chunks
+before the error.
+*/
+func GrepLines(src []byte, re *regexp.Regexp, fn func(lineNo int, line []byte) error) error {
+	var scratch Scratch
+	var lines lineScanner
+	unpacked := make([]byte, DecompressBound())
+	lineNo := 0
+	match := func(line []byte) error {
+		lineNo++
+		if line = bytes.TrimSuffix(line, []byte{'\n'}); re.Match(line) {
+			return fn(lineNo, line)
+		}
+		return nil
+	}
+
+	for len(src) >= HEADER_SIZE {
+		// one chunk at a time, so that matches of valid chunks come before an error
+		chunkSize, _ := readHeader(src)
+		read, written := DecompressWith(unpacked, src[:min(len(src), HEADER_SIZE+chunkSize)], &scratch)
+		switch read {
+		case CORRUPT_INPUT:
+			return ErrCorruptInput
+		case NOT_ENOUGH_INPUT:
+			return io.ErrUnexpectedEOF
+		}
+		src = src[read:]
+
+		lines.feed(unpacked[:written])
+		for line, ok := lines.next(); ok; line, ok = lines.next() {
+			if err := match(line); err != nil {
+				return err
+			}
+		}
+	}
+	if len(src) > 0 {
+		return fmt.Errorf("%w: %d bytes", ErrTrailingBytes, len(src))
+	}
+	if last := lines.Remaining(); len(last) > 0 {
+		return match(last)
+	}
+	return nil
+}
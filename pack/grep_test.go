@@ -0,0 +1,94 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+type grepMatch struct {
+	lineNo int
+	line   string
+}
+
+func grepAll(src []byte, pattern string) (matches []grepMatch, err error) {
+	err = GrepLines(src, regexp.MustCompile(pattern), func(lineNo int, line []byte) error {
+		matches = append(matches, grepMatch{lineNo, string(line)})
+		return nil
+	})
+	return matches, err
+}
+
+func TestGrepLinesNumbersLinesAcrossChunks(t *testing.T) {
+	var input strings.Builder
+	for i := 1; i <= 20000; i++ {
+		fmt.Fprintf(&input, "2024-05-17 12:00:00 INFO request %d served in %d ms\n", i, i%97)
+	}
+	input.WriteString("last line without newline 42")
+	packed := make([]byte, 2*input.Len()+DecompressBound())
+	packed = packed[:packBufferWithOptions([]byte(input.String()), packed, Options{})]
+	if chunks, _ := ChunkMetadata(packed); len(chunks) < 3 {
+		t.Fatalf("Expected several chunks; got %d", len(chunks))
+	}
+
+	re := regexp.MustCompile(`request \d*7 served in 13 ms$|without newline`)
+	matches, err := grepAll(packed, re.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// what grep -n finds in the unpacked input
+	var expected []grepMatch
+	for i, line := range strings.SplitAfter(input.String(), "\n") {
+		if line = strings.TrimSuffix(line, "\n"); re.MatchString(line) {
+			expected = append(expected, grepMatch{i + 1, line})
+		}
+	}
+	if fmt.Sprint(matches) != fmt.Sprint(expected) {
+		t.Errorf("Expected %d matches %v; got %d: %v", len(expected), expected, len(matches), matches)
+	}
+	if last := expected[len(expected)-1]; last.lineNo != 20001 {
+		t.Errorf("Expected the last line matched; got %v", last)
+	}
+}
+
+// Line cut between chunks is matched once, whole.
+func TestGrepLinesMatchesLineCutBetweenChunks(t *testing.T) {
+	long := strings.Repeat("x", 3*MAX_CHUNK_SIZE)
+	input := []byte("first\n" + long + "needle\nlast\n")
+	packed := make([]byte, 2*len(input)+DecompressBound())
+	packed = packed[:packBufferWithOptions(input, packed, Options{})]
+
+	matches, err := grepAll(packed, `^x+needle$`)
+	if err != nil || len(matches) != 1 || matches[0] != (grepMatch{2, long + "needle"}) {
+		t.Errorf("Expected line 2 matched once; got %d matches, err: %v", len(matches), err)
+	}
+	if matches, err := grepAll(packed, `^last$`); err != nil || len(matches) != 1 || matches[0].lineNo != 3 {
+		t.Errorf("Expected line 3; got %v, err: %v", matches, err)
+	}
+}
+
+func TestGrepLinesStopsAtErrors(t *testing.T) {
+	input := bytes.Repeat([]byte("some line\n"), 10000)
+	packed := make([]byte, 2*len(input)+DecompressBound())
+	packed = packed[:packBufferWithOptions(input, packed, Options{})]
+
+	errStop := errors.New("stop")
+	calls := 0
+	err := GrepLines(packed, regexp.MustCompile("line"), func(int, []byte) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Errorf("Expected errStop after 1 call; got %v after %d", err, calls)
+	}
+	if _, err := grepAll(packed[:len(packed)-1], "line"); err != io.ErrUnexpectedEOF {
+		t.Errorf("Truncated: expected io.ErrUnexpectedEOF; got %v", err)
+	}
+	if _, err := grepAll(append(packed, 1), "line"); !errors.Is(err, ErrTrailingBytes) {
+		t.Errorf("Trailing byte: expected ErrTrailingBytes; got %v", err)
+	}
+}
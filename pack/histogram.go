@@ -0,0 +1,33 @@
+package pack
+
+// Returns how many times each distance to the referred line (linesBefore) was chosen when packing src at given
+// compression level. Index 0 counts lines that refer nothing - first lines of chunks. Sum of the histogram is
+// the number of lines of src.
+// Distances close to the window size of the level (see compressionLevelPresets) hint that a bigger window would help.
+func ReferenceHistogram(src []byte, compressionLevel int) (histogram [MAX_BACKREFERENCE_CAPACITY + 1]int) {
+	compressionParams := getCompressionParameters(compressionLevel)
+	dst := make([]byte, DecompressBound())
+
+	// chunks are cut by Compress() itself so that references are chosen among the same lines
+	for len(src) > 0 {
+		read, _ := compress(dst, src, compressionParams, MAX_SIMILARITY)
+		countReferences(src[:read], compressionParams, &histogram)
+		src = src[read:]
+	}
+	return histogram
+}
+
+// Chooses references for lines of one chunk the same way compress() does.
+func countReferences(chunk []byte, compressionParams compressionParameters, histogram *[MAX_BACKREFERENCE_CAPACITY + 1]int) {
+	backref := backrefBuffer{capacity: int(compressionParams.backreferenceCapacity)}
+
+	firstLine, chunk := nextLine(chunk)
+	backref.add(firstLine)
+	histogram[0]++
+
+	for currLine, chunk := nextLine(chunk); len(currLine) > 0; currLine, chunk = nextLine(chunk) {
+		lineRef := backref.chooseReferenceLine(currLine, compressionParams.goodEnoughPercent, MAX_SIMILARITY)
+		histogram[lineRef.linesBefore]++
+		backref.add(currLine)
+	}
+}
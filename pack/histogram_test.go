@@ -0,0 +1,39 @@
+package pack
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReferenceHistogramCountsEveryLine(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	dir := path_defaultLoghubCorpus + "apache/"
+	inputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+	input := inputBuff[:inputSize]
+
+	histogram := ReferenceHistogram(input, COMPRESSION_LEVEL_BEST)
+	sum := 0
+	for _, count := range histogram {
+		sum += count
+	}
+	lines := bytes.Count(input, []byte{'\n'})
+	if input[len(input)-1] != '\n' {
+		lines++
+	}
+	if sum != lines {
+		t.Errorf("Expected %d lines in histogram; got %d", lines, sum)
+	}
+	t.Logf("apache, level 9: %v", histogram)
+}
+
+func TestReferenceHistogramFindsPeriodicLines(t *testing.T) {
+	// every line is the same as 3 lines before
+	input := []byte(strings.Repeat("first kind of line\nsecond sort\nthird line type here\n", 100))
+
+	histogram := ReferenceHistogram(input, COMPRESSION_LEVEL_BEST)
+	// first line of the chunk refers nothing; next two have nothing alike 3 lines before
+	if histogram[0] != 1 || histogram[1]+histogram[2] != 2 || histogram[3] != 297 {
+		t.Errorf("Unexpected histogram: %v", histogram[:4])
+	}
+}
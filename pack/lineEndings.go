@@ -0,0 +1,51 @@
+package pack
+
+import (
+	"bytes"
+)
+
+// Counts of line endings found by AnalyzeLineEndings()
+type LineEndingStats struct {
+	// lines ending with "\n" not preceded by '\r'
+	LF int
+	// lines ending with "\r\n"
+	CRLF int
+}
+
+// Counts lines of src ending with "\n" and "\r\n". Incomplete last line is not counted.
+// It's a read-only pass for diagnostics: lines ending differently do not share the ending, which spoils matching
+// (eg. a line ending with "\r\n" cannot be fully copied from a line ending with "\n").
+func AnalyzeLineEndings(src []byte) (stats LineEndingStats) {
+	for lineEnd := bytes.IndexByte(src, '\n'); lineEnd >= 0; lineEnd = bytes.IndexByte(src, '\n') {
+		if lineEnd > 0 && src[lineEnd-1] == '\r' {
+			stats.CRLF++
+		} else {
+			stats.LF++
+		}
+		src = src[lineEnd+1:]
+	}
+	return stats
+}
+
+// Sum of stats of consecutive parts of input.
+func (stats LineEndingStats) Add(other LineEndingStats) LineEndingStats {
+	return LineEndingStats{LF: stats.LF + other.LF, CRLF: stats.CRLF + other.CRLF}
+}
+
+// Number of lines counted
+func (stats LineEndingStats) Lines() int {
+	return stats.LF + stats.CRLF
+}
+
+// Fraction of lines ending with "\r\n" (0 if there are no lines).
+func (stats LineEndingStats) CRLFFraction() float64 {
+	if stats.Lines() == 0 {
+		return 0
+	}
+	return float64(stats.CRLF) / float64(stats.Lines())
+}
+
+// True if all lines end the same way.
+func (stats LineEndingStats) Consistent() bool {
+	return stats.LF == 0 || stats.CRLF == 0
+}
@@ -0,0 +1,28 @@
+package pack
+
+import (
+	"testing"
+)
+
+func TestAnalyzeLineEndings(t *testing.T) {
+	testCases := []struct {
+		src        string
+		expected   LineEndingStats
+		consistent bool
+	}{
+		{"", LineEndingStats{}, true},
+		{"no line end", LineEndingStats{}, true},
+		{"a\nb\n\n", LineEndingStats{LF: 3}, true},
+		{"a\r\n\r\nlast\r", LineEndingStats{CRLF: 2}, true},
+		{"\r\na\n\rb\nc\r\r\n", LineEndingStats{LF: 2, CRLF: 2}, false},
+	}
+	for _, tc := range testCases {
+		stats := AnalyzeLineEndings([]byte(tc.src))
+		if stats != tc.expected || stats.Consistent() != tc.consistent {
+			t.Errorf("%q: expected %+v (consistent: %t); got %+v", tc.src, tc.expected, tc.consistent, stats)
+		}
+	}
+	if fraction := (LineEndingStats{LF: 3, CRLF: 1}).CRLFFraction(); fraction != 0.25 {
+		t.Errorf("Expected CRLF fraction 0.25; got %f", fraction)
+	}
+}
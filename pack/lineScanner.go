@@ -0,0 +1,48 @@
+package pack
+
+import "bytes"
+
+// Splits data arriving in pieces of any size (eg. successive Write() calls) into complete lines, looking at every
+// byte once. Lines within a piece are returned as slices of it; only a line cut between pieces is copied - into
+// the carry buffer, until the piece with its end arrives.
+type lineScanner struct {
+	// beginning of the line cut at the end of previous pieces
+	carry []byte
+	// not yet scanned rest of the current piece
+	piece []byte
+	// lines end with it (see Options.RecordSeparator); 0 for '\n'
+	separator byte
+}
+
+// Makes p the piece to scan. Lines of the previous piece must have been taken (next() returned false).
+func (s *lineScanner) feed(p []byte) {
+	s.piece = p
+}
+
+// Returns the next complete line including '\n' (or the separator), or false once the piece ends without completing
+// a line - its tail is then carried over to the next piece. Line is valid until the next call: it may be the carry
+// buffer.
+func (s *lineScanner) next() (line []byte, ok bool) {
+	lineEnd := bytes.IndexByte(s.piece, recordSeparator(s.separator))
+	if lineEnd < 0 {
+		s.carry = append(s.carry, s.piece...)
+		s.piece = nil
+		return nil, false
+	}
+	line, s.piece = s.piece[:lineEnd+1], s.piece[lineEnd+1:]
+	if len(s.carry) > 0 {
+		line = append(s.carry, line...)
+		s.carry = line[:0]
+	}
+	return line, true
+}
+
+// Incomplete line carried over so far, eg. the tail of input to handle on Close(). It stays carried until reset().
+func (s *lineScanner) Remaining() []byte {
+	return s.carry
+}
+
+// Drops the carried line. Its rest (up to '\n') is still returned by next() as a line of its own.
+func (s *lineScanner) reset() {
+	s.carry = s.carry[:0]
+}
@@ -0,0 +1,95 @@
+package pack
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// Feeds pieces to s and returns lines it yields concatenated with "|" after each
+func scanPieces(s *lineScanner, pieces ...[]byte) string {
+	var sb strings.Builder
+	for _, piece := range pieces {
+		s.feed(piece)
+		for line, ok := s.next(); ok; line, ok = s.next() {
+			sb.Write(line)
+			sb.WriteString("|")
+		}
+	}
+	return sb.String()
+}
+
+func TestLineScannerYieldsLinesCutAtAnyByte(t *testing.T) {
+	input := []byte("first\n\nthird line\nx\nunfinished")
+	expected := "first\n|\n|third line\n|x\n|"
+
+	for cut1 := 0; cut1 <= len(input); cut1++ {
+		for cut2 := cut1; cut2 <= len(input); cut2++ {
+			var s lineScanner
+			lines := scanPieces(&s, input[:cut1], input[cut1:cut2], input[cut2:])
+			if lines != expected || string(s.Remaining()) != "unfinished" {
+				t.Errorf("Cut at %d and %d: got lines %q and remaining %q", cut1, cut2, lines, s.Remaining())
+			}
+		}
+	}
+}
+
+func TestLineScannerReturnsLinesOfPieceWithoutCopying(t *testing.T) {
+	var s lineScanner
+	piece := []byte("a\nb\n")
+	s.feed(piece)
+	line, _ := s.next()
+	if &line[0] != &piece[0] {
+		t.Errorf("Line within the piece was copied")
+	}
+	if s.next(); s.carry != nil {
+		t.Errorf("Nothing should be carried; got %q", s.carry)
+	}
+}
+
+func TestLineScannerMatchesSplitOfRandomPieces(t *testing.T) {
+	r := rand.New(rand.NewSource(11))
+	input := randomTextWithLongLines(11)
+	expected := bytes.SplitAfter(input, []byte{'\n'})
+	tail := expected[len(expected)-1]
+
+	var s lineScanner
+	var pieces [][]byte
+	for rest := input; len(rest) > 0; {
+		size := min2(1+r.Intn(300), len(rest))
+		pieces, rest = append(pieces, rest[:size]), rest[size:]
+	}
+	lines := scanPieces(&s, pieces...)
+	if lines != string(bytes.Join(expected[:len(expected)-1], []byte("|")))+"|" || !bytes.Equal(s.Remaining(), tail) {
+		t.Errorf("Lines of %d pieces do not match the input", len(pieces))
+	}
+}
+
+func TestLineScannerResetKeepsRestOfLine(t *testing.T) {
+	var s lineScanner
+	scanPieces(&s, []byte("done\nhead of "))
+	s.reset()
+	if lines := scanPieces(&s, []byte("line\nnext")); lines != "line\n|" || string(s.Remaining()) != "next" {
+		t.Errorf("Got lines %q and remaining %q", lines, s.Remaining())
+	}
+}
+
+func TestWriterFlushingEveryLinesPacksLongLineAsItComes(t *testing.T) {
+	var packed bytes.Buffer
+	w, _ := NewWriterOpts(&packed, WriterOptions{FlushEveryLines: 10})
+	line := []byte(strings.Repeat("long line without end ", MAX_CHUNK_SIZE/5))
+	for i := 0; i < len(line); i += 1000 {
+		w.Write(line[i:min2(i+1000, len(line))])
+	}
+	if packed.Len() == 0 {
+		t.Errorf("Nothing of %d bytes of incomplete line packed", len(line))
+	}
+	w.Write([]byte("\n"))
+	w.Close()
+
+	var unpacked bytes.Buffer
+	if _, err := DecompressTo(&unpacked, &packed); err != nil || unpacked.String() != string(line)+"\n" {
+		t.Errorf("Unpacked %d bytes; err: %v", unpacked.Len(), err)
+	}
+}
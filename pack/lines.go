@@ -0,0 +1,61 @@
+//go:build go1.23
+
+package pack
+
+import (
+	"fmt"
+	"io"
+	"iter"
+)
+
+/*
+Returns an iterator over lines src (sequence of chunks, as Decompress() takes) unpacks to:
+
+	for line, err := range pack.Lines(src) {
+		if err != nil {
+			return err
+		}
+		...
+	}
+
+Chunks are unpacked one at a time, as the loop gets to them. Every line ends with '\n' except possibly the last one.
+Line is valid until the next iteration only - its memory is reused; copy it to keep it.
+Error (ErrCorruptInput, io.ErrUnexpectedEOF for an incomplete last chunk or ErrTrailingBytes, as in
+DecompressOpts()) is yielded once, after lines of the chunks before it, and ends the iteration.
+*/
+func Lines(src []byte) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		var scratch Scratch
+		var lines lineScanner
+		unpacked := make([]byte, DecompressBound())
+
+		for len(src) >= HEADER_SIZE {
+			// one chunk at a time, so that lines of valid chunks come before an error
+			chunkSize, _ := readHeader(src)
+			read, written := DecompressWith(unpacked, src[:min(len(src), HEADER_SIZE+chunkSize)], &scratch)
+			switch read {
+			case CORRUPT_INPUT:
+				yield(nil, ErrCorruptInput)
+				return
+			case NOT_ENOUGH_INPUT:
+				yield(nil, io.ErrUnexpectedEOF)
+				return
+			}
+			src = src[read:]
+
+			lines.feed(unpacked[:written])
+			for line, ok := lines.next(); ok; line, ok = lines.next() {
+				if !yield(line, nil) {
+					return
+				}
+			}
+		}
+		if len(src) > 0 {
+			yield(nil, fmt.Errorf("%w: %d bytes", ErrTrailingBytes, len(src)))
+			return
+		}
+		if last := lines.Remaining(); len(last) > 0 {
+			yield(last, nil)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+//go:build go1.23
+
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func collectLines(src []byte) (lines [][]byte, err error) {
+	for line, err := range Lines(src) {
+		if err != nil {
+			return lines, err
+		}
+		lines = append(lines, bytes.Clone(line))
+	}
+	return lines, nil
+}
+
+func TestLinesYieldsLinesOfEveryChunk(t *testing.T) {
+	for _, input := range [][]byte{
+		randomTextWithLongLines(3),
+		[]byte("no newline at the end\nlast"),
+		[]byte("\n\n"),
+		nil,
+	} {
+		packedBuff := make([]byte, 2*len(input)+DecompressBound())
+		packed := packedBuff[:PackBuffer(input, packedBuff, COMPRESSION_LEVEL_DEFAULT)]
+
+		lines, err := collectLines(packed)
+		expected := bytes.SplitAfter(input, []byte{'\n'})
+		if len(expected[len(expected)-1]) == 0 {
+			expected = expected[:len(expected)-1]
+		}
+		if err != nil || len(lines) != len(expected) {
+			t.Fatalf("Expected %d lines; got %d, err: %v", len(expected), len(lines), err)
+		}
+		for i := range lines {
+			if !bytes.Equal(lines[i], expected[i]) {
+				t.Fatalf("Line %d: expected %d bytes %.40q...; got %d bytes %.40q...", i, len(expected[i]), expected[i],
+					len(lines[i]), lines[i])
+			}
+		}
+	}
+}
+
+func TestLinesStopsOnBreak(t *testing.T) {
+	packed := make([]byte, DecompressBound())
+	_, written := Compress(packed, []byte("first\nsecond\nthird\n"), COMPRESSION_LEVEL_DEFAULT)
+	count := 0
+	for range Lines(packed[:written]) {
+		if count++; count == 2 {
+			break
+		}
+	}
+	if count != 2 {
+		t.Errorf("Expected iteration to stop after 2 lines; got %d", count)
+	}
+}
+
+func TestLinesYieldsErrorAfterLinesOfValidChunks(t *testing.T) {
+	packed := make([]byte, 2*DecompressBound())
+	_, written := Compress(packed, []byte("first\nsecond\n"), COMPRESSION_LEVEL_DEFAULT)
+	_, secondWritten := Compress(packed[written:], []byte("third\n"), COMPRESSION_LEVEL_DEFAULT)
+	// second chunk refers a line before its first one
+	corrupt := append(packed[:written:written], craftChunk([]byte{ESCAPE_BYTE + 1, '\n'}, 10)...)
+
+	for _, tc := range []struct {
+		src      []byte
+		expected error
+	}{
+		{corrupt, ErrCorruptInput},
+		{packed[:written+secondWritten-1], io.ErrUnexpectedEOF},
+		{packed[:written+HEADER_SIZE-1], ErrTrailingBytes},
+	} {
+		lines, err := collectLines(tc.src)
+		if !errors.Is(err, tc.expected) || len(lines) != 2 {
+			t.Errorf("Expected 2 lines and %v; got %d lines and %v", tc.expected, len(lines), err)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package pack
+
+import (
+	"fmt"
+	"io"
+)
+
+// Unpacks every archive of srcs and packs the concatenation of their contents into a single archive written to dst.
+// Unlike concatenated archives, merged one can refer lines across boundaries of the original files, which compresses
+// better eg. for rotated logs. It is packed at the highest compression level stored in srcs
+// (COMPRESSION_LEVEL_DEFAULT if none of them stores it). Digests and timestamp encoding of srcs are not carried over.
+func Merge(dst io.Writer, srcs ...io.Reader) error {
+	readers := make([]*Reader, len(srcs))
+	compressionLevel := 0
+	for i, src := range srcs {
+		r, err := NewReader(src)
+		if err != nil {
+			return fmt.Errorf("archive %d: %w", i, err)
+		}
+		readers[i] = r
+		compressionLevel = max(compressionLevel, r.Level())
+	}
+
+	w := NewWriter(dst, compressionLevel)
+	for i, r := range readers {
+		if _, err := io.Copy(w, r); err != nil {
+			return fmt.Errorf("archive %d: %w", i, err)
+		}
+	}
+	return w.Close()
+}
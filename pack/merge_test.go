@@ -0,0 +1,68 @@
+package pack
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestMergeUnpacksToConcatenation(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	dir := path_defaultLoghubCorpus + "apache/"
+	inputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+	input := inputBuff[:inputSize]
+
+	// like rotated logs; the last part is not split on a line boundary
+	parts := [][]byte{input[:inputSize/3], input[inputSize/3 : 2*inputSize/3], input[2*inputSize/3:]}
+	parts[0] = parts[0][:bytes.LastIndexByte(parts[0], '\n')+1]
+	parts[1] = input[len(parts[0]) : 2*inputSize/3]
+
+	var srcs []io.Reader
+	naiveSize := 0
+	for i, part := range parts {
+		var packed bytes.Buffer
+		if i == 1 {
+			// headerless archive
+			packedPart := make([]byte, test_compression_bound_bytes)
+			packed.Write(packedPart[:PackBuffer(part, packedPart, COMPRESSION_LEVEL_DEFAULT)])
+		} else {
+			w := NewWriter(&packed, 2*i+1)
+			w.Write(part)
+			w.Close()
+		}
+		naiveSize += packed.Len()
+		srcs = append(srcs, &packed)
+	}
+
+	var merged bytes.Buffer
+	if err := Merge(&merged, srcs...); err != nil {
+		t.Fatal(err)
+	}
+	mergedSize := merged.Len()
+
+	r, err := NewReader(&merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Level() != 5 {
+		t.Errorf("Expected the highest level of merged archives (5); got %d", r.Level())
+	}
+	unpacked, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertInversibility(t, "apache", inputBuff, unpacked, inputSize, len(unpacked))
+	t.Logf("merged: %d bytes, concatenated archives: %d bytes", mergedSize, naiveSize)
+}
+
+func TestMergeReportsDamagedArchive(t *testing.T) {
+	var packed bytes.Buffer
+	w := NewWriter(&packed, COMPRESSION_LEVEL_DEFAULT)
+	w.Write([]byte("some line\n"))
+	w.Close()
+	truncated := packed.Bytes()[:packed.Len()-1]
+
+	if err := Merge(io.Discard, bytes.NewReader(packed.Bytes()), bytes.NewReader(truncated)); err == nil {
+		t.Errorf("Merging truncated archive should fail")
+	}
+}
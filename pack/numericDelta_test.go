@@ -0,0 +1,164 @@
+package pack
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Lines with numbers that grow by small steps: sequence number, zero padded counter and ids of varying width.
+func incrementingIdsLog(lines int) []byte {
+	r := rand.New(rand.NewSource(3))
+	var sb strings.Builder
+	seq, counter, offset := 999990, 95, uint64(99999999999999990)
+	for i := 0; i < lines; i++ {
+		seq += 1 + r.Intn(3)
+		counter++
+		offset += uint64(r.Intn(200))
+		fmt.Fprintf(&sb, "2024-05-17 12:%02d:%02d INFO [worker-%d] req=%d seq=%05d offset=%d status=%d\n",
+			i/60%60, i%60, r.Intn(4), seq, counter, offset, []int{200, 200, 200, 404}[r.Intn(4)])
+	}
+	return []byte(sb.String())
+}
+
+func packWithOpts(t *testing.T, input []byte, opts WriterOptions) []byte {
+	var packed bytes.Buffer
+	if _, err := PackStream(&packed, bytes.NewReader(input), opts); err != nil {
+		t.Fatal(err)
+	}
+	return packed.Bytes()
+}
+
+func TestNumericDeltaRoundTrips(t *testing.T) {
+	dir := path_defaultLoghubCorpus + "apache/"
+	apache, _ := os.ReadFile(dir + findFirstLogFile(dir))
+	inputs := map[string][]byte{
+		"incrementing ids": incrementingIdsLog(20000),
+		"apache":           apache,
+		"carry and width":  []byte("n=9 x\nn=10 x\nn=0099,\nn=0100,\nn=199a\nn=200b\nid 7\nid 8 9\n1 a\n2 a\n"),
+		"too big":          []byte("a 999999999999999999 b\na 1000000000000000000 b\na 1000000000000000001 b\n"),
+		"decreasing":       []byte("req=105 ok\nreq=104 ok\nreq=300 ok\nreq=301\n"),
+	}
+	for name, input := range inputs {
+		for _, level := range []int{COMPRESSION_LEVEL_WORST, COMPRESSION_LEVEL_BEST} {
+			plain := packWithOpts(t, input, WriterOptions{Options: Options{CompressionLevel: level}})
+			packed := packWithOpts(t, input, WriterOptions{Options: Options{CompressionLevel: level, NumericDelta: true}})
+			if len(packed) > len(plain) {
+				t.Errorf("%s, level %d: %d bytes with numeric delta; %d without", name, level, len(packed), len(plain))
+			}
+			var unpacked bytes.Buffer
+			if _, err := DecompressTo(&unpacked, bytes.NewReader(packed)); err != nil || !bytes.Equal(unpacked.Bytes(), input) {
+				t.Errorf("%s, level %d: did not unpack to input; err: %v", name, level, err)
+			}
+			t.Logf("%s, level %d: %.2fx -> %.2fx", name, level,
+				float64(len(input))/float64(len(plain)), float64(len(input))/float64(len(packed)))
+		}
+	}
+}
+
+func TestNumericDeltaArchiveIsFlagged(t *testing.T) {
+	packed := packWithOpts(t, []byte("req=1 ok\nreq=2 ok\n"), WriterOptions{Options: Options{NumericDelta: true}})
+	if packed[len(ARCHIVE_MAGIC)+1]&FLAG_NUMERIC_DELTA == 0 {
+		t.Errorf("FLAG_NUMERIC_DELTA not set")
+	}
+	header, _, err := ReadArchiveHeader(packed)
+	if err != nil || !header.NumericDelta {
+		t.Errorf("Expected NumericDelta header; got %+v, err: %v", header, err)
+	}
+}
+
+func TestNumericDeltaWithoutNumberIsCorrupt(t *testing.T) {
+	unpackedBuff := make([]byte, DecompressBound())
+	for _, body := range [][]byte{
+		// keyLine has no number where the delta applies
+		{'a', ' ', 'b', '\n', ESCAPE_BYTE + 1, ESCAPE_BYTE + 2, ESCAPE_BYTE, 0, '\n'},
+		// first line has no keyLine
+		{'a', ESCAPE_BYTE, 0, '\n'},
+	} {
+		if read, _ := Decompress(unpackedBuff, craftChunk(body, 10)); read != CORRUPT_INPUT {
+			t.Errorf("Chunk %x should be corrupt. Result: %d", body, read)
+		}
+	}
+}
+
+// Lines of fields like "id=007xy" whose numbers grow, shrink or stay and whose prefixes and suffixes change at random,
+// each line derived from the previous one.
+func randomNumericFieldsLog(seed int64, lines int) []byte {
+	r := rand.New(rand.NewSource(seed))
+	const letters = "abxyz="
+	randomWord := func(maxLength int) string {
+		word := make([]byte, r.Intn(maxLength+1))
+		for i := range word {
+			word[i] = letters[r.Intn(len(letters))]
+		}
+		return string(word)
+	}
+	type field struct {
+		prefix, suffix string
+		number         uint64
+		width          int
+	}
+	fields := make([]field, 1+r.Intn(5))
+	var sb strings.Builder
+	for i := 0; i < lines; i++ {
+		for j := range fields {
+			f := &fields[j]
+			switch r.Intn(6) {
+			case 0:
+				f.prefix = randomWord(3)
+			case 1:
+				f.suffix = randomWord(3)
+			case 2:
+				f.number += uint64(r.Intn(2 * MAX_NUMERIC_DELTA))
+			case 3:
+				f.number = uint64(r.Int63n(1_000_000))
+				f.width = r.Intn(8)
+			}
+			if j > 0 {
+				sb.WriteString([]string{" ", " ", "  ", ""}[r.Intn(4)])
+			}
+			fmt.Fprintf(&sb, "%s%0*d%s", f.prefix, f.width, f.number, f.suffix)
+		}
+		sb.WriteByte('\n')
+	}
+	return []byte(sb.String())
+}
+
+func assertNumericDeltaRoundTrips(t *testing.T, name string, input []byte) {
+	for _, level := range []int{COMPRESSION_LEVEL_WORST, COMPRESSION_LEVEL_BEST} {
+		packed := make([]byte, 2*len(input)+DecompressBound())
+		packed = packed[:packBufferWithOptions(input, packed, Options{CompressionLevel: level, NumericDelta: true})]
+		var unpacked bytes.Buffer
+		if _, err := DecompressTo(&unpacked, bytes.NewReader(packed)); err != nil || !bytes.Equal(unpacked.Bytes(), input) {
+			t.Fatalf("%s, level %d: unpacked %q differs from %q; err: %v", name, level, limitSlice(unpacked.Bytes(), 200),
+				limitSlice(input, 200), err)
+		}
+	}
+}
+
+func TestNumericDeltaRoundTripsRandomFields(t *testing.T) {
+	testSeed := time.Now().UnixMicro()
+	for i := 0; i < number_of_random_cases; i++ {
+		assertNumericDeltaRoundTrips(t, fmt.Sprintf("seed %d", testSeed), randomNumericFieldsLog(testSeed, 200))
+		testSeed++
+	}
+}
+
+func FuzzNumericDeltaRoundTrips(f *testing.F) {
+	for _, seed := range []string{
+		// numbers followed by a space in the line packed, by other chars in the referred one
+		"a b007xy zz\na b100 zz\n",
+		"k=0007xyz w\nk=0100 w\n",
+		"a b007baz \na b100 \n",
+		"req=105 ok\nreq=204 ok\nreq=300x\nreq=399y\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		assertNumericDeltaRoundTrips(t, "fuzzed", input)
+	})
+}
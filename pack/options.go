@@ -0,0 +1,255 @@
+package pack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	ErrInvalidCompressionLevel  = errors.New("logpack: invalid compression level")
+	ErrInvalidMaxSimilarity     = errors.New("logpack: invalid max similarity")
+	ErrInvalidGoodEnoughPercent = errors.New("logpack: invalid good enough percent")
+	ErrInvalidFlushEveryLines   = errors.New("logpack: invalid number of lines to flush after")
+	ErrInvalidMaxDuration       = errors.New("logpack: invalid max duration")
+	ErrInvalidRecordSeparator   = errors.New("logpack: invalid record separator")
+)
+
+// Options of CompressOpts() (and NewWriterOpts() - see WriterOptions). Zero value selects defaults.
+type Options struct {
+	// COMPRESSION_LEVEL_WORST..COMPRESSION_LEVEL_BEST or 0 for COMPRESSION_LEVEL_DEFAULT.
+	// Unlike Compress(), CompressOpts() does not clamp levels out of that range but reports an error.
+	CompressionLevel int
+	// How many chars at the beginning of lines are compared when looking for the best line to refer; 0 for
+	// MAX_SIMILARITY. On long lines differing mostly near their ends higher values find better references
+	// at the cost of speed. It only guides the choice of reference - archive can be unpacked regardless of it.
+	MaxSimilarity int
+	// Search for the line to refer stops at the first line (most recent first) this similar to the line packed:
+	// percent of the best possible similarity score. 1..100 or 0 for the one of CompressionLevel (80 for levels 1-6,
+	// then 90, 95 and 100). Lower values pack faster and worse, especially with the big windows of high levels.
+	// Like MaxSimilarity it only guides the choice of reference.
+	GoodEnoughPercent int
+	// If > 0 Writer and Compressor stop compressing once they have spent that long since their first chunk:
+	// the rest of input is written as stored chunks (see Compress()), which takes no time but is not compressed
+	// at all. Time is checked before every chunk, so a single chunk in progress is always finished.
+	// Bounds time of packing pathological input in latency-sensitive jobs. CompressOpts() ignores it.
+	MaxDuration time.Duration
+	// Encode numbers that are bigger by 1..MAX_NUMERIC_DELTA than the number at the same spot of the referred line
+	// (sequence numbers, incrementing ids) as the delta: 2 bytes rather than the differing digits, used only when
+	// more than 2 digits differ. Eg. synthetic log with a sequence number, counter and 17-digit offset per line packs
+	// 6.63x instead of 6.49x (level 9); apache sample (hardly any such numbers) packs about the same. Lines unpack
+	// exactly as given: a number is left as digits wherever the delta would make the rest of line ambiguous.
+	// Archives can be read only by versions of the package that know the option: Writer marks them with
+	// FLAG_NUMERIC_DELTA, but chunks of CompressOpts() and Compressor are not marked in any way.
+	NumericDelta bool
+	// Byte lines (records) end with instead of '\n', eg. 0x1e (ASCII record separator) for records that contain
+	// newlines; 0 selects '\n'. Must be ASCII. Chunks unpack correctly only with the same separator: Writer stores
+	// it in the archive header (Reader picks it up); for chunks of CompressOpts() and Compressor give it to
+	// Scratch.SetRecordSeparator() or DecompressOptions.RecordSeparator. Can't be a digit along with NumericDelta:
+	// numbers would run across ends of lines.
+	RecordSeparator byte
+	// Compressor Writer runs packed chunks through (see SecondStage); must be registered with RegisterSecondStage().
+	// Nil for none. Archives can be read only by versions of the package that know the option, and only where
+	// the stage is registered. CompressOpts(), Compressor and FrameWriter ignore it: they produce bare chunks.
+	SecondStage SecondStage
+	// Sort lines of every chunk so that lines of the same message template (compared with digits ignored) are next
+	// to each other, and store the permutation restoring their order in the chunk (see SORTED_CHUNK_MARKER).
+	// It pays off for logs interleaving several kinds of messages (1 MB samples of loghub at the default level: mac
+	// 4.09x instead of 2.47x, apache 6.41x instead of 6.11x). The permutation takes a byte or two per line, so every
+	// chunk is packed both ways and the smaller one is kept - packing takes about twice as long.
+	// Archives can be read only by versions of the package that know the option: Writer marks them with
+	// FEATURE_SORTED_LINES (see ArchiveHeader.SortedLines), but chunks of CompressOpts() and Compressor are not marked.
+	SortLines bool
+	// Mark chunks packed from ASCII only (see ASCII_CHUNK_MARKER); chunks with non-ASCII bytes are packed as usual.
+	// It costs 2 bytes per chunk. Meant for tools that want to know which chunks are ASCII without unpacking them
+	// (see ChunkMetadata()), eg. to pick chunks a byte-oriented search can be run on. Unpacking rejects escaped bytes
+	// in marked chunks but is no faster: 1 MB samples of loghub (240 of 275 chunks marked) unpack at about 1450 MB/s
+	// either way (see BenchmarkUnpackAsciiChunks). Writer marks archives with FEATURE_ASCII_CHUNKS so that versions
+	// of the package not knowing the marker refuse them; chunks of CompressOpts() and Compressor are not marked.
+	MarkAsciiChunks bool
+	// Before scanning the backreference window for the line to refer, look up a line with the same first
+	// MAX_SIMILARITY chars (eg. the same line repeated) by its first INDEXED_PREFIX_SIZE bytes. Only level 9 stops
+	// the scan at such a line alone, so other levels ignore the option; output is the same either way. Reference
+	// search of a log of 50 lines repeated in turns is 15x faster at level 9, of 1 MB samples of loghub (which
+	// hardly repeat lines) about 3% slower - see BenchmarkIndexedSearch.
+	IndexedSearch bool
+}
+
+// Returns an error wrapping ErrInvalidCompressionLevel, ErrInvalidMaxSimilarity, ErrInvalidGoodEnoughPercent,
+// ErrInvalidMaxDuration, ErrInvalidRecordSeparator or ErrInvalidSecondStage if respective option is out of range
+// (or not registered).
+func (opts Options) Validate() error {
+	if opts.CompressionLevel < 0 || opts.CompressionLevel > COMPRESSION_LEVEL_BEST {
+		return fmt.Errorf("%w: %d (expected %d-%d or 0 for default)", ErrInvalidCompressionLevel,
+			opts.CompressionLevel, COMPRESSION_LEVEL_WORST, COMPRESSION_LEVEL_BEST)
+	}
+	if opts.MaxSimilarity < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidMaxSimilarity, opts.MaxSimilarity)
+	}
+	if opts.GoodEnoughPercent < 0 || opts.GoodEnoughPercent > 100 {
+		return fmt.Errorf("%w: %d (expected 1-100 or 0 for the one of the level)", ErrInvalidGoodEnoughPercent,
+			opts.GoodEnoughPercent)
+	}
+	if opts.MaxDuration < 0 {
+		return fmt.Errorf("%w: %v", ErrInvalidMaxDuration, opts.MaxDuration)
+	}
+	if opts.RecordSeparator >= ESCAPE_BYTE {
+		return fmt.Errorf("%w: 0x%02x (ASCII expected)", ErrInvalidRecordSeparator, opts.RecordSeparator)
+	}
+	if opts.NumericDelta && isDigit(opts.RecordSeparator) {
+		return fmt.Errorf("%w: %q (digit cannot end lines with numeric delta)", ErrInvalidRecordSeparator,
+			opts.RecordSeparator)
+	}
+	if opts.SecondStage != nil {
+		if err := validateSecondStageName(opts.SecondStage.Name()); err != nil {
+			return err
+		}
+		if _, err := lookupSecondStage(opts.SecondStage.Name()); err != nil {
+			return fmt.Errorf("%w: %q is not registered", ErrInvalidSecondStage, opts.SecondStage.Name())
+		}
+	}
+	return nil
+}
+
+// Tracks Options.MaxDuration. The clock starts at the first exceeded() call.
+type timeBudget struct {
+	limit time.Duration
+	start time.Time
+}
+
+// Whether more than limit has passed since the first call; always false without a limit.
+func (budget *timeBudget) exceeded() bool {
+	if budget.limit == 0 {
+		return false
+	}
+	if budget.start.IsZero() {
+		budget.start = time.Now()
+		return false
+	}
+	return time.Since(budget.start) > budget.limit
+}
+
+// Same as Compress() but with opts validated first. See doc of Compress() for meaning of arguments and results.
+func CompressOpts(dst, src []byte, opts Options) (bytesRead, bytesWritten int, err error) {
+	if err := opts.Validate(); err != nil {
+		return 0, 0, err
+	}
+	bytesRead, bytesWritten = compressSorted(dst, src, opts.chunkOptions())
+	return bytesRead, bytesWritten, nil
+}
+
+// Options that shape chunks resolved for compressSorted(); sorter (if any) is a new one.
+func (opts Options) chunkOptions() chunkOptions {
+	return chunkOptions{
+		compressionParams: opts.compressionParameters(),
+		maxSimilarity:     opts.maxSimilarity(),
+		numericDelta:      opts.NumericDelta,
+		separator:         recordSeparator(opts.RecordSeparator),
+		indexedSearch:     opts.IndexedSearch,
+		sorter:            newLineSorter(opts.SortLines),
+		markAscii:         opts.MarkAsciiChunks,
+	}
+}
+
+// Options.RecordSeparator (or ArchiveHeader.RecordSeparator) with 0 resolved to '\n'.
+func recordSeparator(separator byte) byte {
+	if separator == 0 {
+		return '\n'
+	}
+	return separator
+}
+
+// Options.RecordSeparator as stored in the archive header: 0 (no field) for '\n'.
+func headerRecordSeparator(separator byte) byte {
+	if separator == '\n' {
+		return 0
+	}
+	return separator
+}
+
+// Preset of opts.CompressionLevel with opts.GoodEnoughPercent (if set) in place of its own.
+func (opts Options) compressionParameters() compressionParameters {
+	params := getCompressionParameters(opts.CompressionLevel)
+	if opts.GoodEnoughPercent != 0 {
+		params.goodEnoughPercent = opts.GoodEnoughPercent
+	}
+	return params
+}
+
+// MaxSimilarity with 0 resolved to the default.
+func (opts Options) maxSimilarity() int {
+	if opts.MaxSimilarity == 0 {
+		return MAX_SIMILARITY
+	}
+	return opts.MaxSimilarity
+}
+
+var (
+	ErrTrailingBytes       = errors.New("logpack: trailing bytes after the last chunk")
+	ErrOutputLimitExceeded = errors.New("logpack: unpacked size exceeds the limit")
+)
+
+// Options of DecompressOpts(). Zero value is strict.
+type DecompressOptions struct {
+	// Ignore bytes after the last chunk that are too few to make up a chunk header (eg. padding added by
+	// some transport). By default they are reported as ErrTrailingBytes.
+	IgnoreTrailingBytes bool
+	// If > 0 unpacking stops with ErrOutputLimitExceeded before the chunk that would make the unpacked data
+	// bigger than MaxOutput bytes.
+	MaxOutput int
+	// Separator the chunks were compressed with (see Options.RecordSeparator); 0 for '\n'.
+	RecordSeparator byte
+}
+
+/*
+Unpacks the whole archive src (sequence of chunks, without archive header) into dst. Unlike Decompress(), which
+unpacks just as many chunks as there are in src, it takes src as complete, so anything left after the last chunk
+is an error:
+  - fewer than HEADER_SIZE bytes: ErrTrailingBytes (unless opts.IgnoreTrailingBytes - then bytesRead excludes them)
+  - incomplete chunk: io.ErrUnexpectedEOF
+
+Other errors are ErrCorruptInput, io.ErrShortBuffer if unpacked archive does not fit in dst and
+ErrOutputLimitExceeded if it would exceed opts.MaxOutput. Unpacked data is in dst[:bytesWritten] even on error.
+
+A chunk is unpacked only if all of it fits: dst of exactly the unpacked size is enough, one byte less is not.
+io.ErrShortBuffer tells how many more bytes the chunk that did not fit needs (eg. "short buffer: 1 bytes more
+needed for chunk at 0").
+*/
+func DecompressOpts(dst, src []byte, opts DecompressOptions) (bytesRead, bytesWritten int, err error) {
+	var scratch Scratch
+	scratch.SetRecordSeparator(opts.RecordSeparator)
+	// chunks declare their unpacked size upfront, so a chunk exceeding the limit is never unpacked
+	limitedDst := dst
+	if opts.MaxOutput > 0 && opts.MaxOutput < len(dst) {
+		limitedDst = dst[:opts.MaxOutput]
+	}
+	for len(src)-bytesRead >= HEADER_SIZE {
+		read, written := DecompressWith(limitedDst[bytesWritten:], src[bytesRead:], &scratch)
+		switch read {
+		case CORRUPT_INPUT:
+			return bytesRead, bytesWritten, ErrCorruptInput
+		case NOT_ENOUGH_INPUT:
+			return bytesRead, bytesWritten, io.ErrUnexpectedEOF
+		case NOT_ENOUGH_OUTPUT_SPACE:
+			if len(limitedDst) < len(dst) {
+				return bytesRead, bytesWritten, fmt.Errorf("%w: %d bytes", ErrOutputLimitExceeded, opts.MaxOutput)
+			}
+			_, rawSize := readHeader(src[bytesRead:])
+			return bytesRead, bytesWritten, fmt.Errorf("%w: %d bytes more needed for chunk at %d", io.ErrShortBuffer,
+				rawSize-(len(dst)-bytesWritten), bytesRead)
+		}
+		bytesRead += read
+		bytesWritten += written
+	}
+	if trailing := len(src) - bytesRead; trailing > 0 && !opts.IgnoreTrailingBytes {
+		return bytesRead, bytesWritten, fmt.Errorf("%w: %d bytes", ErrTrailingBytes, trailing)
+	}
+	return bytesRead, bytesWritten, nil
+}
+
+// Unpacks the whole archive src into dst like DecompressOpts() (strict) but never more than maxOutput bytes.
+// Use it on untrusted input - small archive may unpack to huge size. See DecompressOptions.MaxOutput.
+func DecompressLimited(dst, src []byte, maxOutput int) (bytesRead, bytesWritten int, err error) {
+	return DecompressOpts(dst, src, DecompressOptions{MaxOutput: maxOutput})
+}
@@ -0,0 +1,304 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCompressOptsRejectsLevelsOutOfRange(t *testing.T) {
+	src := []byte("first line\nsecond line\n")
+	dst := make([]byte, DecompressBound())
+
+	for _, level := range []int{-1, 10, 1000} {
+		t.Run(fmt.Sprintf("level %d", level), func(t *testing.T) {
+			bytesRead, bytesWritten, err := CompressOpts(dst, src, Options{CompressionLevel: level})
+			if !errors.Is(err, ErrInvalidCompressionLevel) {
+				t.Errorf("Expected ErrInvalidCompressionLevel; got %v", err)
+			}
+			if bytesRead != 0 || bytesWritten != 0 {
+				t.Errorf("Nothing should be compressed; got %d bytes read, %d written", bytesRead, bytesWritten)
+			}
+		})
+	}
+}
+
+func TestCompressOptsLevelZeroIsDefault(t *testing.T) {
+	dir := path_defaultLoghubCorpus + "apache/"
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	inputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+	expected := make([]byte, DecompressBound())
+	dst := make([]byte, DecompressBound())
+
+	_, expectedSize := Compress(expected, inputBuff[:inputSize], COMPRESSION_LEVEL_DEFAULT)
+	_, bytesWritten, err := CompressOpts(dst, inputBuff[:inputSize], Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst[:bytesWritten], expected[:expectedSize]) {
+		t.Errorf("Level 0 should pack the same as COMPRESSION_LEVEL_DEFAULT")
+	}
+}
+
+func TestMaxSimilarityDoesNotAffectCorrectness(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	packedBuff := make([]byte, test_compression_bound_bytes)
+	unpackedBuff := make([]byte, test_max_input_size_bytes)
+
+	dir := path_defaultLoghubCorpus + "android_v2/"
+	inputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+	inputSize = min2(inputSize, test_level_sample_size_bytes)
+
+	for _, maxSimilarity := range []int{1, MAX_SIMILARITY, MAX_CHUNK_SIZE} {
+		t.Run(fmt.Sprintf("max similarity %d", maxSimilarity), func(t *testing.T) {
+			opts := Options{CompressionLevel: COMPRESSION_LEVEL_BEST, MaxSimilarity: maxSimilarity}
+			packOutputSize := packBufferWithOptions(inputBuff[:inputSize], packedBuff, opts)
+			unpackOutputSize := UnpackBuffer(packedBuff[:packOutputSize], unpackedBuff, t)
+			assertInversibility(t, "android_v2", inputBuff, unpackedBuff, inputSize, unpackOutputSize)
+		})
+	}
+}
+
+func TestCompressOptsRejectsNegativeMaxSimilarity(t *testing.T) {
+	dst := make([]byte, DecompressBound())
+	if _, _, err := CompressOpts(dst, []byte("line\n"), Options{MaxSimilarity: -1}); !errors.Is(err, ErrInvalidMaxSimilarity) {
+		t.Errorf("Expected ErrInvalidMaxSimilarity; got %v", err)
+	}
+}
+
+func TestGoodEnoughPercentOverridesTheOneOfLevel(t *testing.T) {
+	dir := path_defaultLoghubCorpus + "apache/"
+	input, _ := os.ReadFile(dir + findFirstLogFile(dir))
+
+	for _, percent := range []int{-1, 101} {
+		if err := (Options{GoodEnoughPercent: percent}).Validate(); !errors.Is(err, ErrInvalidGoodEnoughPercent) {
+			t.Errorf("%d: expected ErrInvalidGoodEnoughPercent; got %v", percent, err)
+		}
+	}
+	packed := func(opts Options) []byte {
+		buff := make([]byte, 2*len(input)+DecompressBound())
+		return buff[:packBufferWithOptions(input, buff, opts)]
+	}
+	// levels 6-9 differ only in goodEnoughPercent
+	level6 := packed(Options{CompressionLevel: 6})
+	level9 := packed(Options{CompressionLevel: 9})
+	if bytes.Equal(level6, level9) {
+		t.Fatalf("Levels 6 and 9 pack the same")
+	}
+	if overridden := packed(Options{CompressionLevel: 6, GoodEnoughPercent: 100}); !bytes.Equal(overridden, level9) {
+		t.Errorf("Level 6 with 100%% good enough should pack as level 9")
+	}
+	if overridden := packed(Options{CompressionLevel: 9, GoodEnoughPercent: 80}); !bytes.Equal(overridden, level6) {
+		t.Errorf("Level 9 with 80%% good enough should pack as level 6")
+	}
+	if unpacked := unpackAll(t, packed(Options{GoodEnoughPercent: 1})); !bytes.Equal(unpacked, input) {
+		t.Errorf("1%% good enough: unpacked %d bytes differ from %d packed", len(unpacked), len(input))
+	}
+}
+
+func TestDecompressOptsTrailingBytes(t *testing.T) {
+	expected, err := os.ReadFile(path_trailingBytesCorpus + "expected.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpackedBuff := make([]byte, DecompressBound())
+
+	for trailing := 1; trailing <= 3; trailing++ {
+		packed, err := os.ReadFile(fmt.Sprintf("%strailing_%d.lp", path_trailingBytesCorpus, trailing))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(fmt.Sprintf("%d trailing bytes", trailing), func(t *testing.T) {
+			_, written, err := DecompressOpts(unpackedBuff, packed, DecompressOptions{})
+			if !errors.Is(err, ErrTrailingBytes) {
+				t.Errorf("Strict mode: expected ErrTrailingBytes; got %v", err)
+			}
+			if !bytes.Equal(unpackedBuff[:written], expected) {
+				t.Errorf("Strict mode: chunks before trailing bytes should be unpacked")
+			}
+
+			read, written, err := DecompressOpts(unpackedBuff, packed, DecompressOptions{IgnoreTrailingBytes: true})
+			if err != nil || read != len(packed)-trailing || !bytes.Equal(unpackedBuff[:written], expected) {
+				t.Errorf("Lenient mode: expected %d bytes read and no error; got %d, %v", len(packed)-trailing, read, err)
+			}
+		})
+	}
+}
+
+func TestDecompressOptsReportsTruncatedChunk(t *testing.T) {
+	packed := make([]byte, DecompressBound())
+	_, packedSize := Compress(packed, []byte("some line\nother line\n"), COMPRESSION_LEVEL_DEFAULT)
+	unpackedBuff := make([]byte, DecompressBound())
+
+	_, _, err := DecompressOpts(unpackedBuff, packed[:packedSize-1], DecompressOptions{IgnoreTrailingBytes: true})
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF; got %v", err)
+	}
+	_, _, err = DecompressOpts(unpackedBuff[:5], packed[:packedSize], DecompressOptions{})
+	if !errors.Is(err, io.ErrShortBuffer) {
+		t.Errorf("Expected io.ErrShortBuffer; got %v", err)
+	}
+}
+
+// Decompress() unpacks as many whole chunks as fit in dst: multi-chunk input needs dst of the sum of their raw
+// sizes, while a dst of DecompressBound() fits at least one chunk per call.
+func TestDecompressMultiChunkIntoDstAroundTotalSize(t *testing.T) {
+	dir := path_defaultLoghubCorpus + "apache/"
+	input, _ := os.ReadFile(dir + findFirstLogFile(dir))
+	input = input[:min2(len(input), 8*MAX_CHUNK_SIZE)]
+	packed := make([]byte, 2*len(input)+DecompressBound())
+	packed = packed[:packBufferWithOptions(input, packed, Options{})]
+	chunks, err := ChunkMetadata(packed)
+	if err != nil || len(chunks) < 3 {
+		t.Fatalf("Expected several chunks; got %d, err: %v", len(chunks), err)
+	}
+	last := chunks[len(chunks)-1]
+
+	dst := make([]byte, len(input))
+	if read, written := Decompress(dst, packed); read != len(packed) || written != len(input) || !bytes.Equal(dst, input) {
+		t.Errorf("Dst of total size: expected %d bytes unpacked from %d; got %d from %d", len(input), len(packed),
+			written, read)
+	}
+
+	// the last chunk does not fit; the ones before it are unpacked
+	dst = make([]byte, len(input)-1)
+	read, written := Decompress(dst, packed)
+	if read != last.Offset || written != len(input)-last.RawSize || !bytes.Equal(dst[:written], input[:written]) {
+		t.Errorf("Dst 1 byte short: expected %d bytes unpacked from %d; got %d from %d", len(input)-last.RawSize,
+			last.Offset, written, read)
+	}
+	if read, written := Decompress(dst[written:], packed[read:]); read != NOT_ENOUGH_OUTPUT_SPACE || written != 0 {
+		t.Errorf("Dst 1 byte short: expected NOT_ENOUGH_OUTPUT_SPACE for the last chunk; got %d, %d", read, written)
+	}
+	_, _, err = DecompressOpts(dst, packed, DecompressOptions{})
+	if expected := fmt.Sprintf("short buffer: 1 bytes more needed for chunk at %d", last.Offset); !errors.Is(err, io.ErrShortBuffer) || err.Error() != expected {
+		t.Errorf("Dst 1 byte short: expected %q; got %v", expected, err)
+	}
+
+	// the way main.go unpacks: dst of DecompressBound() reused for every call
+	dst = make([]byte, DecompressBound())
+	var unpacked []byte
+	for src, calls := packed, 0; len(src) > 0; calls++ {
+		read, written := Decompress(dst, src)
+		if read <= 0 || written > DecompressBound() {
+			t.Fatalf("Call %d: got %d bytes unpacked from %d", calls, written, read)
+		}
+		unpacked, src = append(unpacked, dst[:written]...), src[read:]
+	}
+	if !bytes.Equal(unpacked, input) {
+		t.Errorf("Dst of DecompressBound(): unpacked %d bytes differ from %d packed", len(unpacked), len(input))
+	}
+}
+
+func TestDecompressSingleChunkIntoDstAroundRawSize(t *testing.T) {
+	for name, input := range map[string][]byte{
+		"compressed": []byte("some line\nsome other line\n"),
+		"stored":     {0xff, 0xfe, 0xfd, '\n'},
+	} {
+		packed := make([]byte, DecompressBound())
+		_, packedSize := Compress(packed, input, COMPRESSION_LEVEL_DEFAULT)
+		packed = packed[:packedSize]
+		rawSize := len(input)
+
+		for _, dstSize := range []int{rawSize - 1, rawSize, rawSize + 1} {
+			dst := make([]byte, dstSize)
+			read, written := Decompress(dst, packed)
+			_, optsWritten, err := DecompressOpts(dst, packed, DecompressOptions{})
+			if dstSize < rawSize {
+				if read != NOT_ENOUGH_OUTPUT_SPACE || written != 0 {
+					t.Errorf("%s, dst %d: expected NOT_ENOUGH_OUTPUT_SPACE; got %d, %d", name, dstSize, read, written)
+				}
+				if !errors.Is(err, io.ErrShortBuffer) || err.Error() != "short buffer: 1 bytes more needed for chunk at 0" {
+					t.Errorf("%s, dst %d: expected shortfall of 1 byte; got %v", name, dstSize, err)
+				}
+				continue
+			}
+			if read != packedSize || written != rawSize || !bytes.Equal(dst[:written], input) {
+				t.Errorf("%s, dst %d: expected %d bytes unpacked from %d; got %d from %d", name, dstSize, rawSize, packedSize,
+					written, read)
+			}
+			if err != nil || optsWritten != rawSize {
+				t.Errorf("%s, dst %d: expected %d bytes unpacked; got %d, err: %v", name, dstSize, rawSize, optsWritten, err)
+			}
+		}
+	}
+}
+
+func TestDecompressLimitedStopsAtTheLimit(t *testing.T) {
+	// 100 chunks of a repeated line pack to a tiny fraction of their size
+	input := bytes.Repeat([]byte("the same line again\n"), 100*MAX_CHUNK_SIZE/20)
+	packed := make([]byte, len(input))
+	packed = packed[:PackBuffer(input, packed, COMPRESSION_LEVEL_DEFAULT)]
+	unpacked := make([]byte, len(input))
+	const limit = 1000 * 1000
+
+	_, written, err := DecompressLimited(unpacked, packed, limit)
+	if !errors.Is(err, ErrOutputLimitExceeded) || written > limit {
+		t.Errorf("%d bytes packed to %d; expected ErrOutputLimitExceeded within %d bytes, got %v after %d bytes",
+			len(input), len(packed), limit, err, written)
+	}
+	if !bytes.Equal(unpacked[:written], input[:written]) {
+		t.Errorf("Data unpacked before the limit differs from input")
+	}
+
+	read, written, err := DecompressLimited(unpacked, packed, len(input))
+	if err != nil || read != len(packed) || written != len(input) {
+		t.Errorf("Expected whole archive unpacked at limit of its size; got %d bytes, err: %v", written, err)
+	}
+}
+
+func TestMaxDurationStoresChunksOnceExceeded(t *testing.T) {
+	dir := path_defaultLoghubCorpus + "apache/"
+	input, err := os.ReadFile(dir + findFirstLogFile(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packed bytes.Buffer
+	// only the first chunk is compressed - the clock starts at it and the budget is gone right after
+	result, err := PackStream(&packed, bytes.NewReader(input), WriterOptions{Options: Options{MaxDuration: time.Nanosecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, headerSize, _ := ReadArchiveHeader(packed.Bytes())
+	chunks, _ := ScanChunks(packed.Bytes()[headerSize:])
+	for i, chunk := range chunks {
+		stored := packed.Bytes()[headerSize+chunk.Offset+HEADER_SIZE] == STORED_CHUNK_MARKER
+		if stored != (i > 0) {
+			t.Errorf("Chunk %d of %d: stored: %v", i, len(chunks), stored)
+		}
+	}
+	if result.Ratio() < 0.9 {
+		t.Errorf("Expected stored chunks to take about as much as input; ratio: %.3f", result.Ratio())
+	}
+
+	var unpacked bytes.Buffer
+	if _, err := DecompressTo(&unpacked, &packed); err != nil || !bytes.Equal(unpacked.Bytes(), input) {
+		t.Errorf("Archive did not unpack to the input; err: %v", err)
+	}
+	if _, err := NewCompressor(Options{MaxDuration: -time.Second}); !errors.Is(err, ErrInvalidMaxDuration) {
+		t.Errorf("Expected ErrInvalidMaxDuration; got %v", err)
+	}
+}
+
+// Empty src writes nothing even once chunks are stored - 5 bytes of an empty stored chunk would declare 65536 bytes.
+func TestCompressorWritesNothingForEmptySrcOnceMaxDurationExceeded(t *testing.T) {
+	c, _ := NewCompressor(Options{MaxDuration: time.Nanosecond})
+	dst := make([]byte, DecompressBound())
+	// the clock starts at the first chunk
+	c.Compress(dst, []byte("first line\n"))
+	time.Sleep(time.Millisecond)
+
+	for _, src := range [][]byte{nil, {}} {
+		if read, written := c.Compress(dst, src); read != 0 || written != 0 {
+			t.Errorf("Src %v: expected nothing read nor written; got %d and %d bytes: %x", src, read, written, dst[:written])
+		}
+	}
+	if read, _ := c.Compress(dst, []byte("second line\n")); read == 0 || dst[HEADER_SIZE] != STORED_CHUNK_MARKER {
+		t.Errorf("Expected stored chunk once MaxDuration is exceeded; got %x", dst[:HEADER_SIZE+1])
+	}
+}
@@ -1,6 +1,7 @@
 package pack
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"math"
@@ -20,6 +21,8 @@ const (
 	ESCAPE_BYTE byte = 128 // 0x80
 	// In compressed buffer this flag be set in the byte that encodes linesBefore.
 	// If set it means that encoded number that follows immediately encodes initial offset in keyLine rather than prefix length.
+	// Storing also where the first matched block starts in the current line was measured to save 0.02% at best
+	// (see BenchmarkRealignedFirstBlock) so the format does not do it.
 	NO_SHARED_PREFIX_FLAG byte = 0x40
 	// LENGTH_BASE - 1 is maximum length that can be encoded in one byte
 	LENGTH_BASE byte = 127
@@ -27,13 +30,33 @@ const (
 	MAX_BACKREFERENCE_CAPACITY = 64
 
 	SIZEOF_INT16 = 2
+	SIZEOF_INT64 = 8
 	HEADER_SIZE  = 2 * SIZEOF_INT16
+	// ESCAPE_BYTE repeated in each byte of uint64
+	HIGH_BITS_MASK = 0x8080808080808080
 	// Max buffer size that can be compressed in one Compress() call. Also max size of x
 	// that can be stored in 2-byte var. No need to stored empty buffers so 0 means 1
 	MAX_CHUNK_SIZE = math.MaxUint16 + 1
 
-	// limit to how many chars of line are considered in similarity score
+	// default limit to how many chars of line are considered in similarity score (see Options.MaxSimilarity)
 	MAX_SIMILARITY = 140
+	// When choosing the reference line every match after the shared prefix counts this many chars less: each takes
+	// a length token (a byte at least) while the prefix comes with the line reference. So a line sharing a long
+	// prefix wins over one with marginally more same chars scattered. Loghub samples pack 3.650x instead of 3.646x
+	// at level 4 and 4.694x instead of 4.690x at level 9.
+	SCATTERED_MATCH_COST = 1
+
+	// First byte of a stored chunk - one holding raw bytes of src as they are. The compressor never emits it at
+	// the beginning of a chunk: it would be a reference to line 0 before.
+	STORED_CHUNK_MARKER = ESCAPE_BYTE | NO_SHARED_PREFIX_FLAG
+	// After this many bytes of src the compressor checks whether the chunk compresses at all; if not it stores the chunk.
+	INCOMPRESSIBLE_PROBE_SIZE = 4096
+
+	// Within a line ESCAPE_BYTE followed by an ASCII byte d (quote() never escapes ASCII) is a numeric delta token:
+	// the number in keyLine where the last reference ended, plus d+1 (see Options.NumericDelta).
+	MAX_NUMERIC_DELTA = 128
+	// longer numbers are never delta-encoded so that they fit in uint64
+	MAX_NUMERIC_DELTA_DIGITS = 18
 )
 
 const (
@@ -44,20 +67,22 @@ const (
 
 type compressionParameters struct {
 	backreferenceCapacity byte
-	goodEnoughFactor      float32
+	// search for a reference line stops at a line this similar (percent of the best possible similarity score).
+	// Integer, not float, so that the same input packs to the same bytes on every platform
+	goodEnoughPercent int
 }
 
 var compressionLevelPresets = [...]compressionParameters{
-	{2, 0.80},  // pad to align levels to 1-9 range;
-	{2, 0.80},  // CompressionLevel 1
-	{4, 0.80},  // CompressionLevel 2
-	{8, 0.80},  // CompressionLevel 3
-	{16, 0.80}, // CompressionLevel 4 <-The Default
-	{32, 0.80}, // CompressionLevel 5
-	{64, 0.80}, // CompressionLevel 6
-	{64, 0.90}, // CompressionLevel 7
-	{64, 0.95}, // CompressionLevel 8
-	{64, 1.00}, // CompressionLevel 9
+	{2, 80},   // pad to align levels to 1-9 range; unused
+	{2, 80},   // CompressionLevel 1
+	{4, 80},   // CompressionLevel 2
+	{8, 80},   // CompressionLevel 3
+	{16, 80},  // CompressionLevel 4 <-The Default
+	{32, 80},  // CompressionLevel 5
+	{64, 80},  // CompressionLevel 6
+	{64, 90},  // CompressionLevel 7
+	{64, 95},  // CompressionLevel 8
+	{64, 100}, // CompressionLevel 9
 }
 
 // var debug_LinePacked = 1
@@ -66,19 +91,28 @@ type lineReference struct {
 	line            []byte
 	linesBefore     byte
 	prefixLength    int
+	// similarity less SCATTERED_MATCH_COST for every match after the prefix
 	similarityScore int
 }
 
 // Cyclic buffer of previously read lines. Next line will be stored at writeIdx index.
+// It holds at most capacity-1 lines: writeIdx == oldestLineIdx means it's empty, so slot at writeIdx is never a line
+// of the buffer (it may hold a stale one).
 type backrefBuffer struct {
 	writeIdx      int
 	oldestLineIdx int
 	capacity      int
 	lines         [MAX_BACKREFERENCE_CAPACITY][]byte
+	// prefixKey() of every line; kept only if indexed (see findSamePrefixLine())
+	indexed  bool
+	prefixes [MAX_BACKREFERENCE_CAPACITY]uint64
 }
 
 func (backref *backrefBuffer) add(line []byte) {
 	backref.lines[backref.writeIdx] = line
+	if backref.indexed {
+		backref.prefixes[backref.writeIdx] = prefixKey(line)
+	}
 	backref.writeIdx++
 	backref.writeIdx %= backref.capacity
 	// max capacity reached - remove oldest line
@@ -89,44 +123,64 @@ func (backref *backrefBuffer) add(line []byte) {
 }
 
 // finds a line with longest prefix shared with compressedLine. Returns it along with info lines before it was encountered (eg. 1 for previous line)
-func (backref *backrefBuffer) chooseReferenceLine(compressedLine []byte, goodEnoughFactor float32) (lineRef lineReference) {
+// maxSimilarity - how many chars of compared lines are considered (see estimateSimilarity())
+func (backref *backrefBuffer) chooseReferenceLine(compressedLine []byte, goodEnoughPercent int, maxSimilarity int) (lineRef lineReference) {
+	if backref.indexed && goodEnoughPercent == 100 {
+		if lineRef, found := backref.findSamePrefixLine(compressedLine, maxSimilarity); found {
+			return lineRef
+		}
+	}
 	// don't refer current line (0). refer at least previous line
 	lineRef.linesBefore = 1
 
-	goodEnoughSimilarityScore := goodEnoughFactor * float32(min2(len(compressedLine),
-		MAX_SIMILARITY))
+	// compared as 100*similarity to keep it integer
+	goodEnoughSimilarityScore := goodEnoughPercent * min2(len(compressedLine), maxSimilarity)
 
-	for linesBefore := 1; ; linesBefore++ {
+	// size() rather than reaching oldestLineIdx bounds the scan: empty buffer has nothing to scan
+	for linesBefore, size := 1, backref.size(); linesBefore <= size; linesBefore++ {
 		i := backref.writeIdx - linesBefore
 		// wrap around
 		if i < 0 {
 			i = backref.capacity + i
 		}
 
-		prefixLength, similarity := estimateSimilarity(backref.lines[i], compressedLine)
-		if similarity > lineRef.similarityScore {
-			lineRef.linesBefore = byte(linesBefore)
-			lineRef.line = backref.lines[i]
-			lineRef.prefixLength = prefixLength
-			lineRef.similarityScore = similarity
-			if float32(similarity) >= goodEnoughSimilarityScore {
-				break
+		// similarity never exceeds length of the line, so a line not longer than the best score so far cannot beat it
+		if len(backref.lines[i]) > lineRef.similarityScore {
+			prefixLength, similarity, scatteredMatches := estimateSimilarity(backref.lines[i], compressedLine, maxSimilarity)
+			if score := similarity - SCATTERED_MATCH_COST*scatteredMatches; score > lineRef.similarityScore {
+				lineRef.linesBefore = byte(linesBefore)
+				lineRef.line = backref.lines[i]
+				lineRef.prefixLength = prefixLength
+				lineRef.similarityScore = score
+				if 100*similarity >= goodEnoughSimilarityScore {
+					break
+				}
 			}
 		}
-
-		// reached the end of buffer
-		// watch out! - will see empty buff as full. Not important if we never read empty buff
-		if i == backref.oldestLineIdx {
-			break
-		}
 	}
 	return
 }
 
+// Empties the buffer. Lines are not cleared - getLineAt() never returns lines that were not added after reset.
+func (backref *backrefBuffer) reset(capacity int) {
+	backref.writeIdx = 0
+	backref.oldestLineIdx = 0
+	backref.capacity = capacity
+}
+
+// Number of lines stored in the buffer
+func (backref *backrefBuffer) size() int {
+	return (backref.writeIdx - backref.oldestLineIdx + backref.capacity) % backref.capacity
+}
+
+// Returns line added linesBefore lines ago (1 for the most recent) or nil if there is no such line in the buffer
 func (backref *backrefBuffer) getLineAt(linesBefore int) []byte {
 	if linesBefore > backref.capacity {
 		panic(fmt.Sprintf("Trying to reference a line outside of BACKREFERENCE_CAPACITY: %d", linesBefore))
 	}
+	if linesBefore < 1 || linesBefore > backref.size() {
+		return nil
+	}
 	i := backref.writeIdx - linesBefore
 	// wrap around
 	if i < 0 {
@@ -142,13 +196,14 @@ func limitSlice(slice []byte, lengthLimit int) []byte {
 	return slice
 }
 
-// Returns length of prefix and similarity between refLine and currLine.
+// Returns length of prefix, similarity between refLine and currLine and number of matches after the prefix.
 // Mind that commonPrefixLength has other meaning if it's negative.
 // Negative prefix means there is no common prefix. Instead it denotes a starting offset (its negative) to keyLine
 // when later compressing a currLine in func compressLine(). Eg. if commonPrefixLength = -2 then first common sequence
 // shared by two lines will start at keyLine[2].
-func estimateSimilarity(refLine, currLine []byte) (commonPrefixLength, similarityScore int) {
-	lenLimit := min3(len(refLine), len(currLine), MAX_SIMILARITY)
+// Only first maxSimilarity chars of the lines are compared.
+func estimateSimilarity(refLine, currLine []byte, maxSimilarity int) (commonPrefixLength, similarityScore, scatteredMatches int) {
+	lenLimit := min3(len(refLine), len(currLine), maxSimilarity)
 
 	refLine = limitSlice(refLine, lenLimit)
 	currLine = limitSlice(currLine, lenLimit)
@@ -186,6 +241,9 @@ func estimateSimilarity(refLine, currLine []byte) (commonPrefixLength, similarit
 			// -- end of common sequence --
 			// increase c1. encode common sequence in dst (if there is any)
 			similarityScore += sameStringLength
+			if sameStringLength > 0 {
+				scatteredMatches++
+			}
 			sameStringLength = 0
 
 			// 2. advance cursors in a and b
@@ -194,8 +252,11 @@ func estimateSimilarity(refLine, currLine []byte) (commonPrefixLength, similarit
 		}
 	}
 	similarityScore += sameStringLength
+	if sameStringLength > 0 {
+		scatteredMatches++
+	}
 
-	return commonPrefixLength, similarityScore
+	return commonPrefixLength, similarityScore, scatteredMatches
 }
 
 func min2(a, b int) int {
@@ -219,25 +280,89 @@ func min3(a, b, c int) int {
 }
 
 func getCompressionParameters(compressionLevel int) compressionParameters {
-	var row int
+	return compressionLevelPresets[normalizeCompressionLevel(compressionLevel)]
+}
+
+// Maps any compression level to the one in range COMPRESSION_LEVEL_WORST..COMPRESSION_LEVEL_BEST that it is treated as.
+func normalizeCompressionLevel(compressionLevel int) int {
 	if compressionLevel < 0 {
-		row = 0
+		return COMPRESSION_LEVEL_WORST
 	} else if compressionLevel == 0 {
-		row = int(COMPRESSION_LEVEL_DEFAULT)
+		return COMPRESSION_LEVEL_DEFAULT
 	} else if compressionLevel > COMPRESSION_LEVEL_BEST {
-		row = COMPRESSION_LEVEL_BEST
-	} else {
-		row = compressionLevel
+		return COMPRESSION_LEVEL_BEST
 	}
-	return compressionLevelPresets[row]
+	return compressionLevel
 }
 
+/*
+Compresses beginning of src into one chunk written to dst.
+dst - Buffer for output data. Should have at least DecompressBound() bytes to fit the biggest possible chunk.
+
+	Smaller dst will just result in smaller chunks (it must fit at least HEADER_SIZE + 2 bytes though).
+
+Returns number of bytes consumed from src and number of bytes written to dst.
+
+One chunk holds at most MAX_CHUNK_SIZE bytes of src. So when src is bigger or when dst fills up only part of src is consumed
+(bytesRead < len(src)). Caller should pass the remainder src[bytesRead:] to the next Compress() call - chunks decompress
+to concatenation of their inputs.
+bytesRead always falls on a line boundary (just after '\n' or at the end of src) so the next chunk starts with a whole line.
+The only exception is when the first line does not fit in a chunk. Then just as much of it as fits is consumed.
+Nothing is consumed nor written (not even a header) if src is empty.
+Input that does not compress (eg. an already compressed blob) is written as a stored chunk - raw bytes that take
+only one byte more than src rather than up to twice as much the escaping would.
+
+compressionLevel out of COMPRESSION_LEVEL_WORST..COMPRESSION_LEVEL_BEST range is clamped to it; 0 selects
+COMPRESSION_LEVEL_DEFAULT. Use CompressOpts() to have invalid levels reported.
+
+Compress() keeps no state between calls (every chunk starts with an empty backreference window), so it is safe to call
+from many goroutines at once as long as they pass disjoint dst buffers. So are CompressOpts() and Decompress().
+A Compressor on the other hand is not safe for concurrent use - give every goroutine its own.
+*/
 func Compress(dst, src []byte, compressionLevel int) (bytesRead, bytesWritten int) {
+	return compress(dst, src, getCompressionParameters(compressionLevel), MAX_SIMILARITY)
+}
+
+func compress(dst, src []byte, compressionParams compressionParameters, maxSimilarity int) (bytesRead, bytesWritten int) {
+	return compressPrimed(dst, src, chunkOptions{compressionParams: compressionParams, maxSimilarity: maxSimilarity,
+		separator: '\n'})
+}
+
+// How chunks are packed: Options resolved for compressPrimed() and compressSorted() along with what Compressor
+// adds to them.
+type chunkOptions struct {
+	compressionParams compressionParameters
+	maxSimilarity     int
+	// put in the backreference window of every chunk before its first line (see Compressor.Prime())
+	primingLines [][]byte
+	// see Options.NumericDelta
+	numericDelta bool
+	// lines end with it (see Options.RecordSeparator); never 0
+	separator byte
+	// non-nil chooses the referred lines instead of backrefBuffer.chooseReferenceLine()
+	selector ReferenceSelector
+	// see Options.IndexedSearch
+	indexedSearch bool
+	// sorts lines of chunks (see Options.SortLines); nil if they are not sorted
+	sorter *lineSorter
+	// see Options.MarkAsciiChunks
+	markAscii bool
+}
+
+// Same as compress() but with all of opts other than sorter and markAscii (see compressSorted()). With primingLines
+// even the first line of the chunk may refer a line.
+func compressPrimed(dst, src []byte, opts chunkOptions) (bytesRead, bytesWritten int) {
+	separator, primingLines := opts.separator, opts.primingLines
+	// kept for storing the chunk if it turns out incompressible
+	chunkDst, chunkSrc := dst, src
 	// cut header; limit dest size to max storable chunk size
 	header, dst := dst[:HEADER_SIZE], dst[HEADER_SIZE:]
 
+	// src that does not fit in one chunk ends with partial line; don't compress it unless it is the first line
+	srcCut := len(src) > MAX_CHUNK_SIZE
 	src = limitSlice(src, MAX_CHUNK_SIZE)
 	dst = limitSlice(dst, MAX_CHUNK_SIZE)
+	firstLine, _ := nextRecord(src, separator)
 
 	// fmt.Printf("Compress(), len(src)=%d\n", len(src))
 
@@ -247,30 +372,68 @@ func Compress(dst, src []byte, compressionLevel int) (bytesRead, bytesWritten in
 	// 	fmt.Println("")
 	// }
 
-	compressionParams := getCompressionParameters(compressionLevel)
 	backref := backrefBuffer{}
-	backref.capacity = int(compressionParams.backreferenceCapacity)
+	backref.capacity = int(opts.compressionParams.backreferenceCapacity)
+	backref.indexed = opts.indexedSearch
+	for _, line := range primingLines {
+		backref.add(line)
+	}
 
-	firstLine, src := nextLine(src)
-	backref.add(firstLine)
+	// with no lines to refer the first line is stored as it is
+	if len(primingLines) == 0 {
+		src = src[len(firstLine):]
+		backref.add(firstLine)
 
-	bytesRead, bytesWritten = quoteSafely(dst, firstLine)
-	dst = dst[bytesWritten:]
+		bytesRead, bytesWritten = quoteSafely(dst, firstLine)
+		dst = dst[bytesWritten:]
+		// dst is full if the first line did not fit
+		if bytesRead < len(firstLine) {
+			src = nil
+		}
+	}
 
-	for currLine, src := nextLine(src); len(currLine) > 0; currLine, src = nextLine(src) {
-		// stop compression if dst has not enough space for the worst-case compression ratio
-		// saving the need to do per-char bounds checking later
-		if len(dst) < 2*len(currLine)+2 {
+	// lines that may not fit in dst are compressed here first
+	var lineScratch []byte
+	// lines given to selector
+	var window [][]byte
+
+	for currLine, src := nextRecord(src, separator); len(currLine) > 0; currLine, src = nextRecord(src, separator) {
+		if srcCut && len(src) == 0 && currLine[len(currLine)-1] != separator {
 			break
 		}
-		lineRef := backref.chooseReferenceLine(currLine, compressionParams.goodEnoughFactor)
+		var lineRef lineReference
+		if opts.selector == nil {
+			lineRef = backref.chooseReferenceLine(currLine, opts.compressionParams.goodEnoughPercent, opts.maxSimilarity)
+		} else {
+			lineRef = backref.selectReferenceLine(opts.selector, currLine, opts.maxSimilarity, &window)
+		}
 
-		compressedLineSize := compressLine(lineRef, currLine, dst)
+		var compressedLineSize int
+		// worst-case compressed size is 2*len(currLine)+2. Lines that surely fit are compressed straight into dst
+		// saving the need to do per-char bounds checking later
+		if len(dst) >= 2*len(currLine)+2 {
+			compressedLineSize = compressLine(lineRef, currLine, dst, opts.numericDelta)
+		} else {
+			// try then rollback: compress aside and stop compression if the line does not fit after all
+			if cap(lineScratch) < 2*len(currLine)+2 {
+				lineScratch = make([]byte, 2*len(currLine)+2)
+			}
+			compressedLineSize = compressLine(lineRef, currLine, lineScratch[:cap(lineScratch)], opts.numericDelta)
+			if compressedLineSize > len(dst) {
+				break
+			}
+			copy(dst, lineScratch[:compressedLineSize])
+		}
 		dst = dst[compressedLineSize:]
 
 		bytesRead += len(currLine)
 		bytesWritten += compressedLineSize
 
+		// eg. an already compressed blob; its escaped bytes take more space than raw bytes would
+		if bytesRead >= INCOMPRESSIBLE_PROBE_SIZE && bytesWritten > bytesRead {
+			return storeChunk(chunkDst, chunkSrc, separator)
+		}
+
 		backref.add(currLine)
 
 		// fmt.Printf("l:%d->%d ", debug_LinePacked, lineRef.linesBefore)
@@ -280,15 +443,71 @@ func Compress(dst, src []byte, compressionLevel int) (bytesRead, bytesWritten in
 		// }
 	}
 
+	// primed first line did not fit in the chunk as a whole - store as much of it as fits, like without priming
+	if bytesRead == 0 && len(firstLine) > 0 {
+		bytesRead, bytesWritten = quoteSafely(dst, firstLine)
+	}
+	// empty src or dst too small for a byte of it; header can't declare an empty chunk (sizes are stored minus 1)
+	if bytesRead == 0 {
+		return 0, 0
+	}
+	// storing costs just the marker byte
+	if bytesWritten > bytesRead+1 {
+		return storeChunk(chunkDst, chunkSrc[:bytesRead], separator)
+	}
+
 	storeHeader(header, bytesWritten, bytesRead)
 	return bytesRead, bytesWritten + HEADER_SIZE
 }
 
+// Writes beginning of src to dst as a stored chunk (STORED_CHUNK_MARKER followed by raw bytes). Takes as many whole
+// lines as fit or, if even the first line does not fit, as much of it as fits - same as compress() does.
+// Lines end with separator. Writes nothing for empty src, as compress() does: header can't declare an empty chunk.
+func storeChunk(dst, src []byte, separator byte) (bytesRead, bytesWritten int) {
+	if len(src) == 0 {
+		return 0, 0
+	}
+	header, dst := dst[:HEADER_SIZE], dst[HEADER_SIZE:]
+	// stored size (with the marker) must be storable in the header
+	limit := min(len(dst), MAX_CHUNK_SIZE) - 1
+	if limit <= 0 {
+		return 0, 0
+	}
+	bytesRead = len(src)
+	if len(src) > limit {
+		bytesRead = bytes.LastIndexByte(src[:limit], separator) + 1
+		if bytesRead == 0 {
+			bytesRead = limit
+		}
+	}
+
+	dst[0] = STORED_CHUNK_MARKER
+	copy(dst[1:], src[:bytesRead])
+	storeHeader(header, bytesRead+1, bytesRead)
+	return bytesRead, HEADER_SIZE + bytesRead + 1
+}
+
+// Compresses whole src into chunks appended to buf, growing it as needed. Returns number of bytes consumed
+// from src which is always len(src). Convenient alternative to Compress() when the size of output is not known
+// in advance. compressionLevel is treated the same as by Compress().
+func CompressToBuffer(buf *bytes.Buffer, src []byte, compressionLevel int) (bytesRead int) {
+	compressionParams := getCompressionParameters(compressionLevel)
+	for bytesRead < len(src) {
+		buf.Grow(DecompressBound())
+		chunk := buf.AvailableBuffer()[:DecompressBound()]
+		read, written := compress(chunk, src[bytesRead:], compressionParams, MAX_SIMILARITY)
+		buf.Write(chunk[:written])
+		bytesRead += read
+	}
+	return bytesRead
+}
+
 // Compresses currLine and writes it to dst buffer
 // lineRef - reference to a key line, to which current line is compared
 // currLine - line which will be compressed
 // dst - buffer where compressed data is written to
-func compressLine(lineRef lineReference, currLine, dst []byte) (bytesWritten int) {
+// numericDelta - whether numbers may be encoded as deltas to numbers of keyLine
+func compressLine(lineRef lineReference, currLine, dst []byte, numericDelta bool) (bytesWritten int) {
 	keyLine := lineRef.line
 
 	// previous line is encoded as ESCAPE_BYTE+1; two lines before ESCAPE_BYTE+2 and so on..
@@ -321,6 +540,19 @@ func compressLine(lineRef lineReference, currLine, dst []byte) (bytesWritten int
 			// -- end of common sequence --
 			// 1. encode common sequence in dst (if there is any)
 			bytesWritten += encodeLength(sameStringLength, dst, int(bytesWritten))
+
+			// numbers differing by a small delta (eg. sequence numbers) are encoded as the delta; comparison
+			// continues right after them
+			if numericDelta {
+				keyNumberEnd, currNumberEnd, ok := encodeNumericDelta(keyLine, currLine, idxKeyLine, idxCurrLine,
+					sameStringLength, dst[bytesWritten:])
+				if ok {
+					bytesWritten += 2
+					sameStringLength = 0
+					idxKeyLine, idxCurrLine = keyNumberEnd, currNumberEnd
+					continue
+				}
+			}
 			sameStringLength = 0
 
 			// 2. advance cursor in refLine
@@ -339,42 +571,148 @@ func compressLine(lineRef lineReference, currLine, dst []byte) (bytesWritten int
 	return bytesWritten
 }
 
+/*
+Writes numeric delta token (2 bytes) to dst if the number currLine has at idxCurrLine equals the number keyLine has
+at idxKeyLine plus 1..MAX_NUMERIC_DELTA, formatted the same way (zero padded to the width of keyLine's number),
+and more than 2 of its digits differ.
+Cursors point at the first differing digits; digits before them must be within the last matchedLength chars
+the lines share. Returns where the numbers end in both lines.
+*/
+func encodeNumericDelta(keyLine, currLine []byte, idxKeyLine, idxCurrLine, matchedLength int, dst []byte) (keyNumberEnd, currNumberEnd int, ok bool) {
+	keyNumberStart, keyNumberEnd := numberAround(keyLine, idxKeyLine)
+	matchedDigits := idxKeyLine - keyNumberStart
+	currNumberStart := idxCurrLine - matchedDigits
+	if keyNumberStart == keyNumberEnd || matchedDigits > matchedLength || !isDigit(currLine[idxCurrLine]) ||
+		currNumberStart > 0 && isDigit(currLine[currNumberStart-1]) {
+		return 0, 0, false
+	}
+	_, currNumberEnd = numberAround(currLine, idxCurrLine)
+	// the token takes 2 bytes: 1 or 2 differing digits are cheaper stored as they are
+	if currNumberEnd-idxCurrLine <= 2 ||
+		keyNumberEnd-keyNumberStart > MAX_NUMERIC_DELTA_DIGITS || currNumberEnd-currNumberStart > MAX_NUMERIC_DELTA_DIGITS {
+		return 0, 0, false
+	}
+
+	keyNumber := parseDigits(keyLine[keyNumberStart:keyNumberEnd])
+	currNumber := parseDigits(currLine[currNumberStart:currNumberEnd])
+	if currNumber <= keyNumber || currNumber-keyNumber > MAX_NUMERIC_DELTA {
+		return 0, 0, false
+	}
+	// decompressChunk() skips keyLine to a space after the token only before a literal; a mismatch right after the
+	// numbers that writes no literal (currLine is at a space) would skip in compressLine() alone
+	if keyNumberEnd < len(keyLine) && currNumberEnd < len(currLine) && currLine[currNumberEnd] == ' ' &&
+		keyLine[keyNumberEnd] != ' ' {
+		return 0, 0, false
+	}
+	// eg. "007" -> "7" can't be told from "007" -> "007"
+	var formatted [MAX_NUMERIC_DELTA_DIGITS + 1]byte
+	if !bytes.Equal(formatDigits(formatted[:], currNumber, keyNumberEnd-keyNumberStart), currLine[currNumberStart:currNumberEnd]) {
+		return 0, 0, false
+	}
+	dst[0] = ESCAPE_BYTE
+	dst[1] = byte(currNumber - keyNumber - 1)
+	return keyNumberEnd, currNumberEnd, true
+}
+
+// Bounds of the run of digits in line that includes idx; empty range (idx, idx) if line[idx] is not a digit.
+func numberAround(line []byte, idx int) (start, end int) {
+	if idx >= len(line) || !isDigit(line[idx]) {
+		return idx, idx
+	}
+	start, end = idx, idx
+	for start > 0 && isDigit(line[start-1]) {
+		start--
+	}
+	for end < len(line) && isDigit(line[end]) {
+		end++
+	}
+	return start, end
+}
+
+func isDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+func parseDigits(digits []byte) (number uint64) {
+	for _, digit := range digits {
+		number = 10*number + uint64(digit-'0')
+	}
+	return number
+}
+
+// Formats number in dst, zero padded to width digits. Dst must fit it.
+func formatDigits(dst []byte, number uint64, width int) []byte {
+	i := len(dst)
+	for number > 0 || len(dst)-i < width {
+		i--
+		dst[i] = byte('0' + number%10)
+		number /= 10
+	}
+	return dst[i:]
+}
+
+// Copies src to dst. Every ASCII byte (<128) is copied literally. Other bytes are escaped with ESCAPE_BYTE.
+// Dst must be big enough to fit the result (2*len(src) in the worst case).
 func quote(dst, src []byte) (bytesWritten int) {
-	escapedCharsCount := 0
-	for i, char := range src {
-		// ASCII char
-		if char&ESCAPE_BYTE == 0 {
-			dst[i+escapedCharsCount] = char
-			// anything else (e.g UTF-8)
-		} else {
-			dst[i+escapedCharsCount] = ESCAPE_BYTE
-			escapedCharsCount++
-			dst[i+escapedCharsCount] = char
+	for len(src) > 0 {
+		// fast path: bulk-copy run of ASCII chars
+		asciiLength := asciiPrefixLength(src)
+		bytesWritten += copy(dst[bytesWritten:], src[:asciiLength])
+		src = src[asciiLength:]
+
+		// anything else (e.g UTF-8)
+		for len(src) > 0 && src[0]&ESCAPE_BYTE != 0 {
+			dst[bytesWritten] = ESCAPE_BYTE
+			dst[bytesWritten+1] = src[0]
+			bytesWritten += 2
+			src = src[1:]
 		}
 	}
-	return len(src) + escapedCharsCount
+	return bytesWritten
 }
 
 // Copies src to dst up to len(dst). Every ASCII byte (<128) is copied literally. Other bytes are escaped with ESCAPE_BYTE.
 func quoteSafely(dst, src []byte) (bytesRead, bytesWritten int) {
-	escapedCharsCount := 0
-	for i, char := range src {
-		if char&ESCAPE_BYTE == 0 {
-			// ASCII char
-			dst[i+escapedCharsCount] = char
-		} else {
-			// anything else (e.g UTF-8)
+	for bytesRead < len(src) {
+		// fast path: bulk-copy run of ASCII chars
+		asciiLength := asciiPrefixLength(src[bytesRead:])
+		copied := copy(dst[bytesWritten:], src[bytesRead:bytesRead+asciiLength])
+		bytesRead += copied
+		bytesWritten += copied
+		if copied < asciiLength {
+			return bytesRead, bytesWritten
+		}
 
+		// anything else (e.g UTF-8)
+		for bytesRead < len(src) && src[bytesRead]&ESCAPE_BYTE != 0 {
 			// not enough room to fit another escape pair
-			if i+escapedCharsCount+2 > len(dst) {
-				return i, i + escapedCharsCount
+			if bytesWritten+2 > len(dst) {
+				return bytesRead, bytesWritten
 			}
-			dst[i+escapedCharsCount] = ESCAPE_BYTE
-			escapedCharsCount++
-			dst[i+escapedCharsCount] = char
+			dst[bytesWritten] = ESCAPE_BYTE
+			dst[bytesWritten+1] = src[bytesRead]
+			bytesWritten += 2
+			bytesRead++
 		}
 	}
-	return len(src), len(src) + escapedCharsCount
+	return bytesRead, bytesWritten
+}
+
+// Returns length of the longest prefix of buffer that contains only ASCII bytes (<128).
+func asciiPrefixLength(buffer []byte) int {
+	i := 0
+	// check 8 bytes at once; any high bit set ends the run
+	for ; i+SIZEOF_INT64 <= len(buffer); i += SIZEOF_INT64 {
+		if binary.LittleEndian.Uint64(buffer[i:])&HIGH_BITS_MASK != 0 {
+			break
+		}
+	}
+	for ; i < len(buffer); i++ {
+		if buffer[i]&ESCAPE_BYTE != 0 {
+			break
+		}
+	}
+	return i
 }
 
 // Starting from startIdx searches buffer for next space character and returns it's index. Returns len(buffer) if no space was found.
@@ -425,8 +763,13 @@ func decodeLength(compressed []byte) (sameStringLength int, bytesRead int) {
 }
 
 func nextLine(src []byte) (line, rest []byte) {
+	return nextRecord(src, '\n')
+}
+
+// Same as nextLine() but for lines ending with separator.
+func nextRecord(src []byte, separator byte) (line, rest []byte) {
 	for i, char := range src {
-		if char == '\n' {
+		if char == separator {
 			return src[0 : i+1], src[i+1:]
 		}
 	}
@@ -445,6 +788,8 @@ Tries to unpack an integer number of compressed chunks.
 dst - Buffer for output data. Should have at least DecompressBound() bytes size to guarantee there's enough space for any output.
 
 	Smaller buffer of len(dst) = X may be used if it is known that at the time of compression input buffer B of len(B) <= X had been passed to Compress() function.
+	DecompressBound() fits one chunk: following chunks are unpacked only as long as they fit entirely in the rest of dst,
+	so unpacking all chunks in one call takes dst of the sum of their raw sizes.
 
 srcCompressed - Buffer with compressed input data. It should point at the beginning of a compressed chunk and should contain entire chunk or the function will fail and
 
@@ -461,8 +806,39 @@ Two ints are returned:
     -CORRUPT_INPUT:             srcCompressed does not contain a valid Logpack archive and cannot be unpacked.
 
   - bytesWritten:   Number of bytes written into output buffer Dst.
+
+Bytes after the last complete chunk are left unread (bytesRead < len(srcCompressed)) - they may be the beginning of
+the next chunk. To unpack the whole archive and have such leftovers reported use DecompressOpts().
 */
 func Decompress(dst, srcCompressed []byte) (bytesRead, bytesWritten int) {
+	var scratch Scratch
+	return DecompressWith(dst, srcCompressed, &scratch)
+}
+
+// Reusable state of decompression. Passing the same Scratch to consecutive DecompressWith() calls saves on its
+// initialization in tight loops decompressing many small archives.
+// Scratch is not safe for concurrent use - every goroutine needs its own.
+type Scratch struct {
+	backref backrefBuffer
+	// lines the archive was primed with (see Compressor.Prime())
+	primingLines [][]byte
+	// 0 for '\n'
+	separator byte
+}
+
+// Makes DecompressWith() unpack chunks compressed by a Compressor primed with lines. Lines must be the same
+// (and in the same order) as given to Compressor.Prime().
+func (scratch *Scratch) Prime(lines [][]byte) {
+	scratch.primingLines = lines
+}
+
+// Makes DecompressWith() unpack chunks compressed with Options.RecordSeparator. 0 selects '\n'.
+func (scratch *Scratch) SetRecordSeparator(separator byte) {
+	scratch.separator = separator
+}
+
+// Same as Decompress() but keeps its state in scratch. See doc of Decompress() for meaning of arguments and results.
+func DecompressWith(dst, srcCompressed []byte, scratch *Scratch) (bytesRead, bytesWritten int) {
 
 	// buffer too small to contain even a header
 	if len(srcCompressed) < HEADER_SIZE {
@@ -479,19 +855,22 @@ func Decompress(dst, srcCompressed []byte) (bytesRead, bytesWritten int) {
 		return NOT_ENOUGH_OUTPUT_SPACE, 0
 	}
 
-	bytesRead += chunkSize + HEADER_SIZE
-
-	chunkResult := decompressChunk(srcCompressed[:chunkSize], dst[:rawSize])
-	if chunkResult < 0 {
-		return CORRUPT_INPUT, 0
-	}
-
-	bytesWritten += chunkResult
+	for {
+		chunkResult := decompressChunk(srcCompressed[:chunkSize], dst[:rawSize], &scratch.backref, scratch.primingLines,
+			recordSeparator(scratch.separator))
+		if chunkResult < 0 {
+			return CORRUPT_INPUT, 0
+		}
 
-	srcCompressed = srcCompressed[chunkSize:]
-	dst = dst[rawSize:]
+		srcCompressed = srcCompressed[chunkSize:]
+		dst = dst[rawSize:]
+		bytesRead += chunkSize + HEADER_SIZE
+		bytesWritten += chunkResult
 
-	for len(srcCompressed) >= HEADER_SIZE {
+		// unpack following chunks as long as they fit entirely; footer (if any) is not a chunk
+		if len(srcCompressed) < HEADER_SIZE || isFooterMarker(srcCompressed) {
+			return bytesRead, bytesWritten
+		}
 		chunkSize, rawSize = readHeader(srcCompressed)
 		srcCompressed = srcCompressed[HEADER_SIZE:]
 		if len(srcCompressed) < chunkSize {
@@ -500,37 +879,91 @@ func Decompress(dst, srcCompressed []byte) (bytesRead, bytesWritten int) {
 		if len(dst) < rawSize {
 			return bytesRead, bytesWritten
 		}
+	}
+}
 
-		bytesWritten += decompressChunk(srcCompressed[:chunkSize], dst[:rawSize])
-		if chunkResult < 0 {
-			return CORRUPT_INPUT, 0
-		}
-
-		srcCompressed = srcCompressed[chunkSize:]
-		dst = dst[rawSize:]
-		bytesRead += chunkSize + HEADER_SIZE
+/*
+Writes digits of the number keyLine has at idxMatchEnd increased by the delta of token (ESCAPE_BYTE has already been
+read) - the ones not copied by the reference before the token. Returns number of bytes written and where the number
+ends in keyLine or corruptNumericDelta if there's no number or the result does not fit in dst.
+*/
+func decodeNumericDelta(keyLine []byte, idxMatchEnd int, token byte, dst []byte) (bytesWritten, keyNumberEnd int) {
+	keyNumberStart, keyNumberEnd := numberAround(keyLine, idxMatchEnd)
+	width := keyNumberEnd - keyNumberStart
+	if width == 0 || width > MAX_NUMERIC_DELTA_DIGITS {
+		return corruptNumericDelta, 0
 	}
-	return bytesRead, bytesWritten
+	var formatted [MAX_NUMERIC_DELTA_DIGITS + 1]byte
+	digits := formatDigits(formatted[:], parseDigits(keyLine[keyNumberStart:keyNumberEnd])+uint64(token)+1, width)
+	// digits before idxMatchEnd are the same in both numbers and have already been copied
+	digits = digits[idxMatchEnd-keyNumberStart:]
+	if len(digits) > len(dst) {
+		return corruptNumericDelta, 0
+	}
+	return copy(dst, digits), keyNumberEnd
 }
 
-func decompressChunk(compressed, dst []byte) (bytesWritten int) {
+// Reasons decompressChunk() fails for. DecompressWith() reports any of them as CORRUPT_INPUT; tests check that
+// the corrupted corpus triggers each of them.
+const (
+	corruptLineRefAtChunkStart = -(iota + 1)
+	corruptReferenceBeyondKeyLine
+	corruptReferenceBeyondRawSize
+	corruptUnfinishedEscape
+	corruptLiteralBeyondRawSize
+	corruptStoredChunkSize
+	corruptNumericDelta
+	corruptSortedChunk
+	corruptEscapeInAsciiChunk
+	corruptReasonsCount = -corruptEscapeInAsciiChunk
+)
+
+// Unpacks one chunk (without header) into dst of the raw size declared in the header. Lines end with separator.
+// Returns number of bytes written or one of corrupt* reasons (negative).
+func decompressChunk(compressed, dst []byte, backref *backrefBuffer, primingLines [][]byte, separator byte) (bytesWritten int) {
 	// fmt.Printf("DecompressChunk() len(compressed): %d; len(dst): %d\n", len(compressed), len(dst))
-	backref := backrefBuffer{}
-	backref.capacity = MAX_BACKREFERENCE_CAPACITY
+	backref.reset(MAX_BACKREFERENCE_CAPACITY)
+	for _, line := range primingLines {
+		backref.add(line)
+	}
 
 	idxLineBegin := bytesWritten
 
+	if compressed[0] == STORED_CHUNK_MARKER {
+		// header declares rawSize one less than chunk size
+		if len(compressed)-1 != len(dst) {
+			return corruptStoredChunkSize
+		}
+		return copy(dst, compressed[1:])
+	}
+	if len(compressed) > 1 && compressed[0] == ESCAPE_BYTE && compressed[1] == SORTED_CHUNK_MARKER {
+		return decompressSortedChunk(compressed[2:], dst, backref, primingLines, separator)
+	}
+	// no literal of ASCII chunk is escaped
+	asciiOnly := len(compressed) > 1 && compressed[0] == ESCAPE_BYTE && compressed[1] == ASCII_CHUNK_MARKER
+	if asciiOnly {
+		compressed = compressed[2:]
+		if len(compressed) == 0 {
+			return corruptEscapeInAsciiChunk
+		}
+	}
+
 	// Is compressed corrupt? If during packing, first byte of the chunk was > ESCAPE_FLAG,
-	// it would have been prefixed/escaped with ESCAPE_FLAG;
-	if compressed[0] > ESCAPE_BYTE {
+	// it would have been prefixed/escaped with ESCAPE_FLAG; so chunk may start with ESCAPE_BYTE (escaped literal)
+	// but never with a line reference (> ESCAPE_BYTE) - there are no lines to refer yet (unless primed).
+	if compressed[0] > ESCAPE_BYTE && len(primingLines) == 0 {
 		// fmt.Println("Decompress() failed! Line ref at the beginning of a chunk");
-		return -1
+		return corruptLineRefAtChunkStart
 	}
 
 	// compressed is advanced one line per outer loop iteration; points to the first char of line
 	for len(compressed) > 0 {
 		var keyLine, lastDecompressedLine []byte
 		idxKeyLine, idxCompressed := 0, 0
+		// where the last reference ended in keyLine (before skipping to a space); numeric delta applies there
+		idxMatchEnd := 0
+		// set by numeric delta token: compressor skips to a space in keyLine before a literal that follows it
+		skipBeforeLiteral := false
 
 		// first char of line contains backreference to a line
 		if compressed[idxCompressed] > ESCAPE_BYTE {
@@ -545,6 +978,7 @@ func decompressChunk(compressed, dst []byte) (bytesWritten int) {
 				idxKeyLine = initialIdxKeyLine
 				compressed = compressed[bytesRead:]
 			}
+			idxMatchEnd = idxKeyLine
 		}
 
 		// For each char in line until newline plus
@@ -558,42 +992,79 @@ func decompressChunk(compressed, dst []byte) (bytesWritten int) {
 				// this check triggers fail when encoded substring reference is longer than the actual referred line (which would cause OOB read)
 				// it fails also in a situation where line reference references linesBefore that is not present in backrefBUffer - 
 				// in such case backrefBuffer will return nil slice and len(nil) is 0 so this will always trigger
+				// Valid input never trips it once a reference exhausted keyLine: compressLine() stops comparing at the end
+				// of keyLine and stores the rest of the line as literals.
 				if len(keyLine)-idxKeyLine < length {
 					// fmt.Println("Decompress() failed! Reference too long for keyLine");
-					return -1
+					return corruptReferenceBeyondKeyLine
+				}
+				// same check as for literals below. Length is never 0 so dst[bytesWritten-1] is the last byte copied
+				if len(dst)-bytesWritten < length {
+					// fmt.Println("Decompress() failed! Actual raw chunk size larger than declared in header");
+					return corruptReferenceBeyondRawSize
 				}
 
 				copy(dst[bytesWritten:], keyLine[idxKeyLine:idxKeyLine+length])
 
-				idxKeyLine = indexOfFirstSpace(idxKeyLine+length, keyLine)
+				idxMatchEnd = idxKeyLine + length
+				idxKeyLine = indexOfFirstSpace(idxMatchEnd, keyLine)
+				skipBeforeLiteral = false
 				bytesWritten += length
 				// LF reached, break to decompress next line
-				if dst[bytesWritten-1] == '\n' {
+				if dst[bytesWritten-1] == separator {
 					lastDecompressedLine = dst[idxLineBegin:bytesWritten]
 					idxLineBegin = bytesWritten
 					break
 				}
 			} else {
+				// literals are copied in runs: up to the next token or escape, or up to LF (inclusive)
+				runEnd := idxCompressed + 1
 				// unquote and copy literally do dst
 				if compressed[idxCompressed] == ESCAPE_BYTE {
 					//skip ESCAPE_BYTE
 					idxCompressed++
 					if idxCompressed >= len(compressed) {
                         // fmt.Println("Decompress() failed! Unfinished escape sequence in input");
-                        return -1;
+                        return corruptUnfinishedEscape;
                     }
+					// ASCII is never escaped - it's a numeric delta
+					if compressed[idxCompressed] < ESCAPE_BYTE {
+						written, keyNumberEnd := decodeNumericDelta(keyLine, idxMatchEnd, compressed[idxCompressed], dst[bytesWritten:])
+						if written < 0 {
+							return written
+						}
+						bytesWritten += written
+						idxKeyLine, idxMatchEnd = keyNumberEnd, keyNumberEnd
+						skipBeforeLiteral = true
+						idxCompressed++
+						continue
+					}
+					if asciiOnly {
+						return corruptEscapeInAsciiChunk
+					}
+					// escaped literal is a single (non-ASCII) byte
+					runEnd = idxCompressed + 1
+				} else {
+					for runEnd < len(compressed) && compressed[runEnd] < ESCAPE_BYTE && compressed[runEnd-1] != separator {
+						runEnd++
+					}
+				}
+				if skipBeforeLiteral {
+					idxKeyLine = indexOfFirstSpace(idxKeyLine, keyLine)
+					skipBeforeLiteral = false
 				}
+				idxMatchEnd = idxKeyLine
 
-				if bytesWritten >= len(dst) {
+				if len(dst)-bytesWritten < runEnd-idxCompressed {
                     // fmt.Println("Decompress() failed! Actual raw chunk size larger than declared in header");
-                    return -1;
+                    return corruptLiteralBeyondRawSize;
                 }
-				dst[bytesWritten] = compressed[idxCompressed]
+				copy(dst[bytesWritten:], compressed[idxCompressed:runEnd])
 
-				idxCompressed++
-				bytesWritten++
+				bytesWritten += runEnd - idxCompressed
+				idxCompressed = runEnd
 				// LF reached, break to decompress next line
-				if dst[bytesWritten-1] == '\n' {
+				if dst[bytesWritten-1] == separator {
 					lastDecompressedLine = dst[idxLineBegin:bytesWritten]
 					idxLineBegin = bytesWritten
 					break
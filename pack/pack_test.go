@@ -1,6 +1,7 @@
 package pack
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"log"
@@ -16,34 +17,81 @@ const (
 	test_max_input_size_bytes = 10 * 1024 * 1024
 	// size guaranteed to fit worstcase compression in all tests
 	test_compression_bound_bytes = 2*test_max_input_size_bytes + 1000
-	path_loghubCorpus            = "./../testData/loghubCorpus/"
-	path_corruptedCorpus         = "./../testData/unpackCorruptedCorpus/"
+	// tests needing particular files of the corpus use it even if LOGPACK_CORPUS is set
+	path_defaultLoghubCorpus = "./../testData/loghubCorpus/"
+	// one archive with 1, 2 and 3 bytes appended
+	path_trailingBytesCorpus = "./../testData/trailingBytesCorpus/"
+
+	// packing whole corpus at every level takes too long
+	test_level_sample_size_bytes = 1000 * 1000
+	// how much bigger output of a higher level may be
+	test_level_size_tolerance = 0.001
 )
 
 var benchmarked_compression_levels = [...]int{4, 9}
 
-func TestPackAndUnpackOnCorpus(t *testing.T) {
-	testPackAndUnpackFromDir(t, path_loghubCorpus)
+// Corpus directories may be overridden with environment variables, eg. to benchmark on your own logs:
+//
+//	LOGPACK_CORPUS=/var/log/myapp go test ./pack -v -run=ThisRegexMatchesNoTest -bench=Packing$
+//
+// Corpus directory holds subdirectories with a *.log file each (like loghubCorpus) or just log files.
+var (
+	path_loghubCorpus    = corpusDirFromEnv("LOGPACK_CORPUS", path_defaultLoghubCorpus)
+	path_corruptedCorpus = corpusDirFromEnv("LOGPACK_CORRUPTED_CORPUS", "./../testData/unpackCorruptedCorpus/")
+)
+
+func corpusDirFromEnv(envVariable, defaultDir string) string {
+	dir := os.Getenv(envVariable)
+	if dir == "" {
+		return defaultDir
+	}
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	return dir
 }
 
-func testPackAndUnpackFromDir(t *testing.T, directory string) {
+type corpusFile struct {
+	name string
+	path string
+}
+
+// The first *.log file of every subdirectory of directory (loghubCorpus layout). If there are no subdirectories
+// every regular file in directory is taken.
+func corpusFiles(directory string) (files []corpusFile) {
 	entries, err := os.ReadDir(directory)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, e := range entries {
+		if e.IsDir() {
+			dir := directory + e.Name() + "/"
+			files = append(files, corpusFile{e.Name(), dir + findFirstLogFile(dir)})
+		}
+	}
+	if len(files) > 0 {
+		return files
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			files = append(files, corpusFile{e.Name(), directory + e.Name()})
+		}
+	}
+	return files
+}
+
+func TestPackAndUnpackOnCorpus(t *testing.T) {
+	testPackAndUnpackFromDir(t, path_loghubCorpus)
+}
 
+func testPackAndUnpackFromDir(t *testing.T, directory string) {
 	inputBuff := make([]byte, test_max_input_size_bytes)
 	packedBuff := make([]byte, test_compression_bound_bytes)
 	unpackedBuff := make([]byte, test_max_input_size_bytes)
 
-	for _, e := range entries {
-		if !e.IsDir() {
-			continue
-		}
-		dir := directory + e.Name() + "/"
-
-		packInputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
-		t.Run(e.Name(), func(t *testing.T) {
+	for _, file := range corpusFiles(directory) {
+		packInputSize := readFileToBuffer(inputBuff, file.path)
+		t.Run(file.name, func(t *testing.T) {
 			// --------- packing
 			packOutputSize := PackBuffer(inputBuff[:packInputSize], packedBuff, COMPRESSION_LEVEL_DEFAULT)
 
@@ -51,7 +99,33 @@ func testPackAndUnpackFromDir(t *testing.T, directory string) {
 			_, unpackOutputSize := Decompress(unpackedBuff, packedBuff[:packOutputSize])
 
 			// --------- test assertions
-			assertInversibility(t, e.Name(), inputBuff, unpackedBuff, packInputSize, unpackOutputSize)
+			assertInversibility(t, file.name, inputBuff, unpackedBuff, packInputSize, unpackOutputSize)
+		})
+	}
+}
+
+// Higher compression level must not yield bigger output. Reference line is chosen by similarity score which only estimates
+// the encoded size, so a higher level may lose by a small margin: eg. whole open_stack sample packs 0.04% bigger at
+// level 9 than at level 8.
+func TestHigherLevelsCompressBetterOnCorpus(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	packedBuff := make([]byte, test_compression_bound_bytes)
+
+	for _, file := range corpusFiles(path_loghubCorpus) {
+		packInputSize := readFileToBuffer(inputBuff, file.path)
+		packInputSize = min2(packInputSize, test_level_sample_size_bytes)
+		t.Run(file.name, func(t *testing.T) {
+			previousOutputSize := PackBuffer(inputBuff[:packInputSize], packedBuff, COMPRESSION_LEVEL_WORST)
+
+			for level := COMPRESSION_LEVEL_WORST + 1; level <= COMPRESSION_LEVEL_BEST; level++ {
+				packOutputSize := PackBuffer(inputBuff[:packInputSize], packedBuff, level)
+
+				if float64(packOutputSize) > float64(previousOutputSize)*(1+test_level_size_tolerance) {
+					t.Errorf("Level %d packed to %d bytes; level %d to %d bytes",
+						level, packOutputSize, level-1, previousOutputSize)
+				}
+				previousOutputSize = packOutputSize
+			}
 		})
 	}
 }
@@ -69,27 +143,55 @@ func findFirstLogFile(path string) string {
 	panic("Dir with benchmark data is corrupted")
 }
 
+// Reads the whole file into inBuff. Fails if the file does not fit - a test would check just its prefix otherwise.
 func readFileToBuffer(inBuff []byte, path string) (fileSize int) {
-	file, err := os.Open(path)
+	fileSize, err := tryReadFileToBuffer(inBuff, path)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return fileSize
+}
+
+func tryReadFileToBuffer(inBuff []byte, path string) (fileSize int, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
 	defer file.Close()
 
-	for {
-		n, err := file.ReadAt(inBuff, int64(fileSize))
+	for fileSize < len(inBuff) {
+		n, err := file.ReadAt(inBuff[fileSize:], int64(fileSize))
 
 		if err != nil && err != io.EOF {
-			log.Fatal(err)
+			return fileSize, err
 		}
 
 		fileSize += n
 
 		if err == io.EOF {
-			break
+			return fileSize, nil
 		}
 	}
-	return
+	// buffer is full; the file must end here
+	var next [1]byte
+	if n, _ := file.ReadAt(next[:], int64(fileSize)); n > 0 {
+		return fileSize, fmt.Errorf("%s does not fit in the %d bytes of test buffer", path, len(inBuff))
+	}
+	return fileSize, nil
+}
+
+func TestReadFileToBufferRejectsTruncation(t *testing.T) {
+	path := t.TempDir() + "/ten.log"
+	os.WriteFile(path, []byte("123456789\n"), 0644)
+
+	for _, size := range []int{10, 11, 100} {
+		if fileSize, err := tryReadFileToBuffer(make([]byte, size), path); err != nil || fileSize != 10 {
+			t.Errorf("Buffer of %d bytes: read %d bytes; err: %v", size, fileSize, err)
+		}
+	}
+	if _, err := tryReadFileToBuffer(make([]byte, 9), path); err == nil {
+		t.Error("File bigger than the buffer read without error")
+	}
 }
 
 func PackBuffer(fileContent, outBuff []byte, compressionLevel int) (totalBytesWritten int) {
@@ -103,6 +205,43 @@ func PackBuffer(fileContent, outBuff []byte, compressionLevel int) (totalBytesWr
 	return
 }
 
+func TestCompressToBufferPacksWholeInput(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	unpackedBuff := make([]byte, test_max_input_size_bytes)
+	dir := path_defaultLoghubCorpus + "apache/"
+	inputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+
+	var packed bytes.Buffer
+	packed.WriteString("already there")
+	read := CompressToBuffer(&packed, inputBuff[:inputSize], COMPRESSION_LEVEL_DEFAULT)
+	if read != inputSize {
+		t.Fatalf("Consumed %d bytes of %d", read, inputSize)
+	}
+	if !bytes.HasPrefix(packed.Bytes(), []byte("already there")) {
+		t.Fatal("Previous content of the buffer was overwritten")
+	}
+	unpackedSize := UnpackBuffer(packed.Bytes()[len("already there"):], unpackedBuff, t)
+	assertInversibility(t, "apache", inputBuff, unpackedBuff, inputSize, unpackedSize)
+
+	packed.Reset()
+	if read := CompressToBuffer(&packed, nil, COMPRESSION_LEVEL_DEFAULT); read != 0 || packed.Len() != 0 {
+		t.Errorf("Empty input packed to %d bytes", packed.Len())
+	}
+}
+
+func packBufferWithOptions(fileContent, outBuff []byte, opts Options) (totalBytesWritten int) {
+	for len(fileContent) > 0 {
+		read, written, err := CompressOpts(outBuff, fileContent, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileContent = fileContent[read:]
+		outBuff = outBuff[written:]
+		totalBytesWritten += written
+	}
+	return
+}
+
 func UnpackBuffer(packedBuffer, outBuff []byte, t *testing.T) int {
 	read, written := Decompress(outBuff, packedBuffer)
 
@@ -152,55 +291,69 @@ func lowerMargin(a int) int {
 
 
 func TestGracefullyFailUnpackingCorruptedArchives(t *testing.T) {
-	entries, err := os.ReadDir(path_corruptedCorpus)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	packedBuff := make([]byte, test_compression_bound_bytes)
 	unpackedBuff := make([]byte, test_max_input_size_bytes)
 
-	for _, e := range entries {
-		path := path_corruptedCorpus + e.Name()
-
-		unpackInputSize := readFileToBuffer(packedBuff, path)
-		t.Run(e.Name(), func(t *testing.T) {
+	for _, file := range corpusFiles(path_corruptedCorpus) {
+		unpackInputSize := readFileToBuffer(packedBuff, file.path)
+		t.Run(file.name, func(t *testing.T) {
 			// ---------try to unpack
 			bytesRead, _ := Decompress(unpackedBuff, packedBuff[:unpackInputSize])
 
 			if bytesRead != CORRUPT_INPUT {
-				t.Errorf("Failed to detect corrupted *.lp archive! file: %s", e.Name())
+				t.Errorf("Failed to detect corrupted *.lp archive! file: %s", file.name)
 				return
 			}
 		})
 	}
 }
 
-////////////////////
-
-func BenchmarkPacking(b *testing.B) {
+// Every way decompressChunk() detects corruption must be exercised by some file of the corrupted corpus.
+func TestCorruptedCorpusCoversEveryFailureReason(t *testing.T) {
+	packedBuff := make([]byte, test_compression_bound_bytes)
+	unpackedBuff := make([]byte, DecompressBound())
+	covered := make(map[int][]string)
+
+	for _, file := range corpusFiles(path_corruptedCorpus) {
+		packed := packedBuff[:readFileToBuffer(packedBuff, file.path)]
+		var backref backrefBuffer
+		// the same walk over chunks as DecompressWith() does
+		for len(packed) >= HEADER_SIZE {
+			chunkSize, rawSize := readHeader(packed)
+			if len(packed)-HEADER_SIZE < chunkSize {
+				break
+			}
+			result := decompressChunk(packed[HEADER_SIZE:HEADER_SIZE+chunkSize], unpackedBuff[:rawSize], &backref, nil, '\n')
+			if result < 0 {
+				covered[result] = append(covered[result], file.name)
+				break
+			}
+			packed = packed[HEADER_SIZE+chunkSize:]
+		}
+	}
 
-	entries, err := os.ReadDir(path_loghubCorpus)
-	if err != nil {
-		log.Fatal(err)
+	for reason := -1; reason >= -corruptReasonsCount; reason-- {
+		if len(covered[reason]) == 0 {
+			t.Errorf("No file of %s fails for reason %d", path_corruptedCorpus, reason)
+		}
 	}
+}
+
+////////////////////
 
+func BenchmarkPacking(b *testing.B) {
 	inputBuff := make([]byte, test_max_input_size_bytes)
 	packedBuff := make([]byte, test_max_input_size_bytes)
 	unpackedBuff := make([]byte, test_max_input_size_bytes)
 
 	for _, compressionLevel := range benchmarked_compression_levels {
-		for _, e := range entries {
-			if !e.IsDir() {
-				continue
-			}
-			dir := path_loghubCorpus + e.Name() + "/"
-			packInputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+		for _, file := range corpusFiles(path_loghubCorpus) {
+			packInputSize := readFileToBuffer(inputBuff, file.path)
 			var packOutputSize int
 
 			// --------- benchmark packing
 			level_str := "_level_" + strconv.Itoa(compressionLevel) + "_"
-			b.Run("pack" + level_str+e.Name(), func(b *testing.B) {
+			b.Run("pack" + level_str+file.name, func(b *testing.B) {
 				for i := 0; i < b.N; i++ {
 					// report MB/s
 					b.SetBytes(int64(packInputSize))
@@ -209,7 +362,7 @@ func BenchmarkPacking(b *testing.B) {
 				}
 				b.ReportMetric(float64(packInputSize)/float64(packOutputSize), "compRatio")
 			})
-			b.Run("unpack" + level_str + e.Name(), func(b *testing.B) {
+			b.Run("unpack" + level_str + file.name, func(b *testing.B) {
 				for i := 0; i < b.N; i++ {
 					b.SetBytes(int64(packOutputSize))
 					Decompress(unpackedBuff, packedBuff[:packOutputSize])
@@ -219,12 +372,78 @@ func BenchmarkPacking(b *testing.B) {
 	}
 }
 
-func BenchmarkVsZstd(b *testing.B) {
-	entries, err := os.ReadDir(path_loghubCorpus)
-	if err != nil {
-		log.Fatal(err)
+// Steady-state decoding throughput: one big archive (sample of every corpus file) is unpacked in a tight loop
+// with reused Scratch. Setup is done outside of the timed loop. MB/s are reported in unpacked bytes, as zstd does.
+func BenchmarkUnpackSteadyState(b *testing.B) {
+	input := readCorpusSample(test_level_sample_size_bytes)
+
+	for _, compressionLevel := range benchmarked_compression_levels {
+		packedBuff := make([]byte, 2*len(input)+DecompressBound())
+		unpackedBuff := make([]byte, len(input))
+		packedSize := PackBuffer(input, packedBuff, compressionLevel)
+		var scratch Scratch
+
+		b.Run("level_"+strconv.Itoa(compressionLevel), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, written := DecompressWith(unpackedBuff, packedBuff[:packedSize], &scratch); written != len(input) {
+					b.Fatalf("Unpacked %d bytes; expected %d", written, len(input))
+				}
+			}
+		})
+	}
+}
+
+// Ratio and speed as Options.MaxSimilarity varies
+func BenchmarkMaxSimilarity(b *testing.B) {
+	input := readCorpusSample(test_level_sample_size_bytes)
+	packedBuff := make([]byte, 2*len(input)+DecompressBound())
+
+	for _, maxSimilarity := range []int{35, 70, MAX_SIMILARITY, 2 * MAX_SIMILARITY, 8 * MAX_SIMILARITY, MAX_CHUNK_SIZE} {
+		opts := Options{CompressionLevel: COMPRESSION_LEVEL_DEFAULT, MaxSimilarity: maxSimilarity}
+		b.Run("max_similarity_"+strconv.Itoa(maxSimilarity), func(b *testing.B) {
+			var packOutputSize int
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				packOutputSize = packBufferWithOptions(input, packedBuff, opts)
+			}
+			b.ReportMetric(float64(len(input))/float64(packOutputSize), "compRatio")
+		})
 	}
+}
+
+// Concatenation of up to sampleSize bytes of every file in the corpus
+func readCorpusSample(sampleSize int) (sample []byte) {
+	fileBuff := make([]byte, test_max_input_size_bytes)
+	for _, file := range corpusFiles(path_loghubCorpus) {
+		fileSize := readFileToBuffer(fileBuff, file.path)
+		sample = append(sample, fileBuff[:min2(fileSize, sampleSize)]...)
+	}
+	return sample
+}
 
+func BenchmarkQuote(b *testing.B) {
+	// long mostly-ASCII line, like in a typical log
+	line := []byte(strings.Repeat("2005-06-09 06:07:04 [notice] LDAP: SSL support unavailable ", 1000) + "\xc5\xbc\n")
+	dst := make([]byte, 2*len(line))
+
+	b.Run("quote", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.SetBytes(int64(len(line)))
+			quote(dst, line)
+		}
+	})
+	b.Run("quoteSafely", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.SetBytes(int64(len(line)))
+			quoteSafely(dst, line)
+		}
+	})
+}
+
+func BenchmarkVsZstd(b *testing.B) {
 	inputBuff        := make([]byte, test_max_input_size_bytes)
 	packedStage1Buff := make([]byte, test_max_input_size_bytes)
 	packedStage2Buff := make([]byte, test_max_input_size_bytes)
@@ -234,20 +453,14 @@ func BenchmarkVsZstd(b *testing.B) {
 	var totalLp4ZstdompressedSize int64
 	var totalLp9ZstdompressedSize int64
 
-	for _,e := range entries {
-		if !e.IsDir() {
-			continue
-		}
-
-		
+	for _, file := range corpusFiles(path_loghubCorpus) {
 		var packStage1OutputSize int
 		var ratio_zstd float64
 
-		dir := path_loghubCorpus + e.Name() + "/"
-		packInputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+		packInputSize := readFileToBuffer(inputBuff, file.path)
 		totalInputSize += int64(packInputSize)
 
-		b.Run("zstd_" + e.Name(), func(b *testing.B) {
+		b.Run("zstd_" + file.name, func(b *testing.B) {
 			for i := 0; i < b.N; i++ {
 				// report MB/s
 				b.SetBytes(int64(packInputSize))
@@ -270,7 +483,7 @@ func BenchmarkVsZstd(b *testing.B) {
 
 			var packStage2OutputSize int
 			
-			b.Run("lp" + levelStr + "zstd_"+e.Name(), func(b *testing.B) {
+			b.Run("lp" + levelStr + "zstd_"+file.name, func(b *testing.B) {
 				for i := 0; i < b.N; i++ {
 					// report MB/s
 					b.SetBytes(int64(packInputSize))
@@ -0,0 +1,55 @@
+package pack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+)
+
+// How many first bytes of lines backrefBuffer indexes them by (see backrefBuffer.findSamePrefixLine()).
+const INDEXED_PREFIX_SIZE = SIZEOF_INT64
+
+// First INDEXED_PREFIX_SIZE bytes of line as a number; 0 for shorter lines.
+func prefixKey(line []byte) uint64 {
+	if len(line) < INDEXED_PREFIX_SIZE {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(line)
+}
+
+/*
+Looks up the most recent line of the buffer that chooseReferenceLine() with goodEnoughPercent 100 would stop at:
+one whose first min(len(line), maxSimilarity) bytes are the same as of line. Nothing else is that similar - after
+a mismatch the rest of the compared chars is never all matched - and it scores higher than any line that is not,
+so the linear search returns exactly this line when there is one. Only lines with the same prefix key are compared.
+found is false if there's no such line or line is too short to be looked up by its prefix.
+*/
+func (backref *backrefBuffer) findSamePrefixLine(line []byte, maxSimilarity int) (lineRef lineReference, found bool) {
+	compared := min2(len(line), maxSimilarity)
+	if compared < INDEXED_PREFIX_SIZE {
+		return lineRef, false
+	}
+	key := prefixKey(line)
+	// most lines have no such line; a tight loop over all keys (stale ones of free slots too) tells it quickly
+	if !slices.Contains(backref.prefixes[:backref.capacity], key) {
+		return lineRef, false
+	}
+	for linesBefore, size := 1, backref.size(); linesBefore <= size; linesBefore++ {
+		i := backref.writeIdx - linesBefore
+		// wrap around
+		if i < 0 {
+			i = backref.capacity + i
+		}
+		if backref.prefixes[i] != key || len(backref.lines[i]) < compared ||
+			!bytes.Equal(backref.lines[i][:compared], line[:compared]) {
+			continue
+		}
+		lineRef.linesBefore = byte(linesBefore)
+		lineRef.line = backref.lines[i]
+		prefixLength, similarity, scatteredMatches := estimateSimilarity(lineRef.line, line, maxSimilarity)
+		lineRef.prefixLength = prefixLength
+		lineRef.similarityScore = similarity - SCATTERED_MATCH_COST*scatteredMatches
+		return lineRef, true
+	}
+	return lineRef, false
+}
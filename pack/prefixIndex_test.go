@@ -0,0 +1,79 @@
+package pack
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// Log of a few long lines repeated over and over, each far back in the window at level 9.
+func repeatedLinesLog(lines int) []byte {
+	var log bytes.Buffer
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&log, "worker %02d finished processing the queue of pending requests and went back to sleep\n", i*7%50)
+	}
+	return log.Bytes()
+}
+
+// References chooseReferenceLine() picks for every line of src, each line added to the window after it.
+func chooseReferences(src []byte, compressionParams compressionParameters, indexed bool) (refs []lineReference) {
+	backref := backrefBuffer{capacity: int(compressionParams.backreferenceCapacity), indexed: indexed}
+	for line, next := nextRecord(src, '\n'); len(line) > 0; line, next = nextRecord(next, '\n') {
+		refs = append(refs, backref.chooseReferenceLine(line, compressionParams.goodEnoughPercent, MAX_SIMILARITY))
+		backref.add(line)
+	}
+	return refs
+}
+
+func TestIndexedSearchChoosesSameLinesAsLinear(t *testing.T) {
+	inputs := map[string][]byte{
+		"corpus sample":  readCorpusSample(100 * 1000),
+		"repeated lines": repeatedLinesLog(5000),
+		"short lines":    []byte("a\nb\na\n1234567\n1234567\n12345678\n12345678\n\n\n"),
+	}
+	for name, input := range inputs {
+		for level := COMPRESSION_LEVEL_WORST; level <= COMPRESSION_LEVEL_BEST; level++ {
+			params := getCompressionParameters(level)
+			linear, indexed := chooseReferences(input, params, false), chooseReferences(input, params, true)
+			for i := range linear {
+				if indexed[i].linesBefore != linear[i].linesBefore || indexed[i].prefixLength != linear[i].prefixLength ||
+					indexed[i].similarityScore != linear[i].similarityScore || !bytes.Equal(indexed[i].line, linear[i].line) {
+					t.Fatalf("%s, level %d, line %d: indexed search chose %+v; linear %+v", name, level, i, indexed[i], linear[i])
+				}
+			}
+		}
+	}
+}
+
+func TestIndexedSearchPacksSameBytes(t *testing.T) {
+	input := append(repeatedLinesLog(5000), readCorpusSample(10*1000)...)
+	opts := Options{CompressionLevel: COMPRESSION_LEVEL_BEST}
+	plain := make([]byte, 2*len(input)+DecompressBound())
+	plain = plain[:packBufferWithOptions(input, plain, opts)]
+	opts.IndexedSearch = true
+	indexed := make([]byte, 2*len(input)+DecompressBound())
+	indexed = indexed[:packBufferWithOptions(input, indexed, opts)]
+	if !bytes.Equal(indexed, plain) {
+		t.Errorf("Packed to %d bytes with index, %d without; expected the same bytes", len(indexed), len(plain))
+	}
+}
+
+// Reference search at level 9 with and without the prefix index. Loghub sample rarely repeats the first
+// MAX_SIMILARITY chars of a line, so the index hardly ever finds a line; repeated lines are found at once.
+func BenchmarkIndexedSearch(b *testing.B) {
+	inputs := map[string][]byte{
+		"loghub":   readCorpusSample(test_level_sample_size_bytes / 10),
+		"repeated": repeatedLinesLog(20000),
+	}
+	params := getCompressionParameters(COMPRESSION_LEVEL_BEST)
+	for name, input := range inputs {
+		for _, indexed := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s_indexed_%v", name, indexed), func(b *testing.B) {
+				b.SetBytes(int64(len(input)))
+				for i := 0; i < b.N; i++ {
+					chooseReferences(input, params, indexed)
+				}
+			})
+		}
+	}
+}
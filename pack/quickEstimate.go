@@ -0,0 +1,37 @@
+package pack
+
+/*
+Rough compressibility of sample, cheap enough to decide whether to pack at all: fraction of its bytes that are in
+the prefix each line shares with the line before it. 0 if no line starts like the previous one, close to 1 if every
+line repeats it. Takes a single pass comparing neighbouring lines - no references are chosen and nothing is encoded
+- at about 1 GB/s on the corpus sample, several times faster than packing at the default level (see
+BenchmarkQuickEstimate).
+
+It is a heuristic, not a ratio: matches past the shared prefix and references to older lines are not counted (so
+the actual saving is usually bigger), while the cost of encoding the rest of lines is not estimated at all. Compare
+scores of samples with each other rather than with a ratio.
+*/
+func QuickEstimate(sample []byte) float64 {
+	if len(sample) == 0 {
+		return 0
+	}
+	sharedBytes := 0
+	prevLine, rest := nextLine(sample)
+	for len(rest) > 0 {
+		var line []byte
+		line, rest = nextLine(rest)
+		sharedBytes += sharedPrefixLength(prevLine, line)
+		prevLine = line
+	}
+	return float64(sharedBytes) / float64(len(sample))
+}
+
+func sharedPrefixLength(a, b []byte) int {
+	length := min2(len(a), len(b))
+	for i := 0; i < length; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return length
+}
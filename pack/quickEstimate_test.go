@@ -0,0 +1,52 @@
+package pack
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestQuickEstimateOfSharedPrefixes(t *testing.T) {
+	noise := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(noise)
+
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected float64
+	}{
+		{"empty", "", 0},
+		{"single line", "only line\n", 0},
+		// the first of 4 lines is not counted
+		{"repeated line", strings.Repeat("same line\n", 4), 0.75},
+		{"quarter shared", "abc12\nabc34\n", 0.25},
+		{"no shared prefix", "first\nsecond\nthird\n", 0},
+	} {
+		if estimate := QuickEstimate([]byte(tc.input)); estimate != tc.expected {
+			t.Errorf("%s: estimated %v; expected %v", tc.name, estimate, tc.expected)
+		}
+	}
+	if estimate := QuickEstimate(noise); estimate > 0.01 {
+		t.Errorf("Random bytes estimated %v", estimate)
+	}
+}
+
+func TestQuickEstimateOfCorpusSample(t *testing.T) {
+	input := readCorpusSample(test_level_sample_size_bytes)
+	repeated := []byte(strings.Repeat("2024-03-17 12:00:00 INFO request served\n", 10000))
+
+	if corpus, lines := QuickEstimate(input), QuickEstimate(repeated); !(0 < corpus && corpus < lines) {
+		t.Errorf("Estimated corpus sample %v, repeated lines %v", corpus, lines)
+	}
+}
+
+// Speed of QuickEstimate() on the corpus sample; compare with BenchmarkPacking.
+func BenchmarkQuickEstimate(b *testing.B) {
+	input := readCorpusSample(test_level_sample_size_bytes)
+	b.SetBytes(int64(len(input)))
+	var estimate float64
+	for i := 0; i < b.N; i++ {
+		estimate = QuickEstimate(input)
+	}
+	b.ReportMetric(estimate, "estimate")
+}
@@ -0,0 +1,207 @@
+package pack
+
+import (
+	"bytes"
+	"io"
+)
+
+// Reader unpacks a Logpack archive read from the underlying io.Reader. Both archives with a header
+// (as written by Writer) and headerless ones are accepted. The trailer (if any) is never returned as content.
+type Reader struct {
+	r      io.Reader
+	header ArchiveHeader
+	// compressed data read from r; the part not unpacked yet is pending
+	buff    []byte
+	pending []byte
+	// unpacked data not returned to the caller yet
+	unpacked     []byte
+	unpackedBuff []byte
+	scratch      Scratch
+	// restores timestamps if the archive has them encoded; output goes to decoded
+	timestamps *TimestampCodec
+	decoded    bytes.Buffer
+	primed     bool
+	// unpacked bytes returned by Read() so far
+	offset int64
+	// digest of the original content stored in the trailer (see FLAG_DIGEST); set once chunks are over
+	digest []byte
+	eof    bool
+	err    error
+}
+
+// Returns a Reader unpacking archive read from r. The archive header is read (and validated) right away.
+// Archives of a second stage that is not registered (see RegisterSecondStage()) fail with ErrUnknownSecondStage.
+func NewReader(r io.Reader) (*Reader, error) {
+	// whole chunk plus the trailer has to fit in the buffer
+	buffSize := 2*DecompressBound() + MAX_ARCHIVE_HEADER_SIZE
+	reader := &Reader{
+		r:            r,
+		buff:         make([]byte, buffSize),
+		unpackedBuff: make([]byte, DecompressBound()),
+	}
+	reader.pending = reader.buff[:0]
+
+	for len(reader.pending) < MAX_ARCHIVE_HEADER_SIZE && !reader.eof {
+		if err := reader.fill(); err != nil {
+			return nil, err
+		}
+	}
+	header, headerSize, err := ReadArchiveHeader(reader.pending)
+	if err != nil {
+		return nil, err
+	}
+	reader.header = header
+	reader.pending = reader.pending[headerSize:]
+	if header.SecondStage != "" {
+		stage, err := lookupSecondStage(header.SecondStage)
+		if err != nil {
+			return nil, err
+		}
+		// frames read along with the header are unwrapped first
+		framed := bytes.Clone(reader.pending)
+		reader.r = &secondStageReader{r: io.MultiReader(bytes.NewReader(framed), r), stage: stage}
+		reader.pending, reader.eof = reader.buff[:0], false
+	}
+	reader.scratch.SetRecordSeparator(header.RecordSeparator)
+	if header.TimestampPattern != "" {
+		reader.timestamps, err = NewTimestampDecoder(&reader.decoded, header.TimestampPattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return reader, nil
+}
+
+// Compression level the archive was packed at or 0 if the archive does not store it.
+func (r *Reader) Level() int {
+	return r.header.CompressionLevel
+}
+
+// Header of the archive being read.
+func (r *Reader) Header() ArchiveHeader {
+	return r.header
+}
+
+// Number of unpacked bytes returned by Read() so far, ie. offset in the unpacked content the next Read()
+// starts at.
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Primes unpacking with the lines the archive was primed with when packing (see Compressor.Prime()). Returns
+// ErrPrimingMismatch if header of the archive identifies other lines. Must be called before the first Read().
+func (r *Reader) Prime(lines [][]byte) error {
+	if !r.header.Primed || PrimingHash(lines) != r.header.PrimingHash {
+		return ErrPrimingMismatch
+	}
+	r.scratch.Prime(lines)
+	r.primed = true
+	return nil
+}
+
+// Reads unpacked content into p. Returns io.EOF after the last chunk, ErrCorruptInput if the archive
+// is damaged and io.ErrUnexpectedEOF if it ends in the middle of a chunk. Primed archive cannot be read
+// (ErrPrimingMismatch is returned) until Prime() is called.
+// Part of a chunk is never unpacked: on a stream still being written (eg. a pipe) Read() keeps reading the
+// underlying reader, and blocks as long as it does, until the chunk is complete. Only the end of the stream
+// before that makes the archive truncated.
+func (r *Reader) Read(p []byte) (n int, err error) {
+	if r.header.Primed && !r.primed {
+		return 0, ErrPrimingMismatch
+	}
+	for len(r.unpacked) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.unpackChunks()
+		if r.timestamps != nil {
+			r.err = r.decodeTimestamps(r.err)
+		}
+	}
+	n = copy(p, r.unpacked)
+	r.unpacked = r.unpacked[n:]
+	r.offset += int64(n)
+	return n, nil
+}
+
+// Unpacks as many chunks as fit in r.unpackedBuff. Footer and trailer bytes at the end of the archive are never
+// passed to the decompressor.
+func (r *Reader) unpackChunks() error {
+	trailerSize := r.header.TrailerSize()
+	for {
+		if r.header.Footer && isFooterMarker(r.pending) {
+			return r.skipFooter()
+		}
+		if len(r.pending) > trailerSize {
+			read, written := DecompressWith(r.unpackedBuff, r.pending[:len(r.pending)-trailerSize], &r.scratch)
+			if read > 0 {
+				r.pending = r.pending[read:]
+				r.unpacked = r.unpackedBuff[:written]
+				return nil
+			}
+			if read == CORRUPT_INPUT {
+				return ErrCorruptInput
+			}
+			// NOT_ENOUGH_INPUT - read more
+		}
+		if r.eof {
+			if len(r.pending) == trailerSize {
+				r.keepDigest()
+				return io.EOF
+			}
+			return io.ErrUnexpectedEOF
+		}
+		if err := r.fill(); err != nil {
+			return err
+		}
+	}
+}
+
+// Passes r.unpacked through the timestamp decoder. Returns err of unpacking or error of decoding.
+func (r *Reader) decodeTimestamps(err error) error {
+	r.decoded.Reset()
+	var decodeErr error
+	if err == nil {
+		_, decodeErr = r.timestamps.Write(r.unpacked)
+	} else if err == io.EOF {
+		decodeErr = r.timestamps.Close()
+	}
+	r.unpacked = r.decoded.Bytes()
+	if decodeErr != nil {
+		return decodeErr
+	}
+	return err
+}
+
+// Reads the rest of the archive (footer and trailer) without returning it, keeping just the trailer. Chunks are over.
+func (r *Reader) skipFooter() error {
+	trailerSize := r.header.TrailerSize()
+	for !r.eof {
+		r.pending = r.pending[max(0, len(r.pending)-trailerSize):]
+		if err := r.fill(); err != nil {
+			return err
+		}
+	}
+	if len(r.pending) < trailerSize {
+		return io.ErrUnexpectedEOF
+	}
+	r.keepDigest()
+	return io.EOF
+}
+
+// Keeps the digest at the end of r.pending, which must end with the trailer.
+func (r *Reader) keepDigest() {
+	r.digest = r.pending[len(r.pending)-DigestSize(r.header.Digest):]
+}
+
+// Moves pending data to the beginning of the buffer and reads from r after it.
+func (r *Reader) fill() error {
+	r.pending = r.buff[:copy(r.buff, r.pending)]
+	n, err := r.r.Read(r.buff[len(r.pending):])
+	r.pending = r.buff[:len(r.pending)+n]
+	if err == io.EOF {
+		r.eof = true
+		return nil
+	}
+	return err
+}
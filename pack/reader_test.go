@@ -0,0 +1,236 @@
+package pack
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReaderUnpacksWriterOutput(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	dir := path_defaultLoghubCorpus + "apache/"
+	inputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+
+	var packed bytes.Buffer
+	w := NewWriter(&packed, 7)
+	w.Write(inputBuff[:inputSize])
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(&packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Level() != 7 {
+		t.Errorf("Expected level 7; got %d", r.Level())
+	}
+	unpacked, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertInversibility(t, "apache", inputBuff, unpacked, inputSize, len(unpacked))
+}
+
+func TestReaderStoresNormalizedLevel(t *testing.T) {
+	for _, tc := range []struct{ level, expected int }{
+		{0, COMPRESSION_LEVEL_DEFAULT}, {-1, COMPRESSION_LEVEL_WORST}, {12, COMPRESSION_LEVEL_BEST},
+	} {
+		var packed bytes.Buffer
+		NewWriter(&packed, tc.level).Close()
+
+		r, err := NewReader(&packed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Level() != tc.expected {
+			t.Errorf("Packed at %d; expected level %d, got %d", tc.level, tc.expected, r.Level())
+		}
+	}
+}
+
+func TestReaderReadsHeaderlessArchive(t *testing.T) {
+	input := []byte("first line\nsecond line\nsecond line\n")
+	packed := make([]byte, DecompressBound())
+	packedSize := PackBuffer(input, packed, COMPRESSION_LEVEL_BEST)
+
+	r, err := NewReader(bytes.NewReader(packed[:packedSize]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Level() != 0 || r.Header().Version != 0 {
+		t.Errorf("Headerless archive has no level; got header %v", r.Header())
+	}
+	unpacked, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(unpacked, input) {
+		t.Errorf("Expected %q; got %q, err: %v", input, unpacked, err)
+	}
+}
+
+func TestReaderReadsVersion1Header(t *testing.T) {
+	input := []byte("some line\n")
+	archive := append([]byte(ARCHIVE_MAGIC), 1, FLAG_DIGEST, DIGEST_MD5)
+	chunk := make([]byte, DecompressBound())
+	_, chunkSize := Compress(chunk, input, COMPRESSION_LEVEL_DEFAULT)
+	archive = append(archive, chunk[:chunkSize]...)
+	digest := NewDigest(DIGEST_MD5)
+	digest.Write(input)
+	archive = digest.Sum(archive)
+
+	r, err := NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := r.Header(); header.Version != 1 || header.Digest != DIGEST_MD5 || r.Level() != 0 {
+		t.Errorf("Unexpected version 1 header: %v", header)
+	}
+	// trailer must not be unpacked as a chunk
+	unpacked, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(unpacked, input) {
+		t.Errorf("Expected %q; got %q, err: %v", input, unpacked, err)
+	}
+}
+
+// Archives of later versions are read unless they need a bigger window or a feature unknown to this version.
+func TestReaderReadsLaterVersionsThatFitWindow(t *testing.T) {
+	dir := path_defaultLoghubCorpus + "apache/"
+	input, _ := os.ReadFile(dir + findFirstLogFile(dir))
+	chunks := make([]byte, 2*len(input)+DecompressBound())
+	chunks = chunks[:packBufferWithOptions(input, chunks, Options{CompressionLevel: COMPRESSION_LEVEL_BEST})]
+	archiveWith := func(header ArchiveHeader, patch func(header []byte)) []byte {
+		archive := make([]byte, MAX_ARCHIVE_HEADER_SIZE)
+		archive = archive[:StoreArchiveHeader(archive, header)]
+		patch(archive)
+		return append(archive, chunks...)
+	}
+	versionOffset := len(ARCHIVE_MAGIC)
+	// offsets of backreference capacity and required features
+	capacityOffset, featuresOffset := versionOffset+3, versionOffset+4
+
+	for _, tc := range []struct {
+		name     string
+		header   ArchiveHeader
+		patch    func(header []byte)
+		expected error
+	}{
+		{"window of current version", ArchiveHeader{BackreferenceCapacity: MAX_BACKREFERENCE_CAPACITY},
+			func([]byte) {}, nil},
+		{"smaller window", ArchiveHeader{BackreferenceCapacity: 16}, func([]byte) {}, nil},
+		{"unknown extension", ArchiveHeader{BackreferenceCapacity: 16, Extension: []byte("field of version 5")},
+			func(header []byte) { header[versionOffset] = 5 }, nil},
+		{"bigger window", ArchiveHeader{BackreferenceCapacity: 16},
+			func(header []byte) { header[capacityOffset] = 2 * MAX_BACKREFERENCE_CAPACITY }, ErrUnsupportedWindow},
+		{"unknown required feature", ArchiveHeader{BackreferenceCapacity: 16},
+			func(header []byte) { header[featuresOffset] = 0x80 }, ErrUnsupportedVersion},
+		{"zero window", ArchiveHeader{BackreferenceCapacity: 16},
+			func(header []byte) { header[capacityOffset] = 0 }, ErrCorruptInput},
+	} {
+		archive := archiveWith(tc.header, tc.patch)
+		r, err := NewReader(bytes.NewReader(archive))
+		if err != tc.expected {
+			t.Errorf("%s: expected %v; got %v", tc.name, tc.expected, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if header := r.Header(); header.BackreferenceCapacity != tc.header.BackreferenceCapacity ||
+			!bytes.Equal(header.Extension, tc.header.Extension) {
+			t.Errorf("%s: unexpected header %v", tc.name, header)
+		}
+		if unpacked, err := io.ReadAll(r); err != nil || !bytes.Equal(unpacked, input) {
+			t.Errorf("%s: unpacked %d bytes differ from %d packed, err: %v", tc.name, len(unpacked), len(input), err)
+		}
+	}
+}
+
+func TestReaderReportsTruncatedArchive(t *testing.T) {
+	var packed bytes.Buffer
+	w := NewWriter(&packed, COMPRESSION_LEVEL_DEFAULT)
+	w.Write([]byte("a line that will get cut off\n"))
+	w.Close()
+
+	r, err := NewReader(bytes.NewReader(packed.Bytes()[:packed.Len()-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF; got %v", err)
+	}
+}
+
+func TestReaderWaitsForChunksOfTricklingStream(t *testing.T) {
+	input := interleavedLog(5000)
+	archives := make(map[string][]byte)
+	for name, opts := range map[string]WriterOptions{
+		"plain":        {},
+		"footer":       {Footer: true},
+		"flushed":      {FlushEveryLines: 7},
+		"second stage": {Options: Options{SecondStage: GzipSecondStage{}}},
+	} {
+		archives[name] = packWithOpts(t, input, opts)
+	}
+	// digest trailer is written by the CLI only
+	digest := NewDigest(DIGEST_SHA256)
+	digest.Write(input)
+	withDigest := make([]byte, MAX_ARCHIVE_HEADER_SIZE)
+	withDigest = withDigest[:StoreArchiveHeader(withDigest, ArchiveHeader{Digest: DIGEST_SHA256})]
+	packed := make([]byte, 2*len(input)+DecompressBound())
+	withDigest = append(withDigest, packed[:packBufferWithOptions(input, packed, Options{})]...)
+	archives["digest"] = digest.Sum(withDigest)
+
+	for name, archive := range archives {
+		// bytes arrive one at a time, as from a stream still being written
+		stream, streamWriter := io.Pipe()
+		go func(archive []byte) {
+			for i := range archive {
+				streamWriter.Write(archive[i : i+1])
+			}
+			streamWriter.Close()
+		}(archive)
+		r, err := NewReader(stream)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if unpacked, err := io.ReadAll(r); err != nil || !bytes.Equal(unpacked, input) {
+			t.Errorf("%s: unpacked %d bytes of %d; err: %v", name, len(unpacked), len(input), err)
+		}
+
+		// stream that ends in the middle of a chunk is truncated
+		r, err = NewReader(iotest.OneByteReader(bytes.NewReader(archive[:len(archive)/2])))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := io.ReadAll(r); err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: expected io.ErrUnexpectedEOF of archive cut in half; got %v", name, err)
+		}
+	}
+}
+
+func TestReaderOffsetCountsUnpackedBytes(t *testing.T) {
+	input := bytes.Repeat([]byte("some line of the log\n"), 10000)
+	var packed bytes.Buffer
+	w := NewWriter(&packed, COMPRESSION_LEVEL_DEFAULT)
+	w.Write(input)
+	w.Close()
+
+	r, _ := NewReader(&packed)
+	buff := make([]byte, 1000)
+	for {
+		n, err := r.Read(buff)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset := r.Offset(); !bytes.Equal(buff[:n], input[offset-int64(n):offset]) {
+			t.Fatalf("Read ending at offset %d returned wrong data", offset)
+		}
+	}
+	if r.Offset() != int64(len(input)) {
+		t.Errorf("Expected offset %d at the end; got %d", len(input), r.Offset())
+	}
+}
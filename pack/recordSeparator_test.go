@@ -0,0 +1,109 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+const test_record_separator = 0x1e
+
+// Records of several lines each (eg. messages with stack traces), ended with test_record_separator.
+func multilineRecords(records int) []byte {
+	var sb strings.Builder
+	for i := 0; i < records; i++ {
+		fmt.Fprintf(&sb, "2024-05-17 12:%02d:%02d ERROR request %d failed\n", i/60%60, i%60, i)
+		for frame := 0; frame < i%4; frame++ {
+			fmt.Fprintf(&sb, "\tat handler.serve(handler.go:%d)\n", 100+frame)
+		}
+		sb.WriteByte(test_record_separator)
+	}
+	return []byte(sb.String())
+}
+
+func TestRecordSeparatorRoundTripsThroughWriterAndReader(t *testing.T) {
+	input := multilineRecords(5000)
+	for _, level := range []int{COMPRESSION_LEVEL_WORST, COMPRESSION_LEVEL_BEST} {
+		packed := packWithOpts(t, input,
+			WriterOptions{Options: Options{CompressionLevel: level, RecordSeparator: test_record_separator}})
+		header, _, err := ReadArchiveHeader(packed)
+		if err != nil || header.RecordSeparator != test_record_separator || packed[len(ARCHIVE_MAGIC)+1]&FLAG_RECORD_SEPARATOR == 0 {
+			t.Errorf("Level %d: expected record separator in header; got %+v, err: %v", level, header, err)
+		}
+		r, _ := NewReader(bytes.NewReader(packed))
+		if unpacked, err := io.ReadAll(r); err != nil || !bytes.Equal(unpacked, input) {
+			t.Errorf("Level %d: did not unpack to input; err: %v", level, err)
+		}
+		plain := packWithOpts(t, input, WriterOptions{Options: Options{CompressionLevel: level}})
+		t.Logf("Level %d: %.2fx with record separator; %.2fx with '\\n'", level,
+			float64(len(input))/float64(len(packed)), float64(len(input))/float64(len(plain)))
+	}
+}
+
+func TestRecordSeparatorRoundTripsThroughCompressOpts(t *testing.T) {
+	input := multilineRecords(300)
+	packed := make([]byte, DecompressBound())
+	read, written, err := CompressOpts(packed, input, Options{RecordSeparator: test_record_separator})
+	if err != nil || read != len(input) {
+		t.Fatalf("Packed %d of %d bytes; err: %v", read, len(input), err)
+	}
+	unpacked := make([]byte, len(input))
+	_, unpackedSize, err := DecompressOpts(unpacked, packed[:written],
+		DecompressOptions{RecordSeparator: test_record_separator})
+	if err != nil || !bytes.Equal(unpacked[:unpackedSize], input) {
+		t.Errorf("Did not unpack to input; err: %v", err)
+	}
+}
+
+func TestDefaultRecordSeparatorIsNewline(t *testing.T) {
+	input := []byte("first\nsecond\nsecond\n")
+	packed := packWithOpts(t, input, WriterOptions{Options: Options{RecordSeparator: '\n'}})
+	if header, _, _ := ReadArchiveHeader(packed); header.RecordSeparator != 0 {
+		t.Errorf("'\\n' should not be stored in the header; got 0x%02x", header.RecordSeparator)
+	}
+	if !bytes.Equal(packed, packWithOpts(t, input, WriterOptions{})) {
+		t.Errorf("'\\n' separator should pack the same as the default")
+	}
+}
+
+// Digits end lines fine, but not along with numeric delta: numbers would run across ends of lines.
+func TestDigitRecordSeparatorRoundTrips(t *testing.T) {
+	input := []byte("20242024-014-0141667\xbf41734 ")
+	for separator := byte('0'); separator <= '9'; separator++ {
+		opts := Options{CompressionLevel: COMPRESSION_LEVEL_BEST, RecordSeparator: separator}
+		packed := make([]byte, DecompressBound())
+		read, written, err := CompressOpts(packed, input, opts)
+		if err != nil || read != len(input) {
+			t.Fatalf("%q: packed %d of %d bytes; err: %v", separator, read, len(input), err)
+		}
+		unpacked := make([]byte, len(input))
+		_, unpackedSize, err := DecompressOpts(unpacked, packed[:written], DecompressOptions{RecordSeparator: separator})
+		if err != nil || !bytes.Equal(unpacked[:unpackedSize], input) {
+			t.Errorf("%q: unpacked %q; err: %v", separator, unpacked[:unpackedSize], err)
+		}
+
+		opts.NumericDelta = true
+		if _, _, err := CompressOpts(packed, input, opts); !errors.Is(err, ErrInvalidRecordSeparator) {
+			t.Errorf("%q with numeric delta: expected ErrInvalidRecordSeparator; got %v", separator, err)
+		}
+	}
+}
+
+func TestInvalidRecordSeparatorIsRejected(t *testing.T) {
+	if _, err := NewCompressor(Options{RecordSeparator: ESCAPE_BYTE}); !errors.Is(err, ErrInvalidRecordSeparator) {
+		t.Errorf("Expected ErrInvalidRecordSeparator; got %v", err)
+	}
+	buff := make([]byte, MAX_ARCHIVE_HEADER_SIZE)
+	headerSize := StoreArchiveHeader(buff, ArchiveHeader{RecordSeparator: test_record_separator})
+	buff[headerSize-1] = ESCAPE_BYTE
+	if _, _, err := ReadArchiveHeader(buff[:headerSize]); err != ErrCorruptInput {
+		t.Errorf("Expected ErrCorruptInput; got %v", err)
+	}
+	headerSize = StoreArchiveHeader(buff, ArchiveHeader{NumericDelta: true, RecordSeparator: '7'})
+	if _, _, err := ReadArchiveHeader(buff[:headerSize]); err != ErrCorruptInput {
+		t.Errorf("Digit separator with numeric delta: expected ErrCorruptInput; got %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package pack
+
+/*
+Chooses the line a line of a chunk is encoded against in place of the built-in linear search (see
+Compressor.SetReferenceSelector()). window holds the lines the line can refer, most recent first: window[0] is the
+previous line. Returns linesBefore of the chosen line - its index in window plus 1 - or 0 for none; values out of
+range of window count as none. The selector must not modify window nor the lines and must not keep them after
+it returns.
+
+Which line is referred affects only the ratio: archives unpack the same whatever the selector chooses.
+*/
+type ReferenceSelector func(window [][]byte, line []byte) (linesBefore int)
+
+// Same as chooseReferenceLine() but with the line chosen by selector. window is a buffer kept between calls.
+func (backref *backrefBuffer) selectReferenceLine(selector ReferenceSelector, line []byte, maxSimilarity int,
+	window *[][]byte) (lineRef lineReference) {
+	*window = (*window)[:0]
+	for linesBefore, size := 1, backref.size(); linesBefore <= size; linesBefore++ {
+		*window = append(*window, backref.getLineAt(linesBefore))
+	}
+	// no line to refer is encoded as a reference to the previous line that matches nothing
+	lineRef.linesBefore = 1
+	linesBefore := selector(*window, line)
+	if linesBefore < 1 || linesBefore > len(*window) {
+		return lineRef
+	}
+	lineRef.linesBefore = byte(linesBefore)
+	lineRef.line = (*window)[linesBefore-1]
+	lineRef.prefixLength, lineRef.similarityScore, _ = estimateSimilarity(lineRef.line, line, maxSimilarity)
+	return lineRef
+}
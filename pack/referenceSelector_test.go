@@ -0,0 +1,78 @@
+package pack
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func packWithCompressor(t *testing.T, c *Compressor, src []byte) []byte {
+	packed := make([]byte, 0, 2*len(src)+DecompressBound())
+	for len(src) > 0 {
+		read, written := c.Compress(packed[len(packed):cap(packed)], src)
+		packed, src = packed[:len(packed)+written], src[read:]
+	}
+	return packed
+}
+
+func TestReferenceSelectorChoosesReferredLines(t *testing.T) {
+	dir := path_defaultLoghubCorpus + "apache/"
+	input, _ := os.ReadFile(dir + findFirstLogFile(dir))
+
+	selectors := map[string]ReferenceSelector{
+		"previous line": func(window [][]byte, line []byte) int { return 1 },
+		"oldest line":   func(window [][]byte, line []byte) int { return len(window) },
+		"none":          func(window [][]byte, line []byte) int { return 0 },
+		"out of range":  func(window [][]byte, line []byte) int { return len(window) + 1 },
+		"same length": func(window [][]byte, line []byte) int {
+			for i, candidate := range window {
+				if len(candidate) == len(line) {
+					return i + 1
+				}
+			}
+			return 0
+		},
+	}
+	c, _ := NewCompressor(Options{})
+	defaultSize := len(packWithCompressor(t, c, input))
+	sizes := make(map[string]int)
+	for name, selector := range selectors {
+		c.SetReferenceSelector(selector)
+		packed := packWithCompressor(t, c, input)
+		if unpacked := unpackAll(t, packed); !bytes.Equal(unpacked, input) {
+			t.Errorf("%s: unpacked %d bytes differ from %d packed", name, len(unpacked), len(input))
+		}
+		sizes[name] = len(packed)
+	}
+	// matching nothing, every line is all literals
+	if sizes["none"] != sizes["out of range"] || sizes["none"] <= sizes["previous line"] {
+		t.Errorf("Sizes: %v", sizes)
+	}
+
+	c.SetReferenceSelector(nil)
+	if restored := len(packWithCompressor(t, c, input)); restored != defaultSize {
+		t.Errorf("Without selector packed to %d bytes instead of %d", restored, defaultSize)
+	}
+}
+
+func TestReferenceSelectorGetsWindowMostRecentFirst(t *testing.T) {
+	c, _ := NewCompressor(Options{CompressionLevel: 2})
+	c.Prime([][]byte{[]byte("primed\n")})
+	var windows []string
+	c.SetReferenceSelector(func(window [][]byte, line []byte) int {
+		windows = append(windows, string(bytes.Join(window, []byte(",")))+"|"+string(line))
+		return 1
+	})
+	packWithCompressor(t, c, []byte("a\nb\nc\n"))
+
+	// level 2 window holds 3 lines
+	expected := []string{"primed\n|a\n", "a\n,primed\n|b\n", "b\n,a\n,primed\n|c\n"}
+	if len(windows) != len(expected) {
+		t.Fatalf("Selector called for %q; expected %q", windows, expected)
+	}
+	for i := range expected {
+		if windows[i] != expected[i] {
+			t.Errorf("Call %d: %q; expected %q", i, windows[i], expected[i])
+		}
+	}
+}
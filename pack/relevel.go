@@ -0,0 +1,36 @@
+package pack
+
+import (
+	"bytes"
+	"io"
+)
+
+// Repacks archive src at newLevel into dst without the original file: chunks are unpacked and packed again
+// as they stream through, so memory use does not depend on size of the archive. Comment, footer, numeric delta
+// and second stage settings of src are kept; like with Merge() digest and timestamp encoding are not carried over.
+// Returns an error if newLevel is invalid (see Options.Validate()) or if src cannot be unpacked - dst holds
+// an incomplete archive then. Primed archives fail with ErrPrimingMismatch.
+func Relevel(dst io.Writer, src []byte, newLevel int) error {
+	r, err := NewReader(bytes.NewReader(src))
+	if err != nil {
+		return err
+	}
+	header := r.Header()
+	var secondStage SecondStage
+	if header.SecondStage != "" {
+		// Reader found it already
+		secondStage, _ = lookupSecondStage(header.SecondStage)
+	}
+	w, err := NewWriterOpts(dst, WriterOptions{
+		Options: Options{CompressionLevel: newLevel, NumericDelta: header.NumericDelta, SecondStage: secondStage},
+		Comment: header.Comment,
+		Footer:  header.Footer,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,61 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestRelevelUnpacksToSameContent(t *testing.T) {
+	dir := path_defaultLoghubCorpus + "apache/"
+	apache, _ := os.ReadFile(dir + findFirstLogFile(dir))
+	packed := packWithOpts(t, apache, WriterOptions{
+		Options: Options{CompressionLevel: COMPRESSION_LEVEL_DEFAULT, NumericDelta: true},
+		Comment: []byte("host=web01"),
+		Footer:  true,
+	})
+
+	var releveled bytes.Buffer
+	if err := Relevel(&releveled, packed, COMPRESSION_LEVEL_BEST); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("level %d: %d bytes; releveled to %d: %d bytes", COMPRESSION_LEVEL_DEFAULT, len(packed),
+		COMPRESSION_LEVEL_BEST, releveled.Len())
+	if releveled.Len() >= len(packed) {
+		t.Errorf("Releveled archive (%d bytes) is not smaller than the original (%d bytes)", releveled.Len(), len(packed))
+	}
+	// same as packing the original file at the new level
+	if expected := packWithOpts(t, apache, WriterOptions{
+		Options: Options{CompressionLevel: COMPRESSION_LEVEL_BEST, NumericDelta: true},
+		Comment: []byte("host=web01"),
+		Footer:  true,
+	}); !bytes.Equal(releveled.Bytes(), expected) {
+		t.Errorf("Releveled archive differs from the original file packed at level %d", COMPRESSION_LEVEL_BEST)
+	}
+
+	r, err := NewReader(&releveled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := r.Header(); header.CompressionLevel != COMPRESSION_LEVEL_BEST || string(header.Comment) != "host=web01" ||
+		!header.Footer || !header.NumericDelta {
+		t.Errorf("Header not carried over: %+v", header)
+	}
+	unpacked, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(unpacked, apache) {
+		t.Errorf("Releveled archive did not unpack to the original content; err: %v", err)
+	}
+}
+
+func TestRelevelFails(t *testing.T) {
+	packed := packWithOpts(t, []byte("first\nsecond\n"), WriterOptions{})
+	var releveled bytes.Buffer
+	if err := Relevel(&releveled, packed, COMPRESSION_LEVEL_BEST+1); !errors.Is(err, ErrInvalidCompressionLevel) {
+		t.Errorf("Expected invalid level; got %v", err)
+	}
+	if err := Relevel(&releveled, packed[:len(packed)-2], COMPRESSION_LEVEL_BEST); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected truncated archive; got %v", err)
+	}
+}
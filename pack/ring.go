@@ -0,0 +1,110 @@
+package pack
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidRingSize = errors.New("logpack: invalid ring size")
+
+/*
+RingPacker keeps the most recent logs written to it packed in memory, eg. to dump them when the program crashes.
+Written data is packed into chunks as soon as a chunk fills up; once the chunks take more than maxBytes the oldest
+ones are dropped. Chunks do not refer lines of each other, so the ones left unpack fine on their own.
+
+Snapshot() returns an archive of what is retained, including data written since the last full chunk.
+Memory use is about maxBytes plus two chunks.
+*/
+type RingPacker struct {
+	compressor *Compressor
+	header     []byte
+	maxBytes   int
+	// packed chunks, the oldest first, and their total size
+	chunks     [][]byte
+	chunksSize int
+	// raw data not packed yet; at most MAX_CHUNK_SIZE bytes between writes
+	pending []byte
+	chunk   []byte
+}
+
+// Returns a RingPacker retaining at most maxBytes of packed data or an error if maxBytes is smaller than
+// DecompressBound() (the biggest chunk) or if opts are invalid (see Options.Validate()).
+func NewRingPacker(maxBytes int, opts Options) (*RingPacker, error) {
+	if maxBytes < DecompressBound() {
+		return nil, fmt.Errorf("%w: %d bytes (at least %d expected)", ErrInvalidRingSize, maxBytes, DecompressBound())
+	}
+	compressor, err := NewCompressor(opts)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, MAX_ARCHIVE_HEADER_SIZE)
+	headerSize := StoreArchiveHeader(header, ArchiveHeader{CompressionLevel: opts.CompressionLevel,
+		NumericDelta: opts.NumericDelta, RecordSeparator: headerRecordSeparator(opts.RecordSeparator),
+		SortedLines: opts.SortLines, AsciiChunks: opts.MarkAsciiChunks})
+	return &RingPacker{
+		compressor: compressor,
+		header:     header[:headerSize],
+		maxBytes:   maxBytes,
+		pending:    make([]byte, 0, 2*MAX_CHUNK_SIZE),
+		chunk:      make([]byte, DecompressBound()),
+	}, nil
+}
+
+// Buffers p and packs every chunk that is complete, dropping the oldest chunks if needed. Never fails.
+func (r *RingPacker) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		copied := copy(r.pending[len(r.pending):cap(r.pending)], p)
+		r.pending = r.pending[:len(r.pending)+copied]
+		p = p[copied:]
+		n += copied
+
+		// more than a chunk pending - Compress() can end the chunk on a line boundary
+		for len(r.pending) > MAX_CHUNK_SIZE {
+			r.packChunk()
+		}
+	}
+	return n, nil
+}
+
+func (r *RingPacker) packChunk() {
+	read, written := r.compressor.Compress(r.chunk, r.pending)
+	r.pending = r.pending[:copy(r.pending, r.pending[read:])]
+
+	r.chunks = append(r.chunks, append([]byte(nil), r.chunk[:written]...))
+	r.chunksSize += written
+	dropped := 0
+	for r.chunksSize > r.maxBytes {
+		r.chunksSize -= len(r.chunks[dropped])
+		dropped++
+	}
+	if dropped > 0 {
+		kept := copy(r.chunks, r.chunks[dropped:])
+		// let dropped chunks be collected
+		clear(r.chunks[kept:])
+		r.chunks = r.chunks[:kept]
+	}
+}
+
+// Returns an archive (with a header, as Writer writes it) of the retained data: the most recent chunks and data
+// written after them, packed for the snapshot. Chunks are at most maxBytes in total - packing the recent data
+// may push the oldest chunk out of the snapshot. Retained data is not changed.
+func (r *RingPacker) Snapshot() []byte {
+	var recent []byte
+	for src := r.pending; len(src) > 0; {
+		read, written := r.compressor.Compress(r.chunk, src)
+		recent = append(recent, r.chunk[:written]...)
+		src = src[read:]
+	}
+
+	first, size := len(r.chunks), len(recent)
+	for first > 0 && size+len(r.chunks[first-1]) <= r.maxBytes {
+		first--
+		size += len(r.chunks[first])
+	}
+	snapshot := make([]byte, 0, len(r.header)+size)
+	snapshot = append(snapshot, r.header...)
+	for _, chunk := range r.chunks[first:] {
+		snapshot = append(snapshot, chunk...)
+	}
+	return append(snapshot, recent...)
+}
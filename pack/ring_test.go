@@ -0,0 +1,68 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func unpackArchive(t *testing.T, archive []byte) []byte {
+	r, err := NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return unpacked
+}
+
+func TestRingPackerRetainsMostRecentData(t *testing.T) {
+	const maxBytes = 200 * 1000
+	ring, err := NewRingPacker(maxBytes, Options{CompressionLevel: COMPRESSION_LEVEL_DEFAULT})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unpacked := unpackArchive(t, ring.Snapshot()); len(unpacked) != 0 {
+		t.Errorf("Snapshot of empty ring unpacked to %d bytes", len(unpacked))
+	}
+
+	var written bytes.Buffer
+	for i := 0; i < 200000; i++ {
+		line := fmt.Sprintf("2024-05-17 12:%02d:%02d INFO worker-%d processed job %d in %d ms\n", i/60%60, i%60, i%7, i, i*37%1000)
+		// lines come in pieces, as from a stream
+		for _, piece := range []string{line[:10], line[10:]} {
+			ring.Write([]byte(piece))
+			written.WriteString(piece)
+		}
+
+		if i%50000 == 49999 || i == 199999 {
+			snapshot := ring.Snapshot()
+			if len(snapshot) > MAX_ARCHIVE_HEADER_SIZE+maxBytes {
+				t.Errorf("Snapshot of %d bytes exceeds the limit", len(snapshot))
+			}
+			unpacked := unpackArchive(t, snapshot)
+			if !bytes.HasSuffix(written.Bytes(), unpacked) || !bytes.HasSuffix(unpacked, []byte(line)) {
+				t.Fatalf("Line %d: snapshot did not unpack to the most recent data", i)
+			}
+			t.Logf("line %d: %d bytes of %d retained in %d bytes", i, len(unpacked), written.Len(), len(snapshot))
+		}
+	}
+	// partial line at the end is retained too
+	ring.Write([]byte("crash in the middle of"))
+	if unpacked := unpackArchive(t, ring.Snapshot()); !bytes.HasSuffix(unpacked, []byte("\ncrash in the middle of")) {
+		t.Errorf("Partial last line was not retained")
+	}
+}
+
+func TestNewRingPackerRejectsTooSmallSize(t *testing.T) {
+	if _, err := NewRingPacker(DecompressBound()-1, Options{}); !errors.Is(err, ErrInvalidRingSize) {
+		t.Errorf("Expected ErrInvalidRingSize; got %v", err)
+	}
+	if _, err := NewRingPacker(DecompressBound(), Options{CompressionLevel: -1}); !errors.Is(err, ErrInvalidCompressionLevel) {
+		t.Errorf("Expected ErrInvalidCompressionLevel; got %v", err)
+	}
+}
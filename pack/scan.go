@@ -0,0 +1,181 @@
+package pack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrInvalidRange = errors.New("logpack: invalid range")
+
+// Location and sizes of one chunk, as declared by its header.
+type ChunkInfo struct {
+	// offset of the chunk header in the scanned buffer
+	Offset int
+	// size of the chunk including its header
+	CompressedSize int
+	RawSize        int
+}
+
+// Walks headers of chunks in src (sequence of chunks, without archive header and trailer) without unpacking
+// anything. Returns every complete chunk and number of bytes left after the last of them - an incomplete chunk
+// or trailing bytes. Chunk bodies are not validated, so a chunk listed here may still fail to unpack.
+func ScanChunks(src []byte) (chunks []ChunkInfo, remainder int) {
+	offset := 0
+	for len(src)-offset >= HEADER_SIZE {
+		chunkSize, rawSize := readHeader(src[offset:])
+		if len(src)-offset-HEADER_SIZE < chunkSize {
+			break
+		}
+		chunks = append(chunks, ChunkInfo{Offset: offset, CompressedSize: HEADER_SIZE + chunkSize, RawSize: rawSize})
+		offset += HEADER_SIZE + chunkSize
+	}
+	return chunks, len(src) - offset
+}
+
+// Unpacked size of chunks in src read from their headers, without unpacking. Returns io.ErrUnexpectedEOF
+// if the last chunk is incomplete and ErrTrailingBytes if there are bytes after it too few to make up a chunk.
+func DecompressedSize(src []byte) (size int64, err error) {
+	chunks, remainder := ScanChunks(src)
+	for _, chunk := range chunks {
+		size += int64(chunk.RawSize)
+	}
+	if remainder >= HEADER_SIZE {
+		return size, io.ErrUnexpectedEOF
+	} else if remainder > 0 {
+		return size, fmt.Errorf("%w: %d bytes", ErrTrailingBytes, remainder)
+	}
+	return size, nil
+}
+
+// Chunk as ChunkMetadata() sees it: its location and sizes along with parameters it was packed with that are
+// stored in it. Fields for parameters of newer formats are zero for chunks that don't store them.
+type ChunkMeta struct {
+	ChunkInfo
+	// chunk did not compress and holds raw bytes (see STORED_CHUNK_MARKER)
+	Stored bool
+	// lines of the chunk were packed sorted (see Options.SortLines)
+	Sorted bool
+	// chunk is packed from ASCII only (see Options.MarkAsciiChunks)
+	Ascii bool
+}
+
+// Like ScanChunks() but tells also what every chunk stores about how it was packed, reading just the headers
+// and the first bytes of chunk bodies (no line is decoded). Errors are the same as of DecompressedSize(); chunks
+// before the error are returned along with it.
+func ChunkMetadata(src []byte) ([]ChunkMeta, error) {
+	chunks, remainder := ScanChunks(src)
+	metadata := make([]ChunkMeta, len(chunks))
+	for i, chunk := range chunks {
+		body := src[chunk.Offset+HEADER_SIZE : chunk.Offset+chunk.CompressedSize]
+		metadata[i] = ChunkMeta{
+			ChunkInfo: chunk,
+			Stored:    body[0] == STORED_CHUNK_MARKER,
+			Sorted:    len(body) > 1 && body[0] == ESCAPE_BYTE && body[1] == SORTED_CHUNK_MARKER,
+			Ascii:     len(body) > 1 && body[0] == ESCAPE_BYTE && body[1] == ASCII_CHUNK_MARKER,
+		}
+	}
+	if remainder >= HEADER_SIZE {
+		return metadata, io.ErrUnexpectedEOF
+	} else if remainder > 0 {
+		return metadata, fmt.Errorf("%w: %d bytes", ErrTrailingBytes, remainder)
+	}
+	return metadata, nil
+}
+
+/*
+Unpacks bytes [start, end) of what src (sequence of chunks, without archive header and trailer) unpacks to.
+Chunk headers tell where the range lies, so only chunks that overlap it are unpacked - eg. a log viewer paging
+through a huge archive unpacks at most a couple of chunks per page.
+
+Returns ErrInvalidRange if the range is reversed, negative or goes beyond the unpacked size, io.ErrUnexpectedEOF
+if it reaches into an incomplete last chunk and ErrCorruptInput if a chunk it needs fails to unpack. Chunks of
+a primed Compressor (see Compressor.Prime()) can't be unpacked this way.
+*/
+func DecompressRange(src []byte, start, end int64) ([]byte, error) {
+	chunks, remainder := ScanChunks(src)
+	var firstChunkStart, size int64
+	var needed []ChunkInfo
+	for _, chunk := range chunks {
+		chunkStart, chunkEnd := size, size+int64(chunk.RawSize)
+		if chunkEnd > start && chunkStart < end && start < end {
+			if len(needed) == 0 {
+				firstChunkStart = chunkStart
+			}
+			needed = append(needed, chunk)
+		}
+		size = chunkEnd
+	}
+	if start < 0 || end < start || end > size {
+		if start >= 0 && end >= start && remainder >= HEADER_SIZE {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("%w: [%d, %d) of %d bytes", ErrInvalidRange, start, end, size)
+	}
+	if len(needed) == 0 {
+		return []byte{}, nil
+	}
+
+	var scratch Scratch
+	unpacked := make([]byte, 0, int(end-start)+2*MAX_CHUNK_SIZE)
+	for _, chunk := range needed {
+		unpacked = unpacked[:len(unpacked)+chunk.RawSize]
+		read, _ := DecompressWith(unpacked[len(unpacked)-chunk.RawSize:], src[chunk.Offset:chunk.Offset+chunk.CompressedSize], &scratch)
+		if read < 0 {
+			return nil, ErrCorruptInput
+		}
+	}
+	return unpacked[start-firstChunkStart : end-firstChunkStart], nil
+}
+
+// Result of Verify().
+type VerifyReport struct {
+	// complete chunks, including a bad one
+	Chunks int
+	// unpacked size of the chunks before the first bad one (of all chunks if none is bad)
+	RawSize int64
+	// bytes after the last chunk too few to make up a chunk (eg. padding); 0 if none
+	TrailingBytes int
+	// index of the first chunk that fails to unpack and its offset in src; -1 if every chunk unpacks.
+	// An incomplete last chunk counts as bad (at index Chunks).
+	FirstBadChunk       int
+	FirstBadChunkOffset int
+}
+
+/*
+Checks src (sequence of chunks, without archive header and trailer) by unpacking every chunk, and reports what
+it found. Unlike DecompressedSize() it does not trust chunk headers: a chunk counts only if its body unpacks to
+the size its header declares.
+
+Returns an error wrapping ErrCorruptInput if a chunk fails to unpack and io.ErrUnexpectedEOF if the last chunk is
+incomplete; the report tells which chunk it is. Trailing bytes are not an error - just reported. Verification
+stops at the first bad chunk. Chunks of a primed Compressor (see Compressor.Prime()) can't be verified this way.
+*/
+func Verify(src []byte) (report VerifyReport, err error) {
+	report.FirstBadChunk, report.FirstBadChunkOffset = -1, -1
+	chunks, remainder := ScanChunks(src)
+	report.Chunks = len(chunks)
+
+	var scratch Scratch
+	unpacked := make([]byte, DecompressBound())
+	for i, chunk := range chunks {
+		read, written := DecompressWith(unpacked, src[chunk.Offset:chunk.Offset+chunk.CompressedSize], &scratch)
+		if read < 0 {
+			report.FirstBadChunk, report.FirstBadChunkOffset = i, chunk.Offset
+			return report, fmt.Errorf("%w: chunk %d at offset %d", ErrCorruptInput, i, chunk.Offset)
+		}
+		// DecompressWith() takes body that unpacks to less than the header declares
+		if written != chunk.RawSize {
+			report.FirstBadChunk, report.FirstBadChunkOffset = i, chunk.Offset
+			return report, fmt.Errorf("%w: chunk %d at offset %d unpacks to %d bytes; its header declares %d",
+				ErrCorruptInput, i, chunk.Offset, written, chunk.RawSize)
+		}
+		report.RawSize += int64(written)
+	}
+	if remainder >= HEADER_SIZE {
+		report.FirstBadChunk, report.FirstBadChunkOffset = len(chunks), len(src)-remainder
+		return report, fmt.Errorf("%w: chunk %d at offset %d", io.ErrUnexpectedEOF, len(chunks), len(src)-remainder)
+	}
+	report.TrailingBytes = remainder
+	return report, nil
+}
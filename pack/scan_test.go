@@ -0,0 +1,207 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestScanChunksMatchesPacking(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	packedBuff := make([]byte, test_compression_bound_bytes)
+	dir := path_defaultLoghubCorpus + "hadoop/"
+	inputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+
+	var expected []ChunkInfo
+	packedSize := 0
+	for input := inputBuff[:inputSize]; len(input) > 0; {
+		read, written := Compress(packedBuff[packedSize:], input, COMPRESSION_LEVEL_DEFAULT)
+		expected = append(expected, ChunkInfo{Offset: packedSize, CompressedSize: written, RawSize: read})
+		input = input[read:]
+		packedSize += written
+	}
+
+	chunks, remainder := ScanChunks(packedBuff[:packedSize])
+	if remainder != 0 || len(chunks) != len(expected) {
+		t.Fatalf("Expected %d chunks; got %d and %d bytes of remainder", len(expected), len(chunks), remainder)
+	}
+	for i := range chunks {
+		if chunks[i] != expected[i] {
+			t.Errorf("Chunk %d: expected %+v; got %+v", i, expected[i], chunks[i])
+		}
+	}
+	if size, err := DecompressedSize(packedBuff[:packedSize]); err != nil || size != int64(inputSize) {
+		t.Errorf("Expected size %d; got %d, err: %v", inputSize, size, err)
+	}
+}
+
+func TestDecompressedSizeReportsIncompleteArchive(t *testing.T) {
+	packed := make([]byte, DecompressBound()+HEADER_SIZE)
+	_, written := Compress(packed, []byte("first line\nsecond line\n"), COMPRESSION_LEVEL_DEFAULT)
+
+	if _, err := DecompressedSize(packed[:written-1]); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF; got %v", err)
+	}
+	size, err := DecompressedSize(packed[:written+HEADER_SIZE-1])
+	if !errors.Is(err, ErrTrailingBytes) || size != int64(len("first line\nsecond line\n")) {
+		t.Errorf("Expected ErrTrailingBytes after the complete chunk; got %v, size %d", err, size)
+	}
+}
+
+func TestDecompressRangeMatchesSliceOfUnpacked(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	packedBuff := make([]byte, test_compression_bound_bytes)
+	dir := path_defaultLoghubCorpus + "hadoop/"
+	input := inputBuff[:readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))]
+
+	packedSize := 0
+	for rest := input; len(rest) > 0; {
+		read, written := Compress(packedBuff[packedSize:], rest, COMPRESSION_LEVEL_DEFAULT)
+		rest = rest[read:]
+		packedSize += written
+	}
+	packed := packedBuff[:packedSize]
+	chunks, _ := ScanChunks(packed)
+	if len(chunks) < 3 {
+		t.Fatalf("Expected input to make at least 3 chunks; got %d", len(chunks))
+	}
+	firstChunkEnd := int64(chunks[0].RawSize)
+	size := int64(len(input))
+
+	for _, r := range [][2]int64{
+		{0, 0}, {0, 1}, {0, size}, {size, size}, {size - 1, size}, {10, 20},
+		{firstChunkEnd - 1, firstChunkEnd + 1}, {firstChunkEnd, firstChunkEnd}, {firstChunkEnd, 2 * firstChunkEnd},
+		{firstChunkEnd / 2, size - firstChunkEnd/2},
+	} {
+		unpacked, err := DecompressRange(packed, r[0], r[1])
+		if err != nil || !bytes.Equal(unpacked, input[r[0]:r[1]]) {
+			t.Errorf("Range %v: got %d bytes not matching input; err: %v", r, len(unpacked), err)
+		}
+	}
+}
+
+func TestDecompressRangeRejectsInvalidRange(t *testing.T) {
+	packed := make([]byte, DecompressBound())
+	_, written := Compress(packed, []byte("first line\nsecond line\n"), COMPRESSION_LEVEL_DEFAULT)
+	packed = packed[:written]
+
+	for _, r := range [][2]int64{{-1, 5}, {5, 4}, {0, 24}, {30, 40}} {
+		if _, err := DecompressRange(packed, r[0], r[1]); !errors.Is(err, ErrInvalidRange) {
+			t.Errorf("Range %v: expected ErrInvalidRange; got %v", r, err)
+		}
+	}
+	if _, err := DecompressRange(packed[:written-1], 0, 5); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF for incomplete chunk; got %v", err)
+	}
+	// corrupt body of the only chunk: reference to a line before the first one
+	corrupt := append([]byte{}, packed...)
+	corrupt[HEADER_SIZE] = ESCAPE_BYTE + 1
+	if _, err := DecompressRange(corrupt, 0, 5); err != ErrCorruptInput {
+		t.Errorf("Expected ErrCorruptInput; got %v", err)
+	}
+}
+
+func TestVerifyReportsChunksOfArchive(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	packedBuff := make([]byte, test_compression_bound_bytes)
+	dir := path_defaultLoghubCorpus + "hadoop/"
+	inputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+	packed := packedBuff[:PackBuffer(inputBuff[:inputSize], packedBuff, COMPRESSION_LEVEL_DEFAULT)]
+	chunks, _ := ScanChunks(packed)
+
+	report, err := Verify(packed)
+	if err != nil || report != (VerifyReport{Chunks: len(chunks), RawSize: int64(inputSize), FirstBadChunk: -1, FirstBadChunkOffset: -1}) {
+		t.Errorf("Unexpected report %+v, err: %v", report, err)
+	}
+	report, err = Verify(append(packed[:len(packed):len(packed)], 0, 0))
+	if err != nil || report.TrailingBytes != 2 || report.RawSize != int64(inputSize) {
+		t.Errorf("Expected 2 trailing bytes; got %+v, err: %v", report, err)
+	}
+	report, err = Verify(packed[:len(packed)-1])
+	last := chunks[len(chunks)-1]
+	if !errors.Is(err, io.ErrUnexpectedEOF) || report.Chunks != len(chunks)-1 || report.FirstBadChunk != len(chunks)-1 ||
+		report.FirstBadChunkOffset != last.Offset || report.RawSize != int64(inputSize-last.RawSize) {
+		t.Errorf("Expected incomplete last chunk; got %+v, err: %v", report, err)
+	}
+
+	// second chunk refers a line before its first one
+	corrupt := append(packed[:chunks[1].Offset:chunks[1].Offset], craftChunk([]byte{ESCAPE_BYTE + 1, '\n'}, 2)...)
+	corrupt = append(corrupt, packed[chunks[1].Offset:]...)
+	report, err = Verify(corrupt)
+	if !errors.Is(err, ErrCorruptInput) || report.FirstBadChunk != 1 || report.FirstBadChunkOffset != chunks[1].Offset ||
+		report.RawSize != int64(chunks[0].RawSize) {
+		t.Errorf("Expected corrupt chunk 1; got %+v, err: %v", report, err)
+	}
+
+	// second chunk unpacks to less than its header declares
+	short := append(packed[:chunks[1].Offset:chunks[1].Offset], craftChunk([]byte("abc\n"), 10)...)
+	short = append(short, packed[chunks[1].Offset:]...)
+	report, err = Verify(short)
+	if !errors.Is(err, ErrCorruptInput) || report.FirstBadChunk != 1 || report.FirstBadChunkOffset != chunks[1].Offset ||
+		report.RawSize != int64(chunks[0].RawSize) {
+		t.Errorf("Expected chunk 1 of wrong size; got %+v, err: %v", report, err)
+	}
+}
+
+func TestVerifyDoesNotPanicOnAdversarialInput(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	packed := make([]byte, 2*DecompressBound())
+	_, written := Compress(packed, []byte(strings.Repeat("GET /index.html 200 1234 ms\nPOST /api 500 12 ms\n", 50)),
+		COMPRESSION_LEVEL_DEFAULT)
+	packed = packed[:written]
+
+	for i := 0; i < 20000; i++ {
+		var src []byte
+		if i%2 == 0 {
+			src = make([]byte, random.Intn(200))
+			random.Read(src)
+		} else {
+			src = bytes.Clone(packed)
+			for n := random.Intn(4) + 1; n > 0; n-- {
+				src[random.Intn(len(src))] = byte(random.Intn(256))
+			}
+		}
+		report, err := Verify(src)
+		if (err == nil) != (report.FirstBadChunk == -1) {
+			t.Fatalf("Input %x: report %+v does not match err %v", src, report, err)
+		}
+	}
+}
+
+func TestChunkMetadataTellsHowChunksWerePacked(t *testing.T) {
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+	plain := []byte(strings.Repeat("GET /index.html 200\n", 100))
+	interleaved := interleavedLog(500)
+	packed := make([]byte, 2*(len(plain)+len(random)+len(interleaved))+3*DecompressBound())
+	packedSize := packBufferWithOptions(plain, packed, Options{})
+	packedSize += packBufferWithOptions(random, packed[packedSize:], Options{})
+	packedSize += packBufferWithOptions(interleaved, packed[packedSize:],
+		Options{CompressionLevel: COMPRESSION_LEVEL_WORST, SortLines: true})
+	packed = packed[:packedSize]
+
+	metadata, err := ChunkMetadata(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, _ := ScanChunks(packed)
+	if len(metadata) != 3 || len(chunks) != 3 {
+		t.Fatalf("Expected 3 chunks; got %d (scanned %d)", len(metadata), len(chunks))
+	}
+	expected := [][2]bool{{false, false}, {true, false}, {false, true}}
+	for i, meta := range metadata {
+		if meta.ChunkInfo != chunks[i] {
+			t.Errorf("Chunk %d: %+v, scanned %+v", i, meta.ChunkInfo, chunks[i])
+		}
+		if [2]bool{meta.Stored, meta.Sorted} != expected[i] {
+			t.Errorf("Chunk %d: stored %v, sorted %v; expected %v", i, meta.Stored, meta.Sorted, expected[i])
+		}
+	}
+
+	if metadata, err := ChunkMetadata(packed[:len(packed)-1]); !errors.Is(err, io.ErrUnexpectedEOF) || len(metadata) != 2 {
+		t.Errorf("Truncated: %d chunks, err %v", len(metadata), err)
+	}
+}
@@ -0,0 +1,231 @@
+package pack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// second stage name is stored in the archive header with one byte of length
+	MAX_SECOND_STAGE_NAME_SIZE = 32
+	// Writer passes chunks to the second stage in blocks of at least that many bytes (less only on Flush())
+	SECOND_STAGE_BLOCK_SIZE = 1 << 20
+	// most chunk bytes a frame may hold: Writer compresses the block once the chunk that reaches its size is added
+	MAX_SECOND_STAGE_BLOCK_SIZE = SECOND_STAGE_BLOCK_SIZE + MAX_CHUNK_SIZE + HEADER_SIZE
+	// biggest frame Reader accepts; stages that expand a block beyond it make Writer fail
+	MAX_SECOND_STAGE_FRAME_SIZE = 2 * MAX_SECOND_STAGE_BLOCK_SIZE
+	// frame length field; length 0 ends the frames
+	SIZEOF_FRAME_LENGTH = 4
+)
+
+var (
+	ErrInvalidSecondStage = errors.New("logpack: invalid second stage")
+	ErrUnknownSecondStage = errors.New("logpack: unknown second stage")
+)
+
+/*
+SecondStage is a general purpose compressor run over packed chunks, eg. zstd: lines referring similar lines leave
+repetitions a byte-oriented compressor still finds (see BenchmarkVsZstd). Set it in Options.SecondStage; Writer then
+wraps chunks in frames compressed by the stage and stores its name in the archive header. Reader looks the stage up
+by that name among registered ones (see RegisterSecondStage()), so the same stage must be registered wherever
+the archive is unpacked.
+
+Each frame is a 4-byte little endian length followed by what Compress() returned for a block of whole chunks.
+Frame of length 0 ends the frames; the trailer follows it.
+*/
+type SecondStage interface {
+	// Name the stage is registered and stored in archives with; 1-MAX_SECOND_STAGE_NAME_SIZE bytes.
+	Name() string
+	// Appends src compressed to dst and returns the extended slice.
+	Compress(dst, src []byte) ([]byte, error)
+	// Appends src decompressed to dst and returns the extended slice. Called for frames read from archives,
+	// so src may be damaged or crafted; no valid frame decompresses to more than MAX_SECOND_STAGE_BLOCK_SIZE bytes.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+var (
+	secondStagesLock sync.RWMutex
+	secondStages     = map[string]SecondStage{
+		NoopSecondStage{}.Name(): NoopSecondStage{},
+		GzipSecondStage{}.Name(): GzipSecondStage{},
+	}
+)
+
+// Makes stage available to Writer and Reader under stage.Name(). Stages of the package (NoopSecondStage and
+// GzipSecondStage) are registered already. Returns an error wrapping ErrInvalidSecondStage if the name is invalid
+// or taken.
+func RegisterSecondStage(stage SecondStage) error {
+	name := stage.Name()
+	if err := validateSecondStageName(name); err != nil {
+		return err
+	}
+	secondStagesLock.Lock()
+	defer secondStagesLock.Unlock()
+	if _, ok := secondStages[name]; ok {
+		return fmt.Errorf("%w: %q is registered already", ErrInvalidSecondStage, name)
+	}
+	secondStages[name] = stage
+	return nil
+}
+
+// Returns stage registered with name or an error wrapping ErrUnknownSecondStage.
+func lookupSecondStage(name string) (SecondStage, error) {
+	secondStagesLock.RLock()
+	defer secondStagesLock.RUnlock()
+	stage, ok := secondStages[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownSecondStage, name)
+	}
+	return stage, nil
+}
+
+func validateSecondStageName(name string) error {
+	if len(name) == 0 || len(name) > MAX_SECOND_STAGE_NAME_SIZE {
+		return fmt.Errorf("%w: name of %d bytes (expected 1-%d)", ErrInvalidSecondStage, len(name),
+			MAX_SECOND_STAGE_NAME_SIZE)
+	}
+	return nil
+}
+
+// Second stage that leaves chunks as they are; frames just add their lengths. Registered as "none".
+type NoopSecondStage struct{}
+
+func (NoopSecondStage) Name() string {
+	return "none"
+}
+
+func (NoopSecondStage) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (NoopSecondStage) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+// Second stage compressing chunks with gzip at its default level. Registered as "gzip".
+type GzipSecondStage struct{}
+
+func (GzipSecondStage) Name() string {
+	return "gzip"
+}
+
+func (GzipSecondStage) Compress(dst, src []byte) ([]byte, error) {
+	buff := bytes.NewBuffer(dst)
+	gz := gzip.NewWriter(buff)
+	if _, err := gz.Write(src); err != nil {
+		return dst, err
+	}
+	if err := gz.Close(); err != nil {
+		return dst, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (GzipSecondStage) Decompress(dst, src []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return dst, err
+	}
+	buff := bytes.NewBuffer(dst)
+	// a crafted frame could decompress to gigabytes
+	if n, err := io.Copy(buff, io.LimitReader(gz, MAX_SECOND_STAGE_BLOCK_SIZE+1)); err != nil {
+		return dst, err
+	} else if n > MAX_SECOND_STAGE_BLOCK_SIZE {
+		return dst, fmt.Errorf("frame decompresses to more than %d bytes", MAX_SECOND_STAGE_BLOCK_SIZE)
+	}
+	return buff.Bytes(), gz.Close()
+}
+
+// Unwraps chunks from frames of the second stage read from r. Anything after the frames (the trailer) passes through.
+type secondStageReader struct {
+	r     io.Reader
+	stage SecondStage
+	frame []byte
+	// chunks of the last frame; the part not read yet is pending
+	chunks     []byte
+	pending    []byte
+	framesOver bool
+}
+
+func (sr *secondStageReader) Read(p []byte) (n int, err error) {
+	for len(sr.pending) == 0 {
+		if sr.framesOver {
+			return sr.r.Read(p)
+		}
+		if err := sr.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, sr.pending)
+	sr.pending = sr.pending[n:]
+	return n, nil
+}
+
+// Reads and decompresses the next frame. Returns io.ErrUnexpectedEOF if r ends before the last frame.
+func (sr *secondStageReader) readFrame() error {
+	var length [SIZEOF_FRAME_LENGTH]byte
+	if _, err := io.ReadFull(sr.r, length[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	frameSize := binary.LittleEndian.Uint32(length[:])
+	if frameSize == 0 {
+		sr.framesOver = true
+		return nil
+	}
+	if frameSize > MAX_SECOND_STAGE_FRAME_SIZE {
+		return fmt.Errorf("%w: second stage frame of %d bytes", ErrCorruptInput, frameSize)
+	}
+	if cap(sr.frame) < int(frameSize) {
+		sr.frame = make([]byte, frameSize)
+	}
+	sr.frame = sr.frame[:frameSize]
+	if _, err := io.ReadFull(sr.r, sr.frame); err != nil {
+		return unexpectedEOF(err)
+	}
+	chunks, err := sr.stage.Decompress(sr.chunks[:0], sr.frame)
+	if err == nil && len(chunks) > MAX_SECOND_STAGE_BLOCK_SIZE {
+		err = fmt.Errorf("frame decompressed to %d bytes", len(chunks))
+	}
+	if err != nil {
+		return fmt.Errorf("%w: second stage %q: %v", ErrCorruptInput, sr.stage.Name(), err)
+	}
+	sr.chunks, sr.pending = chunks, chunks
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Compresses chunks with stage and appends them to dst as a frame. Returns an error wrapping ErrInvalidSecondStage
+// if the frame would be empty (taken for the end of frames) or too big for Reader.
+func appendSecondStageFrame(dst, chunks []byte, stage SecondStage) ([]byte, error) {
+	frameStart := len(dst)
+	dst, err := stage.Compress(append(dst, make([]byte, SIZEOF_FRAME_LENGTH)...), chunks)
+	if err != nil {
+		return dst[:frameStart], err
+	}
+	frameSize := len(dst) - frameStart - SIZEOF_FRAME_LENGTH
+	if frameSize == 0 || frameSize > MAX_SECOND_STAGE_FRAME_SIZE {
+		return dst[:frameStart], fmt.Errorf("%w: %q compressed %d bytes to %d", ErrInvalidSecondStage, stage.Name(),
+			len(chunks), frameSize)
+	}
+	binary.LittleEndian.PutUint32(dst[frameStart:], uint32(frameSize))
+	return dst, nil
+}
+
+// Name of stage as stored in the archive header; empty for nil.
+func secondStageName(stage SecondStage) string {
+	if stage == nil {
+		return ""
+	}
+	return stage.Name()
+}
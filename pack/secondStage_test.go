@@ -0,0 +1,134 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// Flips every bit; registered for tests only.
+type invertingSecondStage struct{}
+
+func (invertingSecondStage) Name() string {
+	return "test-invert"
+}
+
+func (invertingSecondStage) Compress(dst, src []byte) ([]byte, error) {
+	for _, b := range src {
+		dst = append(dst, ^b)
+	}
+	return dst, nil
+}
+
+func (stage invertingSecondStage) Decompress(dst, src []byte) ([]byte, error) {
+	return stage.Compress(dst, src)
+}
+
+func init() {
+	if err := RegisterSecondStage(invertingSecondStage{}); err != nil {
+		panic(err)
+	}
+}
+
+func TestSecondStageRoundTrips(t *testing.T) {
+	dir := path_defaultLoghubCorpus + "apache/"
+	apache, _ := os.ReadFile(dir + findFirstLogFile(dir))
+	plain := packWithOpts(t, apache, WriterOptions{})
+
+	for _, stage := range []SecondStage{NoopSecondStage{}, GzipSecondStage{}, invertingSecondStage{}} {
+		packed := packWithOpts(t, apache, WriterOptions{Options: Options{SecondStage: stage}})
+		header, _, err := ReadArchiveHeader(packed)
+		if err != nil || header.SecondStage != stage.Name() || packed[len(ARCHIVE_MAGIC)+1]&FLAG_SECOND_STAGE == 0 {
+			t.Errorf("%s: expected the stage in header; got %+v, err: %v", stage.Name(), header, err)
+		}
+		var unpacked bytes.Buffer
+		if _, err := DecompressTo(&unpacked, bytes.NewReader(packed)); err != nil || !bytes.Equal(unpacked.Bytes(), apache) {
+			t.Errorf("%s: did not unpack to input; err: %v", stage.Name(), err)
+		}
+		t.Logf("%s: %.2fx; %.2fx without second stage", stage.Name(), float64(len(apache))/float64(len(packed)),
+			float64(len(apache))/float64(len(plain)))
+	}
+	if gzipped := packWithOpts(t, apache, WriterOptions{Options: Options{SecondStage: GzipSecondStage{}}}); len(gzipped) >= len(plain) {
+		t.Errorf("gzip second stage should pack better: %d bytes; %d without", len(gzipped), len(plain))
+	}
+}
+
+func TestSecondStageFramesEndAtFlushAndKeepTrailer(t *testing.T) {
+	input := incrementingIdsLog(3000)
+	opts := WriterOptions{Options: Options{SecondStage: GzipSecondStage{}}, FlushEveryLines: 500}
+	archive := packWithDigest(t, input, opts)
+	if unpacked, err := readChecked(archive); err != nil || !bytes.Equal(unpacked, input) {
+		t.Errorf("Did not unpack to input; err: %v", err)
+	}
+
+	// flushed frames can be read before the archive is complete
+	var packed bytes.Buffer
+	w, _ := NewWriterOpts(&packed, opts)
+	w.Write(input[:len(input)/2])
+	w.Flush()
+	r, err := NewReader(bytes.NewReader(packed.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unpacked, err := io.ReadAll(r); err != io.ErrUnexpectedEOF || !bytes.Equal(unpacked, input[:len(input)/2]) {
+		t.Errorf("Expected flushed half and io.ErrUnexpectedEOF; got %d bytes, err: %v", len(unpacked), err)
+	}
+}
+
+func TestDamagedSecondStageArchiveFails(t *testing.T) {
+	input := incrementingIdsLog(1000)
+	packed := packWithOpts(t, input, WriterOptions{Options: Options{SecondStage: GzipSecondStage{}}})
+	_, headerSize, _ := ReadArchiveHeader(packed)
+
+	damaged := bytes.Clone(packed)
+	damaged[headerSize+SIZEOF_FRAME_LENGTH+20] ^= 0xff
+	huge := bytes.Clone(packed)
+	huge[headerSize+SIZEOF_FRAME_LENGTH-1] = 0xff
+	for _, tc := range []struct {
+		name     string
+		archive  []byte
+		expected error
+	}{
+		{"damaged frame", damaged, ErrCorruptInput},
+		{"huge frame", huge, ErrCorruptInput},
+		{"no end of frames", packed[:len(packed)-SIZEOF_FRAME_LENGTH], io.ErrUnexpectedEOF},
+		{"truncated frame", packed[:headerSize+SIZEOF_FRAME_LENGTH+10], io.ErrUnexpectedEOF},
+	} {
+		r, err := NewReader(bytes.NewReader(tc.archive))
+		if err == nil {
+			_, err = io.ReadAll(r)
+		}
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("%s: expected %v; got %v", tc.name, tc.expected, err)
+		}
+	}
+
+	// stage not registered here
+	buff := make([]byte, MAX_ARCHIVE_HEADER_SIZE)
+	unknown := append(buff[:StoreArchiveHeader(buff, ArchiveHeader{SecondStage: "zstd"})], packed[headerSize:]...)
+	if _, err := NewReader(bytes.NewReader(unknown)); !errors.Is(err, ErrUnknownSecondStage) {
+		t.Errorf("Expected ErrUnknownSecondStage; got %v", err)
+	}
+}
+
+type unregisteredSecondStage struct{ invertingSecondStage }
+
+func (unregisteredSecondStage) Name() string {
+	return "test-unregistered"
+}
+
+func TestInvalidSecondStageIsRejected(t *testing.T) {
+	for name, opts := range map[string]WriterOptions{
+		"unregistered": {Options: Options{SecondStage: unregisteredSecondStage{}}},
+		"with footer":  {Options: Options{SecondStage: NoopSecondStage{}}, Footer: true},
+	} {
+		if _, err := NewWriterOpts(io.Discard, opts); !errors.Is(err, ErrInvalidSecondStage) {
+			t.Errorf("%s: expected ErrInvalidSecondStage; got %v", name, err)
+		}
+	}
+	if err := RegisterSecondStage(GzipSecondStage{}); !errors.Is(err, ErrInvalidSecondStage) {
+		t.Errorf("Registering taken name: expected ErrInvalidSecondStage; got %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package pack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+/*
+Second byte of a sorted chunk (see Options.SortLines), following ESCAPE_BYTE. ESCAPE_BYTE followed by an ASCII byte
+is a numeric delta token otherwise, which never starts a chunk - there is no referred line for it yet.
+
+Sorted chunk: ESCAPE_BYTE | SORTED_CHUNK_MARKER | uvarint n | permutation | body
+Body is a regular chunk (without header) of the first n lines of the chunk sorted, followed by its last line
+if that one has no separator (it stays last). Permutation tells the original index of every sorted line: n uvarints
+of zigzag encoded difference from the index of the previous sorted line plus 1, so runs of lines that kept their
+order take a byte per line.
+*/
+const SORTED_CHUNK_MARKER byte = 'S'
+
+// Packs lines of chunks sorted (see Options.SortLines). Keeps buffers between chunks.
+type lineSorter struct {
+	lines [][]byte
+	// order[i] is index in lines of the i-th sorted line
+	order  []int
+	sorted []byte
+	body   []byte
+	chunk  []byte
+}
+
+/*
+Packs whole lines of src (the raw content of the chunk of plainWritten bytes, header included, at the beginning
+of dst) sorted with compress and replaces the chunk in dst if the sorted one is smaller. Returns size of the chunk
+that is in dst then. Lines that sort the same keep their order.
+*/
+func (sorter *lineSorter) sortChunk(dst, src []byte, plainWritten int, separator byte,
+	compress func(dst, src []byte) (bytesRead, bytesWritten int)) int {
+	sorter.lines = sorter.lines[:0]
+	rest := src
+	for line, next := nextRecord(rest, separator); len(line) > 0 && line[len(line)-1] == separator; line, next = nextRecord(next, separator) {
+		sorter.lines = append(sorter.lines, line)
+		rest = next
+	}
+	if len(sorter.lines) < 2 {
+		return plainWritten
+	}
+	sorter.order = sorter.order[:0]
+	for i := range sorter.lines {
+		sorter.order = append(sorter.order, i)
+	}
+	sort.SliceStable(sorter.order, func(a, b int) bool {
+		return compareIgnoringDigits(sorter.lines[sorter.order[a]], sorter.lines[sorter.order[b]]) < 0
+	})
+
+	sorter.sorted = sorter.sorted[:0]
+	for _, i := range sorter.order {
+		sorter.sorted = append(sorter.sorted, sorter.lines[i]...)
+	}
+	sorter.sorted = append(sorter.sorted, rest...)
+	if sorter.body == nil {
+		sorter.body = make([]byte, DecompressBound())
+	}
+	bodyRead, bodyWritten := compress(sorter.body, sorter.sorted)
+	if bodyRead != len(sorter.sorted) {
+		return plainWritten
+	}
+
+	chunk := append(sorter.chunk[:0], make([]byte, HEADER_SIZE)...)
+	chunk = append(chunk, ESCAPE_BYTE, SORTED_CHUNK_MARKER)
+	chunk = binary.AppendUvarint(chunk, uint64(len(sorter.lines)))
+	previous := -1
+	for _, i := range sorter.order {
+		chunk = binary.AppendUvarint(chunk, zigzag(i-previous-1))
+		previous = i
+	}
+	chunk = append(chunk, sorter.body[HEADER_SIZE:bodyWritten]...)
+	sorter.chunk = chunk
+	if len(chunk) >= plainWritten || len(chunk) > len(dst) || len(chunk)-HEADER_SIZE > MAX_CHUNK_SIZE {
+		return plainWritten
+	}
+	storeHeader(chunk, len(chunk)-HEADER_SIZE, len(src))
+	return copy(dst, chunk)
+}
+
+// Compares a and b as if they had no ASCII digits, so that lines of the same message template sort next to each
+// other however their timestamps and ids differ.
+func compareIgnoringDigits(a, b []byte) int {
+	i, j := 0, 0
+	for {
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+		if i == len(a) || j == len(b) {
+			return (len(a) - i) - (len(b) - j)
+		}
+		if a[i] != b[j] {
+			return int(a[i]) - int(b[j])
+		}
+		i++
+		j++
+	}
+}
+
+func zigzag(n int) uint64 {
+	return uint64(n<<1) ^ uint64(n>>63)
+}
+
+func unzigzag(n uint64) int {
+	return int(n>>1) ^ -int(n&1)
+}
+
+// Unpacks sorted chunk (ESCAPE_BYTE and SORTED_CHUNK_MARKER cut off) into dst in the original order of lines.
+// Returns number of bytes written or one of corrupt* reasons.
+func decompressSortedChunk(compressed, dst []byte, backref *backrefBuffer, primingLines [][]byte, separator byte) int {
+	count, size := binary.Uvarint(compressed)
+	// every line takes a byte at least
+	if size <= 0 || count < 2 || count > uint64(len(dst)) {
+		return corruptSortedChunk
+	}
+	compressed = compressed[size:]
+	n := int(count)
+	// originalIndex[i] is the index of the i-th sorted line in the original order
+	originalIndex := make([]int, n)
+	taken := make([]bool, n)
+	previous := -1
+	for i := range originalIndex {
+		delta, size := binary.Uvarint(compressed)
+		if size <= 0 || delta > uint64(2*n) {
+			return corruptSortedChunk
+		}
+		compressed = compressed[size:]
+		index := previous + 1 + unzigzag(delta)
+		if index < 0 || index >= n || taken[index] {
+			return corruptSortedChunk
+		}
+		taken[index] = true
+		originalIndex[i], previous = index, index
+	}
+	// body is a regular chunk; never another sorted one
+	if len(compressed) == 0 || len(compressed) > 1 && compressed[0] == ESCAPE_BYTE && compressed[1] == SORTED_CHUNK_MARKER {
+		return corruptSortedChunk
+	}
+
+	sorted := make([]byte, len(dst))
+	written := decompressChunk(compressed, sorted, backref, primingLines, separator)
+	if written < 0 {
+		return written
+	}
+	sorted = sorted[:written]
+	lines := make([][]byte, n)
+	for _, index := range originalIndex {
+		end := bytes.IndexByte(sorted, separator)
+		if end < 0 {
+			return corruptSortedChunk
+		}
+		lines[index], sorted = sorted[:end+1], sorted[end+1:]
+	}
+	bytesWritten := 0
+	for _, line := range lines {
+		bytesWritten += copy(dst[bytesWritten:], line)
+	}
+	return bytesWritten + copy(dst[bytesWritten:], sorted)
+}
+
+// Same as compressPrimed() but with lines of the chunk sorted by opts.sorter if that makes the chunk smaller; nil
+// sorter leaves them as they are. With opts.markAscii the chunk is marked if it is packed from ASCII only
+// (see markAsciiChunk()).
+func compressSorted(dst, src []byte, opts chunkOptions) (bytesRead, bytesWritten int) {
+	bytesRead, bytesWritten = compressPrimed(dst, src, opts)
+	if bytesRead == 0 {
+		return bytesRead, bytesWritten
+	}
+	if opts.sorter != nil {
+		bytesWritten = opts.sorter.sortChunk(dst, src[:bytesRead], bytesWritten, opts.separator,
+			func(dst, src []byte) (int, int) {
+				return compressPrimed(dst, src, opts)
+			})
+	}
+	if opts.markAscii {
+		bytesWritten = markAsciiChunk(dst, bytesWritten, src[:bytesRead])
+	}
+	return bytesRead, bytesWritten
+}
+
+// lineSorter for Options.SortLines; nil if lines are not sorted.
+func newLineSorter(sortLines bool) *lineSorter {
+	if !sortLines {
+		return nil
+	}
+	return &lineSorter{}
+}
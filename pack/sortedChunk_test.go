@@ -0,0 +1,165 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// Log of three kinds of messages taking turns irregularly, so that a line rarely finds its kind among the lines
+// the level looks back at.
+func interleavedLog(lines int) []byte {
+	var log bytes.Buffer
+	kinds := []string{
+		"%06d INFO  [pool-3-thread-%d] c.e.http.RequestHandler: GET /api/v2/orders/%d served in %d ms\n",
+		"%06d DEBUG [cache-evictor-%d] c.e.cache.LruCache: evicted %d entries, %d bytes still cached\n",
+		"%06d WARN  [scheduler-%d] c.e.jobs.Scheduler: job %d is late by %d seconds, rescheduling\n",
+	}
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&log, kinds[(i*i/7+i/3)%len(kinds)], i, i%5, 7919*i%100000, i*31%997)
+	}
+	return log.Bytes()
+}
+
+func unpackAll(t *testing.T, packed []byte) []byte {
+	var unpacked bytes.Buffer
+	if _, err := DecompressTo(&unpacked, bytes.NewReader(packed)); err != nil {
+		t.Fatal(err)
+	}
+	return unpacked.Bytes()
+}
+
+func countSortedChunks(packed []byte) (sorted int) {
+	chunks, _ := ScanChunks(packed)
+	for _, chunk := range chunks {
+		body := packed[chunk.Offset+HEADER_SIZE:]
+		if body[0] == ESCAPE_BYTE && body[1] == SORTED_CHUNK_MARKER {
+			sorted++
+		}
+	}
+	return sorted
+}
+
+func TestSortedLinesRestoreOriginalOrder(t *testing.T) {
+	inputs := map[string][]byte{
+		"interleaved":          interleavedLog(20000),
+		"incrementing ids":     incrementingIdsLog(5000),
+		"long lines":           randomTextWithLongLines(7),
+		"no newline at end":    []byte("b 2\na 1\nc 3\nno newline"),
+		"same template":        []byte("x 3\nx 1\nx 2\n"),
+		"non-ASCII and digits": []byte("\xff 9\n1\n\x80 2\n\n\xff 1\n\n"),
+	}
+	for name, input := range inputs {
+		for _, level := range []int{COMPRESSION_LEVEL_WORST, COMPRESSION_LEVEL_BEST} {
+			plain := make([]byte, 2*len(input)+DecompressBound())
+			plain = plain[:packBufferWithOptions(input, plain, Options{CompressionLevel: level})]
+			sorted := make([]byte, 2*len(input)+DecompressBound())
+			sorted = sorted[:packBufferWithOptions(input, sorted, Options{CompressionLevel: level, SortLines: true})]
+			if unpacked := unpackAll(t, sorted); !bytes.Equal(unpacked, input) {
+				t.Errorf("%s, level %d: unpacked %d bytes differ from input of %d", name, level, len(unpacked), len(input))
+			}
+			if len(sorted) > len(plain) {
+				t.Errorf("%s, level %d: sorted %d bytes; %d without sorting", name, level, len(sorted), len(plain))
+			}
+			t.Logf("%s, level %d: %d of %d chunks sorted, %.3fx instead of %.3fx", name, level, countSortedChunks(sorted),
+				len(ChunkPlan(input)), float64(len(input))/float64(len(sorted)), float64(len(input))/float64(len(plain)))
+		}
+	}
+
+	// lines of different templates interleaved pack better sorted where the level looks back at few lines
+	input := interleavedLog(20000)
+	opts := Options{CompressionLevel: COMPRESSION_LEVEL_WORST}
+	plain := make([]byte, 2*len(input)+DecompressBound())
+	plain = plain[:packBufferWithOptions(input, plain, opts)]
+	opts.SortLines = true
+	sorted := make([]byte, 2*len(input)+DecompressBound())
+	sorted = sorted[:packBufferWithOptions(input, sorted, opts)]
+	if countSortedChunks(sorted) == 0 || len(sorted) >= len(plain) {
+		t.Errorf("Interleaved log: %d sorted chunks, %d bytes; %d without sorting", countSortedChunks(sorted),
+			len(sorted), len(plain))
+	}
+}
+
+func TestSortedLinesOnCorpus(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	for _, file := range corpusFiles(path_loghubCorpus) {
+		input := inputBuff[:min2(readFileToBuffer(inputBuff, file.path), test_level_sample_size_bytes)]
+		plain := packWithOpts(t, input, WriterOptions{})
+		sorted := packWithOpts(t, input, WriterOptions{Options: Options{SortLines: true}})
+		r, _ := NewReader(bytes.NewReader(sorted))
+		if unpacked, err := io.ReadAll(r); err != nil || !bytes.Equal(unpacked, input) {
+			t.Errorf("%s: did not unpack to input; err: %v", file.name, err)
+		}
+		t.Logf("%s: %.3fx instead of %.3fx", file.name, float64(len(input))/float64(len(sorted)),
+			float64(len(input))/float64(len(plain)))
+	}
+}
+
+func TestSortedLinesOfPrimedCompressor(t *testing.T) {
+	input := interleavedLog(3000)
+	c, _ := NewCompressor(Options{SortLines: true})
+	priming := [][]byte{[]byte("000000 INFO  [pool-3-thread-0] c.e.http.RequestHandler: GET /api/v2/orders/0 served in 0 ms\n")}
+	c.Prime(priming)
+	packed := make([]byte, 2*len(input)+DecompressBound())
+	packed = packed[:compressAll(c, packed, input)]
+
+	var scratch Scratch
+	scratch.Prime(priming)
+	unpacked := make([]byte, len(input)+MAX_CHUNK_SIZE)
+	if read, written := DecompressWith(unpacked, packed, &scratch); read != len(packed) || !bytes.Equal(unpacked[:written], input) {
+		t.Errorf("Read %d of %d bytes, unpacked %d of %d", read, len(packed), written, len(input))
+	}
+}
+
+// Writer marks archives of sorted lines with a required feature, so versions that can't unpack them refuse them.
+func TestWriterMarksSortedLinesAsRequiredFeature(t *testing.T) {
+	input := interleavedLog(3000)
+	var packed bytes.Buffer
+	w, _ := NewWriterOpts(&packed, WriterOptions{Options: Options{SortLines: true}})
+	w.Write(input)
+	w.Close()
+
+	r, err := NewReader(bytes.NewReader(packed.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := r.Header(); header.Version != WINDOW_FORMAT_VERSION || !header.SortedLines {
+		t.Errorf("Expected sorted lines in header of version %d; got %+v", WINDOW_FORMAT_VERSION, header)
+	}
+	if unpacked, err := io.ReadAll(r); err != nil || !bytes.Equal(unpacked, input) {
+		t.Errorf("Unpacked %d bytes differ from %d packed, err: %v", len(unpacked), len(input), err)
+	}
+
+	// archives without sorted lines stay readable by versions older than required features
+	packed.Reset()
+	w = NewWriter(&packed, COMPRESSION_LEVEL_DEFAULT)
+	w.Write(input)
+	w.Close()
+	if header, _, _ := ReadArchiveHeader(packed.Bytes()); header.Version != FORMAT_VERSION {
+		t.Errorf("Expected version %d without sorted lines; got %d", FORMAT_VERSION, header.Version)
+	}
+}
+
+func TestCorruptSortedChunkFails(t *testing.T) {
+	chunk := func(permutation ...byte) []byte {
+		body := []byte{'a', '\n', 'b', '\n'}
+		return craftChunk(append(append([]byte{ESCAPE_BYTE, SORTED_CHUNK_MARKER}, permutation...), body...), 4)
+	}
+	unpacked := make([]byte, DecompressBound())
+	if _, written, err := DecompressOpts(unpacked, chunk(2, 2, 3), DecompressOptions{}); err != nil || string(unpacked[:written]) != "b\na\n" {
+		t.Fatalf("Valid sorted chunk: unpacked %q, err: %v", unpacked[:written], err)
+	}
+	for name, corrupt := range map[string][]byte{
+		"index repeated":       chunk(2, 0, 1),
+		"index beyond lines":   chunk(2, 4, 0),
+		"more lines than body": chunk(3, 0, 0, 0),
+		"single line":          chunk(1, 0),
+		"nested":               chunk(2, 0, 0, ESCAPE_BYTE, SORTED_CHUNK_MARKER),
+	} {
+		if _, _, err := DecompressOpts(unpacked, corrupt, DecompressOptions{}); !errors.Is(err, ErrCorruptInput) {
+			t.Errorf("%s: expected ErrCorruptInput; got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package pack
+
+import "io"
+
+// Amounts of data processed by PackStream() and DecompressTo().
+type Result struct {
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// Output size as a fraction of input size: eg. 0.11 for content packed to 11% of its size (or 9.09 when unpacking
+// it back). 0 if nothing was read.
+func (result Result) Ratio() float64 {
+	if result.BytesRead == 0 {
+		return 0
+	}
+	return float64(result.BytesWritten) / float64(result.BytesRead)
+}
+
+// Packs everything read from src (until io.EOF) into a Logpack archive written to dst. Returns amounts of raw
+// content read and of archive bytes written - also when an error stops packing half way.
+func PackStream(dst io.Writer, src io.Reader, opts WriterOptions) (result Result, err error) {
+	if err := opts.Validate(); err != nil {
+		return result, err
+	}
+	counter := &countingWriter{w: dst}
+	w := newWriter(counter, opts)
+	result.BytesRead, err = io.Copy(w, src)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	result.BytesWritten = counter.n
+	return result, err
+}
+
+// Unpacks Logpack archive read from src into dst. Returns amounts of archive bytes read and of unpacked content
+// written. Primed archives (see Compressor.Prime()) fail with ErrPrimingMismatch - unpack them with Reader.
+func DecompressTo(dst io.Writer, src io.Reader) (result Result, err error) {
+	counter := &countingReader{r: src}
+	r, err := NewReader(counter)
+	if err == nil {
+		result.BytesWritten, err = io.Copy(dst, r)
+	}
+	result.BytesRead = counter.n
+	return result, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,48 @@
+package pack
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestPackStreamAndDecompressToReportSizes(t *testing.T) {
+	dir := path_defaultLoghubCorpus + "apache/"
+	input, err := os.ReadFile(dir + findFirstLogFile(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packed, unpacked bytes.Buffer
+	packResult, err := PackStream(&packed, bytes.NewReader(input), WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Result{BytesRead: int64(len(input)), BytesWritten: int64(packed.Len())}
+	if packResult != expected || packResult.Ratio() >= 0.5 {
+		t.Errorf("Expected %+v; got %+v (ratio %.3f)", expected, packResult, packResult.Ratio())
+	}
+
+	unpackResult, err := DecompressTo(&unpacked, bytes.NewReader(packed.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = Result{BytesRead: packResult.BytesWritten, BytesWritten: packResult.BytesRead}
+	if unpackResult != expected || !bytes.Equal(unpacked.Bytes(), input) {
+		t.Errorf("Expected %+v; got %+v", expected, unpackResult)
+	}
+}
+
+func TestDecompressToReportsBytesReadOnError(t *testing.T) {
+	var packed bytes.Buffer
+	PackStream(&packed, bytes.NewReader([]byte("first line\nsecond line\n")), WriterOptions{})
+	truncated := packed.Bytes()[:packed.Len()-1]
+
+	result, err := DecompressTo(&bytes.Buffer{}, bytes.NewReader(truncated))
+	if err == nil || result.BytesRead != int64(len(truncated)) {
+		t.Errorf("Expected an error after reading %d bytes; got %+v, err: %v", len(truncated), result, err)
+	}
+	if (Result{}).Ratio() != 0 {
+		t.Errorf("Ratio of nothing read should be 0")
+	}
+}
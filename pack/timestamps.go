@@ -0,0 +1,262 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Timestamp delta pre-pass.
+//
+// Logs usually start every line with a timestamp which differs from line to line. Such lines do share the rest
+// but their common prefix ends within the timestamp. TimestampCodec replaces the timestamp at the beginning
+// of each line with the difference to the timestamp of the previous such line, so that lines logged at regular
+// intervals (or at the same time) start the same. The transform is exactly reversible.
+//
+// Timestamp format is given by a pattern where '#' stands for a digit and every other char must match literally,
+// eg. "####-##-## ##:##:##,###" for "2015-10-18 18:01:47,978". Digits of the timestamp are taken as one decimal
+// number; the delta is the difference of such numbers (so it's not in any unit of time, just a number).
+//
+// Encoded line looks like:
+//
+//	TIMESTAMP_MARKER | delta (signed decimal) | TIMESTAMP_MARKER | rest of the line
+//
+// Lines not starting with a timestamp are left intact unless they start with TIMESTAMP_MARKER; those get it doubled.
+const (
+	TIMESTAMP_MARKER byte = 0x1e
+	// timestamp digits must fit in int64
+	MAX_TIMESTAMP_DIGITS         = 18
+	MAX_TIMESTAMP_PATTERN_LENGTH = 40
+	TIMESTAMP_DIGIT              = '#'
+
+	// longest encoded delta: sign and digits
+	maxTimestampDeltaLength = MAX_TIMESTAMP_DIGITS + 2
+)
+
+var ErrInvalidTimestampPattern = errors.New("logpack: invalid timestamp pattern")
+
+// Encodes (or decodes) timestamps of lines written to it and writes the result to the underlying io.Writer.
+// It keeps just a few bytes of the current line buffered, so lines of any length are fine.
+type TimestampCodec struct {
+	w       io.Writer
+	pattern []byte
+	decode  bool
+	// value of the last timestamp seen
+	previous int64
+	// beginning of the current line, collected until it's known if it starts with a timestamp
+	head       []byte
+	collecting bool
+	out        []byte
+	err        error
+}
+
+// Returns a TimestampCodec encoding timestamps described by pattern into w. Close() has to be called when done.
+func NewTimestampEncoder(w io.Writer, pattern string) (*TimestampCodec, error) {
+	return newTimestampCodec(w, pattern, false)
+}
+
+// Returns a TimestampCodec restoring timestamps encoded by NewTimestampEncoder() with the same pattern.
+func NewTimestampDecoder(w io.Writer, pattern string) (*TimestampCodec, error) {
+	return newTimestampCodec(w, pattern, true)
+}
+
+// Returns an error wrapping ErrInvalidTimestampPattern if pattern cannot be used.
+func ValidateTimestampPattern(pattern string) error {
+	digits := bytes.Count([]byte(pattern), []byte{TIMESTAMP_DIGIT})
+	if digits == 0 || digits > MAX_TIMESTAMP_DIGITS || len(pattern) > MAX_TIMESTAMP_PATTERN_LENGTH {
+		return fmt.Errorf("%w: \"%s\" (1-%d digits and at most %d chars expected)",
+			ErrInvalidTimestampPattern, pattern, MAX_TIMESTAMP_DIGITS, MAX_TIMESTAMP_PATTERN_LENGTH)
+	}
+	if bytes.IndexByte([]byte(pattern), '\n') >= 0 || bytes.IndexByte([]byte(pattern), TIMESTAMP_MARKER) >= 0 {
+		return fmt.Errorf("%w: \"%s\" contains newline or TIMESTAMP_MARKER", ErrInvalidTimestampPattern, pattern)
+	}
+	return nil
+}
+
+func newTimestampCodec(w io.Writer, pattern string, decode bool) (*TimestampCodec, error) {
+	if err := ValidateTimestampPattern(pattern); err != nil {
+		return nil, err
+	}
+	return &TimestampCodec{
+		w:          w,
+		pattern:    []byte(pattern),
+		decode:     decode,
+		head:       make([]byte, 0, max(len(pattern), maxTimestampDeltaLength+2)),
+		collecting: true,
+	}, nil
+}
+
+func (c *TimestampCodec) Write(p []byte) (n int, err error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.out = c.out[:0]
+	for n < len(p) {
+		if c.collecting {
+			consumed, err := c.collectHead(p[n:])
+			if err != nil {
+				c.err = err
+				return n, err
+			}
+			n += consumed
+		} else {
+			// rest of the line passes through
+			lineEnd := bytes.IndexByte(p[n:], '\n')
+			if lineEnd < 0 {
+				c.out = append(c.out, p[n:]...)
+				n = len(p)
+			} else {
+				c.out = append(c.out, p[n:n+lineEnd+1]...)
+				n += lineEnd + 1
+				c.collecting = true
+			}
+		}
+	}
+	if _, err := c.w.Write(c.out); err != nil {
+		c.err = err
+		return n, err
+	}
+	return n, nil
+}
+
+// Flushes the last line if it was not complete. It does not close the underlying io.Writer.
+func (c *TimestampCodec) Close() error {
+	if c.err != nil {
+		return c.err
+	}
+	c.out = c.out[:0]
+	if c.collecting && len(c.head) > 0 {
+		if c.decode {
+			// input ended within encoded timestamp
+			c.err = ErrCorruptInput
+			return c.err
+		}
+		c.encodeHead()
+	}
+	if _, err := c.w.Write(c.out); err != nil {
+		c.err = err
+		return err
+	}
+	return nil
+}
+
+// Appends bytes of p to c.head until it's known how to transform the line. Returns number of bytes of p consumed.
+func (c *TimestampCodec) collectHead(p []byte) (consumed int, err error) {
+	for consumed < len(p) {
+		char := p[consumed]
+		c.head = append(c.head, char)
+		consumed++
+
+		var done bool
+		if c.decode {
+			done, err = c.decodeHead()
+		} else {
+			done = c.encodeHeadIfComplete()
+		}
+		if err != nil || done {
+			c.collecting = done && char == '\n'
+			c.head = c.head[:0]
+			return consumed, err
+		}
+	}
+	return consumed, nil
+}
+
+func (c *TimestampCodec) encodeHeadIfComplete() (done bool) {
+	last := c.head[len(c.head)-1]
+	if len(c.head) < len(c.pattern) && last != '\n' && matchesPatternPrefix(c.head, c.pattern) {
+		return false
+	}
+	c.encodeHead()
+	return true
+}
+
+// Writes c.head to c.out encoding the timestamp if it's there.
+func (c *TimestampCodec) encodeHead() {
+	if len(c.head) == len(c.pattern) && matchesPatternPrefix(c.head, c.pattern) {
+		timestamp := timestampValue(c.head, c.pattern)
+		c.out = append(c.out, TIMESTAMP_MARKER)
+		c.out = strconv.AppendInt(c.out, timestamp-c.previous, 10)
+		c.out = append(c.out, TIMESTAMP_MARKER)
+		c.previous = timestamp
+		return
+	}
+	if c.head[0] == TIMESTAMP_MARKER {
+		c.out = append(c.out, TIMESTAMP_MARKER)
+	}
+	c.out = append(c.out, c.head...)
+}
+
+// Restores timestamp from c.head to c.out once all of it is collected.
+func (c *TimestampCodec) decodeHead() (done bool, err error) {
+	if c.head[0] != TIMESTAMP_MARKER {
+		c.out = append(c.out, c.head...)
+		return true, nil
+	}
+	if len(c.head) < 2 {
+		return false, nil
+	}
+	// escaped marker starting a plain line
+	if c.head[1] == TIMESTAMP_MARKER && len(c.head) == 2 {
+		c.out = append(c.out, TIMESTAMP_MARKER)
+		return true, nil
+	}
+	last := c.head[len(c.head)-1]
+	if last != TIMESTAMP_MARKER {
+		if len(c.head) > maxTimestampDeltaLength+1 || last == '\n' {
+			return false, ErrCorruptInput
+		}
+		return false, nil
+	}
+	delta, err := strconv.ParseInt(string(c.head[1:len(c.head)-1]), 10, 64)
+	if err != nil {
+		return false, ErrCorruptInput
+	}
+	timestamp := c.previous + delta
+	start := len(c.out)
+	c.out = append(c.out, c.pattern...)
+	if !storeTimestampValue(c.out[start:], timestamp) {
+		return false, ErrCorruptInput
+	}
+	c.previous = timestamp
+	return true, nil
+}
+
+func matchesPatternPrefix(head, pattern []byte) bool {
+	for i, char := range head {
+		if pattern[i] == TIMESTAMP_DIGIT {
+			if char < '0' || char > '9' {
+				return false
+			}
+		} else if char != pattern[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Digits of timestamp taken as one number.
+func timestampValue(timestamp, pattern []byte) (value int64) {
+	for i, char := range timestamp {
+		if pattern[i] == TIMESTAMP_DIGIT {
+			value = 10*value + int64(char-'0')
+		}
+	}
+	return value
+}
+
+// Overwrites digit positions of dst (a copy of the pattern) with value. Returns false if value does not fit.
+func storeTimestampValue(dst []byte, value int64) bool {
+	if value < 0 {
+		return false
+	}
+	for i := len(dst) - 1; i >= 0; i-- {
+		if dst[i] == TIMESTAMP_DIGIT {
+			dst[i] = byte('0' + value%10)
+			value /= 10
+		}
+	}
+	return value == 0
+}
@@ -0,0 +1,133 @@
+package pack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+const test_timestamp_pattern = "####-##-## ##:##:##,###"
+
+func timestampCodecRoundTrip(t *testing.T, input []byte, writeSize int) (encoded []byte) {
+	var encodedBuff, decodedBuff bytes.Buffer
+	encoder, err := NewTimestampEncoder(&encodedBuff, test_timestamp_pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := input; len(rest) > 0; rest = rest[min2(writeSize, len(rest)):] {
+		encoder.Write(rest[:min2(writeSize, len(rest))])
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder, _ := NewTimestampDecoder(&decodedBuff, test_timestamp_pattern)
+	for rest := encodedBuff.Bytes(); len(rest) > 0; rest = rest[min2(writeSize, len(rest)):] {
+		if _, err := decoder.Write(rest[:min2(writeSize, len(rest))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := decoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decodedBuff.Bytes(), input) {
+		t.Fatalf("Expected %q; got %q", input, decodedBuff.Bytes())
+	}
+	return encodedBuff.Bytes()
+}
+
+func TestTimestampCodecIsReversible(t *testing.T) {
+	inputs := []string{
+		"2015-10-18 18:01:47,978 INFO a\n2015-10-18 18:01:48,002 INFO a\n2015-10-18 18:01:48,002 INFO a\n",
+		// older timestamp - negative delta
+		"2015-10-18 18:01:47,978 x\n2015-10-18 18:01:46,000 x\n",
+		// not timestamps: too short, wrong separator, non-digit, partial last line
+		"2015-10-18\n2015/10/18 18:01:47,978\n2015-10-1X 18:01:47,978\n\n2015-10-18 18:01:4",
+		// lines starting with the marker
+		"\x1e\n\x1e\x1e\x1e5\x1e\n\x1e2015-10-18 18:01:47,978\n",
+		// timestamp with nothing after it and no newline
+		"2015-10-18 18:01:47,978",
+		"",
+	}
+	for i, input := range inputs {
+		for _, writeSize := range []int{1, 3, len(input) + 1} {
+			t.Run(fmt.Sprintf("input %d write size %d", i, writeSize), func(t *testing.T) {
+				timestampCodecRoundTrip(t, []byte(input), writeSize)
+			})
+		}
+	}
+}
+
+func TestTimestampCodecAlignsLinesLoggedAtSameTime(t *testing.T) {
+	input := "2015-10-18 18:01:47,978 INFO a\n2015-10-18 18:01:48,002 INFO b\n2015-10-18 18:01:48,002 INFO c\n"
+	encoded := timestampCodecRoundTrip(t, []byte(input), len(input))
+
+	expected := "\x1e20151018180147978\x1e INFO a\n\x1e24\x1e INFO b\n\x1e0\x1e INFO c\n"
+	if string(encoded) != expected {
+		t.Errorf("Expected %q; got %q", expected, encoded)
+	}
+}
+
+func TestTimestampDecoderRejectsCorruptInput(t *testing.T) {
+	inputs := []string{
+		// unterminated delta
+		"\x1e123\n",
+		"\x1e123",
+		"\x1e12345678901234567890123\x1e\n",
+		// not a number
+		"\x1e1x3\x1e\n",
+		// negative timestamp
+		"\x1e-5\x1e\n",
+		// timestamp too big for the pattern
+		"\x1e1000000000000000000\x1e\n",
+	}
+	for _, input := range inputs {
+		var decodedBuff bytes.Buffer
+		decoder, _ := NewTimestampDecoder(&decodedBuff, test_timestamp_pattern)
+		_, err := decoder.Write([]byte(input))
+		if err == nil {
+			err = decoder.Close()
+		}
+		if err != ErrCorruptInput {
+			t.Errorf("Input %q: expected ErrCorruptInput; got %v", input, err)
+		}
+	}
+}
+
+func TestValidateTimestampPattern(t *testing.T) {
+	for _, pattern := range []string{"", "no digits", "###################", "##\n", "##\x1e"} {
+		if err := ValidateTimestampPattern(pattern); !errors.Is(err, ErrInvalidTimestampPattern) {
+			t.Errorf("Pattern %q: expected ErrInvalidTimestampPattern; got %v", pattern, err)
+		}
+	}
+}
+
+func TestReaderRestoresTimestamps(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	dir := path_defaultLoghubCorpus + "hadoop/"
+	inputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+
+	archive := make([]byte, MAX_ARCHIVE_HEADER_SIZE, test_compression_bound_bytes)
+	archive = archive[:StoreArchiveHeader(archive, ArchiveHeader{TimestampPattern: test_timestamp_pattern})]
+	var encoded bytes.Buffer
+	encoder, _ := NewTimestampEncoder(&encoded, test_timestamp_pattern)
+	encoder.Write(inputBuff[:inputSize])
+	encoder.Close()
+	packedSize := PackBuffer(encoded.Bytes(), archive[len(archive):cap(archive)], COMPRESSION_LEVEL_DEFAULT)
+	archive = archive[:len(archive)+packedSize]
+
+	r, err := NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Header().TimestampPattern != test_timestamp_pattern {
+		t.Errorf("Expected pattern %q in header; got %q", test_timestamp_pattern, r.Header().TimestampPattern)
+	}
+	unpacked, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertInversibility(t, "hadoop", inputBuff, unpacked, inputSize, len(unpacked))
+}
@@ -0,0 +1,107 @@
+package pack
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// Words of genuine UTF-8: 2-byte (Polish, Greek), 3-byte (CJK), 4-byte (emoji, also joined by ZWJ and with
+// skin tone modifiers) and combining characters (accent put on the preceding letter).
+var utf8Words = []string{
+	"zażółć", "gęślą", "jaźń", "λόγος", "服务器", "启动完成", "用户登录失败", "ログイン", "사용자",
+	"🚀", "🔥🔥", "👨‍👩‍👧", "👍🏽", "été", "ño", "ä́",
+	"INFO", "WARN", "user=42", "ok", "-", "|",
+}
+
+// Log lines mixing utf8Words with ASCII: similar enough to refer each other, so non-ASCII text appears both in
+// references and in literals.
+func randomUtf8Lines(seed int64, lines int) []byte {
+	r := rand.New(rand.NewSource(seed))
+	var sb strings.Builder
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&sb, "2024-05-17 %02d:%02d", i/60%24, i%60)
+		for words := 3 + r.Intn(8); words > 0; words-- {
+			sb.WriteString(" " + utf8Words[r.Intn(len(utf8Words))])
+		}
+		sb.WriteString("\n")
+	}
+	return []byte(sb.String())
+}
+
+// Undoes quote(); returns false if an escape byte is left without the byte it escapes.
+func unquote(quoted []byte) (raw []byte, ok bool) {
+	for i := 0; i < len(quoted); i++ {
+		if quoted[i] == ESCAPE_BYTE {
+			if i++; i == len(quoted) {
+				return raw, false
+			}
+		}
+		raw = append(raw, quoted[i])
+	}
+	return raw, true
+}
+
+func TestPackAndUnpackUtf8Lines(t *testing.T) {
+	input := randomUtf8Lines(5, 20000)
+	packedBuff := make([]byte, 2*len(input)+DecompressBound())
+	unpackedBuff := make([]byte, len(input))
+	chunkBuff := make([]byte, DecompressBound())
+
+	for level := COMPRESSION_LEVEL_WORST; level <= COMPRESSION_LEVEL_BEST; level++ {
+		packedSize := PackBuffer(input, packedBuff, level)
+		unpackedSize := UnpackBuffer(packedBuff[:packedSize], unpackedBuff, t)
+		assertInversibility(t, fmt.Sprintf("utf-8 lines, level %d", level), input, unpackedBuff, len(input), unpackedSize)
+
+		// chunks end on line boundaries, so each of them unpacks on its own to whole code points
+		chunks, _ := ScanChunks(packedBuff[:packedSize])
+		for _, chunk := range chunks {
+			_, written := Decompress(chunkBuff, packedBuff[chunk.Offset:chunk.Offset+chunk.CompressedSize])
+			if written != chunk.RawSize || !utf8.Valid(chunkBuff[:written]) {
+				t.Fatalf("Level %d: chunk at %d unpacked to %d bytes of %d, valid UTF-8: %v", level, chunk.Offset,
+					written, chunk.RawSize, utf8.Valid(chunkBuff[:max(written, 0)]))
+			}
+		}
+	}
+}
+
+// Lines longer than a chunk are cut at an arbitrary byte, possibly in the middle of a code point (escaped emoji
+// take twice their size, so such chunks end up stored). Cutting anywhere within a 4-byte emoji must still unpack
+// exactly.
+func TestUtf8LineLongerThanChunkIsCutAnywhereInCodePoint(t *testing.T) {
+	for asciiPrefix := 0; asciiPrefix < 4; asciiPrefix++ {
+		// every emoji byte is escaped, so the escaped line is twice as long
+		line := strings.Repeat("x", asciiPrefix) + strings.Repeat("🚀", MAX_CHUNK_SIZE/4) + " 服务器\n"
+		input := []byte(line + "short 🔥 line\n" + line)
+		packedBuff := make([]byte, 4*len(input))
+		unpackedBuff := make([]byte, len(input))
+
+		packedSize := PackBuffer(input, packedBuff, COMPRESSION_LEVEL_DEFAULT)
+		unpackedSize := UnpackBuffer(packedBuff[:packedSize], unpackedBuff, t)
+		assertInversibility(t, fmt.Sprintf("%d ascii bytes before emoji", asciiPrefix), input, unpackedBuff,
+			len(input), unpackedSize)
+	}
+}
+
+// Every byte of a multibyte code point is escaped on its own - a code point never shares an escape byte and
+// a dst too short for the whole code point takes its leading bytes as complete pairs.
+func TestQuoteSafelyKeepsEscapePairsOfMultibyteCodePoints(t *testing.T) {
+	for _, word := range utf8Words {
+		src := []byte("a" + word + "b")
+		expected := quoteSlowly(src)
+		if written := quote(make([]byte, 2*len(src)), src); written != len(expected) {
+			t.Errorf("%q: quoted to %d bytes; expected %d", word, written, len(expected))
+		}
+
+		for dstSize := 0; dstSize <= len(expected); dstSize++ {
+			dst := make([]byte, dstSize)
+			read, written := quoteSafely(dst, src)
+			raw, ok := unquote(dst[:written])
+			if !ok || string(raw) != string(src[:read]) {
+				t.Errorf("%q, dst size %d: %v does not unquote to %v", word, dstSize, dst[:written], src[:read])
+			}
+		}
+	}
+}
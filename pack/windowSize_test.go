@@ -0,0 +1,37 @@
+package pack
+
+import (
+	"strconv"
+	"testing"
+)
+
+// goodEnoughPercent window sizes are swept at; the one of levels 1-6 (see compressionLevelPresets)
+const benchmarked_good_enough_percent = 80
+
+/*
+Ratio and packing speed of the corpus sample for every backreference capacity the format allows, at fixed
+goodEnoughPercent, to tune capacities of compressionLevelPresets with. Mind that a buffer of capacity n holds n-1
+lines (see backrefBuffer). Run eg. with -bench WindowSize -benchtime 3x: one sub-benchmark packs the whole sample.
+*/
+func BenchmarkWindowSize(b *testing.B) {
+	input := readCorpusSample(test_level_sample_size_bytes)
+	packedBuff := make([]byte, DecompressBound())
+
+	for capacity := 2; capacity <= MAX_BACKREFERENCE_CAPACITY; capacity++ {
+		params := compressionParameters{backreferenceCapacity: byte(capacity),
+			goodEnoughPercent: benchmarked_good_enough_percent}
+		b.Run("capacity_"+strconv.Itoa(capacity), func(b *testing.B) {
+			var packOutputSize int
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				packOutputSize = 0
+				for src := input; len(src) > 0; {
+					read, written := compress(packedBuff, src, params, MAX_SIMILARITY)
+					src = src[read:]
+					packOutputSize += written
+				}
+			}
+			b.ReportMetric(float64(len(input))/float64(packOutputSize), "compRatio")
+		})
+	}
+}
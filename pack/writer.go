@@ -0,0 +1,341 @@
+package pack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrWriterClosed = errors.New("logpack: write to closed Writer")
+
+// Writer packs everything written to it into a Logpack archive and writes it to the underlying io.Writer.
+// Each chunk is compressed in an internal buffer first and then written out in one piece, header followed by body.
+// Output is written strictly sequentially, so any io.Writer (pipe, socket) will do.
+type Writer struct {
+	w io.Writer
+	// packs chunks; never primed
+	compressor      *Compressor
+	flushEveryLines int
+	// complete lines written since the last flush
+	linesPending int
+	// splits input into lines for FlushEveryLines
+	lines         lineScanner
+	header        ArchiveHeader
+	headerSize    int
+	headerWritten bool
+	// raw data waiting to be compressed. Holds up to two chunks so that chunks can end on line boundaries
+	pending []byte
+	// compressed chunk
+	chunk []byte
+	// archive bytes written so far (see CompressedBytesWritten()) and chunks among them, tracked for the footer only
+	written int64
+	chunks  []ChunkInfo
+	// content bytes accepted by Write() so far
+	rawWritten int64
+	// set if the footer offset can be patched into the header; archive starts at headerPos of it
+	seeker    io.WriteSeeker
+	headerPos int64
+	// chunks are gathered in staged until they are compressed by secondStage (if set) into frame
+	secondStage SecondStage
+	staged      []byte
+	frame       []byte
+	err         error
+}
+
+// Options of NewWriterOpts()
+type WriterOptions struct {
+	Options
+	// If > 0 all pending data is flushed (see Flush()) after every FlushEveryLines complete lines, so that
+	// a chunk is emitted at least that often. It bounds latency of log shipping at the cost of ratio:
+	// every chunk starts with no lines to refer, so the fewer lines per chunk, the worse the ratio.
+	// Eg. apache sample packs 9.07x without the option, 9.00x flushing every 1000 lines, 8.13x every 100 lines,
+	// 3.98x every 10 lines and 0.96x (bigger than input) for every single line.
+	// Chunks are still emitted when MAX_CHUNK_SIZE is reached regardless of line count.
+	FlushEveryLines int
+	// Stored in the archive header (see ArchiveHeader.Comment); at most MAX_COMMENT_SIZE bytes.
+	// Read it back with ReadComment() or Reader.Header().
+	Comment []byte
+	// Write index of chunks after the last chunk, so that ReadFooter() can list them without scanning the archive.
+	// If the output is an io.WriteSeeker (eg. a file, but not a pipe), Close() seeks back and patches offset of
+	// the footer into the header: readers find the footer knowing just the header. Otherwise the offset is written
+	// after the footer and readers need size of the archive to find it.
+	// Archives with a footer can't be read by versions of the package older than the option.
+	// Footer lists chunks by their offsets in the archive, so it can't be combined with Options.SecondStage.
+	Footer bool
+}
+
+// Returns an error if any of opts is invalid (see Options.Validate()).
+func (opts WriterOptions) Validate() error {
+	if opts.FlushEveryLines < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidFlushEveryLines, opts.FlushEveryLines)
+	}
+	if len(opts.Comment) > MAX_COMMENT_SIZE {
+		return fmt.Errorf("%w: %d bytes (at most %d allowed)", ErrCommentTooLong, len(opts.Comment), MAX_COMMENT_SIZE)
+	}
+	if opts.Footer && opts.SecondStage != nil {
+		return fmt.Errorf("%w: cannot be combined with footer", ErrInvalidSecondStage)
+	}
+	return opts.Options.Validate()
+}
+
+// Returns a Writer packing at given compression level (see Compress()) into w.
+// It is the caller's responsibility to call Close() when done.
+func NewWriter(w io.Writer, compressionLevel int) *Writer {
+	return newWriter(w, WriterOptions{Options: Options{CompressionLevel: compressionLevel}})
+}
+
+// Same as NewWriter() but with options. Returns an error if opts are invalid (see Options.Validate()).
+func NewWriterOpts(w io.Writer, opts WriterOptions) (*Writer, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return newWriter(w, opts), nil
+}
+
+func newWriter(w io.Writer, opts WriterOptions) *Writer {
+	return &Writer{
+		w:               w,
+		compressor:      newCompressor(opts.Options),
+		flushEveryLines: opts.FlushEveryLines,
+		header: ArchiveHeader{CompressionLevel: opts.CompressionLevel, Comment: opts.Comment, Footer: opts.Footer,
+			NumericDelta: opts.NumericDelta, RecordSeparator: headerRecordSeparator(opts.RecordSeparator),
+			SecondStage: secondStageName(opts.SecondStage), SortedLines: opts.SortLines,
+			AsciiChunks: opts.MarkAsciiChunks},
+		secondStage: opts.SecondStage,
+		lines:       lineScanner{separator: opts.RecordSeparator},
+		pending:     make([]byte, 0, 2*MAX_CHUNK_SIZE),
+		chunk:       make([]byte, DecompressBound()),
+	}
+}
+
+// Buffers p and writes out every chunk that is complete.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	n, err = w.writeLines(p)
+	w.rawWritten += int64(n)
+	return n, err
+}
+
+/*
+Number of bytes written to the underlying io.Writer so far: archive header, chunks and, once closed, the footer
+(with a second stage: frames). Together with RawBytesWritten() it tells the ratio so far, eg. for metrics. Mind that
+Writer holds up to two chunks of content (and a second stage its block of chunks) until it packs them or until
+Flush(), so the ratio is exact only after Flush() or Close().
+*/
+func (w *Writer) CompressedBytesWritten() int64 {
+	return w.written
+}
+
+// Number of content bytes accepted by Write() so far, packed or still pending (see CompressedBytesWritten()).
+func (w *Writer) RawBytesWritten() int64 {
+	return w.rawWritten
+}
+
+func (w *Writer) writeLines(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.flushEveryLines == 0 {
+		return w.buffer(p)
+	}
+	w.lines.feed(p)
+	for {
+		carried := len(w.lines.Remaining())
+		line, ok := w.lines.next()
+		if !ok {
+			break
+		}
+		if _, err := w.buffer(line); err != nil {
+			return n, err
+		}
+		n += len(line) - carried
+		if w.linesPending++; w.linesPending >= w.flushEveryLines {
+			if err := w.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	// long line is packed as it comes rather than held until its end
+	if len(w.lines.Remaining()) >= MAX_CHUNK_SIZE {
+		if err := w.bufferCarriedLine(); err != nil {
+			return n, err
+		}
+	}
+	return len(p), nil
+}
+
+// Copies p to pending data and packs every chunk that is complete.
+func (w *Writer) buffer(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		copied := copy(w.pending[len(w.pending):cap(w.pending)], p)
+		w.pending = w.pending[:len(w.pending)+copied]
+		p = p[copied:]
+		n += copied
+
+		// more than a chunk pending - Compress() can end the chunk on a line boundary
+		for len(w.pending) > MAX_CHUNK_SIZE {
+			if err := w.packChunk(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Moves the incomplete line held by the line scanner (FlushEveryLines only) to pending data.
+func (w *Writer) bufferCarriedLine() error {
+	_, err := w.buffer(w.lines.Remaining())
+	w.lines.reset()
+	return err
+}
+
+// Packs and writes out all pending data, even if it does not fill the chunk.
+// Flushing often degrades compression ratio (next chunk cannot refer lines of the previous one).
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	if err := w.bufferCarriedLine(); err != nil {
+		return err
+	}
+	for len(w.pending) > 0 {
+		if err := w.packChunk(); err != nil {
+			return err
+		}
+	}
+	w.linesPending = 0
+	return w.writeFrame()
+}
+
+// Flushes pending data and finishes the archive (writes the footer if WriterOptions.Footer is set).
+// It does not close the underlying io.Writer.
+func (w *Writer) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if w.header.Footer {
+		if err := w.writeFooter(); err != nil {
+			return err
+		}
+	}
+	if w.secondStage != nil {
+		// frame of length 0 ends the frames
+		if err := w.write(make([]byte, SIZEOF_FRAME_LENGTH)); err != nil {
+			return err
+		}
+	}
+	w.err = ErrWriterClosed
+	return nil
+}
+
+func (w *Writer) writeHeader() error {
+	if w.headerWritten {
+		return nil
+	}
+	if seeker, ok := w.w.(io.WriteSeeker); ok && w.header.Footer {
+		// Seek fails on pipes even though *os.File implements it
+		if pos, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			w.seeker, w.headerPos = seeker, pos
+		}
+	}
+	w.headerSize = StoreArchiveHeader(w.chunk, w.header)
+	w.headerWritten = true
+	return w.write(w.chunk[:w.headerSize])
+}
+
+// Writes the footer and makes it findable: patches its offset into the header or writes it in the trailer.
+func (w *Writer) writeFooter() error {
+	footerOffset := w.written
+	footer := appendFooter(w.chunk[:0], w.chunks)
+	if w.seeker == nil {
+		footer = binary.LittleEndian.AppendUint64(footer, uint64(footerOffset))
+		return w.write(footer)
+	}
+	if err := w.write(footer); err != nil {
+		return err
+	}
+
+	// footer offset is the last field of the header
+	var offsetBytes [SIZEOF_INT64]byte
+	binary.LittleEndian.PutUint64(offsetBytes[:], uint64(footerOffset))
+	if _, err := w.seeker.Seek(w.headerPos+int64(w.headerSize-SIZEOF_INT64), io.SeekStart); err != nil {
+		w.err = err
+		return err
+	}
+	if _, err := w.seeker.Write(offsetBytes[:]); err != nil {
+		w.err = err
+		return err
+	}
+	_, w.err = w.seeker.Seek(w.headerPos+w.written, io.SeekStart)
+	return w.err
+}
+
+func (w *Writer) packChunk() error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	read, written := w.compressor.Compress(w.chunk, w.pending)
+	if w.header.Footer {
+		w.chunks = append(w.chunks, ChunkInfo{Offset: int(w.written), CompressedSize: written, RawSize: read})
+	}
+
+	// keep unpacked remainder at the beginning of the buffer
+	w.pending = w.pending[:copy(w.pending, w.pending[read:])]
+	if w.secondStage == nil {
+		return w.write(w.chunk[:written])
+	}
+	if w.staged = append(w.staged, w.chunk[:written]...); len(w.staged) >= SECOND_STAGE_BLOCK_SIZE {
+		return w.writeFrame()
+	}
+	return nil
+}
+
+// Compresses staged chunks (if any) with the second stage and writes them out as a frame.
+func (w *Writer) writeFrame() error {
+	if len(w.staged) == 0 {
+		return nil
+	}
+	frame, err := appendSecondStageFrame(w.frame[:0], w.staged, w.secondStage)
+	if err != nil {
+		w.err = err
+		return err
+	}
+	w.frame, w.staged = frame, w.staged[:0]
+	return w.write(frame)
+}
+
+func (w *Writer) write(p []byte) error {
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return w.err
+}
+
+type teeWriter struct {
+	passthrough io.Writer
+	packer      *Writer
+}
+
+// Returns a writer that writes everything to passthrough as it is and at the same time packs it (see Writer) into
+// packed. Close() finishes the archive; passthrough is not closed.
+// Data is packed only after passthrough accepts it, so the archive never holds more than passthrough got.
+func TeeWriter(passthrough, packed io.Writer, compressionLevel int) io.WriteCloser {
+	return &teeWriter{passthrough: passthrough, packer: NewWriter(packed, compressionLevel)}
+}
+
+func (t *teeWriter) Write(p []byte) (n int, err error) {
+	n, err = t.passthrough.Write(p)
+	if _, packErr := t.packer.Write(p[:n]); packErr != nil && err == nil {
+		err = packErr
+	}
+	return n, err
+}
+
+func (t *teeWriter) Close() error {
+	return t.packer.Close()
+}
@@ -0,0 +1,207 @@
+package pack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriterPacksWritesOfAnySize(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	unpackedBuff := make([]byte, test_max_input_size_bytes)
+
+	dir := path_defaultLoghubCorpus + "apache/"
+	inputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+
+	for _, writeSize := range []int{1, 1000, MAX_CHUNK_SIZE + 1, inputSize} {
+		t.Run(fmt.Sprintf("write size %d", writeSize), func(t *testing.T) {
+			var packed bytes.Buffer
+			w := NewWriter(&packed, COMPRESSION_LEVEL_DEFAULT)
+
+			for input := inputBuff[:inputSize]; len(input) > 0; input = input[min2(writeSize, len(input)):] {
+				if _, err := w.Write(input[:min2(writeSize, len(input))]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			header, headerSize, err := ReadArchiveHeader(packed.Bytes())
+			if err != nil || header.Version != FORMAT_VERSION {
+				t.Fatalf("Invalid archive header: %v, err: %v", header, err)
+			}
+			unpackOutputSize := UnpackBuffer(packed.Bytes()[headerSize:], unpackedBuff, t)
+
+			assertInversibility(t, "apache", inputBuff, unpackedBuff, inputSize, unpackOutputSize)
+		})
+	}
+}
+
+func TestWriterCountsBytesWritten(t *testing.T) {
+	dir := path_defaultLoghubCorpus + "apache/"
+	input := make([]byte, test_max_input_size_bytes)
+	input = input[:readFileToBuffer(input, dir+findFirstLogFile(dir))]
+
+	for _, opts := range []WriterOptions{{}, {Footer: true}, {FlushEveryLines: 100},
+		{Options: Options{SecondStage: GzipSecondStage{}}}} {
+		var packed bytes.Buffer
+		w, _ := NewWriterOpts(&packed, opts)
+		for i, line := range bytes.SplitAfter(input, []byte{'\n'}) {
+			w.Write(line)
+			if i%1000 == 0 && (w.CompressedBytesWritten() != int64(packed.Len()) || w.RawBytesWritten() < int64(i)) {
+				t.Fatalf("%+v, line %d: counted %d raw, %d compressed bytes; %d bytes written", opts, i,
+					w.RawBytesWritten(), w.CompressedBytesWritten(), packed.Len())
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if w.RawBytesWritten() != int64(len(input)) || w.CompressedBytesWritten() != int64(packed.Len()) {
+			t.Errorf("%+v: counted %d raw, %d compressed bytes; expected %d, %d", opts, w.RawBytesWritten(),
+				w.CompressedBytesWritten(), len(input), packed.Len())
+		}
+	}
+}
+
+func TestWriterRefusesWritesAfterClose(t *testing.T) {
+	var packed bytes.Buffer
+	w := NewWriter(&packed, COMPRESSION_LEVEL_DEFAULT)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("line\n")); err != ErrWriterClosed {
+		t.Errorf("Expected ErrWriterClosed; got %v", err)
+	}
+	if _, headerSize, _ := ReadArchiveHeader(packed.Bytes()); headerSize != packed.Len() {
+		t.Errorf("Empty archive should consist of just the header. Got %d bytes", packed.Len())
+	}
+}
+
+// Raw contents of chunks of archive written by Writer
+func splitIntoChunks(t *testing.T, archive []byte) (chunks [][]byte) {
+	_, headerSize, err := ReadArchiveHeader(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpackedBuff := make([]byte, DecompressBound())
+	for archive = archive[headerSize:]; len(archive) > 0; {
+		compressedSize, _ := readHeader(archive)
+		read, written := Decompress(unpackedBuff, archive[:HEADER_SIZE+compressedSize])
+		if read < 0 {
+			t.Fatalf("Cannot unpack chunk: %d", read)
+		}
+		chunks = append(chunks, append([]byte{}, unpackedBuff[:written]...))
+		archive = archive[read:]
+	}
+	return chunks
+}
+
+func TestWriterFlushesEveryLines(t *testing.T) {
+	const flushEveryLines = 3
+	input := []byte(strings.Repeat("2005-06-09 06:07:04 [notice] some line\n", 10) + "partial")
+
+	for _, writeSize := range []int{1, 7, len(input)} {
+		t.Run(fmt.Sprintf("write size %d", writeSize), func(t *testing.T) {
+			var packed bytes.Buffer
+			w, err := NewWriterOpts(&packed, WriterOptions{FlushEveryLines: flushEveryLines})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rest := input; len(rest) > 0; rest = rest[min2(writeSize, len(rest)):] {
+				w.Write(rest[:min2(writeSize, len(rest))])
+			}
+			// whole lines are flushed before Close()
+			chunksBeforeClose := len(splitIntoChunks(t, packed.Bytes()))
+			w.Close()
+
+			chunks := splitIntoChunks(t, packed.Bytes())
+			if chunksBeforeClose != 3 || len(chunks) != 4 {
+				t.Errorf("Expected 3 chunks before Close() and 4 after; got %d and %d", chunksBeforeClose, len(chunks))
+			}
+			for i, chunk := range chunks[:len(chunks)-1] {
+				if lines := bytes.Count(chunk, []byte{'\n'}); lines != flushEveryLines || chunk[len(chunk)-1] != '\n' {
+					t.Errorf("Chunk %d: expected %d whole lines; got %q", i, flushEveryLines, chunk)
+				}
+			}
+			if last := string(chunks[len(chunks)-1]); last != "2005-06-09 06:07:04 [notice] some line\npartial" {
+				t.Errorf("Unexpected last chunk %q", last)
+			}
+		})
+	}
+}
+
+func TestNewWriterOptsRejectsInvalidOptions(t *testing.T) {
+	for _, opts := range []WriterOptions{{FlushEveryLines: -1}, {Options: Options{CompressionLevel: 10}},
+		{Comment: make([]byte, MAX_COMMENT_SIZE+1)}} {
+		if _, err := NewWriterOpts(io.Discard, opts); err == nil {
+			t.Errorf("Options %+v should be rejected", opts)
+		}
+	}
+}
+
+func TestWriterStoresComment(t *testing.T) {
+	input := []byte("a line\n")
+	comment := []byte("host=web01 app=shop date=2024-01-31")
+	var packed bytes.Buffer
+	w, _ := NewWriterOpts(&packed, WriterOptions{Comment: comment})
+	w.Write(input)
+	w.Close()
+
+	stored, err := ReadComment(bytes.NewReader(packed.Bytes()))
+	if err != nil || !bytes.Equal(stored, comment) {
+		t.Errorf("Expected comment %q; got %q, err: %v", comment, stored, err)
+	}
+	r, _ := NewReader(&packed)
+	if unpacked, err := io.ReadAll(r); err != nil || !bytes.Equal(unpacked, input) {
+		t.Errorf("Expected %q; got %q, err: %v", input, unpacked, err)
+	}
+}
+
+func TestArchiveHeaderWithAllFieldsRoundTrips(t *testing.T) {
+	header := ArchiveHeader{Version: FORMAT_VERSION, CompressionLevel: 7, Digest: DIGEST_SHA256,
+		TimestampPattern: test_timestamp_pattern, Primed: true, PrimingHash: 0xdeadbeef,
+		Comment: bytes.Repeat([]byte{'c'}, MAX_COMMENT_SIZE), RecordSeparator: 0x1e, Footer: true, FooterOffset: 1 << 40}
+	buff := make([]byte, MAX_ARCHIVE_HEADER_SIZE)
+	headerSize := StoreArchiveHeader(buff, header)
+
+	stored, storedSize, err := ReadArchiveHeader(buff[:headerSize])
+	if err != nil || storedSize != headerSize || fmt.Sprint(stored) != fmt.Sprint(header) {
+		t.Errorf("Expected %v; got %v of size %d, err: %v", header, stored, storedSize, err)
+	}
+	if _, _, err := ReadArchiveHeader(buff[:headerSize-1]); err != ErrTruncatedHeader {
+		t.Errorf("Expected ErrTruncatedHeader; got %v", err)
+	}
+}
+
+func TestTeeWriterPassesThroughAndPacks(t *testing.T) {
+	inputBuff := make([]byte, test_max_input_size_bytes)
+	dir := path_defaultLoghubCorpus + "apache/"
+	inputSize := readFileToBuffer(inputBuff, dir+findFirstLogFile(dir))
+
+	var raw, packed bytes.Buffer
+	tee := TeeWriter(&raw, &packed, COMPRESSION_LEVEL_DEFAULT)
+	for input := inputBuff[:inputSize]; len(input) > 0; input = input[min2(4096, len(input)):] {
+		if _, err := tee.Write(input[:min2(4096, len(input))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tee.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(raw.Bytes(), inputBuff[:inputSize]) {
+		t.Errorf("Passthrough got different data than written")
+	}
+	r, err := NewReader(&packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertInversibility(t, "apache", inputBuff, unpacked, inputSize, len(unpacked))
+}